@@ -7,6 +7,7 @@ import (
     "strconv"
 
     "github.com/golang/glog"
+    "github.com/azsvcbusbench/internal/slo"
     "github.com/azsvcbusbench/internal/azevhub"
 )
 
@@ -15,10 +16,23 @@ var (
 
     testId         = flag.String( "test-id", "", "Test id" )
     connStr        = flag.String( "conn-string", "", "Connection string to access event hub" )
-    nameSpace      = flag.String( "namespace", "", "Name Space" )
+    credential     = flag.String( "credential", "", "Credential to authenticate with, connection-string, client-secret, certificate, workload-identity or token, empty to pick it from the settings given" )
+    tenantId       = flag.String( "tenant-id", "", "Tenant of the client the credential authenticates" )
+    clientId       = flag.String( "client-id", "", "Application id of the client the credential authenticates" )
+    clientSecret   = flag.String( "client-secret", "", "Secret of the client-secret credential" )
+    clientCert     = flag.String( "client-certificate", "", "Pem file with the certificate and private key of the certificate credential" )
+    tokenFile      = flag.String( "federated-token-file", "", "File with the federated token of the workload-identity credential" )
+    bearerToken    = flag.String( "bearer-token", "", "Static token of the token credential, for tests" )
+    authorityHost  = flag.String( "authority-host", "", "Authority host tokens are requested from, empty for the public cloud" )
+    nameSpace      = flag.String( "namespace", "", "Name Space, also the one to connect to with a credential other than a connection string" )
     topicName      = flag.String( "topic-name", "", "Topic to subscribe to" )
     consumerGrpPfx = flag.String( "consumer-group-prefix", "", "Consumer Group Prefix" )
     propName       = flag.String( "property-name", "senderid", "Property name" )
+    provision      = flag.Bool( "provision", false, "Create the event hub and consumer groups before the run. A single job deletes them afterwards, with several jobs none does as the others may still be running, run once with -deprovision after they all finished" )
+    deprovision    = flag.Bool( "deprovision", false, "Only delete the event hub and consumer groups provisioned by a run of several jobs, without running the bench" )
+    keepOnFailure  = flag.Bool( "keep-on-failure", false, "Keep provisioned entities when the run fails its slo assertions" )
+    partitionCount = flag.Int( "partition-count", 0, "Partition count of a provisioned event hub, 0 for the service default" )
+    retentionDays  = flag.Int( "retention-days", 0, "Message retention in days of a provisioned event hub, 0 for the service default" )
     totGws         = flag.Int( "total-gateways", 2, "Total simulated gateways" )
     sndIntvl       = flag.Duration( "send-interval", 5 * time.Second, "Interval between successive publish attempts" )
     rcvIntvl       = flag.Duration( "receive-interval", 1 * time.Second, "Interval between successive receive attempts" )
@@ -26,11 +40,29 @@ var (
     msgsPerSnd     = flag.Int( "messages-per-send", 1, "Number of messages to push per send call" )
     testTime       = flag.Duration( "test-duration", 5 * time.Minute, "Total test time" )
     testWarmupTime = flag.Duration( "test-warmup-time", 1 * time.Minute, "Test warmup time" )
+    testCooldown   = flag.Duration( "test-cooldown-time", 2 * time.Minute, "Time receivers keep collecting measured messages after senders stop" )
     sndrOnly       = flag.Bool( "sender-only", false, "Enable sender only" )
     rcvrOnly       = flag.Bool( "receiver-only", false, "Enable receiver only" )
+    senderJobs     = flag.String( "sender-jobs", "", "Job indices that send, e.g. 0-3,5, defaults to this job only" )
+    receiverJobs   = flag.String( "receiver-jobs", "", "Job indices that receive, e.g. 0-3,5, defaults to this job only" )
     statIntvl      = flag.Duration( "stats-dump-interval", 30 * time.Second, "Interval after statistics will be dumped" )
     ipsFile        = flag.String( "ips-file", "", "File with list of ip addresses to use" )
     idsFile        = flag.String( "ids-file", "", "File with list of ids to use" )
+    statsText      = flag.Bool( "stats-text", true, "Enable dumping statistics as text to stdout" )
+    statsCsvFile   = flag.String( "stats-csv-file", "", "File to append per gateway statistics to in csv format" )
+    dashboardOn    = flag.Bool( "dashboard", false, "Enable the live terminal dashboard, ignored when stdout is not a terminal" )
+    dashboardTopN  = flag.Int( "dashboard-top", 5, "Number of slowest and failing gateways shown on the dashboard" )
+    resultFile     = flag.String( "result-file", "", "File to write the structured run result to" )
+    reportFile     = flag.String( "report-file", "", "File to write the html report to" )
+    sloMinTput     = flag.Float64( "slo-min-throughput", -1, "Minimum receive rate in msgs/s, negative to disable" )
+    sloMaxP99      = flag.Duration( "slo-max-p99-latency", 0, "Maximum p99 end to end latency, 0 to disable" )
+    sloMaxLoss     = flag.Float64( "slo-max-loss-pct", -1, "Maximum percentage of expected deliveries lost, negative to disable" )
+    sloMaxErrors   = flag.Float64( "slo-max-error-pct", -1, "Maximum percentage of failed send and receive attempts, negative to disable" )
+    sloMinCell     = flag.Float64( "slo-min-cell-delivery", -1, "Minimum delivered fraction of each sender/receiver pair, negative to disable" )
+    junitFile      = flag.String( "junit-file", "", "File to write slo assertion results to in junit xml format" )
+    clkListen      = flag.String( "clock-sync-listen", "", "Address to serve the reference clock on for other participants" )
+    clkUrl         = flag.String( "clock-sync-url", "", "Url of the reference clock to correct latencies against, e.g. http://coordinator:7070" )
+    clkSamples     = flag.Int( "clock-sync-samples", 16, "Number of clock sync exchanges used for the offset estimate" )
 )
 
 func main( ) {
@@ -51,15 +83,28 @@ func main( ) {
     setupString( &azevhubBench.TestId, testId, "AZEVHUB_TEST_ID" )
 
     setupString( &azevhubBench.ConnStr, connStr, "AZEVHUB_CONN_STR" )
-    if 0 == len( azevhubBench.ConnStr ) {
-        glog.Fatalf( "Connection string cannot be empty" )
-    }
+    setupString( &azevhubBench.Credential.Kind, credential, "AZEVHUB_CREDENTIAL" )
+    setupString( &azevhubBench.Credential.TenantId, tenantId, "AZURE_TENANT_ID" )
+    setupString( &azevhubBench.Credential.ClientId, clientId, "AZURE_CLIENT_ID" )
+    setupString( &azevhubBench.Credential.ClientSecret, clientSecret, "AZURE_CLIENT_SECRET" )
+    setupString( &azevhubBench.Credential.CertFile, clientCert, "AZURE_CLIENT_CERTIFICATE_PATH" )
+    setupString( &azevhubBench.Credential.TokenFile, tokenFile, "AZURE_FEDERATED_TOKEN_FILE" )
+    setupString( &azevhubBench.Credential.Token, bearerToken, "AZEVHUB_BEARER_TOKEN" )
+    setupString( &azevhubBench.Credential.AuthorityHost, authorityHost, "AZURE_AUTHORITY_HOST" )
 
     setupString( &azevhubBench.NameSpace, nameSpace, "AZEVHUB_NAME_SPACE" )
     setupString( &azevhubBench.TopicName, topicName, "AZEVHUB_TOPIC_NAME" )
     setupString( &azevhubBench.ConsumerGroupPrefix, consumerGrpPfx, "AZEVHUB_CONSUMER_GROUP_PREFIX" )
     setupString( &azevhubBench.PropName, propName, "AZEVHUB_PROP_NAME" )
 
+    setupBool( &azevhubBench.Provision, provision, "AZEVHUB_PROVISION" )
+    setupBool( &azevhubBench.KeepOnFailure, keepOnFailure, "AZEVHUB_KEEP_ON_FAILURE" )
+
+    var teardown bool
+    setupBool( &teardown, deprovision, "AZEVHUB_DEPROVISION" )
+    setupInt( &azevhubBench.PartitionCount, partitionCount, "AZEVHUB_PARTITION_COUNT" )
+    setupInt( &azevhubBench.RetentionDays, retentionDays, "AZEVHUB_RETENTION_DAYS" )
+
     setupInt( &azevhubBench.TotGateways, totGws, "AZEVHUB_TOTAL_GATEWAYS" )
     setupInt( &azevhubBench.MsgsPerReceive, msgsPerRcv, "AZEVHUB_MSGS_PER_RECEIVE" )
     setupInt( &azevhubBench.MsgsPerSend, msgsPerSnd, "AZEVHUB_MSGS_PER_SEND" )
@@ -69,6 +114,7 @@ func main( ) {
 
     setupDuration( &azevhubBench.Duration, testTime, "AZEVHUB_TEST_DURATION" )
     setupDuration( &azevhubBench.WarmupDuration, testWarmupTime, "AZSVCBUS_TEST_WARMUP_TIME" )
+    setupDuration( &azevhubBench.CooldownDuration, testCooldown, "AZEVHUB_TEST_COOLDOWN_TIME" )
     setupDuration( &azevhubBench.SendInterval, sndIntvl, "AZEVHUB_SEND_INTERVAL" )
     setupDuration( &azevhubBench.ReceiveInterval, rcvIntvl, "AZEVHUB_RECEIVE_INTERVAL" )
     setupDuration( &azevhubBench.StatDumpInterval, statIntvl, "AZEVHUB_STATS_DUMP_INTERVAL" )
@@ -76,10 +122,59 @@ func main( ) {
     setupString( &azevhubBench.IpsFile, ipsFile, "AZEVHUB_IPS_FILE" )
     setupString( &azevhubBench.IdsFile, idsFile, "AZEVHUB_IDS_FILE" )
 
+    setupBool( &azevhubBench.StatsText, statsText, "AZEVHUB_STATS_TEXT" )
+    setupString( &azevhubBench.StatsCsvFile, statsCsvFile, "AZEVHUB_STATS_CSV_FILE" )
+    setupBool( &azevhubBench.Dashboard, dashboardOn, "AZEVHUB_DASHBOARD" )
+    setupInt( &azevhubBench.DashboardTopN, dashboardTopN, "AZEVHUB_DASHBOARD_TOP" )
+    setupString( &azevhubBench.ResultFile, resultFile, "AZEVHUB_RESULT_FILE" )
+    setupString( &azevhubBench.ReportFile, reportFile, "AZEVHUB_REPORT_FILE" )
+
+    setupString( &azevhubBench.ClockSyncListen, clkListen, "AZEVHUB_CLOCK_SYNC_LISTEN" )
+    setupString( &azevhubBench.ClockSyncUrl, clkUrl, "AZEVHUB_CLOCK_SYNC_URL" )
+    setupInt( &azevhubBench.ClockSyncSamples, clkSamples, "AZEVHUB_CLOCK_SYNC_SAMPLES" )
+
+    assertions := slo.NewAssertions( )
+    setupFloat( &assertions.MinThroughput, sloMinTput, "AZEVHUB_SLO_MIN_THROUGHPUT" )
+    setupDuration( &assertions.MaxP99Latency, sloMaxP99, "AZEVHUB_SLO_MAX_P99_LATENCY" )
+    setupFloat( &assertions.MaxLossPct, sloMaxLoss, "AZEVHUB_SLO_MAX_LOSS_PCT" )
+    setupFloat( &assertions.MaxErrorPct, sloMaxErrors, "AZEVHUB_SLO_MAX_ERROR_PCT" )
+    setupFloat( &assertions.MinCellDelivery, sloMinCell, "AZEVHUB_SLO_MIN_CELL_DELIVERY" )
+
+    var junitPath string
+    setupString( &junitPath, junitFile, "AZEVHUB_JUNIT_FILE" )
+
     setupInt( &azevhubBench.Index, nil, "JOB_COMPLETION_INDEX" )
+    setupString( &azevhubBench.SenderJobs, senderJobs, "AZEVHUB_SENDER_JOBS" )
+    setupString( &azevhubBench.ReceiverJobs, receiverJobs, "AZEVHUB_RECEIVER_JOBS" )
+
+    if teardown {
+        err = azevhubBench.Teardown( )
+        if err != nil {
+            glog.Fatalf( "Failed to delete provisioned event hub: error %v", err )
+        }
+
+        glog.Infof( "Deleted provisioned event hub" )
+        glog.Flush( )
+        return
+    }
 
     glog.Infof( "Starting Azure Event Hub Bench test %+v", azevhubBench )
-    azevhubBench.Start( )
+    err = azevhubBench.Start( )
+    if err != nil {
+        azevhubBench.Deprovision( true )
+        glog.Fatalf( "Azure Event Hub Bench test failed: error %v", err )
+    }
+
+    outcomes := slo.Evaluate( azevhubBench.GetResult( ), assertions )
+    azevhubBench.Deprovision( !slo.Passed( outcomes ) )
+
+    exitCode, err := slo.Conclude( os.Stdout, "azevhubbench", outcomes, junitPath )
+    if err != nil {
+        glog.Errorf( "Failed to write junit file %v: %v", junitPath, err )
+    }
+
+    glog.Flush( )
+    os.Exit( exitCode )
 }
 
 func setupString( field, arg *string, envVar string ) {
@@ -122,6 +217,20 @@ func setupInt( field, arg *int, envVar string ) {
     }
 }
 
+func setupFloat( field, arg *float64, envVar string ) {
+    envVal := os.Getenv( envVar )
+    if len( envVal ) > 0 {
+        if floatVal, err := strconv.ParseFloat( envVal, 64 ); nil == err {
+            *field = floatVal
+            return
+        }
+    }
+
+    if arg != nil {
+        *field = *arg
+    }
+}
+
 func setupDuration( field, arg *time.Duration, envVar string ) {
     envVal := os.Getenv( envVar )
     if len( envVal ) > 0 {
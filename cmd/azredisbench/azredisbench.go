@@ -7,6 +7,7 @@ import (
     "strconv"
 
     "github.com/golang/glog"
+    "github.com/azsvcbusbench/internal/slo"
     "github.com/azsvcbusbench/internal/azredis"
 )
 
@@ -24,11 +25,27 @@ var (
     rcvRetries     = flag.Int( "receive-retries", 4, "No of times to attempt reading a key" )
     testTime       = flag.Duration( "test-duration", 5 * time.Minute, "Total test time" )
     testWarmupTime = flag.Duration( "test-warmup-time", 1 * time.Minute, "Test warmup time" )
+    testCooldown   = flag.Duration( "test-cooldown-time", 30 * time.Second, "Time receivers keep collecting measured messages after senders stop" )
     sndrOnly       = flag.Bool( "sender-only", false, "Enable sender only" )
     rcvrOnly       = flag.Bool( "receiver-only", false, "Enable receiver only" )
     statIntvl      = flag.Duration( "stats-dump-interval", 30 * time.Second, "Interval after statistics will be dumped" )
     ipsFile        = flag.String( "ips-file", "", "File with list of ip addresses to use" )
     idsFile        = flag.String( "ids-file", "", "File with list of ids to use" )
+    statsText      = flag.Bool( "stats-text", true, "Enable dumping statistics as text to stdout" )
+    statsCsvFile   = flag.String( "stats-csv-file", "", "File to append per gateway statistics to in csv format" )
+    dashboardOn    = flag.Bool( "dashboard", false, "Enable the live terminal dashboard, ignored when stdout is not a terminal" )
+    dashboardTopN  = flag.Int( "dashboard-top", 5, "Number of slowest and failing gateways shown on the dashboard" )
+    resultFile     = flag.String( "result-file", "", "File to write the structured run result to" )
+    reportFile     = flag.String( "report-file", "", "File to write the html report to" )
+    sloMinTput     = flag.Float64( "slo-min-throughput", -1, "Minimum receive rate in msgs/s, negative to disable" )
+    sloMaxP99      = flag.Duration( "slo-max-p99-latency", 0, "Maximum p99 end to end latency, 0 to disable" )
+    sloMaxLoss     = flag.Float64( "slo-max-loss-pct", -1, "Maximum percentage of expected deliveries lost, negative to disable" )
+    sloMaxErrors   = flag.Float64( "slo-max-error-pct", -1, "Maximum percentage of failed send and receive attempts, negative to disable" )
+    sloMinCell     = flag.Float64( "slo-min-cell-delivery", -1, "Minimum delivered fraction of each sender/receiver pair, negative to disable" )
+    junitFile      = flag.String( "junit-file", "", "File to write slo assertion results to in junit xml format" )
+    clkListen      = flag.String( "clock-sync-listen", "", "Address to serve the reference clock on for other participants" )
+    clkUrl         = flag.String( "clock-sync-url", "", "Url of the reference clock to correct latencies against, e.g. http://coordinator:7070" )
+    clkSamples     = flag.Int( "clock-sync-samples", 16, "Number of clock sync exchanges used for the offset estimate" )
 )
 
 func main( ) {
@@ -74,6 +91,7 @@ func main( ) {
 
     setupDuration( &azredisBench.Duration, testTime, "AZREDIS_TEST_DURATION" )
     setupDuration( &azredisBench.WarmupDuration, testWarmupTime, "AZSVCBUS_TEST_WARMUP_TIME" )
+    setupDuration( &azredisBench.CooldownDuration, testCooldown, "AZREDIS_TEST_COOLDOWN_TIME" )
     setupDuration( &azredisBench.SendInterval, sndIntvl, "AZREDIS_SEND_INTERVAL" )
     setupDuration( &azredisBench.ReceiveInterval, rcvIntvl, "AZREDIS_RECEIVE_INTERVAL" )
     setupDuration( &azredisBench.StatDumpInterval, statIntvl, "AZREDIS_STATS_DUMP_INTERVAL" )
@@ -81,10 +99,39 @@ func main( ) {
     setupString( &azredisBench.IpsFile, ipsFile, "AZREDIS_IPS_FILE" )
     setupString( &azredisBench.IdsFile, idsFile, "AZREDIS_IDS_FILE" )
 
+    setupBool( &azredisBench.StatsText, statsText, "AZREDIS_STATS_TEXT" )
+    setupString( &azredisBench.StatsCsvFile, statsCsvFile, "AZREDIS_STATS_CSV_FILE" )
+    setupBool( &azredisBench.Dashboard, dashboardOn, "AZREDIS_DASHBOARD" )
+    setupInt( &azredisBench.DashboardTopN, dashboardTopN, "AZREDIS_DASHBOARD_TOP" )
+    setupString( &azredisBench.ResultFile, resultFile, "AZREDIS_RESULT_FILE" )
+    setupString( &azredisBench.ReportFile, reportFile, "AZREDIS_REPORT_FILE" )
+
+    setupString( &azredisBench.ClockSyncListen, clkListen, "AZREDIS_CLOCK_SYNC_LISTEN" )
+    setupString( &azredisBench.ClockSyncUrl, clkUrl, "AZREDIS_CLOCK_SYNC_URL" )
+    setupInt( &azredisBench.ClockSyncSamples, clkSamples, "AZREDIS_CLOCK_SYNC_SAMPLES" )
+
+    assertions := slo.NewAssertions( )
+    setupFloat( &assertions.MinThroughput, sloMinTput, "AZREDIS_SLO_MIN_THROUGHPUT" )
+    setupDuration( &assertions.MaxP99Latency, sloMaxP99, "AZREDIS_SLO_MAX_P99_LATENCY" )
+    setupFloat( &assertions.MaxLossPct, sloMaxLoss, "AZREDIS_SLO_MAX_LOSS_PCT" )
+    setupFloat( &assertions.MaxErrorPct, sloMaxErrors, "AZREDIS_SLO_MAX_ERROR_PCT" )
+    setupFloat( &assertions.MinCellDelivery, sloMinCell, "AZREDIS_SLO_MIN_CELL_DELIVERY" )
+
+    var junitPath string
+    setupString( &junitPath, junitFile, "AZREDIS_JUNIT_FILE" )
+
     setupInt( &azredisBench.Index, nil, "JOB_COMPLETION_INDEX" )
 
     glog.Infof( "Starting Azure Redis Bench test %+v", azredisBench )
     azredisBench.Start( )
+
+    exitCode, err := slo.Conclude( os.Stdout, "azredisbench", slo.Evaluate( azredisBench.GetResult( ), assertions ), junitPath )
+    if err != nil {
+        glog.Errorf( "Failed to write junit file %v: %v", junitPath, err )
+    }
+
+    glog.Flush( )
+    os.Exit( exitCode )
 }
 
 func setupString( field, arg *string, envVar string ) {
@@ -127,6 +174,20 @@ func setupInt( field, arg *int, envVar string ) {
     }
 }
 
+func setupFloat( field, arg *float64, envVar string ) {
+    envVal := os.Getenv( envVar )
+    if len( envVal ) > 0 {
+        if floatVal, err := strconv.ParseFloat( envVal, 64 ); nil == err {
+            *field = floatVal
+            return
+        }
+    }
+
+    if arg != nil {
+        *field = *arg
+    }
+}
+
 func setupDuration( field, arg *time.Duration, envVar string ) {
     envVal := os.Getenv( envVar )
     if len( envVal ) > 0 {
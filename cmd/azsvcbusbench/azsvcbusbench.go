@@ -7,6 +7,7 @@ import (
     "strconv"
 
     "github.com/golang/glog"
+    "github.com/azsvcbusbench/internal/slo"
     "github.com/azsvcbusbench/internal/azsvcbus"
 )
 
@@ -15,21 +16,87 @@ var (
 
     testId         = flag.String( "test-id", "", "Test id" )
     connStr        = flag.String( "conn-string", "", "Connection string to access service bus" )
+    nameSpace      = flag.String( "namespace", "", "Namespace to connect to with a credential other than a connection string, its name or fully qualified" )
+    credential     = flag.String( "credential", "", "Credential to authenticate with, connection-string, client-secret, certificate, workload-identity or token, empty to pick it from the settings given" )
+    tenantId       = flag.String( "tenant-id", "", "Tenant of the client the credential authenticates" )
+    clientId       = flag.String( "client-id", "", "Application id of the client the credential authenticates" )
+    clientSecret   = flag.String( "client-secret", "", "Secret of the client-secret credential" )
+    clientCert     = flag.String( "client-certificate", "", "Pem file with the certificate and private key of the certificate credential" )
+    tokenFile      = flag.String( "federated-token-file", "", "File with the federated token of the workload-identity credential" )
+    bearerToken    = flag.String( "bearer-token", "", "Static token of the token credential, for tests" )
+    authorityHost  = flag.String( "authority-host", "", "Authority host tokens are requested from, empty for the public cloud" )
     topicName      = flag.String( "topic-name", "", "Topic to subscribe to" )
     subName        = flag.String( "subscription-name", "", "Subscription name" )
+    queueName      = flag.String( "queue-name", "", "Queue to send to and drain with competing receivers instead of a topic" )
     propName       = flag.String( "property-name", "senderid", "Property name" )
+    subPerGw       = flag.Bool( "subscription-per-gateway", false, "Receive each gateway from its own subscription named <subscription-name>-<index>, by default receivers share one and compete for each message" )
+    subFilter      = flag.String( "subscription-filter", "", "Create a subscription per gateway that filters out its own messages on the broker, sql or correlation, and delete it afterwards" )
+    clientTopology = flag.String( "client-topology", "single", "How gateways share connections, single, per-gateway or pool" )
+    clientPool     = flag.Int( "client-pool-size", 0, "Number of clients the gateways are spread over with the pool client topology" )
     totGws         = flag.Int( "total-gateways", 2, "Total simulated gateways" )
     sndIntvl       = flag.Duration( "send-interval", 5 * time.Second, "Interval between successive publish attempts" )
     rcvIntvl       = flag.Duration( "receive-interval", 1 * time.Second, "Interval between successive receive attempts" )
     msgsPerRcv     = flag.Int( "messages-per-receive", 1, "Number of messages to get per receive call" )
     msgsPerSnd     = flag.Int( "messages-per-send", 1, "Number of messages to push per send call" )
+    msgsPerBatch   = flag.Int( "messages-per-batch", 1, "Number of separate broker messages to send per batch, 1 sends them one by one" )
+    rcvMode        = flag.String( "receive-mode", "peeklock", "Receive mode, peeklock or receiveanddelete" )
+    abandonPct     = flag.Float64( "abandon-pct", 0, "Percentage of received messages abandoned instead of completed in peeklock mode" )
+    deadLetterPct  = flag.Float64( "dead-letter-pct", 0, "Percentage of received messages dead lettered instead of completed in peeklock mode" )
+    deadLetterChk  = flag.Bool( "dead-letter-check", false, "Read dead lettered messages back from the dead letter queue, verify and remove them" )
+    deferPct       = flag.Float64( "defer-pct", 0, "Percentage of received messages deferred in peeklock mode, fetched back by sequence number and completed later" )
+    deferDelay     = flag.Duration( "defer-delay", 0, "Time after which deferred messages are fetched back, 0 to fetch them on the next poll" )
+    processTime    = flag.String( "process-time", "", "Simulated processing time per received message, e.g. 100ms, uniform:50ms,2m or exp:1s, empty to disable" )
+    workers        = flag.Int( "workers", 1, "Number of messages each receiver processes at a time" )
+    lockRenewal    = flag.Bool( "lock-renewal", true, "Renew message locks while processing outlasts them in peeklock mode" )
+    contReceive    = flag.Bool( "continuous-receive", false, "Receive without pausing between calls and hand messages to the workers through a prefetch buffer" )
+    prefetch       = flag.Int( "prefetch", 0, "Number of received messages buffered ahead of the workers in the continuous receive loop" )
+    rcvCalls       = flag.Int( "concurrent-receives", 1, "Number of receive calls each receiver keeps running at a time in the continuous receive loop, each on a link of its own" )
+    maxWaitTime    = flag.Duration( "max-wait-time", 0, "Time a receive call waits for the first message in the continuous receive loop, 0 to wait until one arrives" )
+    sessionMode    = flag.String( "session-mode", "", "Send with the gateway id as session id and accept sessions, specific or next, empty to disable" )
+    sessionState   = flag.Bool( "session-state", false, "Keep the last received sequence number in the session state" )
+    sessionIdle    = flag.Duration( "session-idle-timeout", 10 * time.Second, "Time without messages after which a next session receiver moves on to another session" )
+    schedDelay     = flag.String( "schedule-delay", "", "Schedule messages this far ahead instead of sending them, e.g. 30s, uniform:10s,60s, normal:30s,5s or exp:30s" )
+    cancelPct      = flag.Float64( "cancel-pct", 0, "Percentage of scheduled messages cancelled right after scheduling" )
+    messageTtl     = flag.Duration( "message-ttl", 0, "Time to live set on every message, 0 to leave it to the entity" )
+    dlOnExpiry     = flag.Bool( "dead-letter-on-expiry", false, "Provision entities that dead letter expired messages, read them back with -dead-letter-check" )
+    rcvPauseAt     = flag.Duration( "receive-pause-at", 0, "Time into the run at which receivers pause to build a backlog" )
+    rcvPauseFor    = flag.Duration( "receive-pause-for", 0, "Time receivers stay paused, 0 to never pause" )
+    rcvSlowdown    = flag.Duration( "receive-slowdown", 0, "Extra wait after every receive call to slow receivers down" )
+    dupPct         = flag.Float64( "duplicate-pct", 0, "Percentage of sent messages resent with the same MessageID to check duplicate detection" )
+    dupDelay       = flag.Duration( "duplicate-delay", 0, "Time after which a message is resent, 0 to resend it right away" )
+    provision      = flag.Bool( "provision", false, "Create the queue or topic and subscriptions before the run. A single job deletes them afterwards, with several jobs none does as the others may still be running, run once with -deprovision after they all finished" )
+    deprovision    = flag.Bool( "deprovision", false, "Only delete the queue or topic and subscriptions provisioned by a run of several jobs, without running the bench" )
+    keepOnFailure  = flag.Bool( "keep-on-failure", false, "Keep provisioned entities when the run fails its slo assertions" )
+    partitioning   = flag.Bool( "enable-partitioning", false, "Provision a partitioned queue or topic" )
+    lockDuration   = flag.Duration( "lock-duration", 0, "Lock duration of provisioned queues and subscriptions, 0 for the service default" )
+    defaultTtl     = flag.Duration( "default-ttl", 0, "Default message time to live of provisioned entities, 0 for the service default" )
+    dupDetection   = flag.Duration( "duplicate-detection-window", 0, "Duplicate detection history window of provisioned queues and topics, 0 to disable" )
+    maxDelivery    = flag.Int( "max-delivery-count", 0, "Max delivery count of provisioned queues and subscriptions, 0 for the service default" )
     testTime       = flag.Duration( "test-duration", 5 * time.Minute, "Total test time" )
     testWarmupTime = flag.Duration( "test-warmup-time", 1 * time.Minute, "Test warmup time" )
+    testCooldown   = flag.Duration( "test-cooldown-time", 2 * time.Minute, "Time receivers keep collecting measured messages after senders stop" )
     sndrOnly       = flag.Bool( "sender-only", false, "Enable sender only" )
     rcvrOnly       = flag.Bool( "receiver-only", false, "Enable receiver only" )
+    senderJobs     = flag.String( "sender-jobs", "", "Job indices that send, e.g. 0-3,5, defaults to this job only" )
+    receiverJobs   = flag.String( "receiver-jobs", "", "Job indices that receive, e.g. 0-3,5, defaults to this job only" )
     statIntvl      = flag.Duration( "stats-dump-interval", 30 * time.Second, "Interval after statistics will be dumped" )
     ipsFile        = flag.String( "ips-file", "", "File with list of ip addresses to use" )
     idsFile        = flag.String( "ids-file", "", "File with list of ids to use" )
+    statsText      = flag.Bool( "stats-text", true, "Enable dumping statistics as text to stdout" )
+    statsCsvFile   = flag.String( "stats-csv-file", "", "File to append per gateway statistics to in csv format" )
+    dashboardOn    = flag.Bool( "dashboard", false, "Enable the live terminal dashboard, ignored when stdout is not a terminal" )
+    dashboardTopN  = flag.Int( "dashboard-top", 5, "Number of slowest and failing gateways shown on the dashboard" )
+    resultFile     = flag.String( "result-file", "", "File to write the structured run result to" )
+    reportFile     = flag.String( "report-file", "", "File to write the html report to" )
+    sloMinTput     = flag.Float64( "slo-min-throughput", -1, "Minimum receive rate in msgs/s, negative to disable" )
+    sloMaxP99      = flag.Duration( "slo-max-p99-latency", 0, "Maximum p99 end to end latency, 0 to disable" )
+    sloMaxLoss     = flag.Float64( "slo-max-loss-pct", -1, "Maximum percentage of expected deliveries lost, counted over all receivers when they compete, negative to disable" )
+    sloMaxErrors   = flag.Float64( "slo-max-error-pct", -1, "Maximum percentage of failed send and receive attempts, negative to disable" )
+    sloMinCell     = flag.Float64( "slo-min-cell-delivery", -1, "Minimum delivered fraction of each sender/receiver pair, fails when receivers compete, negative to disable" )
+    junitFile      = flag.String( "junit-file", "", "File to write slo assertion results to in junit xml format" )
+    clkListen      = flag.String( "clock-sync-listen", "", "Address to serve the reference clock on for other participants" )
+    clkUrl         = flag.String( "clock-sync-url", "", "Url of the reference clock to correct latencies against, e.g. http://coordinator:7070" )
+    clkSamples     = flag.Int( "clock-sync-samples", 16, "Number of clock sync exchanges used for the offset estimate" )
 )
 
 func main( ) {
@@ -50,23 +117,80 @@ func main( ) {
     setupString( &azsvcbusBench.TestId, testId, "AZSVCBUS_TEST_ID" )
 
     setupString( &azsvcbusBench.ConnStr, connStr, "AZSVCBUS_CONN_STR" )
-    if 0 == len( azsvcbusBench.ConnStr ) {
-        glog.Fatalf( "Connection string cannot be empty" )
-    }
+    setupString( &azsvcbusBench.Namespace, nameSpace, "AZSVCBUS_NAMESPACE" )
+    setupString( &azsvcbusBench.Credential.Kind, credential, "AZSVCBUS_CREDENTIAL" )
+    setupString( &azsvcbusBench.Credential.TenantId, tenantId, "AZURE_TENANT_ID" )
+    setupString( &azsvcbusBench.Credential.ClientId, clientId, "AZURE_CLIENT_ID" )
+    setupString( &azsvcbusBench.Credential.ClientSecret, clientSecret, "AZURE_CLIENT_SECRET" )
+    setupString( &azsvcbusBench.Credential.CertFile, clientCert, "AZURE_CLIENT_CERTIFICATE_PATH" )
+    setupString( &azsvcbusBench.Credential.TokenFile, tokenFile, "AZURE_FEDERATED_TOKEN_FILE" )
+    setupString( &azsvcbusBench.Credential.Token, bearerToken, "AZSVCBUS_BEARER_TOKEN" )
+    setupString( &azsvcbusBench.Credential.AuthorityHost, authorityHost, "AZURE_AUTHORITY_HOST" )
 
     setupString( &azsvcbusBench.TopicName, topicName, "AZSVCBUS_TOPIC_NAME" )
     setupString( &azsvcbusBench.SubName, subName, "AZSVCBUS_SUB_NAME" )
+    setupString( &azsvcbusBench.QueueName, queueName, "AZSVCBUS_QUEUE_NAME" )
     setupString( &azsvcbusBench.PropName, propName, "AZSVCBUS_PROP_NAME" )
+    setupBool( &azsvcbusBench.SubPerGateway, subPerGw, "AZSVCBUS_SUBSCRIPTION_PER_GATEWAY" )
+    setupString( &azsvcbusBench.SubFilter, subFilter, "AZSVCBUS_SUBSCRIPTION_FILTER" )
+
+    setupString( &azsvcbusBench.ClientTopology, clientTopology, "AZSVCBUS_CLIENT_TOPOLOGY" )
+    setupInt( &azsvcbusBench.ClientPoolSize, clientPool, "AZSVCBUS_CLIENT_POOL_SIZE" )
 
     setupInt( &azsvcbusBench.TotGateways, totGws, "AZSVCBUS_TOTAL_GATEWAYS" )
     setupInt( &azsvcbusBench.MsgsPerReceive, msgsPerRcv, "AZSVCBUS_MSGS_PER_RECEIVE" )
     setupInt( &azsvcbusBench.MsgsPerSend, msgsPerSnd, "AZSVCBUS_MSGS_PER_SEND" )
+    setupInt( &azsvcbusBench.MsgsPerBatch, msgsPerBatch, "AZSVCBUS_MSGS_PER_BATCH" )
+
+    setupString( &azsvcbusBench.ReceiveMode, rcvMode, "AZSVCBUS_RECEIVE_MODE" )
+    setupFloat( &azsvcbusBench.AbandonPct, abandonPct, "AZSVCBUS_ABANDON_PCT" )
+    setupFloat( &azsvcbusBench.DeadLetterPct, deadLetterPct, "AZSVCBUS_DEAD_LETTER_PCT" )
+    setupBool( &azsvcbusBench.DeadLetterCheck, deadLetterChk, "AZSVCBUS_DEAD_LETTER_CHECK" )
+    setupFloat( &azsvcbusBench.DeferPct, deferPct, "AZSVCBUS_DEFER_PCT" )
+    setupDuration( &azsvcbusBench.DeferDelay, deferDelay, "AZSVCBUS_DEFER_DELAY" )
+
+    setupString( &azsvcbusBench.ProcessTime, processTime, "AZSVCBUS_PROCESS_TIME" )
+    setupInt( &azsvcbusBench.Workers, workers, "AZSVCBUS_WORKERS" )
+    setupBool( &azsvcbusBench.LockRenewal, lockRenewal, "AZSVCBUS_LOCK_RENEWAL" )
+
+    setupBool( &azsvcbusBench.ContinuousReceive, contReceive, "AZSVCBUS_CONTINUOUS_RECEIVE" )
+    setupInt( &azsvcbusBench.Prefetch, prefetch, "AZSVCBUS_PREFETCH" )
+    setupInt( &azsvcbusBench.ReceiveCalls, rcvCalls, "AZSVCBUS_CONCURRENT_RECEIVES" )
+    setupDuration( &azsvcbusBench.MaxWaitTime, maxWaitTime, "AZSVCBUS_MAX_WAIT_TIME" )
+
+    setupString( &azsvcbusBench.SessionMode, sessionMode, "AZSVCBUS_SESSION_MODE" )
+    setupBool( &azsvcbusBench.SessionState, sessionState, "AZSVCBUS_SESSION_STATE" )
+    setupDuration( &azsvcbusBench.SessionIdleTimeout, sessionIdle, "AZSVCBUS_SESSION_IDLE_TIMEOUT" )
+
+    setupString( &azsvcbusBench.ScheduleDelay, schedDelay, "AZSVCBUS_SCHEDULE_DELAY" )
+    setupFloat( &azsvcbusBench.CancelPct, cancelPct, "AZSVCBUS_CANCEL_PCT" )
+
+    setupDuration( &azsvcbusBench.MessageTtl, messageTtl, "AZSVCBUS_MESSAGE_TTL" )
+    setupBool( &azsvcbusBench.DeadLetterOnExpiry, dlOnExpiry, "AZSVCBUS_DEAD_LETTER_ON_EXPIRY" )
+    setupDuration( &azsvcbusBench.ReceivePauseAt, rcvPauseAt, "AZSVCBUS_RECEIVE_PAUSE_AT" )
+    setupDuration( &azsvcbusBench.ReceivePauseFor, rcvPauseFor, "AZSVCBUS_RECEIVE_PAUSE_FOR" )
+    setupDuration( &azsvcbusBench.ReceiveSlowdown, rcvSlowdown, "AZSVCBUS_RECEIVE_SLOWDOWN" )
+
+    setupFloat( &azsvcbusBench.DupPct, dupPct, "AZSVCBUS_DUPLICATE_PCT" )
+    setupDuration( &azsvcbusBench.DupDelay, dupDelay, "AZSVCBUS_DUPLICATE_DELAY" )
+
+    setupBool( &azsvcbusBench.Provision, provision, "AZSVCBUS_PROVISION" )
+    setupBool( &azsvcbusBench.KeepOnFailure, keepOnFailure, "AZSVCBUS_KEEP_ON_FAILURE" )
+
+    var teardown bool
+    setupBool( &teardown, deprovision, "AZSVCBUS_DEPROVISION" )
+    setupBool( &azsvcbusBench.EnablePartitioning, partitioning, "AZSVCBUS_ENABLE_PARTITIONING" )
+    setupDuration( &azsvcbusBench.LockDuration, lockDuration, "AZSVCBUS_LOCK_DURATION" )
+    setupDuration( &azsvcbusBench.DefaultTtl, defaultTtl, "AZSVCBUS_DEFAULT_TTL" )
+    setupDuration( &azsvcbusBench.DupDetectionWindow, dupDetection, "AZSVCBUS_DUPLICATE_DETECTION_WINDOW" )
+    setupInt( &azsvcbusBench.MaxDeliveryCount, maxDelivery, "AZSVCBUS_MAX_DELIVERY_COUNT" )
 
     setupBool( &azsvcbusBench.SenderOnly, sndrOnly, "AZSVCBUS_SENDER_ONLY" )
     setupBool( &azsvcbusBench.ReceiverOnly, rcvrOnly, "AZSVCBUS_RECEIVER_ONLY" )
 
     setupDuration( &azsvcbusBench.Duration, testTime, "AZSVCBUS_TEST_DURATION" )
     setupDuration( &azsvcbusBench.WarmupDuration, testWarmupTime, "AZSVCBUS_TEST_WARMUP_TIME" )
+    setupDuration( &azsvcbusBench.CooldownDuration, testCooldown, "AZSVCBUS_TEST_COOLDOWN_TIME" )
     setupDuration( &azsvcbusBench.SendInterval, sndIntvl, "AZSVCBUS_SEND_INTERVAL" )
     setupDuration( &azsvcbusBench.ReceiveInterval, rcvIntvl, "AZSVCBUS_RECEIVE_INTERVAL" )
     setupDuration( &azsvcbusBench.StatDumpInterval, statIntvl, "AZSVCBUS_STATS_DUMP_INTERVAL" )
@@ -74,10 +198,59 @@ func main( ) {
     setupString( &azsvcbusBench.IpsFile, ipsFile, "AZSVCBUS_IPS_FILE" )
     setupString( &azsvcbusBench.IdsFile, idsFile, "AZSVCBUS_IDS_FILE" )
 
+    setupBool( &azsvcbusBench.StatsText, statsText, "AZSVCBUS_STATS_TEXT" )
+    setupString( &azsvcbusBench.StatsCsvFile, statsCsvFile, "AZSVCBUS_STATS_CSV_FILE" )
+    setupBool( &azsvcbusBench.Dashboard, dashboardOn, "AZSVCBUS_DASHBOARD" )
+    setupInt( &azsvcbusBench.DashboardTopN, dashboardTopN, "AZSVCBUS_DASHBOARD_TOP" )
+    setupString( &azsvcbusBench.ResultFile, resultFile, "AZSVCBUS_RESULT_FILE" )
+    setupString( &azsvcbusBench.ReportFile, reportFile, "AZSVCBUS_REPORT_FILE" )
+
+    setupString( &azsvcbusBench.ClockSyncListen, clkListen, "AZSVCBUS_CLOCK_SYNC_LISTEN" )
+    setupString( &azsvcbusBench.ClockSyncUrl, clkUrl, "AZSVCBUS_CLOCK_SYNC_URL" )
+    setupInt( &azsvcbusBench.ClockSyncSamples, clkSamples, "AZSVCBUS_CLOCK_SYNC_SAMPLES" )
+
+    assertions := slo.NewAssertions( )
+    setupFloat( &assertions.MinThroughput, sloMinTput, "AZSVCBUS_SLO_MIN_THROUGHPUT" )
+    setupDuration( &assertions.MaxP99Latency, sloMaxP99, "AZSVCBUS_SLO_MAX_P99_LATENCY" )
+    setupFloat( &assertions.MaxLossPct, sloMaxLoss, "AZSVCBUS_SLO_MAX_LOSS_PCT" )
+    setupFloat( &assertions.MaxErrorPct, sloMaxErrors, "AZSVCBUS_SLO_MAX_ERROR_PCT" )
+    setupFloat( &assertions.MinCellDelivery, sloMinCell, "AZSVCBUS_SLO_MIN_CELL_DELIVERY" )
+
+    var junitPath string
+    setupString( &junitPath, junitFile, "AZSVCBUS_JUNIT_FILE" )
+
     setupInt( &azsvcbusBench.Index, nil, "JOB_COMPLETION_INDEX" )
+    setupString( &azsvcbusBench.SenderJobs, senderJobs, "AZSVCBUS_SENDER_JOBS" )
+    setupString( &azsvcbusBench.ReceiverJobs, receiverJobs, "AZSVCBUS_RECEIVER_JOBS" )
+
+    if teardown {
+        err = azsvcbusBench.Teardown( )
+        if err != nil {
+            glog.Fatalf( "Failed to delete provisioned entities: error %v", err )
+        }
+
+        glog.Infof( "Deleted provisioned entities" )
+        glog.Flush( )
+        return
+    }
 
     glog.Infof( "Starting Azure Service Bus Bench test %+v", azsvcbusBench )
-    azsvcbusBench.Start( )
+    err = azsvcbusBench.Start( )
+    if err != nil {
+        azsvcbusBench.Deprovision( true )
+        glog.Fatalf( "Azure Service Bus Bench test failed: error %v", err )
+    }
+
+    outcomes := slo.Evaluate( azsvcbusBench.GetResult( ), assertions )
+    azsvcbusBench.Deprovision( !slo.Passed( outcomes ) )
+
+    exitCode, err := slo.Conclude( os.Stdout, "azsvcbusbench", outcomes, junitPath )
+    if err != nil {
+        glog.Errorf( "Failed to write junit file %v: %v", junitPath, err )
+    }
+
+    glog.Flush( )
+    os.Exit( exitCode )
 }
 
 func setupString( field, arg *string, envVar string ) {
@@ -120,6 +293,20 @@ func setupInt( field, arg *int, envVar string ) {
     }
 }
 
+func setupFloat( field, arg *float64, envVar string ) {
+    envVal := os.Getenv( envVar )
+    if len( envVal ) > 0 {
+        if floatVal, err := strconv.ParseFloat( envVal, 64 ); nil == err {
+            *field = floatVal
+            return
+        }
+    }
+
+    if arg != nil {
+        *field = *arg
+    }
+}
+
 func setupDuration( field, arg *time.Duration, envVar string ) {
     envVal := os.Getenv( envVar )
     if len( envVal ) > 0 {
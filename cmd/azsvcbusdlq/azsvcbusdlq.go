@@ -0,0 +1,145 @@
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "os"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/azsvcbusbench/internal/azauth"
+    "github.com/azsvcbusbench/internal/azsvcbus"
+)
+
+var (
+    version        string
+
+    connStr        = flag.String( "conn-string", "", "Connection string to access service bus, defaults to AZSVCBUS_CONN_STR" )
+    nameSpace      = flag.String( "namespace", "", "Namespace to connect to with a credential other than a connection string, its name or fully qualified, defaults to AZSVCBUS_NAMESPACE" )
+    credential     = flag.String( "credential", "", "Credential to authenticate with, connection-string, client-secret, certificate, workload-identity or token, empty to pick it from the settings given" )
+    tenantId       = flag.String( "tenant-id", "", "Tenant of the client the credential authenticates, defaults to AZURE_TENANT_ID" )
+    clientId       = flag.String( "client-id", "", "Application id of the client the credential authenticates, defaults to AZURE_CLIENT_ID" )
+    clientSecret   = flag.String( "client-secret", "", "Secret of the client-secret credential, defaults to AZURE_CLIENT_SECRET" )
+    clientCert     = flag.String( "client-certificate", "", "Pem file with the certificate and private key of the certificate credential, defaults to AZURE_CLIENT_CERTIFICATE_PATH" )
+    tokenFile      = flag.String( "federated-token-file", "", "File with the federated token of the workload-identity credential, defaults to AZURE_FEDERATED_TOKEN_FILE" )
+    bearerToken    = flag.String( "bearer-token", "", "Static token of the token credential, for tests" )
+    authorityHost  = flag.String( "authority-host", "", "Authority host tokens are requested from, empty for the public cloud" )
+    topicName      = flag.String( "topic-name", "", "Topic of the subscription whose dead letter queue is read" )
+    subName        = flag.String( "subscription-name", "", "Subscription whose dead letter queue is read" )
+    queueName      = flag.String( "queue-name", "", "Queue whose dead letter queue is read instead of a subscription" )
+    action         = flag.String( "action", "dump", "dump to write dead lettered messages as json lines, requeue to send those of a queue back and remove them" )
+    maxMsgs        = flag.Int( "max-messages", 0, "Maximum number of messages to dump or requeue, 0 for all of them" )
+    outFile        = flag.String( "out-file", "", "File to dump to, defaults to stdout" )
+)
+
+func main( ) {
+    flag.Parse( )
+
+    err := flag.Lookup( "logtostderr" ).Value.Set( "true" )
+    if err != nil {
+        glog.Fatalf( "Error setting logtostderr to true: %v", err )
+    }
+
+    glog.Infof( "Starting azsvcbusdlq %v", version )
+
+    src := &azsvcbus.DeadLetterSource {
+        QueueName   :   *queueName,
+        TopicName   :   *topicName,
+        SubName     :   *subName,
+    }
+
+    if 0 == len( src.QueueName ) && ( 0 == len( src.TopicName ) || 0 == len( src.SubName ) ) {
+        glog.Fatalf( "Either a queue or a topic and subscription is needed" )
+    }
+
+    client, err := newClient( )
+    if err != nil {
+        glog.Fatalf( "Failed to setup Azure Service Bus client: %v", err )
+    }
+
+    defer client.Close( context.Background( ) )
+
+    switch *action {
+        case "dump":
+            out := os.Stdout
+            if len( *outFile ) > 0 {
+                out, err = os.Create( *outFile )
+                if err != nil {
+                    glog.Fatalf( "Failed to create %v: %v", *outFile, err )
+                }
+
+                defer out.Close( )
+            }
+
+            count, err := azsvcbus.DumpDeadLetters( context.Background( ), client, src, *maxMsgs, out )
+            if err != nil {
+                glog.Fatalf( "Failed to dump %v after %v messages: %v", src, count, err )
+            }
+
+            glog.Infof( "Dumped %v messages from %v", count, src )
+
+        case "requeue":
+            count, err := azsvcbus.RequeueDeadLetters( context.Background( ), client, src, *maxMsgs )
+            if err != nil {
+                glog.Fatalf( "Failed to requeue %v after %v messages: %v", src, count, err )
+            }
+
+            glog.Infof( "Requeued %v messages from %v", count, src )
+
+        default:
+            glog.Fatalf( "Unknown action %v", *action )
+    }
+}
+
+// Same credentials as the bench, a connection string unless the settings given call for another one
+func newClient( )( client *azservicebus.Client, err error ) {
+    opts := azauth.Options {
+        Kind            :   flagOrEnv( credential, "AZSVCBUS_CREDENTIAL" ),
+        TenantId        :   flagOrEnv( tenantId, "AZURE_TENANT_ID" ),
+        ClientId        :   flagOrEnv( clientId, "AZURE_CLIENT_ID" ),
+        ClientSecret    :   flagOrEnv( clientSecret, "AZURE_CLIENT_SECRET" ),
+        CertFile        :   flagOrEnv( clientCert, "AZURE_CLIENT_CERTIFICATE_PATH" ),
+        TokenFile       :   flagOrEnv( tokenFile, "AZURE_FEDERATED_TOKEN_FILE" ),
+        Token           :   flagOrEnv( bearerToken, "AZSVCBUS_BEARER_TOKEN" ),
+        AuthorityHost   :   flagOrEnv( authorityHost, "AZURE_AUTHORITY_HOST" ),
+    }
+
+    conn := flagOrEnv( connStr, "AZSVCBUS_CONN_STR" )
+    if 0 == len( opts.Kind ) && len( conn ) > 0 {
+        opts.Kind = azauth.CredentialConnStr
+    }
+
+    err = opts.Resolve( )
+    if err != nil {
+        return nil, err
+    }
+
+    if opts.Kind == azauth.CredentialConnStr {
+        if 0 == len( conn ) {
+            return nil, fmt.Errorf( "connection string cannot be empty" )
+        }
+
+        return azservicebus.NewClientFromConnectionString( conn, nil )
+    }
+
+    namespace := flagOrEnv( nameSpace, "AZSVCBUS_NAMESPACE" )
+    if 0 == len( namespace ) {
+        return nil, fmt.Errorf( "%v credential needs a namespace", opts.Kind )
+    }
+
+    cred, err := azauth.NewCredential( opts, nil )
+    if err != nil {
+        return nil, err
+    }
+
+    return azservicebus.NewClient( azauth.Host( namespace ), cred, nil )
+}
+
+func flagOrEnv( arg *string, envVar string )( string ) {
+    if len( *arg ) > 0 {
+        return *arg
+    }
+
+    return os.Getenv( envVar )
+}
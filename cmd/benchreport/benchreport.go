@@ -0,0 +1,64 @@
+package main
+
+import (
+    "flag"
+    "strings"
+
+    "github.com/golang/glog"
+    "github.com/azsvcbusbench/internal/report"
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+var (
+    resultFile  = flag.String( "result-file", "", "Comma separated structured run results written by the benches, several are merged into one" )
+    reportFile  = flag.String( "report-file", "report.html", "File to write the html report to" )
+    mergedFile  = flag.String( "merged-result-file", "", "File to write the merged structured result to" )
+)
+
+func main( ) {
+    flag.Parse( )
+
+    err := flag.Lookup( "logtostderr" ).Value.Set( "true" )
+    if err != nil {
+        glog.Fatalf( "Error setting logtostderr to true: %v", err )
+    }
+
+    glog.Infof( "Starting benchreport" )
+
+    if 0 == len( *resultFile ) {
+        glog.Fatalf( "Result file cannot be empty" )
+    }
+
+    var results [ ]*stats.Result
+    for _, file := range strings.Split( *resultFile, "," ) {
+        result, err := report.ReadJsonFile( file )
+        if err != nil {
+            glog.Fatalf( "Failed to read result file %v: %v", file, err )
+        }
+
+        results = append( results, result )
+    }
+
+    // Each job only sees its own side of the deliveries, merging completes the picture
+    result := results[ 0 ]
+    if len( results ) > 1 {
+        result, err = stats.MergeResults( results )
+        if err != nil {
+            glog.Fatalf( "Failed to merge results: %v", err )
+        }
+    }
+
+    if len( *mergedFile ) > 0 {
+        err = report.WriteJsonFile( *mergedFile, result )
+        if err != nil {
+            glog.Fatalf( "Failed to write merged result file %v: %v", *mergedFile, err )
+        }
+    }
+
+    err = report.WriteHtmlFile( *reportFile, result )
+    if err != nil {
+        glog.Fatalf( "Failed to write report file %v: %v", *reportFile, err )
+    }
+
+    glog.Infof( "Wrote report to %v", *reportFile )
+}
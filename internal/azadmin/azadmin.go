@@ -0,0 +1,237 @@
+package azadmin
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/xml"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    sbApiVersion    = "2017-04"
+    ehApiVersion    = "2014-01"
+    tokenValidity   = time.Hour
+    atomContentType = "application/atom+xml;type=entry;charset=utf-8"
+
+    atomNs          = "http://www.w3.org/2005/Atom"
+    sbNs            = "http://schemas.microsoft.com/netservices/2010/10/servicebus/connect"
+    xsiNs           = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+// Non 2xx answer of the management endpoint
+type ResponseError struct {
+    Method          string
+    Path            string
+    StatusCode      int
+    Body            string
+}
+
+func ( e *ResponseError )Error( )( string ) {
+    return fmt.Sprintf( "%v %v: status %v: %v", e.Method, e.Path, e.StatusCode, e.Body )
+}
+
+func IsConflict( err error )( bool ) {
+    respErr, ok := err.( *ResponseError )
+    return ok && respErr.StatusCode == http.StatusConflict
+}
+
+func IsNotFound( err error )( bool ) {
+    respErr, ok := err.( *ResponseError )
+    return ok && respErr.StatusCode == http.StatusNotFound
+}
+
+// Bearer token for the management endpoint, asked for before every request
+type TokenFunc func( ctx context.Context )( token string, err error )
+
+// Minimal client of the management REST API for what the admin package of the SDK has no calls
+// for, subscription rules and Event Hubs entities, authenticated with a shared access key or a bearer token
+type Client struct {
+    endpoint        string
+    keyName         string
+    key             string
+    token           TokenFunc
+    httpClient     *http.Client
+}
+
+// The endpoint is the https url of the namespace, tests point it at a fake
+func NewClient( endpoint, keyName, key string )( *Client ) {
+    return &Client {
+        endpoint    :   strings.TrimSuffix( endpoint, "/" ),
+        keyName     :   keyName,
+        key         :   key,
+        httpClient  :   &http.Client{ Timeout : time.Minute },
+    }
+}
+
+// Endpoint, key and entity path of a Service Bus or Event Hubs connection string, the entity path is optional
+func ParseConnectionString( connStr string )( endpoint, keyName, key, entityPath string, err error ) {
+    for _, part := range strings.Split( connStr, ";" ) {
+        kv := strings.SplitN( part, "=", 2 )
+        if len( kv ) != 2 {
+            continue
+        }
+
+        switch strings.ToLower( strings.TrimSpace( kv[ 0 ] ) ) {
+            case "endpoint":
+                endpoint = kv[ 1 ]
+
+            case "sharedaccesskeyname":
+                keyName = kv[ 1 ]
+
+            case "sharedaccesskey":
+                key = kv[ 1 ]
+
+            case "entitypath":
+                entityPath = kv[ 1 ]
+        }
+    }
+
+    if 0 == len( endpoint ) || 0 == len( keyName ) || 0 == len( key ) {
+        return "", "", "", "", fmt.Errorf( "connection string needs an endpoint and a shared access key" )
+    }
+
+    return endpoint, keyName, key, entityPath, nil
+}
+
+// For namespaces with shared access keys disabled
+func NewClientWithToken( endpoint string, token TokenFunc )( *Client ) {
+    return &Client {
+        endpoint    :   strings.TrimSuffix( endpoint, "/" ),
+        token       :   token,
+        httpClient  :   &http.Client{ Timeout : time.Minute },
+    }
+}
+
+func NewClientFromConnectionString( connStr string )( client *Client, err error ) {
+    endpoint, keyName, key, _, err := ParseConnectionString( connStr )
+    if err != nil {
+        return nil, err
+    }
+
+    u, err := url.Parse( endpoint )
+    if err != nil {
+        return nil, fmt.Errorf( "invalid endpoint %v: error %v", endpoint, err )
+    }
+
+    return NewClient( "https://" + u.Host, keyName, key ), nil
+}
+
+func ( client *Client )sasToken( resource string, expiry time.Time )( token string ) {
+    encoded := url.QueryEscape( resource )
+    se := expiry.Unix( )
+
+    mac := hmac.New( sha256.New, [ ]byte( client.key ) )
+    fmt.Fprintf( mac, "%v\n%v", encoded, se )
+    sig := base64.StdEncoding.EncodeToString( mac.Sum( nil ) )
+
+    return fmt.Sprintf( "SharedAccessSignature sr=%v&sig=%v&se=%v&skn=%v", encoded, url.QueryEscape( sig ), se, client.keyName )
+}
+
+func ( client *Client )authorization( ctx context.Context, resource string )( header string, err error ) {
+    if client.token == nil {
+        return client.sasToken( resource, time.Now( ).Add( tokenValidity ) ), nil
+    }
+
+    token, err := client.token( ctx )
+    if err != nil {
+        return "", err
+    }
+
+    return "Bearer " + token, nil
+}
+
+func ( client *Client )do( ctx context.Context, method, path, apiVersion string, body [ ]byte )( respBody [ ]byte, err error ) {
+    reqUrl := client.endpoint + path + "?api-version=" + apiVersion
+
+    req, err := http.NewRequestWithContext( ctx, method, reqUrl, bytes.NewReader( body ) )
+    if err != nil {
+        return nil, err
+    }
+
+    authorization, err := client.authorization( ctx, client.endpoint + path )
+    if err != nil {
+        return nil, err
+    }
+
+    req.Header.Set( "Authorization", authorization )
+    if body != nil {
+        req.Header.Set( "Content-Type", atomContentType )
+    }
+
+    resp, err := client.httpClient.Do( req )
+    if err != nil {
+        return nil, err
+    }
+
+    defer resp.Body.Close( )
+
+    respBody, err = io.ReadAll( resp.Body )
+    if err != nil {
+        return nil, err
+    }
+
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return nil, &ResponseError {
+            Method      :   method,
+            Path        :   path,
+            StatusCode  :   resp.StatusCode,
+            Body        :   string( respBody ),
+        }
+    }
+
+    return respBody, nil
+}
+
+// Descriptions are written by hand, the service insists on the i prefix in type attributes
+func atomEntry( description string )( [ ]byte ) {
+    return [ ]byte( `<entry xmlns="` + atomNs + `"><content type="application/xml">` + description + `</content></entry>` )
+}
+
+func escape( s string )( string ) {
+    var b strings.Builder
+    xml.EscapeText( &b, [ ]byte( s ) )
+    return b.String( )
+}
+
+func element( name, value string )( string ) {
+    return "<" + name + ">" + escape( value ) + "</" + name + ">"
+}
+
+func ( client *Client )put( ctx context.Context, path, apiVersion, description string )( err error ) {
+    _, err = client.do( ctx, http.MethodPut, path, apiVersion, atomEntry( description ) )
+    return err
+}
+
+func ( client *Client )delete( ctx context.Context, path, apiVersion string )( err error ) {
+    _, err = client.do( ctx, http.MethodDelete, path, apiVersion, nil )
+    return err
+}
+
+func intElement( name string, v int )( string ) {
+    if v <= 0 {
+        return ""
+    }
+
+    return element( name, strconv.Itoa( v ) )
+}
+
+func entityPath( name string )( string ) {
+    return "/" + url.PathEscape( name )
+}
+
+func subscriptionPath( topic, sub string )( string ) {
+    return entityPath( topic ) + "/subscriptions/" + url.PathEscape( sub )
+}
+
+func rulePath( topic, sub, rule string )( string ) {
+    return subscriptionPath( topic, sub ) + "/rules/" + url.PathEscape( rule )
+}
@@ -0,0 +1,162 @@
+package azadmin
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/azsvcbusbench/internal/azadmin/azadmintest"
+)
+
+const (
+    testKeyName = "RootManageSharedAccessKey"
+    testKey     = "c2VjcmV0"
+)
+
+func newFakeAdmin( t *testing.T )( fake *azadmintest.Fake, client *Client ) {
+    fake = azadmintest.NewFake( testKeyName, testKey )
+    server := httptest.NewServer( fake )
+    t.Cleanup( server.Close )
+
+    return fake, NewClient( server.URL, testKeyName, testKey )
+}
+
+func TestNewClientFromConnectionString( t *testing.T ) {
+    client, err := NewClientFromConnectionString( "Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=" + testKeyName + ";SharedAccessKey=a2V5=" )
+    if err != nil {
+        t.Fatalf( "NewClientFromConnectionString - unexpected error %v", err )
+    }
+
+    if client.endpoint != "https://ns.servicebus.windows.net" || client.keyName != testKeyName || client.key != "a2V5=" {
+        t.Errorf( "NewClientFromConnectionString - got endpoint %v key name %v key %v", client.endpoint, client.keyName, client.key )
+    }
+
+    _, err = NewClientFromConnectionString( "Endpoint=sb://ns.servicebus.windows.net/" )
+    if err == nil {
+        t.Errorf( "NewClientFromConnectionString - expected an error without a key" )
+    }
+}
+
+func TestSasToken( t *testing.T ) {
+    client := NewClient( "https://ns.servicebus.windows.net", testKeyName, testKey )
+    token := client.sasToken( "https://ns.servicebus.windows.net/topic", time.Unix( 1700000000, 0 ) )
+
+    if !strings.HasPrefix( token, "SharedAccessSignature sr=https%3A%2F%2Fns.servicebus.windows.net%2Ftopic&sig=" ) {
+        t.Errorf( "sasToken - unexpected token %v", token )
+    }
+
+    if !strings.HasSuffix( token, "&se=1700000000&skn=" + testKeyName ) {
+        t.Errorf( "sasToken - unexpected token %v", token )
+    }
+}
+
+func TestRules( t *testing.T ) {
+    fake, client := newFakeAdmin( t )
+    ctx := context.Background( )
+
+    rule := &Rule{ Name : DefaultRuleName, Filter : &SqlFilter{ Expression : "senderid <> 'gw-0'" } }
+    err := client.CreateRule( ctx, "topic", "sub-0", rule )
+    if err != nil {
+        t.Fatalf( "CreateRule - unexpected error %v", err )
+    }
+
+    body, version, _ := fake.Entity( "/topic/subscriptions/sub-0/rules/$Default" )
+    for _, want := range [ ]string{ `i:type="SqlFilter"`, "senderid &lt;&gt; &#39;gw-0&#39;", "<Name>$Default</Name>" } {
+        if !strings.Contains( body, want ) || version != sbApiVersion {
+            t.Errorf( "CreateRule - %v missing from %v version %v", want, body, version )
+        }
+    }
+
+    err = client.CreateRule( ctx, "topic", "sub-0", rule )
+    if !IsConflict( err ) {
+        t.Errorf( "CreateRule - expected a conflict, got %v", err )
+    }
+
+    rule = &Rule{ Name : "from-1", Filter : &CorrelationFilter{ Properties : map[ string ]string{ "senderid" : "gw-1" } } }
+    err = client.CreateRule( ctx, "topic", "sub-0", rule )
+    if err != nil {
+        t.Fatalf( "CreateRule - unexpected error %v", err )
+    }
+
+    body, _, _ = fake.Entity( "/topic/subscriptions/sub-0/rules/from-1" )
+    if !strings.Contains( body, `i:type="CorrelationFilter"` ) || !strings.Contains( body, "<Key>senderid</Key>" ) {
+        t.Errorf( "CreateRule - unexpected rule %v", body )
+    }
+
+    err = client.DeleteRule( ctx, "topic", "sub-0", "from-1" )
+    if err != nil || fake.Count( ) != 1 {
+        t.Errorf( "DeleteRule - expected one rule left, got %v error %v", fake.Count( ), err )
+    }
+
+    err = client.DeleteRule( ctx, "topic", "sub-0", "from-1" )
+    if !IsNotFound( err ) {
+        t.Errorf( "DeleteRule - expected not found, got %v", err )
+    }
+}
+
+func TestUnauthorized( t *testing.T ) {
+    _, client := newFakeAdmin( t )
+    client.key = "d3Jvbmc="
+
+    err := client.CreateRule( context.Background( ), "topic", "sub-0", &Rule{ Name : DefaultRuleName, Filter : &SqlFilter{ Expression : "1=1" } } )
+    respErr, ok := err.( *ResponseError )
+    if !ok || respErr.StatusCode != http.StatusUnauthorized {
+        t.Errorf( "CreateRule - expected unauthorized, got %v", err )
+    }
+}
+
+func TestBearerToken( t *testing.T ) {
+    fake := azadmintest.NewFake( testKeyName, testKey )
+    fake.Bearer = "token-1"
+    server := httptest.NewServer( fake )
+    t.Cleanup( server.Close )
+
+    token := "token-1"
+    client := NewClientWithToken( server.URL, func( ctx context.Context )( string, error ) {
+        return token, nil
+    } )
+
+    err := client.CreateRule( context.Background( ), "topic", "sub-0", &Rule{ Name : DefaultRuleName, Filter : &SqlFilter{ Expression : "1=1" } } )
+    if err != nil {
+        t.Errorf( "CreateRule - failed with a bearer token: %v", err )
+    }
+
+    token = "token-2"
+    err = client.DeleteRule( context.Background( ), "topic", "sub-0", DefaultRuleName )
+    respErr, ok := err.( *ResponseError )
+    if !ok || respErr.StatusCode != http.StatusUnauthorized {
+        t.Errorf( "DeleteRule - expected unauthorized for a wrong token, got %v", err )
+    }
+}
+
+func TestEventHub( t *testing.T ) {
+    fake, client := newFakeAdmin( t )
+    ctx := context.Background( )
+
+    err := client.CreateEventHub( ctx, "hub", &EventHubOptions{ RetentionDays : 1, PartitionCount : 4 } )
+    if err != nil {
+        t.Fatalf( "CreateEventHub - unexpected error %v", err )
+    }
+
+    body, version, _ := fake.Entity( "/hub" )
+    if !strings.Contains( body, "<MessageRetentionInDays>1</MessageRetentionInDays><PartitionCount>4</PartitionCount>" ) || version != ehApiVersion {
+        t.Errorf( "CreateEventHub - unexpected description %v version %v", body, version )
+    }
+
+    err = client.CreateConsumerGroup( ctx, "hub", "cg0" )
+    if err != nil {
+        t.Fatalf( "CreateConsumerGroup - unexpected error %v", err )
+    }
+
+    if _, _, ok := fake.Entity( "/hub/consumergroups/cg0" ); !ok {
+        t.Errorf( "CreateConsumerGroup - consumer group missing" )
+    }
+
+    err = client.DeleteEventHub( ctx, "hub" )
+    if err != nil || fake.Count( ) != 0 {
+        t.Errorf( "DeleteEventHub - expected nothing left, got %v entities error %v", fake.Count( ), err )
+    }
+}
@@ -0,0 +1,153 @@
+package azadmintest
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/xml"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+)
+
+// Stand-in for the management endpoint of a namespace, keeps entity descriptions by path and
+// checks shared access signatures like the service does, or the bearer token if one is set.
+// Paths are case insensitive like on the service and deleting an entity deletes its children.
+type Fake struct {
+    keyName         string
+    key             string
+    Bearer          string
+
+    // Requests for this path are refused as if the key had no manage rights
+    Forbidden       string
+
+    lock            sync.Mutex
+    entities        map[ string ]string
+    versions        map[ string ]string
+}
+
+func NewFake( keyName, key string )( fake *Fake ) {
+    return &Fake {
+        keyName     :   keyName,
+        key         :   key,
+        entities    :   make( map[ string ]string ),
+        versions    :   make( map[ string ]string ),
+    }
+}
+
+// Description an entity was created with and the api version used, ok is false if it does not exist
+func ( fake *Fake )Entity( path string )( description, apiVersion string, ok bool ) {
+    fake.lock.Lock( )
+    defer fake.lock.Unlock( )
+
+    path = strings.ToLower( path )
+    description, ok = fake.entities[ path ]
+    return description, fake.versions[ path ], ok
+}
+
+func ( fake *Fake )Count( )( count int ) {
+    fake.lock.Lock( )
+    defer fake.lock.Unlock( )
+
+    return len( fake.entities )
+}
+
+func ( fake *Fake )validToken( r *http.Request )( bool ) {
+    if len( fake.Bearer ) > 0 {
+        return r.Header.Get( "Authorization" ) == "Bearer " + fake.Bearer
+    }
+
+    token := strings.TrimPrefix( r.Header.Get( "Authorization" ), "SharedAccessSignature " )
+    values, err := url.ParseQuery( token )
+    if err != nil {
+        return false
+    }
+
+    if values.Get( "skn" ) != fake.keyName {
+        return false
+    }
+
+    // The SDK signs the lower cased encoding of the resource
+    encoded := url.QueryEscape( values.Get( "sr" ) )
+    for _, resource := range [ ]string{ encoded, strings.ToLower( encoded ) } {
+        mac := hmac.New( sha256.New, [ ]byte( fake.key ) )
+        mac.Write( [ ]byte( resource + "\n" + values.Get( "se" ) ) )
+
+        if values.Get( "sig" ) == base64.StdEncoding.EncodeToString( mac.Sum( nil ) ) {
+            return true
+        }
+    }
+
+    return false
+}
+
+func wellFormed( body [ ]byte )( bool ) {
+    dec := xml.NewDecoder( strings.NewReader( string( body ) ) )
+    for {
+        _, err := dec.Token( )
+        if err == io.EOF {
+            return len( body ) > 0
+        }
+
+        if err != nil {
+            return false
+        }
+    }
+}
+
+func ( fake *Fake )ServeHTTP( w http.ResponseWriter, r *http.Request ) {
+    if !fake.validToken( r ) {
+        w.WriteHeader( http.StatusUnauthorized )
+        return
+    }
+
+    fake.lock.Lock( )
+    defer fake.lock.Unlock( )
+
+    path := strings.ToLower( r.URL.Path )
+    if len( fake.Forbidden ) > 0 && path == strings.ToLower( fake.Forbidden ) {
+        w.WriteHeader( http.StatusForbidden )
+        return
+    }
+
+    _, exists := fake.entities[ path ]
+    switch r.Method {
+        case http.MethodPut:
+            if exists {
+                w.WriteHeader( http.StatusConflict )
+                return
+            }
+
+            body, _ := io.ReadAll( r.Body )
+            if !wellFormed( body ) {
+                w.WriteHeader( http.StatusBadRequest )
+                return
+            }
+
+            fake.entities[ path ] = string( body )
+            fake.versions[ path ] = r.URL.Query( ).Get( "api-version" )
+
+            // The service answers with the created entry, the SDK client parses it
+            w.Header( ).Set( "Content-Type", "application/atom+xml" )
+            w.WriteHeader( http.StatusCreated )
+            w.Write( body )
+
+        case http.MethodDelete:
+            if !exists {
+                w.WriteHeader( http.StatusNotFound )
+                return
+            }
+
+            for entity := range fake.entities {
+                if entity == path || strings.HasPrefix( entity, path + "/" ) {
+                    delete( fake.entities, entity )
+                    delete( fake.versions, entity )
+                }
+            }
+
+        default:
+            w.WriteHeader( http.StatusMethodNotAllowed )
+    }
+}
@@ -0,0 +1,45 @@
+package azadmin
+
+import (
+    "context"
+    "net/url"
+)
+
+// Zero values keep the service defaults
+type EventHubOptions struct {
+    RetentionDays           int
+    PartitionCount          int
+}
+
+func ( opts *EventHubOptions )description( )( string ) {
+    description := `<EventHubDescription xmlns="` + sbNs + `" xmlns:i="` + xsiNs + `">`
+    description += intElement( "MessageRetentionInDays", opts.RetentionDays )
+    description += intElement( "PartitionCount", opts.PartitionCount )
+    return description + "</EventHubDescription>"
+}
+
+func consumerGroupPath( hub, group string )( string ) {
+    return entityPath( hub ) + "/consumergroups/" + url.PathEscape( group )
+}
+
+func ( client *Client )CreateEventHub( ctx context.Context, hub string, opts *EventHubOptions )( err error ) {
+    if nil == opts {
+        opts = &EventHubOptions{ }
+    }
+
+    return client.put( ctx, entityPath( hub ), ehApiVersion, opts.description( ) )
+}
+
+// Deletes the event hub along with its consumer groups
+func ( client *Client )DeleteEventHub( ctx context.Context, hub string )( err error ) {
+    return client.delete( ctx, entityPath( hub ), ehApiVersion )
+}
+
+func ( client *Client )CreateConsumerGroup( ctx context.Context, hub, group string )( err error ) {
+    description := `<ConsumerGroupDescription xmlns="` + sbNs + `" xmlns:i="` + xsiNs + `"/>`
+    return client.put( ctx, consumerGroupPath( hub, group ), ehApiVersion, description )
+}
+
+func ( client *Client )DeleteConsumerGroup( ctx context.Context, hub, group string )( err error ) {
+    return client.delete( ctx, consumerGroupPath( hub, group ), ehApiVersion )
+}
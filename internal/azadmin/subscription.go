@@ -0,0 +1,68 @@
+package azadmin
+
+import (
+    "context"
+    "sort"
+)
+
+const (
+    DefaultRuleName = "$Default"
+
+    // Broker limit on the number of rules of a subscription
+    MaxRules        = 2000
+)
+
+type Filter interface {
+    filterXml( )( string )
+}
+
+// Matches messages for which the expression over their properties is true
+type SqlFilter struct {
+    Expression      string
+}
+
+func ( filter *SqlFilter )filterXml( )( string ) {
+    return `<Filter i:type="SqlFilter">` + element( "SqlExpression", filter.Expression ) + `</Filter>`
+}
+
+// Matches messages carrying every one of the application properties with exactly these values
+type CorrelationFilter struct {
+    Properties      map[ string ]string
+}
+
+func ( filter *CorrelationFilter )filterXml( )( string ) {
+    keys := make( [ ]string, 0, len( filter.Properties ) )
+    for key := range filter.Properties {
+        keys = append( keys, key )
+    }
+
+    sort.Strings( keys )
+
+    props := ""
+    for _, key := range keys {
+        props += "<KeyValueOfstringanyType>" + element( "Key", key ) +
+            `<Value i:type="d6p1:string" xmlns:d6p1="http://www.w3.org/2001/XMLSchema">` + escape( filter.Properties[ key ] ) + "</Value>" +
+            "</KeyValueOfstringanyType>"
+    }
+
+    return `<Filter i:type="CorrelationFilter"><Properties>` + props + `</Properties></Filter>`
+}
+
+type Rule struct {
+    Name            string
+    Filter          Filter
+}
+
+func ( rule *Rule )body( )( string ) {
+    return rule.Filter.filterXml( ) + `<Action i:type="EmptyRuleAction"/>` + element( "Name", rule.Name )
+}
+
+// A message gets into the subscription when any one of its rules matches
+func ( client *Client )CreateRule( ctx context.Context, topic, sub string, rule *Rule )( err error ) {
+    description := `<RuleDescription xmlns="` + sbNs + `" xmlns:i="` + xsiNs + `">` + rule.body( ) + "</RuleDescription>"
+    return client.put( ctx, rulePath( topic, sub, rule.Name ), sbApiVersion, description )
+}
+
+func ( client *Client )DeleteRule( ctx context.Context, topic, sub, rule string )( err error ) {
+    return client.delete( ctx, rulePath( topic, sub, rule ), sbApiVersion )
+}
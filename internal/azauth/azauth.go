@@ -0,0 +1,461 @@
+package azauth
+
+import (
+    "context"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/Azure/azure-amqp-common-go/v3/auth"
+    "github.com/Azure/azure-sdk-for-go/sdk/azcore"
+    "github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+    "github.com/google/uuid"
+)
+
+const (
+    CredentialConnStr       = "connection-string"
+    CredentialSecret        = "client-secret"
+    CredentialCert          = "certificate"
+    CredentialWorkload      = "workload-identity"
+    CredentialToken         = "token"
+
+    DefaultAuthorityHost    = "https://login.microsoftonline.com/"
+    ServiceBusScope         = "https://servicebus.azure.net/.default"
+    EventHubsScope          = "https://eventhubs.azure.net/.default"
+
+    serviceBusSuffix        = ".servicebus.windows.net"
+    assertionType           = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+    assertionValidity       = 10 * time.Minute
+    requestTimeout          = time.Minute
+
+    // Tokens are fetched again this long before they expire
+    refreshMargin           = 5 * time.Minute
+
+    // Expiry assumed for a static token that does not carry one
+    staticValidity          = time.Hour
+)
+
+// Settings of a credential, Kind picks the flow and the other fields are what that flow needs
+type Options struct {
+    Kind                string
+    TenantId            string
+    ClientId            string
+    ClientSecret        string
+    CertFile            string
+    TokenFile           string
+    Token               string
+    AuthorityHost       string
+}
+
+// Secrets stay out of logs and the run configuration
+func ( opts Options )String( )( string ) {
+    return fmt.Sprintf(
+        "{Kind:%v TenantId:%v ClientId:%v ClientSecret:%v CertFile:%v TokenFile:%v Token:%v AuthorityHost:%v}",
+        opts.Kind, opts.TenantId, opts.ClientId, redacted( opts.ClientSecret ), opts.CertFile, opts.TokenFile, redacted( opts.Token ), opts.AuthorityHost,
+    )
+}
+
+func redacted( secret string )( string ) {
+    if 0 == len( secret ) {
+        return ""
+    }
+
+    return "<redacted>"
+}
+
+// Without a kind the flow follows from the settings given, a connection string if there are none
+func ( opts *Options )Resolve( )( err error ) {
+    opts.Kind = strings.ToLower( opts.Kind )
+    if 0 == len( opts.Kind ) {
+        switch {
+            case len( opts.Token ) > 0:
+                opts.Kind = CredentialToken
+
+            case len( opts.TokenFile ) > 0:
+                opts.Kind = CredentialWorkload
+
+            case len( opts.CertFile ) > 0:
+                opts.Kind = CredentialCert
+
+            case len( opts.ClientSecret ) > 0:
+                opts.Kind = CredentialSecret
+
+            default:
+                opts.Kind = CredentialConnStr
+        }
+    }
+
+    var missing string
+    switch opts.Kind {
+        case CredentialConnStr:
+
+        case CredentialToken:
+            if 0 == len( opts.Token ) {
+                missing = "a token"
+            }
+
+        case CredentialSecret:
+            if 0 == len( opts.ClientSecret ) {
+                missing = "a client secret"
+            }
+
+        case CredentialCert:
+            if 0 == len( opts.CertFile ) {
+                missing = "a certificate file"
+            }
+
+        case CredentialWorkload:
+            if 0 == len( opts.TokenFile ) {
+                missing = "a federated token file"
+            }
+
+        default:
+            return fmt.Errorf( "unknown credential %v", opts.Kind )
+    }
+
+    if 0 == len( missing ) && opts.Kind != CredentialConnStr && opts.Kind != CredentialToken {
+        if 0 == len( opts.TenantId ) || 0 == len( opts.ClientId ) {
+            missing = "a tenant and client id"
+        }
+    }
+
+    if len( missing ) > 0 {
+        return fmt.Errorf( "%v credential needs %v", opts.Kind, missing )
+    }
+
+    if 0 == len( opts.AuthorityHost ) {
+        opts.AuthorityHost = DefaultAuthorityHost
+    }
+
+    return nil
+}
+
+// Fully qualified host of a namespace given by its name alone or in full
+func Host( namespace string )( string ) {
+    namespace = strings.TrimSuffix( strings.TrimPrefix( namespace, "sb://" ), "/" )
+    if strings.Contains( namespace, "." ) {
+        return namespace
+    }
+
+    return namespace + serviceBusSuffix
+}
+
+// Called after every token request, refresh tells a renewal from the first token of a scope
+type Observer func( refresh bool, latency time.Duration, err error )
+
+type cachedToken struct {
+    token               string
+    expiresOn           time.Time
+}
+
+// Microsoft Entra ID credential for the data plane and management endpoints. Tokens are cached per
+// scope and fetched again shortly before they expire.
+type Credential struct {
+    opts                Options
+    observer            Observer
+    httpClient         *http.Client
+
+    certKey            *rsa.PrivateKey
+    certThumbprint      string
+
+    lock                sync.Mutex
+    tokens              map[ string ]cachedToken
+}
+
+func NewCredential( opts Options, observer Observer )( cred *Credential, err error ) {
+    err = opts.Resolve( )
+    if err != nil {
+        return nil, err
+    }
+
+    if opts.Kind == CredentialConnStr {
+        return nil, fmt.Errorf( "a connection string needs no credential" )
+    }
+
+    cred = &Credential {
+        opts        :   opts,
+        observer    :   observer,
+        httpClient  :   &http.Client{ Timeout : requestTimeout },
+        tokens      :   make( map[ string ]cachedToken ),
+    }
+
+    if opts.Kind == CredentialCert {
+        cred.certKey, cred.certThumbprint, err = loadCertificate( opts.CertFile )
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return cred, nil
+}
+
+func ( cred *Credential )Kind( )( string ) {
+    return cred.opts.Kind
+}
+
+// Token credential of the Service Bus client
+func ( cred *Credential )GetToken( ctx context.Context, options policy.TokenRequestOptions )( accessToken *azcore.AccessToken, err error ) {
+    token, err := cred.token( ctx, strings.Join( options.Scopes, " " ) )
+    if err != nil {
+        return nil, err
+    }
+
+    return &azcore.AccessToken{ Token : token.token, ExpiresOn : token.expiresOn }, nil
+}
+
+// Bearer token for the management endpoint
+func ( cred *Credential )Bearer( ctx context.Context, scope string )( token string, err error ) {
+    cached, err := cred.token( ctx, scope )
+    return cached.token, err
+}
+
+// Token provider of the Event Hubs client, which asks for tokens by audience without a context
+type tokenProvider struct {
+    cred               *Credential
+    scope               string
+}
+
+func ( cred *Credential )TokenProvider( scope string )( auth.TokenProvider ) {
+    return &tokenProvider{ cred : cred, scope : scope }
+}
+
+func ( provider *tokenProvider )GetToken( uri string )( token *auth.Token, err error ) {
+    ctx, cancel := context.WithTimeout( context.Background( ), requestTimeout )
+    defer cancel( )
+
+    cached, err := provider.cred.token( ctx, provider.scope )
+    if err != nil {
+        return nil, err
+    }
+
+    return auth.NewToken( auth.CBSTokenTypeJWT, cached.token, strconv.FormatInt( cached.expiresOn.Unix( ), 10 ) ), nil
+}
+
+func ( cred *Credential )token( ctx context.Context, scope string )( token cachedToken, err error ) {
+    cred.lock.Lock( )
+    defer cred.lock.Unlock( )
+
+    cached, refresh := cred.tokens[ scope ]
+    if refresh && time.Now( ).Before( cached.expiresOn.Add( -refreshMargin ) ) {
+        return cached, nil
+    }
+
+    start := time.Now( )
+    token, err = cred.fetch( ctx, scope )
+    if cred.observer != nil {
+        cred.observer( refresh, time.Since( start ), err )
+    }
+
+    if err != nil {
+        return cachedToken{ }, err
+    }
+
+    cred.tokens[ scope ] = token
+    return token, nil
+}
+
+func ( cred *Credential )tokenUrl( )( string ) {
+    return strings.TrimSuffix( cred.opts.AuthorityHost, "/" ) + "/" + cred.opts.TenantId + "/oauth2/v2.0/token"
+}
+
+type tokenResponse struct {
+    AccessToken         string                  `json:"access_token"`
+    ExpiresIn           json.Number             `json:"expires_in"`
+    Error               string                  `json:"error"`
+    ErrorDescription    string                  `json:"error_description"`
+}
+
+// Client credentials grant, authenticated with the secret or a client assertion. The federated token
+// file is read again for every request, it is rotated underneath the process.
+func ( cred *Credential )fetch( ctx context.Context, scope string )( token cachedToken, err error ) {
+    if cred.opts.Kind == CredentialToken {
+        return cachedToken{ token : cred.opts.Token, expiresOn : staticExpiry( cred.opts.Token ) }, nil
+    }
+
+    form := url.Values{ }
+    form.Set( "grant_type", "client_credentials" )
+    form.Set( "client_id", cred.opts.ClientId )
+    form.Set( "scope", scope )
+
+    switch cred.opts.Kind {
+        case CredentialSecret:
+            form.Set( "client_secret", cred.opts.ClientSecret )
+
+        case CredentialCert:
+            assertion, err := cred.certAssertion( )
+            if err != nil {
+                return cachedToken{ }, err
+            }
+
+            form.Set( "client_assertion_type", assertionType )
+            form.Set( "client_assertion", assertion )
+
+        case CredentialWorkload:
+            assertion, err := os.ReadFile( cred.opts.TokenFile )
+            if err != nil {
+                return cachedToken{ }, err
+            }
+
+            form.Set( "client_assertion_type", assertionType )
+            form.Set( "client_assertion", strings.TrimSpace( string( assertion ) ) )
+    }
+
+    req, err := http.NewRequestWithContext( ctx, http.MethodPost, cred.tokenUrl( ), strings.NewReader( form.Encode( ) ) )
+    if err != nil {
+        return cachedToken{ }, err
+    }
+
+    req.Header.Set( "Content-Type", "application/x-www-form-urlencoded" )
+
+    requested := time.Now( )
+    resp, err := cred.httpClient.Do( req )
+    if err != nil {
+        return cachedToken{ }, err
+    }
+
+    defer resp.Body.Close( )
+
+    body, err := io.ReadAll( resp.Body )
+    if err != nil {
+        return cachedToken{ }, err
+    }
+
+    var tokenResp tokenResponse
+    err = json.Unmarshal( body, &tokenResp )
+    if err != nil && resp.StatusCode == http.StatusOK {
+        return cachedToken{ }, fmt.Errorf( "invalid token response: error %v", err )
+    }
+
+    if resp.StatusCode != http.StatusOK || 0 == len( tokenResp.AccessToken ) {
+        return cachedToken{ }, fmt.Errorf( "token request for %v: status %v: %v %v", scope, resp.StatusCode, tokenResp.Error, tokenResp.ErrorDescription )
+    }
+
+    expiresIn, err := tokenResp.ExpiresIn.Int64( )
+    if err != nil {
+        return cachedToken{ }, fmt.Errorf( "invalid token expiry %v: error %v", tokenResp.ExpiresIn, err )
+    }
+
+    return cachedToken {
+        token       :   tokenResp.AccessToken,
+        expiresOn   :   requested.Add( time.Duration( expiresIn ) * time.Second ),
+    }, nil
+}
+
+// Expiry claim of a static token, which need not be a jwt at all
+func staticExpiry( token string )( expiresOn time.Time ) {
+    parts := strings.Split( token, "." )
+    if len( parts ) == 3 {
+        var claims struct {
+            Exp         int64                   `json:"exp"`
+        }
+
+        payload, err := base64.RawURLEncoding.DecodeString( parts[ 1 ] )
+        if err == nil && json.Unmarshal( payload, &claims ) == nil && claims.Exp > 0 {
+            return time.Unix( claims.Exp, 0 )
+        }
+    }
+
+    return time.Now( ).Add( staticValidity )
+}
+
+// Pem file holding the certificate and its unencrypted rsa key, the thumbprint identifies the
+// certificate to the token endpoint
+func loadCertificate( path string )( key *rsa.PrivateKey, thumbprint string, err error ) {
+    data, err := os.ReadFile( path )
+    if err != nil {
+        return nil, "", err
+    }
+
+    for block, rest := pem.Decode( data ); block != nil; block, rest = pem.Decode( rest ) {
+        switch block.Type {
+            case "CERTIFICATE":
+                if 0 == len( thumbprint ) {
+                    sum := sha1.Sum( block.Bytes )
+                    thumbprint = base64.RawURLEncoding.EncodeToString( sum[ : ] )
+                }
+
+            case "RSA PRIVATE KEY":
+                key, err = x509.ParsePKCS1PrivateKey( block.Bytes )
+                if err != nil {
+                    return nil, "", err
+                }
+
+            case "PRIVATE KEY":
+                parsed, err := x509.ParsePKCS8PrivateKey( block.Bytes )
+                if err != nil {
+                    return nil, "", err
+                }
+
+                var ok bool
+                if key, ok = parsed.( *rsa.PrivateKey ); !ok {
+                    return nil, "", fmt.Errorf( "%v: only rsa keys are supported", path )
+                }
+        }
+    }
+
+    if key == nil || 0 == len( thumbprint ) {
+        return nil, "", fmt.Errorf( "%v: needs a certificate and its private key", path )
+    }
+
+    return key, thumbprint, nil
+}
+
+func encodeSegment( v interface{ } )( segment string, err error ) {
+    data, err := json.Marshal( v )
+    if err != nil {
+        return "", err
+    }
+
+    return base64.RawURLEncoding.EncodeToString( data ), nil
+}
+
+// Short lived jwt signed with the certificate key, addressed to the token endpoint
+func ( cred *Credential )certAssertion( )( assertion string, err error ) {
+    now := time.Now( )
+
+    header, err := encodeSegment( map[ string ]string {
+        "alg"   :   "RS256",
+        "typ"   :   "JWT",
+        "x5t"   :   cred.certThumbprint,
+    } )
+    if err != nil {
+        return "", err
+    }
+
+    claims, err := encodeSegment( map[ string ]interface{ } {
+        "aud"   :   cred.tokenUrl( ),
+        "iss"   :   cred.opts.ClientId,
+        "sub"   :   cred.opts.ClientId,
+        "jti"   :   uuid.NewString( ),
+        "nbf"   :   now.Unix( ),
+        "exp"   :   now.Add( assertionValidity ).Unix( ),
+    } )
+    if err != nil {
+        return "", err
+    }
+
+    signingInput := header + "." + claims
+    sum := sha256.Sum256( [ ]byte( signingInput ) )
+
+    sig, err := rsa.SignPKCS1v15( rand.Reader, cred.certKey, crypto.SHA256, sum[ : ] )
+    if err != nil {
+        return "", err
+    }
+
+    return signingInput + "." + base64.RawURLEncoding.EncodeToString( sig ), nil
+}
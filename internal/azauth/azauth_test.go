@@ -0,0 +1,282 @@
+package azauth
+
+import (
+    "context"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/base64"
+    "encoding/pem"
+    "math/big"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+    testTenant = "tenant"
+    testClient = "client"
+)
+
+type tokenCounts struct {
+    acquired    int
+    refreshed   int
+    failed      int
+}
+
+func ( counts *tokenCounts )observe( refresh bool, latency time.Duration, err error ) {
+    switch {
+        case err != nil:
+            counts.failed++
+
+        case refresh:
+            counts.refreshed++
+
+        default:
+            counts.acquired++
+    }
+}
+
+func newFakeEndpoint( t *testing.T, expiresIn time.Duration )( fake *Fake, authority string ) {
+    fake = NewFake( testTenant, testClient, expiresIn )
+    server := httptest.NewServer( fake )
+    t.Cleanup( server.Close )
+
+    return fake, server.URL + "/"
+}
+
+// Self signed certificate and its key in one pem file
+func writeCertificate( t *testing.T )( cert *x509.Certificate, path string ) {
+    key, err := rsa.GenerateKey( rand.Reader, 2048 )
+    if err != nil {
+        t.Fatalf( "GenerateKey - failed: %v", err )
+    }
+
+    template := &x509.Certificate {
+        SerialNumber    :   big.NewInt( 1 ),
+        Subject         :   pkix.Name{ CommonName : testClient },
+        NotBefore       :   time.Now( ).Add( -time.Hour ),
+        NotAfter        :   time.Now( ).Add( time.Hour ),
+    }
+
+    der, err := x509.CreateCertificate( rand.Reader, template, template, &key.PublicKey, key )
+    if err != nil {
+        t.Fatalf( "CreateCertificate - failed: %v", err )
+    }
+
+    cert, err = x509.ParseCertificate( der )
+    if err != nil {
+        t.Fatalf( "ParseCertificate - failed: %v", err )
+    }
+
+    keyDer, err := x509.MarshalPKCS8PrivateKey( key )
+    if err != nil {
+        t.Fatalf( "MarshalPKCS8PrivateKey - failed: %v", err )
+    }
+
+    data := pem.EncodeToMemory( &pem.Block{ Type : "CERTIFICATE", Bytes : der } )
+    data = append( data, pem.EncodeToMemory( &pem.Block{ Type : "PRIVATE KEY", Bytes : keyDer } )... )
+
+    path = filepath.Join( t.TempDir( ), "client.pem" )
+    if err = os.WriteFile( path, data, 0600 ); err != nil {
+        t.Fatalf( "WriteFile - failed: %v", err )
+    }
+
+    return cert, path
+}
+
+func TestResolve( t *testing.T ) {
+    opts := Options{ }
+    if err := opts.Resolve( ); err != nil || opts.Kind != CredentialConnStr {
+        t.Errorf( "Resolve - expected a connection string without settings, got %v error %v", opts.Kind, err )
+    }
+
+    opts = Options{ TenantId : testTenant, ClientId : testClient, TokenFile : "/var/run/token" }
+    if err := opts.Resolve( ); err != nil || opts.Kind != CredentialWorkload || opts.AuthorityHost != DefaultAuthorityHost {
+        t.Errorf( "Resolve - expected workload identity from the public cloud, got %v %v error %v", opts.Kind, opts.AuthorityHost, err )
+    }
+
+    opts = Options{ ClientSecret : "secret" }
+    if err := opts.Resolve( ); err == nil {
+        t.Errorf( "Resolve - expected error for a secret without tenant and client" )
+    }
+
+    opts = Options{ Kind : CredentialCert, TenantId : testTenant, ClientId : testClient }
+    if err := opts.Resolve( ); err == nil {
+        t.Errorf( "Resolve - expected error for a certificate credential without a file" )
+    }
+
+    opts = Options{ Kind : "managed-identity" }
+    if err := opts.Resolve( ); err == nil {
+        t.Errorf( "Resolve - expected error for an unknown credential" )
+    }
+}
+
+func TestOptionsString( t *testing.T ) {
+    opts := Options{ Kind : CredentialSecret, ClientSecret : "hunter2", Token : "abc" }
+    if s := opts.String( ); strings.Contains( s, "hunter2" ) || strings.Contains( s, "abc" ) {
+        t.Errorf( "String - expected secrets redacted, got %v", s )
+    }
+}
+
+func TestHost( t *testing.T ) {
+    if host := Host( "bench" ); host != "bench.servicebus.windows.net" {
+        t.Errorf( "Host - expected the public suffix added, got %v", host )
+    }
+
+    if host := Host( "sb://bench.servicebus.chinacloudapi.cn/" ); host != "bench.servicebus.chinacloudapi.cn" {
+        t.Errorf( "Host - expected a fully qualified namespace kept, got %v", host )
+    }
+}
+
+func TestClientSecret( t *testing.T ) {
+    fake, authority := newFakeEndpoint( t, time.Hour )
+    fake.Secret = "secret"
+
+    counts := &tokenCounts{ }
+    opts := Options{ TenantId : testTenant, ClientId : testClient, ClientSecret : "secret", AuthorityHost : authority }
+    cred, err := NewCredential( opts, counts.observe )
+    if err != nil {
+        t.Fatalf( "NewCredential - failed: %v", err )
+    }
+
+    ctx := context.Background( )
+    for i := 0; i < 3; i++ {
+        token, err := cred.GetToken( ctx, policy.TokenRequestOptions{ Scopes : [ ]string{ ServiceBusScope } } )
+        if err != nil || token.Token != "token-1" {
+            t.Fatalf( "GetToken - expected the cached token, got %v error %v", token, err )
+        }
+    }
+
+    token, err := cred.Bearer( ctx, EventHubsScope )
+    if err != nil || token != "token-2" {
+        t.Errorf( "Bearer - expected a token of its own for another scope, got %v error %v", token, err )
+    }
+
+    if issued, scopes := fake.Issued( ); issued != 2 || scopes[ 0 ] != ServiceBusScope || scopes[ 1 ] != EventHubsScope {
+        t.Errorf( "GetToken - expected a token per scope, got %v for %v", issued, scopes )
+    }
+
+    if counts.acquired != 2 || counts.refreshed != 0 || counts.failed != 0 {
+        t.Errorf( "GetToken - expected two acquisitions, got %+v", *counts )
+    }
+}
+
+func TestRefresh( t *testing.T ) {
+    fake, authority := newFakeEndpoint( t, refreshMargin + time.Second )
+    fake.Secret = "secret"
+
+    counts := &tokenCounts{ }
+    opts := Options{ TenantId : testTenant, ClientId : testClient, ClientSecret : "secret", AuthorityHost : authority }
+    cred, err := NewCredential( opts, counts.observe )
+    if err != nil {
+        t.Fatalf( "NewCredential - failed: %v", err )
+    }
+
+    ctx := context.Background( )
+    if token, _ := cred.Bearer( ctx, ServiceBusScope ); token != "token-1" {
+        t.Errorf( "Bearer - expected the first token, got %v", token )
+    }
+
+    time.Sleep( 1100 * time.Millisecond )
+
+    if token, _ := cred.Bearer( ctx, ServiceBusScope ); token != "token-2" {
+        t.Errorf( "Bearer - expected a token refreshed within the margin, got %v", token )
+    }
+
+    if counts.acquired != 1 || counts.refreshed != 1 {
+        t.Errorf( "Bearer - expected one acquisition and one refresh, got %+v", *counts )
+    }
+}
+
+func TestWrongSecret( t *testing.T ) {
+    fake, authority := newFakeEndpoint( t, time.Hour )
+    fake.Secret = "secret"
+
+    counts := &tokenCounts{ }
+    opts := Options{ TenantId : testTenant, ClientId : testClient, ClientSecret : "wrong", AuthorityHost : authority }
+    cred, err := NewCredential( opts, counts.observe )
+    if err != nil {
+        t.Fatalf( "NewCredential - failed: %v", err )
+    }
+
+    _, err = cred.Bearer( context.Background( ), ServiceBusScope )
+    if err == nil || !strings.Contains( err.Error( ), "invalid_client" ) || counts.failed != 1 {
+        t.Errorf( "Bearer - expected a counted failure, got %v counts %+v", err, *counts )
+    }
+}
+
+func TestWorkloadIdentity( t *testing.T ) {
+    fake, authority := newFakeEndpoint( t, time.Hour )
+    fake.Assertion = "federated"
+
+    tokenFile := filepath.Join( t.TempDir( ), "token" )
+    if err := os.WriteFile( tokenFile, [ ]byte( "federated\n" ), 0600 ); err != nil {
+        t.Fatalf( "WriteFile - failed: %v", err )
+    }
+
+    opts := Options{ TenantId : testTenant, ClientId : testClient, TokenFile : tokenFile, AuthorityHost : authority }
+    cred, err := NewCredential( opts, nil )
+    if err != nil {
+        t.Fatalf( "NewCredential - failed: %v", err )
+    }
+
+    token, err := cred.TokenProvider( EventHubsScope ).GetToken( "amqps://bench.servicebus.windows.net/hub" )
+    if err != nil || token.Token != "token-1" {
+        t.Errorf( "GetToken - expected a token for the federated assertion, got %v error %v", token, err )
+    }
+}
+
+func TestCertificate( t *testing.T ) {
+    fake, authority := newFakeEndpoint( t, time.Hour )
+    cert, certFile := writeCertificate( t )
+    fake.Cert = cert
+
+    opts := Options{ TenantId : testTenant, ClientId : testClient, CertFile : certFile, AuthorityHost : authority }
+    cred, err := NewCredential( opts, nil )
+    if err != nil {
+        t.Fatalf( "NewCredential - failed: %v", err )
+    }
+
+    token, err := cred.Bearer( context.Background( ), ServiceBusScope )
+    if err != nil || token != "token-1" {
+        t.Errorf( "Bearer - expected a token for the signed assertion, got %v error %v", token, err )
+    }
+
+    _, err = NewCredential( Options{ TenantId : testTenant, ClientId : testClient, CertFile : filepath.Join( t.TempDir( ), "missing.pem" ) }, nil )
+    if err == nil {
+        t.Errorf( "NewCredential - expected error for a missing certificate file" )
+    }
+}
+
+func TestStaticToken( t *testing.T ) {
+    exp := time.Now( ).Add( 2 * time.Hour ).Unix( )
+    payload := base64.RawURLEncoding.EncodeToString( [ ]byte( `{"exp":` + strconv.FormatInt( exp, 10 ) + `}` ) )
+    jwt := "e30." + payload + ".c2ln"
+
+    counts := &tokenCounts{ }
+    cred, err := NewCredential( Options{ Token : jwt }, counts.observe )
+    if err != nil {
+        t.Fatalf( "NewCredential - failed: %v", err )
+    }
+
+    token, err := cred.GetToken( context.Background( ), policy.TokenRequestOptions{ Scopes : [ ]string{ ServiceBusScope } } )
+    if err != nil || token.Token != jwt || token.ExpiresOn.Unix( ) != exp {
+        t.Errorf( "GetToken - expected the static token with its expiry, got %v error %v", token, err )
+    }
+
+    if counts.acquired != 1 {
+        t.Errorf( "GetToken - expected the static token counted as acquired, got %+v", *counts )
+    }
+
+    if expiresOn := staticExpiry( "opaque" ); time.Until( expiresOn ) <= 0 {
+        t.Errorf( "staticExpiry - expected an opaque token to stay valid, got %v", expiresOn )
+    }
+}
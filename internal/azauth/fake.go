@@ -0,0 +1,125 @@
+package azauth
+
+import (
+    "crypto"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Stand-in for the token endpoint of a tenant. Hands out numbered tokens to its client when it
+// presents the secret, a federated assertion or an assertion signed with the certificate it expects.
+type Fake struct {
+    tenantId            string
+    clientId            string
+    expiresIn           time.Duration
+
+    Secret              string
+    Assertion           string
+    Cert               *x509.Certificate
+
+    lock                sync.Mutex
+    issued              int
+    scopes           [ ]string
+}
+
+func NewFake( tenantId, clientId string, expiresIn time.Duration )( fake *Fake ) {
+    return &Fake {
+        tenantId    :   tenantId,
+        clientId    :   clientId,
+        expiresIn   :   expiresIn,
+    }
+}
+
+// Number of tokens handed out and the scopes they were asked for, in order
+func ( fake *Fake )Issued( )( issued int, scopes [ ]string ) {
+    fake.lock.Lock( )
+    defer fake.lock.Unlock( )
+
+    return fake.issued, append( [ ]string{ }, fake.scopes... )
+}
+
+// Checks the signature, issuer and audience of a certificate assertion
+func ( fake *Fake )validCertAssertion( assertion string )( bool ) {
+    if fake.Cert == nil {
+        return false
+    }
+
+    parts := strings.Split( assertion, "." )
+    if len( parts ) != 3 {
+        return false
+    }
+
+    sig, err := base64.RawURLEncoding.DecodeString( parts[ 2 ] )
+    if err != nil {
+        return false
+    }
+
+    pub, ok := fake.Cert.PublicKey.( *rsa.PublicKey )
+    sum := sha256.Sum256( [ ]byte( parts[ 0 ] + "." + parts[ 1 ] ) )
+    if !ok || rsa.VerifyPKCS1v15( pub, crypto.SHA256, sum[ : ], sig ) != nil {
+        return false
+    }
+
+    var claims struct {
+        Aud             string                  `json:"aud"`
+        Iss             string                  `json:"iss"`
+    }
+
+    payload, err := base64.RawURLEncoding.DecodeString( parts[ 1 ] )
+    if err != nil || json.Unmarshal( payload, &claims ) != nil {
+        return false
+    }
+
+    return claims.Iss == fake.clientId && strings.HasSuffix( claims.Aud, "/" + fake.tenantId + "/oauth2/v2.0/token" )
+}
+
+func ( fake *Fake )authorized( r *http.Request )( bool ) {
+    if r.PostForm.Get( "client_id" ) != fake.clientId || r.PostForm.Get( "grant_type" ) != "client_credentials" {
+        return false
+    }
+
+    if secret := r.PostForm.Get( "client_secret" ); len( secret ) > 0 {
+        return secret == fake.Secret
+    }
+
+    if r.PostForm.Get( "client_assertion_type" ) != assertionType {
+        return false
+    }
+
+    assertion := r.PostForm.Get( "client_assertion" )
+    return ( len( fake.Assertion ) > 0 && assertion == fake.Assertion ) || fake.validCertAssertion( assertion )
+}
+
+func ( fake *Fake )ServeHTTP( w http.ResponseWriter, r *http.Request ) {
+    w.Header( ).Set( "Content-Type", "application/json" )
+
+    if r.Method != http.MethodPost || r.URL.Path != "/" + fake.tenantId + "/oauth2/v2.0/token" {
+        w.WriteHeader( http.StatusNotFound )
+        return
+    }
+
+    if r.ParseForm( ) != nil || !fake.authorized( r ) {
+        w.WriteHeader( http.StatusUnauthorized )
+        json.NewEncoder( w ).Encode( tokenResponse{ Error : "invalid_client", ErrorDescription : "client authentication failed" } )
+        return
+    }
+
+    fake.lock.Lock( )
+    fake.issued++
+    fake.scopes = append( fake.scopes, r.PostForm.Get( "scope" ) )
+    token := "token-" + strconv.Itoa( fake.issued )
+    fake.lock.Unlock( )
+
+    json.NewEncoder( w ).Encode( tokenResponse {
+        AccessToken :   token,
+        ExpiresIn   :   json.Number( strconv.FormatInt( int64( fake.expiresIn / time.Second ), 10 ) ),
+    } )
+}
@@ -6,26 +6,29 @@ import (
     "context"
     "os"
     "fmt"
-    "strconv"
 
     "github.com/golang/glog"
 
     evhub "github.com/Azure/azure-event-hubs-go/v3"
     evhub_persist "github.com/Azure/azure-event-hubs-go/v3/persist"
 
+    "github.com/azsvcbusbench/internal/clocksync"
+    "github.com/azsvcbusbench/internal/dashboard"
     "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/phase"
+    "github.com/azsvcbusbench/internal/report"
     "github.com/azsvcbusbench/internal/stats"
 )
 
 const (
     testIdPropName  = "testId"
     idxPropName     = "senderIdx"
-    trackPropName   = "track"
+    phasePropName   = "phase"
 )
 
 var (
     msgContentType = "application/json"
-    strFalse       = strconv.FormatBool( false )
+    measureName    = phase.Measure.String( )
 )
 
 func NewAzEvHub( )( *AzEvHub ) {
@@ -44,7 +47,6 @@ func ( azEvHub *AzEvHub )initMsgGen( )( err error ) {
     if len( azEvHub.IpsFile ) > 0 {
         fh, err := os.Open( azEvHub.IpsFile )
         if err != nil {
-            glog.Fatalf( "failed to open file %v: error %v", azEvHub.IpsFile, err )
             return fmt.Errorf( "failed to open file %v: error %v", azEvHub.IpsFile, err )
         }
 
@@ -58,7 +60,6 @@ func ( azEvHub *AzEvHub )initMsgGen( )( err error ) {
     }
 
     if err != nil {
-        glog.Fatalf( "failed to initialize message generator" )
         return fmt.Errorf( "failed to initialize message generator" )
     }
 
@@ -72,7 +73,6 @@ func ( azEvHub *AzEvHub )initIdGen( )( err error ) {
     if len( azEvHub.IdsFile ) > 0 {
         fh, err := os.Open( azEvHub.IdsFile )
         if err != nil {
-            glog.Fatalf( "failed to open file %v: error %v", azEvHub.IdsFile, err )
             return fmt.Errorf( "failed to open file %v: error %v", azEvHub.IdsFile, err )
         }
 
@@ -86,7 +86,6 @@ func ( azEvHub *AzEvHub )initIdGen( )( err error ) {
     }
 
     if err != nil {
-        glog.Fatalf( "failed to initialize id generator" )
         return fmt.Errorf( "failed to initialize id generator" )
     }
 
@@ -111,52 +110,160 @@ func ( azEvHub *AzEvHub )setupCheckPointPersister( )( evhub_persist.CheckpointPe
     return persister, nil
 }
 
-func ( azEvHub *AzEvHub )Start( ) {
+// Jobs not listed default to this job alone, which covers a single process as well as a sender
+// only and receiver only pair sharing an index
+func ( azEvHub *AzEvHub )parseJobs( list string )( jobs [ ]int, err error ) {
+    jobs, err = helpers.ParseIndexList( list )
+    if err != nil {
+        return nil, err
+    }
+
+    if len( jobs ) == 0 {
+        jobs = [ ]int{ azEvHub.Index }
+    }
+
+    return jobs, nil
+}
+
+// Every receiver subscribes to the topic and skips what its own gateway sent
+func ( azEvHub *AzEvHub )initTopology( )( err error ) {
+    topology := &stats.Topology {
+        GatewaysPerJob  :   azEvHub.TotGateways,
+        Delivery        :   stats.DeliveryFanout,
+        SelfSkip        :   true,
+    }
+
+    topology.SenderJobs, err = azEvHub.parseJobs( azEvHub.SenderJobs )
+    if err != nil {
+        return fmt.Errorf( "invalid sender jobs: error %v", err )
+    }
+
+    topology.ReceiverJobs, err = azEvHub.parseJobs( azEvHub.ReceiverJobs )
+    if err != nil {
+        return fmt.Errorf( "invalid receiver jobs: error %v", err )
+    }
+
+    azEvHub.stats.SetTopology( topology, azEvHub.Index, !azEvHub.ReceiverOnly, !azEvHub.SenderOnly )
+    return nil
+}
+
+func ( azEvHub *AzEvHub )initStatsSinks( )( err error ) {
+    useDashboard := azEvHub.Dashboard && dashboard.IsTerminal( os.Stdout )
+    if azEvHub.Dashboard && !useDashboard {
+        glog.Infof( "stdout is not a terminal, falling back to plain statistics output" )
+    }
+
+    // Plain text would scroll the dashboard off the screen
+    if azEvHub.StatsText && !useDashboard {
+        azEvHub.stats.AddSink( stats.NewTextSink( os.Stdout ) )
+    }
+
+    if useDashboard {
+        azEvHub.dashboard = dashboard.New( os.Stdout, azEvHub.stats, azEvHub.DashboardTopN )
+    }
+
+    if len( azEvHub.ResultFile ) > 0 {
+        azEvHub.stats.AddSink( stats.NewJsonFileSink( azEvHub.ResultFile ) )
+    }
+
+    if len( azEvHub.StatsCsvFile ) > 0 {
+        csvSink, err := stats.NewCsvSink( azEvHub.StatsCsvFile )
+        if err != nil {
+            return fmt.Errorf( "failed to create csv file %v: error %v", azEvHub.StatsCsvFile, err )
+        }
+
+        azEvHub.stats.AddSink( csvSink )
+    }
+
+    return nil
+}
+
+// Registers an additional stats sink, has to be called before Start
+func ( azEvHub *AzEvHub )AddStatsSink( sink stats.Sink ) {
+    azEvHub.stats.AddSink( sink )
+}
+
+func ( azEvHub *AzEvHub )Start( )( err error ) {
+    err = azEvHub.initCredential( )
+    if err != nil {
+        return fmt.Errorf( "invalid credential settings: error %v", err )
+    }
+
     persister, err := azEvHub.setupCheckPointPersister( )
     if err != nil {
-        glog.Fatalf( "failed to initialize checkpoint persister %v", err )
-        return
+        return fmt.Errorf( "failed to initialize checkpoint persister %v", err )
     }
 
     azEvHub.persister = persister
 
-    hub, err := evhub.NewHubFromConnectionString( azEvHub.ConnStr, evhub.HubWithOffsetPersistence( azEvHub ) )
+    if azEvHub.Provision {
+        err = azEvHub.provision( )
+        if err != nil {
+            return fmt.Errorf( "failed to provision event hub: error %v", err )
+        }
+    }
+
+    hub, err := azEvHub.newHub( evhub.HubWithOffsetPersistence( azEvHub ) )
     if err != nil {
-        glog.Fatalf( "failed to setup event hub %v", err )
-        return
+        return fmt.Errorf( "failed to setup event hub %v", err )
     }
 
     azEvHub.hub = hub
 
-    realDuration := azEvHub.Duration + azEvHub.WarmupDuration
-
-    ctx, _             := context.WithTimeout( context.Background( ), realDuration )
-    azEvHub.senderCtx  = ctx
-
-    ctx, cancel := context.WithTimeout( context.Background( ), realDuration + ( 2 * time.Minute ) )
+    azEvHub.phases = phase.NewTracker( azEvHub.WarmupDuration, azEvHub.Duration, azEvHub.CooldownDuration )
     defer func( ) {
-        cancel( )
+        azEvHub.phases.Stop( )
     }( )
-    azEvHub.receiverCtx = ctx
-    azEvHub.statsCtx    = ctx
+
+    azEvHub.senderCtx   = azEvHub.phases.SenderCtx( )
+    azEvHub.receiverCtx = azEvHub.phases.ReceiverCtx( )
+    azEvHub.statsCtx    = azEvHub.receiverCtx
+
+    clockEst, err := clocksync.Setup( azEvHub.receiverCtx, azEvHub.ClockSyncListen, azEvHub.ClockSyncUrl, azEvHub.ClockSyncSamples )
+    if err != nil {
+        return fmt.Errorf( "failed to synchronize clock: error %v", err )
+    }
+
+    if clockEst != nil {
+        azEvHub.stats.SetClockEstimate( clockEst.Offset, clockEst.Uncertainty )
+    }
 
     err = azEvHub.initMsgGen( )
     if err != nil {
-        glog.Fatalf( "failed to initialize message generator: error %v", err )
-        return
+        return fmt.Errorf( "failed to initialize message generator: error %v", err )
     }
 
     err = azEvHub.initIdGen( )
     if err != nil {
-        glog.Fatalf( "failed to initialize id generator: error %v", err )
-        return
+        return fmt.Errorf( "failed to initialize id generator: error %v", err )
     }
 
+    azEvHub.stats.SetConfig( "azevhub", azEvHub )
     azEvHub.stats.SetCtx( azEvHub.statsCtx )
     azEvHub.stats.SetIds( azEvHub.idGen.Block )
+
+    err = azEvHub.initTopology( )
+    if err != nil {
+        return fmt.Errorf( "failed to initialize topology: error %v", err )
+    }
+
     azEvHub.stats.SetStatsDumpInterval( azEvHub.StatDumpInterval )
+
+    err = azEvHub.initStatsSinks( )
+    if err != nil {
+        return fmt.Errorf( "failed to initialize stats sinks: error %v", err )
+    }
+
     azEvHub.stats.StartDumper( )
 
+    if azEvHub.dashboard != nil {
+        azEvHub.wg.Add( 1 )
+        go func( ) {
+            defer azEvHub.wg.Done( )
+            azEvHub.dashboard.Run( azEvHub.statsCtx )
+        }( )
+    }
+
     if !azEvHub.SenderOnly {
         azEvHub.receiversChan  = make( [ ]chan error, azEvHub.TotGateways )
         azEvHub.consumerGroups = make( [ ]string, azEvHub.TotGateways )
@@ -171,7 +278,7 @@ func ( azEvHub *AzEvHub )Start( ) {
 
             receiverErr := <-azEvHub.receiversChan[ i ]
             if receiverErr != nil {
-                glog.Fatalf( "failed to start receiver: %v", receiverErr )
+                return fmt.Errorf( "failed to start receiver: error %v", receiverErr )
             }
         }
     }
@@ -189,25 +296,38 @@ func ( azEvHub *AzEvHub )Start( ) {
     azEvHub.wg.Add( 1 )
     go func( ) {
         defer azEvHub.wg.Done( )
-        azEvHub.trackWarmup( )
+        azEvHub.trackPhases( )
     }( )
 
     azEvHub.wg.Wait( )
     azEvHub.stats.StopDumper( )
+
+    azEvHub.result = azEvHub.stats.GetFinalResult( )
+
+    if len( azEvHub.ReportFile ) > 0 {
+        err = report.WriteHtmlFile( azEvHub.ReportFile, azEvHub.result )
+        if err != nil {
+            glog.Errorf( "failed to write report file %v: error %v", azEvHub.ReportFile, err )
+        }
+    }
+
+    return nil
 }
 
-func ( azEvHub *AzEvHub )trackWarmup( ) {
-    warmupTimer := time.NewTimer( azEvHub.WarmupDuration )
+func ( azEvHub *AzEvHub )GetResult( )( *stats.Result ) {
+    return azEvHub.result
+}
 
-    select {
-        case <-warmupTimer.C:
-            azEvHub.trackTest = true
-            return
+func ( azEvHub *AzEvHub )trackPhases( ) {
+    azEvHub.phases.Run( func( p phase.Phase ) {
+        switch p {
+            case phase.Measure:
+                azEvHub.stats.MarkMeasureStart( )
 
-        case <-azEvHub.senderCtx.Done( ):
-            warmupTimer.Stop( )
-            return
-    }
+            case phase.Cooldown:
+                azEvHub.stats.MarkMeasureEnd( )
+        }
+    } )
 }
 
 func ( azEvHub *AzEvHub )getSenderIdFromIdx( idx int )( id string, realIdx int, err error ) {
@@ -219,6 +339,17 @@ func ( azEvHub *AzEvHub )getSenderIdFromIdx( idx int )( id string, realIdx int,
     return azEvHub.idGen.Block[ realIdx ], realIdx, nil
 }
 
+// Payload plus everything else that travels with each event
+func eventSize( event *evhub.Event )( size int ) {
+    size = len( event.Data ) + helpers.PropertiesSize( event.Properties )
+
+    if event.PartitionKey != nil {
+        size += len( *event.PartitionKey )
+    }
+
+    return size
+}
+
 func ( azEvHub *AzEvHub )sendMessage( idx int )( err error ) {
     id, realIdx, err := azEvHub.getSenderIdFromIdx( idx )
     if err != nil {
@@ -226,11 +357,14 @@ func ( azEvHub *AzEvHub )sendMessage( idx int )( err error ) {
         return err
     }
 
+    // Read once so the tag and the accounting of the message always agree
+    sentPhase := azEvHub.phases.Get( )
+
     appProps := map[ string ]interface{ }{
         azEvHub.PropName  : id,
         testIdPropName    : azEvHub.TestId,
         idxPropName       : realIdx,
-        trackPropName     : strconv.FormatBool( azEvHub.trackTest ),
+        phasePropName     : sentPhase.String( ),
     }
 
     event := &evhub.Event {
@@ -246,14 +380,22 @@ func ( azEvHub *AzEvHub )sendMessage( idx int )( err error ) {
 
     event.Data = msg
 
+    sendStart := time.Now( )
     err = azEvHub.hub.Send( azEvHub.senderCtx, event )
+    sendLatency := time.Since( sendStart )
     if err != nil {
         glog.Errorf( "%v: Failed to send event, error = %v", id, err )
+        if azEvHub.senderCtx.Err( ) == nil {
+            azEvHub.stats.UpdateErrorStat( realIdx, stats.ErrorClassSend )
+        }
+
         return err
     }
 
-    if azEvHub.trackTest {
+    if sentPhase == phase.Measure {
         azEvHub.stats.UpdateSenderStat( realIdx, uint64( azEvHub.MsgsPerSend ) )
+        azEvHub.stats.UpdateSendLatency( realIdx, sendLatency )
+        azEvHub.stats.UpdateSenderBytes( realIdx, uint64( eventSize( event ) ) )
     }
 
     return nil
@@ -292,8 +434,6 @@ func ( azEvHub *AzEvHub )startSender( idx int ) {
 
         time.Sleep( azEvHub.SendInterval )
     }
-
-    return
 }
 
 func ( azEvHub *AzEvHub )getReceiverIdFromIdx( idx int )( id string, realIdx int, err error ) {
@@ -312,10 +452,11 @@ func ( azEvHub *AzEvHub )receivedMessageCallback( idx int, event *evhub.Event )(
         return err
     }
 
-    trackVal, exists := event.Properties[ trackPropName ]
+    // Only messages sent while measuring count, no matter when they arrive
+    phaseVal, exists := event.Properties[ phasePropName ]
     if exists {
-        track, ok := trackVal.( string )
-        if ok && track == strFalse {
+        sentPhase, ok := phaseVal.( string )
+        if ok && sentPhase != measureName {
             return nil
         }
     }
@@ -334,6 +475,7 @@ func ( azEvHub *AzEvHub )receivedMessageCallback( idx int, event *evhub.Event )(
 
     msgList, err := azEvHub.msgGen.ParseMsg( event.Data, msgCb )
     if err != nil {
+        azEvHub.stats.UpdateErrorStat( realIdx, stats.ErrorClassParse )
         glog.Errorf( "%v: Failed to parse message, error = %v", id, err )
         return fmt.Errorf( "%v: Failed to parse message, error = %v", id, err )
     }
@@ -350,6 +492,12 @@ func ( azEvHub *AzEvHub )receivedMessageCallback( idx int, event *evhub.Event )(
         senderIdx, ok := senderIdxPropVal.( int64 )
         if ok {
             azEvHub.stats.UpdateReceiverStat( realIdx, int( senderIdx ), uint64( msgList.Count ), uint64( msgList.GetLatency( ) ) )
+            azEvHub.stats.UpdateReceiverBytes( realIdx, uint64( eventSize( event ) ) )
+            if azEvHub.phases.Get( ) >= phase.Cooldown {
+                azEvHub.stats.UpdateLateStat( realIdx, uint64( msgList.Count ) )
+            }
+
+            azEvHub.stats.UpdateClockStat( realIdx, msgList.GetRawLatency( ), uint64( msgList.GetLatencyBound( ) ) )
         } else {
             glog.Errorf( "%v: Invalid sender index in event properties", id )
             return fmt.Errorf( "%v: Invalid sender index in event properties", id )
@@ -370,10 +518,14 @@ func ( azEvHub *AzEvHub )closeReceiver( idx int )( err error ) {
     return nil
 }
 
+func ( azEvHub *AzEvHub )consumerGroupName( idx int )( string ) {
+    return azEvHub.ConsumerGroupPrefix + fmt.Sprint( idx )
+}
+
 func ( azEvHub *AzEvHub )getConsumerGroupForReceiver( idx int )( string ) {
     if len( azEvHub.consumerGroups[ idx ] ) == 0 {
         if len( azEvHub.ConsumerGroupPrefix ) > 0 {
-            azEvHub.consumerGroups[ idx ] = azEvHub.ConsumerGroupPrefix + fmt.Sprint( idx )
+            azEvHub.consumerGroups[ idx ] = azEvHub.consumerGroupName( idx )
         } else {
             azEvHub.consumerGroups[ idx ] = evhub.DefaultConsumerGroup
         }
@@ -430,14 +582,6 @@ func ( azEvHub *AzEvHub )startReceiver( idx int ) {
 
     azEvHub.receiversChan[ idx ] <- nil
 
-    for {
-        select {
-            case <-azEvHub.receiverCtx.Done( ):
-                return
-
-            default:
-        }
-    }
-
-    return
+    // Events are delivered on the hub's goroutines, keep the handles open until cooldown is over
+    <-azEvHub.receiverCtx.Done( )
 }
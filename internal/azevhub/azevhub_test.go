@@ -1,8 +1,113 @@
 package azevhub
 
 import (
+    "net/http/httptest"
     "testing"
+
+    "github.com/azsvcbusbench/internal/azadmin"
+    "github.com/azsvcbusbench/internal/azadmin/azadmintest"
+    "github.com/azsvcbusbench/internal/azauth"
 )
 
 func TestNewAzEvHub( t *testing.T ) {
 }
+
+func TestHubName( t *testing.T ) {
+    azEvHub := &AzEvHub{ ConnStr : "Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=key;SharedAccessKey=c2VjcmV0;EntityPath=hub" }
+    if name, err := azEvHub.hubName( ); err != nil || name != "hub" {
+        t.Errorf( "hubName - expected entity path hub, got %v error %v", name, err )
+    }
+
+    azEvHub.TopicName = "topic"
+    if name, err := azEvHub.hubName( ); err != nil || name != "topic" {
+        t.Errorf( "hubName - expected topic, got %v error %v", name, err )
+    }
+}
+
+func TestInitCredential( t *testing.T ) {
+    azEvHub := NewAzEvHub( )
+    azEvHub.ConnStr = "Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=key;SharedAccessKey=c2VjcmV0"
+    azEvHub.Credential.ClientSecret = "secret"
+    if err := azEvHub.initCredential( ); err != nil || azEvHub.credential != nil {
+        t.Errorf( "initCredential - expected the connection string to win, got error %v", err )
+    }
+
+    azEvHub = NewAzEvHub( )
+    azEvHub.Credential = azauth.Options{ Token : "token" }
+    if err := azEvHub.initCredential( ); err == nil {
+        t.Errorf( "initCredential - expected error for a credential without namespace and topic" )
+    }
+
+    azEvHub.NameSpace = "ns"
+    azEvHub.TopicName = "hub"
+    if err := azEvHub.initCredential( ); err != nil || azEvHub.credential == nil {
+        t.Fatalf( "initCredential - failed for a token credential: %v", err )
+    }
+
+    if _, err := azEvHub.newHub( ); err != nil {
+        t.Errorf( "newHub - failed with a token credential: %v", err )
+    }
+
+    if name, err := azEvHub.hubName( ); err != nil || name != "hub" {
+        t.Errorf( "hubName - expected hub, got %v error %v", name, err )
+    }
+}
+
+func TestProvision( t *testing.T ) {
+    fake := azadmintest.NewFake( "key", "c2VjcmV0" )
+    server := httptest.NewServer( fake )
+    defer server.Close( )
+
+    azEvHub := &AzEvHub {
+        TopicName           :   "hub",
+        ConsumerGroupPrefix :   "cg",
+        TotGateways         :   2,
+        PartitionCount      :   4,
+        Provision           :   true,
+        KeepOnFailure       :   true,
+        Index               :   1,
+        SenderJobs          :   "1-2",
+    }
+    azEvHub.admin = azadmin.NewClient( server.URL, "key", "c2VjcmV0" )
+
+    err := azEvHub.provision( )
+    if err != nil {
+        t.Fatalf( "provision - unexpected error %v", err )
+    }
+
+    if fake.Count( ) != 3 {
+        t.Errorf( "provision - expected hub and 2 consumer groups, got %v entities", fake.Count( ) )
+    }
+
+    // Provisioning again, as the other jobs of the run do, keeps what is there
+    if err = azEvHub.provision( ); err != nil {
+        t.Errorf( "provision - unexpected error for existing entities %v", err )
+    }
+
+    azEvHub.Deprovision( true )
+    if fake.Count( ) != 3 {
+        t.Errorf( "Deprovision - expected entities kept on failure, got %v", fake.Count( ) )
+    }
+
+    // Other jobs of the run may still be using the hub, it is left to Teardown
+    azEvHub.Deprovision( false )
+    if fake.Count( ) != 3 {
+        t.Errorf( "Deprovision - expected entities kept for the other jobs, got %v", fake.Count( ) )
+    }
+
+    azEvHub.ConnStr = "Endpoint=sb://bench.servicebus.windows.net/;SharedAccessKeyName=bench;SharedAccessKey=c2VjcmV0"
+    if err = azEvHub.Teardown( ); err != nil || fake.Count( ) != 0 {
+        t.Errorf( "Teardown - expected entities deleted, got %v error %v", fake.Count( ), err )
+    }
+
+    // A single job tears down on its own
+    if err = azEvHub.provision( ); err != nil {
+        t.Fatalf( "provision - unexpected error %v", err )
+    }
+
+    azEvHub.SenderJobs = "1"
+    azEvHub.Deprovision( false )
+    if fake.Count( ) != 0 {
+        t.Errorf( "Deprovision - expected entities deleted, got %v", fake.Count( ) )
+    }
+}
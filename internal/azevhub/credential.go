@@ -0,0 +1,65 @@
+package azevhub
+
+import (
+    "context"
+    "fmt"
+    "strings"
+
+    evhub "github.com/Azure/azure-event-hubs-go/v3"
+
+    "github.com/azsvcbusbench/internal/azadmin"
+    "github.com/azsvcbusbench/internal/azauth"
+)
+
+// Connection strings carry their own key and may name the hub, every other credential needs the
+// namespace and the hub given separately
+func ( azEvHub *AzEvHub )initCredential( )( err error ) {
+    if 0 == len( azEvHub.Credential.Kind ) && len( azEvHub.ConnStr ) > 0 {
+        azEvHub.Credential.Kind = azauth.CredentialConnStr
+    }
+
+    err = azEvHub.Credential.Resolve( )
+    if err != nil {
+        return err
+    }
+
+    if azEvHub.Credential.Kind == azauth.CredentialConnStr {
+        if 0 == len( azEvHub.ConnStr ) {
+            return fmt.Errorf( "connection string cannot be empty" )
+        }
+
+        return nil
+    }
+
+    if 0 == len( azEvHub.NameSpace ) || 0 == len( azEvHub.TopicName ) {
+        return fmt.Errorf( "%v credential needs a namespace and a topic name", azEvHub.Credential.Kind )
+    }
+
+    azEvHub.credential, err = azauth.NewCredential( azEvHub.Credential, azEvHub.stats.UpdateTokenStat )
+    if err != nil {
+        return err
+    }
+
+    azEvHub.stats.SetCredential( azEvHub.Credential.Kind )
+    return nil
+}
+
+// The hub client wants the namespace by its name, it adds the suffix of the cloud itself
+func ( azEvHub *AzEvHub )newHub( opts ...evhub.HubOption )( hub *evhub.Hub, err error ) {
+    if azEvHub.credential == nil {
+        return evhub.NewHubFromConnectionString( azEvHub.ConnStr, opts... )
+    }
+
+    name := strings.SplitN( azauth.Host( azEvHub.NameSpace ), ".", 2 )[ 0 ]
+    return evhub.NewHub( name, azEvHub.TopicName, azEvHub.credential.TokenProvider( azauth.EventHubsScope ), opts... )
+}
+
+func ( azEvHub *AzEvHub )newAdmin( )( admin *azadmin.Client, err error ) {
+    if azEvHub.credential == nil {
+        return azadmin.NewClientFromConnectionString( azEvHub.ConnStr )
+    }
+
+    return azadmin.NewClientWithToken( "https://" + azauth.Host( azEvHub.NameSpace ), func( ctx context.Context )( string, error ) {
+        return azEvHub.credential.Bearer( ctx, azauth.EventHubsScope )
+    } ), nil
+}
@@ -0,0 +1,168 @@
+package azevhub
+
+import (
+    "context"
+    "fmt"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/azsvcbusbench/internal/azadmin"
+)
+
+const (
+    provisionTimeout    = 5 * time.Minute
+)
+
+// The hub named by TopicName, or else the one the connection string points at
+func ( azEvHub *AzEvHub )hubName( )( name string, err error ) {
+    if len( azEvHub.TopicName ) > 0 {
+        return azEvHub.TopicName, nil
+    }
+
+    _, _, _, name, err = azadmin.ParseConnectionString( azEvHub.ConnStr )
+    if err != nil {
+        return "", err
+    }
+
+    if 0 == len( name ) {
+        return "", fmt.Errorf( "neither a topic name nor an entity path in the connection string" )
+    }
+
+    return name, nil
+}
+
+func ( azEvHub *AzEvHub )initAdmin( )( err error ) {
+    if azEvHub.admin != nil {
+        return nil
+    }
+
+    azEvHub.admin, err = azEvHub.newAdmin( )
+    return err
+}
+
+// Another job of the same run may have created the entity first
+func created( err error, kind, name string )( error ) {
+    if azadmin.IsConflict( err ) {
+        glog.Warningf( "%v %v exists already, keeping its settings", kind, name )
+        return nil
+    }
+
+    return err
+}
+
+// Jobs do not know when the others finish, whichever tore down first would delete the hub from
+// under the ones still running. Only a run of a single job tears down on its own.
+func ( azEvHub *AzEvHub )isOnlyJob( )( bool ) {
+    senderJobs, _   := azEvHub.parseJobs( azEvHub.SenderJobs )
+    receiverJobs, _ := azEvHub.parseJobs( azEvHub.ReceiverJobs )
+
+    for _, job := range append( senderJobs, receiverJobs... ) {
+        if job != azEvHub.Index {
+            return false
+        }
+    }
+
+    return true
+}
+
+// Creates the event hub and the consumer groups of this job's receivers unless they exist
+func ( azEvHub *AzEvHub )provision( )( err error ) {
+    err = azEvHub.initAdmin( )
+    if err != nil {
+        return err
+    }
+
+    hub, err := azEvHub.hubName( )
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout( context.Background( ), provisionTimeout )
+    defer cancel( )
+
+    start := time.Now( )
+
+    opts := &azadmin.EventHubOptions {
+        RetentionDays   :   azEvHub.RetentionDays,
+        PartitionCount  :   azEvHub.PartitionCount,
+    }
+
+    err = created( azEvHub.admin.CreateEventHub( ctx, hub, opts ), "event hub", hub )
+    if err != nil {
+        return err
+    }
+
+    // Deprovision takes down the event hub should a consumer group fail
+    azEvHub.provisioned = true
+
+    if !azEvHub.SenderOnly && len( azEvHub.ConsumerGroupPrefix ) > 0 {
+        for i := 0; i < azEvHub.TotGateways; i++ {
+            group := azEvHub.consumerGroupName( i )
+            err = created( azEvHub.admin.CreateConsumerGroup( ctx, hub, group ), "consumer group", group )
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    glog.Infof( "Provisioned event hub %v in %v", hub, time.Since( start ) )
+    return nil
+}
+
+// Deleting the event hub deletes its consumer groups along with it
+func ( azEvHub *AzEvHub )deleteHub( )( err error ) {
+    hub, err := azEvHub.hubName( )
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout( context.Background( ), provisionTimeout )
+    defer cancel( )
+
+    err = azEvHub.admin.DeleteEventHub( ctx, hub )
+    if err != nil && !azadmin.IsNotFound( err ) {
+        return fmt.Errorf( "failed to delete event hub %v: %v", hub, err )
+    }
+
+    return nil
+}
+
+// Deletes the provisioned event hub along with its consumer groups, unless the run failed and
+// they are kept to look into. Has to be called after Start, whether it failed or not. Runs of
+// several jobs keep it, the other jobs may still be using it, and leave it to Teardown.
+func ( azEvHub *AzEvHub )Deprovision( failed bool ) {
+    if !azEvHub.provisioned {
+        return
+    }
+
+    if !azEvHub.isOnlyJob( ) {
+        glog.Infof( "Keeping provisioned event hub for a teardown once every job of the run finished" )
+        return
+    }
+
+    if failed && azEvHub.KeepOnFailure {
+        glog.Infof( "Keeping provisioned event hub of the failed run" )
+        return
+    }
+
+    err := azEvHub.deleteHub( )
+    if err != nil {
+        glog.Errorf( "Failed to delete provisioned event hub, error = %v", err )
+    }
+}
+
+// Deletes the event hub a run of several jobs provisioned, in place of Start once every job of
+// the run finished
+func ( azEvHub *AzEvHub )Teardown( )( err error ) {
+    err = azEvHub.initCredential( )
+    if err != nil {
+        return fmt.Errorf( "invalid credential settings: error %v", err )
+    }
+
+    err = azEvHub.initAdmin( )
+    if err != nil {
+        return fmt.Errorf( "failed to setup admin client: error %v", err )
+    }
+
+    return azEvHub.deleteHub( )
+}
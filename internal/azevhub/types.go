@@ -8,12 +8,19 @@ import (
     evhub "github.com/Azure/azure-event-hubs-go/v3"
     evhub_persist "github.com/Azure/azure-event-hubs-go/v3/persist"
 
+    "github.com/azsvcbusbench/internal/azadmin"
+    "github.com/azsvcbusbench/internal/azauth"
+    "github.com/azsvcbusbench/internal/dashboard"
     "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/phase"
     "github.com/azsvcbusbench/internal/stats"
 )
 
 type azEvHubCtx struct {
     hub                *evhub.Hub
+    admin              *azadmin.Client
+    credential         *azauth.Credential
+    provisioned         bool
 
     persister           evhub_persist.CheckpointPersister
 
@@ -25,28 +32,47 @@ type azEvHubCtx struct {
 
     stats              *stats.Stats
     statsCtx            context.Context
+    result             *stats.Result
+    dashboard          *dashboard.Dashboard
 
     msgGen             *helpers.MsgGen
     idGen              *helpers.IdGen
 
     wg                 *sync.WaitGroup
 
-    trackTest           bool
+    phases             *phase.Tracker
 }
 
 type AzEvHub struct {
     TestId              string
     ConnStr             string
     NameSpace           string
+    Credential          azauth.Options
     TopicName           string
     ConsumerGroupPrefix string
     PropName            string
 
     PersistDir          string
 
+    Provision           bool
+    KeepOnFailure       bool
+    PartitionCount      int
+    RetentionDays       int
+
     IpsFile             string
     IdsFile             string
 
+    StatsText           bool
+    Dashboard           bool
+    DashboardTopN       int
+    StatsCsvFile        string
+    ResultFile          string
+    ReportFile          string
+
+    ClockSyncListen     string
+    ClockSyncUrl        string
+    ClockSyncSamples    int
+
     TotGateways         int
     MsgsPerReceive      int
     MsgsPerSend         int
@@ -56,11 +82,14 @@ type AzEvHub struct {
 
     WarmupDuration      time.Duration
     Duration            time.Duration
+    CooldownDuration    time.Duration
     SendInterval        time.Duration
     ReceiveInterval     time.Duration
     StatDumpInterval    time.Duration
 
     Index               int
+    SenderJobs          string
+    ReceiverJobs        string
 
     azEvHubCtx
 }
@@ -3,7 +3,6 @@ package azredis
 import (
     "sync"
     "time"
-    "context"
     "os"
     "fmt"
     "strconv"
@@ -12,21 +11,25 @@ import (
     "github.com/golang/glog"
     "github.com/go-redis/redis/v8"
 
+    "github.com/azsvcbusbench/internal/clocksync"
+    "github.com/azsvcbusbench/internal/dashboard"
     "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/phase"
+    "github.com/azsvcbusbench/internal/report"
     "github.com/azsvcbusbench/internal/stats"
 )
 
 const (
     testIdPropName  = "testId"
     idxPropName     = "senderIdx"
-    trackPropName   = "track"
+    phasePropName   = "phase"
     contentTypeKey  = "content-type"
     bodyKey         = "body"
 )
 
 var (
     msgContentType = "application/json"
-    strFalse       = strconv.FormatBool( false )
+    measureName    = phase.Measure.String( )
 )
 
 func NewAzRedis( )( *AzRedis ) {
@@ -140,18 +143,64 @@ func ( azRedis *AzRedis )initClients( )( err error ) {
     return nil
 }
 
-func ( azRedis *AzRedis )Start( ) {
-    realDuration := azRedis.Duration + azRedis.WarmupDuration
+// Every receiver reads back the keys its own gateway wrote
+func ( azRedis *AzRedis )initTopology( )( err error ) {
+    topology := &stats.Topology {
+        GatewaysPerJob  :   azRedis.TotGateways,
+        SenderJobs      :   [ ]int{ azRedis.Index },
+        ReceiverJobs    :   [ ]int{ azRedis.Index },
+        Delivery        :   stats.DeliveryLoopback,
+    }
+
+    azRedis.stats.SetTopology( topology, azRedis.Index, !azRedis.ReceiverOnly, !azRedis.SenderOnly )
+    return nil
+}
+
+func ( azRedis *AzRedis )initStatsSinks( )( err error ) {
+    useDashboard := azRedis.Dashboard && dashboard.IsTerminal( os.Stdout )
+    if azRedis.Dashboard && !useDashboard {
+        glog.Infof( "stdout is not a terminal, falling back to plain statistics output" )
+    }
+
+    // Plain text would scroll the dashboard off the screen
+    if azRedis.StatsText && !useDashboard {
+        azRedis.stats.AddSink( stats.NewTextSink( os.Stdout ) )
+    }
+
+    if useDashboard {
+        azRedis.dashboard = dashboard.New( os.Stdout, azRedis.stats, azRedis.DashboardTopN )
+    }
+
+    if len( azRedis.ResultFile ) > 0 {
+        azRedis.stats.AddSink( stats.NewJsonFileSink( azRedis.ResultFile ) )
+    }
 
-    ctx, _             := context.WithTimeout( context.Background( ), realDuration )
-    azRedis.senderCtx  = ctx
+    if len( azRedis.StatsCsvFile ) > 0 {
+        csvSink, err := stats.NewCsvSink( azRedis.StatsCsvFile )
+        if err != nil {
+            return fmt.Errorf( "failed to create csv file %v: error %v", azRedis.StatsCsvFile, err )
+        }
 
-    ctx, cancel := context.WithTimeout( context.Background( ), realDuration + ( 30 * time.Second ) )
+        azRedis.stats.AddSink( csvSink )
+    }
+
+    return nil
+}
+
+// Registers an additional stats sink, has to be called before Start
+func ( azRedis *AzRedis )AddStatsSink( sink stats.Sink ) {
+    azRedis.stats.AddSink( sink )
+}
+
+func ( azRedis *AzRedis )Start( ) {
+    azRedis.phases = phase.NewTracker( azRedis.WarmupDuration, azRedis.Duration, azRedis.CooldownDuration )
     defer func( ) {
-        cancel( )
+        azRedis.phases.Stop( )
     }( )
-    azRedis.receiverCtx = ctx
-    azRedis.statsCtx    = ctx
+
+    azRedis.senderCtx   = azRedis.phases.SenderCtx( )
+    azRedis.receiverCtx = azRedis.phases.ReceiverCtx( )
+    azRedis.statsCtx    = azRedis.receiverCtx
 
     err := azRedis.initClients( )
     if err != nil {
@@ -159,6 +208,16 @@ func ( azRedis *AzRedis )Start( ) {
         return
     } 
 
+    clockEst, err := clocksync.Setup( azRedis.receiverCtx, azRedis.ClockSyncListen, azRedis.ClockSyncUrl, azRedis.ClockSyncSamples )
+    if err != nil {
+        glog.Fatalf( "failed to synchronize clock: error %v", err )
+        return
+    }
+
+    if clockEst != nil {
+        azRedis.stats.SetClockEstimate( clockEst.Offset, clockEst.Uncertainty )
+    }
+
     err = azRedis.initMsgGen( )
     if err != nil {
         glog.Fatalf( "failed to initialize message generator: error %v", err )
@@ -171,11 +230,34 @@ func ( azRedis *AzRedis )Start( ) {
         return
     }
 
+    azRedis.stats.SetConfig( "azredis", azRedis )
     azRedis.stats.SetCtx( azRedis.statsCtx )
     azRedis.stats.SetIds( azRedis.idGen.Block )
+
+    err = azRedis.initTopology( )
+    if err != nil {
+        glog.Fatalf( "failed to initialize topology: error %v", err )
+        return
+    }
+
     azRedis.stats.SetStatsDumpInterval( azRedis.StatDumpInterval )
+
+    err = azRedis.initStatsSinks( )
+    if err != nil {
+        glog.Fatalf( "failed to initialize stats sinks: error %v", err )
+        return
+    }
+
     azRedis.stats.StartDumper( )
 
+    if azRedis.dashboard != nil {
+        azRedis.wg.Add( 1 )
+        go func( ) {
+            defer azRedis.wg.Done( )
+            azRedis.dashboard.Run( azRedis.statsCtx )
+        }( )
+    }
+
     azRedis.lookupC = make( [ ]chan *azRedisLookup, azRedis.TotGateways )
     for i := 0; i < azRedis.TotGateways; i++ {
         azRedis.lookupC[ i ] = make( chan *azRedisLookup, azRedis.ReceiveRetries )
@@ -204,25 +286,36 @@ func ( azRedis *AzRedis )Start( ) {
     azRedis.wg.Add( 1 )
     go func( ) {
         defer azRedis.wg.Done( )
-        azRedis.trackWarmup( )
+        azRedis.trackPhases( )
     }( )
 
     azRedis.wg.Wait( )
     azRedis.stats.StopDumper( )
+
+    azRedis.result = azRedis.stats.GetFinalResult( )
+
+    if len( azRedis.ReportFile ) > 0 {
+        err = report.WriteHtmlFile( azRedis.ReportFile, azRedis.result )
+        if err != nil {
+            glog.Errorf( "failed to write report file %v: error %v", azRedis.ReportFile, err )
+        }
+    }
 }
 
-func ( azRedis *AzRedis )trackWarmup( ) {
-    warmupTimer := time.NewTimer( azRedis.WarmupDuration )
+func ( azRedis *AzRedis )GetResult( )( *stats.Result ) {
+    return azRedis.result
+}
 
-    select {
-        case <-warmupTimer.C:
-            azRedis.trackTest = true
-            return
+func ( azRedis *AzRedis )trackPhases( ) {
+    azRedis.phases.Run( func( p phase.Phase ) {
+        switch p {
+            case phase.Measure:
+                azRedis.stats.MarkMeasureStart( )
 
-        case <-azRedis.senderCtx.Done( ):
-            warmupTimer.Stop( )
-            return
-    }
+            case phase.Cooldown:
+                azRedis.stats.MarkMeasureEnd( )
+        }
+    } )
 }
 
 func ( azRedis *AzRedis )getSenderIdFromIdx( idx int )( id string, realIdx int, err error ) {
@@ -241,9 +334,12 @@ func ( azRedis *AzRedis )sendMessage( idx int )( err error ) {
         return err
     }
 
+    // Read once so the tag and the accounting of the message always agree
+    sentPhase := azRedis.phases.Get( )
+
     message := map[ string ]interface{ } {
         contentTypeKey  :   msgContentType,
-        trackPropName   :   strconv.FormatBool( azRedis.trackTest ),
+        phasePropName   :   sentPhase.String( ),
         testIdPropName  :   azRedis.TestId,
         idxPropName     :   realIdx,
     }
@@ -262,16 +358,24 @@ func ( azRedis *AzRedis )sendMessage( idx int )( err error ) {
 
     message[ bodyKey ] = msg
 
+    sendStart := time.Now( )
     _, err = azRedis.clients[ idx ].HSet( azRedis.senderCtx, key, message ).Result( )
+    sendLatency := time.Since( sendStart )
     if err != nil {
         glog.Errorf( "%v: Failed to send message, error = %v", id, err )
+        if azRedis.senderCtx.Err( ) == nil {
+            azRedis.stats.UpdateErrorStat( realIdx, stats.ErrorClassSend )
+        }
+
         return err
     }
 
     azRedis.lookupC[ idx ] <- lookup
 
-    if azRedis.trackTest {
+    if sentPhase == phase.Measure {
         azRedis.stats.UpdateSenderStat( realIdx, 1 )
+        azRedis.stats.UpdateSendLatency( realIdx, sendLatency )
+        azRedis.stats.UpdateSenderBytes( realIdx, uint64( len( key ) + helpers.PropertiesSize( message ) ) )
     }
 
     return nil
@@ -311,8 +415,6 @@ func ( azRedis *AzRedis )startSender( idx int ) {
 
         time.Sleep( azRedis.SendInterval )
     }
-
-    return
 }
 
 func ( azRedis *AzRedis )getReceiverIdFromIdx( idx int )( id string, realIdx int, err error ) {
@@ -386,8 +488,8 @@ func ( azRedis *AzRedis )receivedMessageCallback( idx int, message map[ string ]
         return fmt.Errorf( "%v: Ignoring message with unknown content type %v", id, contentType )
     }
 
-    track, exists := message[ trackPropName ]
-    if exists && track == strFalse {
+    sentPhase, exists := message[ phasePropName ]
+    if exists && sentPhase != measureName {
         return nil
     }
 
@@ -432,6 +534,12 @@ func ( azRedis *AzRedis )receivedMessageCallback( idx int, message map[ string ]
         }
 
         azRedis.stats.UpdateReceiverStat( realIdx, int( senderIdx ), uint64( msgList.Count ), uint64( msgList.GetLatency( ) ) )
+        azRedis.stats.UpdateReceiverBytes( realIdx, uint64( len( lookup.key ) + helpers.StringMapSize( message ) ) )
+        if azRedis.phases.Get( ) >= phase.Cooldown {
+            azRedis.stats.UpdateLateStat( realIdx, uint64( msgList.Count ) )
+        }
+
+        azRedis.stats.UpdateClockStat( realIdx, msgList.GetRawLatency( ), uint64( msgList.GetLatencyBound( ) ) )
         azRedis.stats.UpdateReceiverStatRetries( realIdx, uint64( retries ) )
     } else {
         glog.Errorf( "%v: Did not find sender index in message application properties", id )
@@ -471,10 +579,6 @@ func ( azRedis *AzRedis )startReceiver( idx int ) {
             case <-azRedis.receiverCtx.Done( ):
                 glog.Infof( "%v: Receiver done", idx )
                 return
-
-            default:
         }
     }
-
-    return
 }
@@ -7,7 +7,9 @@ import (
 
     "github.com/go-redis/redis/v8"
 
+    "github.com/azsvcbusbench/internal/dashboard"
     "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/phase"
     "github.com/azsvcbusbench/internal/stats"
 )
 
@@ -26,13 +28,15 @@ type azRedisCtx struct {
 
     stats              *stats.Stats
     statsCtx            context.Context
+    result             *stats.Result
+    dashboard          *dashboard.Dashboard
 
     msgGen             *helpers.MsgGen
     idGen              *helpers.IdGen
 
     wg                 *sync.WaitGroup
 
-    trackTest           bool
+    phases             *phase.Tracker
 }
 
 type AzRedis struct {
@@ -46,6 +50,17 @@ type AzRedis struct {
     IpsFile             string
     IdsFile             string
 
+    StatsText           bool
+    Dashboard           bool
+    DashboardTopN       int
+    StatsCsvFile        string
+    ResultFile          string
+    ReportFile          string
+
+    ClockSyncListen     string
+    ClockSyncUrl        string
+    ClockSyncSamples    int
+
     TotGateways         int
     MsgsPerReceive      int
     MsgsPerSend         int
@@ -57,6 +72,7 @@ type AzRedis struct {
 
     WarmupDuration      time.Duration
     Duration            time.Duration
+    CooldownDuration    time.Duration
     SendInterval        time.Duration
     ReceiveInterval     time.Duration
     StatDumpInterval    time.Duration
@@ -2,35 +2,52 @@ package azsvcbus
 
 import (
     "sync"
-    "time"
     "context"
+    "time"
     "os"
     "fmt"
+    "math/rand"
     "strconv"
+    "strings"
 
     "github.com/golang/glog"
     "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/azsvcbusbench/internal/clocksync"
+    "github.com/azsvcbusbench/internal/dashboard"
     "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/phase"
+    "github.com/azsvcbusbench/internal/report"
     "github.com/azsvcbusbench/internal/stats"
 )
 
 const (
     testIdPropName  = "testId"
     idxPropName     = "senderIdx"
-    trackPropName   = "track"
+    phasePropName   = "phase"
+    seqPropName     = "seq"
+    cancelPropName  = "cancelled"
+)
+
+const (
+    ReceiveModePeekLock         = "peeklock"
+    ReceiveModeReceiveAndDelete = "receiveanddelete"
 )
 
 var (
-    msgContentType = "application/json"
-    strFalse       = strconv.FormatBool( false )
+    msgContentType          = "application/json"
+    measureName             = phase.Measure.String( )
+    deadLetterReason        = "azsvcbusbench"
+    invalidDeadLetterReason = "azsvcbusbench-invalid"
 )
 
 func NewAzSvcBus( )( *AzSvcBus ) {
     return &AzSvcBus {
         Index       : 0,
         azSvcBusCtx : azSvcBusCtx {
-            wg     : &sync.WaitGroup{ },
-            stats  : stats.NewStats( nil, nil ),
+            wg      : &sync.WaitGroup{ },
+            stats   : stats.NewStats( nil, nil ),
+            dupSeen : newEntityIdSets( ),
+            counted : newEntityIdSets( ),
         },
     }
 }
@@ -41,7 +58,6 @@ func ( azSvcBus *AzSvcBus )initMsgGen( )( err error ) {
     if len( azSvcBus.IpsFile ) > 0 {
         fh, err := os.Open( azSvcBus.IpsFile )
         if err != nil {
-            glog.Fatalf( "failed to open file %v: error %v", azSvcBus.IpsFile, err )
             return fmt.Errorf( "failed to open file %v: error %v", azSvcBus.IpsFile, err )
         }
 
@@ -55,7 +71,6 @@ func ( azSvcBus *AzSvcBus )initMsgGen( )( err error ) {
     }
 
     if err != nil {
-        glog.Fatalf( "failed to initialize message generator" )
         return fmt.Errorf( "failed to initialize message generator" )
     }
 
@@ -69,7 +84,6 @@ func ( azSvcBus *AzSvcBus )initIdGen( )( err error ) {
     if len( azSvcBus.IdsFile ) > 0 {
         fh, err := os.Open( azSvcBus.IdsFile )
         if err != nil {
-            glog.Fatalf( "failed to open file %v: error %v", azSvcBus.IdsFile, err )
             return fmt.Errorf( "failed to open file %v: error %v", azSvcBus.IdsFile, err )
         }
 
@@ -83,7 +97,6 @@ func ( azSvcBus *AzSvcBus )initIdGen( )( err error ) {
     }
 
     if err != nil {
-        glog.Fatalf( "failed to initialize id generator" )
         return fmt.Errorf( "failed to initialize id generator" )
     }
 
@@ -91,46 +104,321 @@ func ( azSvcBus *AzSvcBus )initIdGen( )( err error ) {
     return nil
 }
 
-func ( azSvcBus *AzSvcBus )Start( ) {
-    client, err := azservicebus.NewClientFromConnectionString( azSvcBus.ConnStr, nil )
+func parseReceiveMode( mode string )( receiveMode azservicebus.ReceiveMode, err error ) {
+    switch strings.ToLower( mode ) {
+        case ReceiveModePeekLock, "":
+            return azservicebus.ReceiveModePeekLock, nil
+
+        case ReceiveModeReceiveAndDelete:
+            return azservicebus.ReceiveModeReceiveAndDelete, nil
+    }
+
+    return azservicebus.ReceiveModePeekLock, fmt.Errorf( "unknown receive mode %v", mode )
+}
+
+func ( azSvcBus *AzSvcBus )initReceiveMode( )( err error ) {
+    azSvcBus.receiveMode, err = parseReceiveMode( azSvcBus.ReceiveMode )
     if err != nil {
-        glog.Fatalf( "failed to setup Azure Service Bus client %v", err )
-        return
+        return err
     }
 
-    azSvcBus.client = client
+    if azSvcBus.AbandonPct < 0 || azSvcBus.DeadLetterPct < 0 || azSvcBus.AbandonPct + azSvcBus.DeadLetterPct > 100 {
+        return fmt.Errorf( "abandon %v%% and dead letter %v%% must be positive and add up to at most 100%%", azSvcBus.AbandonPct, azSvcBus.DeadLetterPct )
+    }
+
+    if azSvcBus.receiveMode != azservicebus.ReceiveModePeekLock && azSvcBus.AbandonPct + azSvcBus.DeadLetterPct > 0 {
+        return fmt.Errorf( "abandon and dead letter percentages need the %v receive mode", ReceiveModePeekLock )
+    }
+
+    return nil
+}
+
+// A queue name switches from topic and subscriptions to a single queue drained by competing receivers
+func ( azSvcBus *AzSvcBus )isQueue( )( bool ) {
+    return len( azSvcBus.QueueName ) > 0
+}
+
+func ( azSvcBus *AzSvcBus )initEntity( )( err error ) {
+    if azSvcBus.isQueue( ) {
+        if len( azSvcBus.TopicName ) > 0 || azSvcBus.SubPerGateway {
+            return fmt.Errorf( "queue %v cannot be combined with a topic or subscriptions per gateway", azSvcBus.QueueName )
+        }
+
+        return nil
+    }
 
-    realDuration := azSvcBus.Duration + azSvcBus.WarmupDuration
+    if 0 == len( azSvcBus.TopicName ) {
+        return fmt.Errorf( "either a topic or a queue is needed" )
+    }
+
+    return nil
+}
+
+// Queue or topic the senders send to
+func ( azSvcBus *AzSvcBus )entityName( )( string ) {
+    if azSvcBus.isQueue( ) {
+        return azSvcBus.QueueName
+    }
+
+    return azSvcBus.TopicName
+}
+
+// Only receivers with a subscription of their own see what their own gateway sent, unless a
+// subscription filter keeps it out on the broker. Whatever still gets through is counted.
+func ( azSvcBus *AzSvcBus )selfSkip( )( bool ) {
+    return azSvcBus.SubPerGateway && !azSvcBus.isQueue( )
+}
+
+// With a subscription per gateway every receiver sees every message, otherwise they compete for them
+func ( azSvcBus *AzSvcBus )subscriptionName( realIdx int )( string ) {
+    if azSvcBus.SubPerGateway {
+        return azSvcBus.SubName + "-" + strconv.Itoa( realIdx )
+    }
+
+    return azSvcBus.SubName
+}
+
+// Jobs not listed default to this job alone, which covers a single process as well as a sender
+// only and receiver only pair sharing an index
+func ( azSvcBus *AzSvcBus )parseJobs( list string )( jobs [ ]int, err error ) {
+    jobs, err = helpers.ParseIndexList( list )
+    if err != nil {
+        return nil, err
+    }
+
+    if len( jobs ) == 0 {
+        jobs = [ ]int{ azSvcBus.Index }
+    }
+
+    return jobs, nil
+}
+
+// Receivers with their own subscription skip what their own gateway sent, receivers
+// sharing a subscription or a queue compete for every message so skipping would lose it.
+// Receivers of specific sessions only get the session of their own gateway.
+func ( azSvcBus *AzSvcBus )initTopology( )( err error ) {
+    topology := &stats.Topology {
+        GatewaysPerJob  :   azSvcBus.TotGateways,
+        Delivery        :   stats.DeliveryCompeting,
+    }
 
-    ctx, _             := context.WithTimeout( context.Background( ), realDuration )
-    azSvcBus.senderCtx  = ctx
+    switch {
+        case azSvcBus.SessionMode == SessionModeSpecific:
+            topology.Delivery = stats.DeliveryLoopback
 
-    ctx, cancel := context.WithTimeout( context.Background( ), realDuration + ( 2 * time.Minute ) )
+        case azSvcBus.selfSkip( ):
+            topology.Delivery = stats.DeliveryFanout
+            topology.SelfSkip = true
+    }
+
+    topology.SenderJobs, err = azSvcBus.parseJobs( azSvcBus.SenderJobs )
+    if err != nil {
+        return fmt.Errorf( "invalid sender jobs: error %v", err )
+    }
+
+    topology.ReceiverJobs, err = azSvcBus.parseJobs( azSvcBus.ReceiverJobs )
+    if err != nil {
+        return fmt.Errorf( "invalid receiver jobs: error %v", err )
+    }
+
+    azSvcBus.stats.SetTopology( topology, azSvcBus.Index, !azSvcBus.ReceiverOnly, !azSvcBus.SenderOnly )
+    return nil
+}
+
+func ( azSvcBus *AzSvcBus )initStatsSinks( )( err error ) {
+    useDashboard := azSvcBus.Dashboard && dashboard.IsTerminal( os.Stdout )
+    if azSvcBus.Dashboard && !useDashboard {
+        glog.Infof( "stdout is not a terminal, falling back to plain statistics output" )
+    }
+
+    // Plain text would scroll the dashboard off the screen
+    if azSvcBus.StatsText && !useDashboard {
+        azSvcBus.stats.AddSink( stats.NewTextSink( os.Stdout ) )
+    }
+
+    if useDashboard {
+        azSvcBus.dashboard = dashboard.New( os.Stdout, azSvcBus.stats, azSvcBus.DashboardTopN )
+    }
+
+    if len( azSvcBus.ResultFile ) > 0 {
+        azSvcBus.stats.AddSink( stats.NewJsonFileSink( azSvcBus.ResultFile ) )
+    }
+
+    if len( azSvcBus.StatsCsvFile ) > 0 {
+        csvSink, err := stats.NewCsvSink( azSvcBus.StatsCsvFile )
+        if err != nil {
+            return fmt.Errorf( "failed to create csv file %v: error %v", azSvcBus.StatsCsvFile, err )
+        }
+
+        azSvcBus.stats.AddSink( csvSink )
+    }
+
+    return nil
+}
+
+// Registers an additional stats sink, has to be called before Start
+func ( azSvcBus *AzSvcBus )AddStatsSink( sink stats.Sink ) {
+    azSvcBus.stats.AddSink( sink )
+}
+
+// Errors are returned rather than fatal so that the deferred cleanup, such as deleting filtered
+// subscriptions, still runs
+func ( azSvcBus *AzSvcBus )Start( )( err error ) {
+    err = azSvcBus.initCredential( )
+    if err != nil {
+        return fmt.Errorf( "invalid credential settings: error %v", err )
+    }
+
+    err = azSvcBus.initClientTopology( )
+    if err != nil {
+        return fmt.Errorf( "invalid client settings: error %v", err )
+    }
+
+    err = azSvcBus.newClients( )
+    if err != nil {
+        return fmt.Errorf( "failed to setup Azure Service Bus client: error %v", err )
+    }
+
+    defer azSvcBus.closeClients( )
+
+    err = azSvcBus.initEntity( )
+    if err != nil {
+        return fmt.Errorf( "invalid entity settings: error %v", err )
+    }
+
+    err = azSvcBus.initSubFilter( )
+    if err != nil {
+        return fmt.Errorf( "invalid subscription filter settings: error %v", err )
+    }
+
+    err = azSvcBus.initReceiveMode( )
+    if err != nil {
+        return fmt.Errorf( "invalid receive settings: error %v", err )
+    }
+
+    err = azSvcBus.initSessionMode( )
+    if err != nil {
+        return fmt.Errorf( "invalid session settings: error %v", err )
+    }
+
+    err = azSvcBus.initDeferral( )
+    if err != nil {
+        return fmt.Errorf( "invalid deferral settings: error %v", err )
+    }
+
+    err = azSvcBus.initProcessing( )
+    if err != nil {
+        return fmt.Errorf( "invalid processing settings: error %v", err )
+    }
+
+    err = azSvcBus.initReceiveLoop( )
+    if err != nil {
+        return fmt.Errorf( "invalid receive loop settings: error %v", err )
+    }
+
+    err = azSvcBus.initSchedule( )
+    if err != nil {
+        return fmt.Errorf( "invalid schedule settings: error %v", err )
+    }
+
+    err = azSvcBus.initExpiry( )
+    if err != nil {
+        return fmt.Errorf( "invalid expiry settings: error %v", err )
+    }
+
+    err = azSvcBus.initDuplicates( )
+    if err != nil {
+        return fmt.Errorf( "invalid duplicate settings: error %v", err )
+    }
+
+    if azSvcBus.Provision {
+        err = azSvcBus.provision( )
+        if err != nil {
+            return fmt.Errorf( "failed to provision entities: error %v", err )
+        }
+    }
+
+    azSvcBus.phases = phase.NewTracker( azSvcBus.WarmupDuration, azSvcBus.Duration, azSvcBus.CooldownDuration )
     defer func( ) {
-        cancel( )
+        azSvcBus.phases.Stop( )
     }( )
-    azSvcBus.receiverCtx = ctx
-    azSvcBus.statsCtx    = ctx
+
+    // Stats outlive the receivers so that what is fetched back after them still makes the final snapshot
+    statsCtx, statsCancel := context.WithCancel( context.Background( ) )
+    defer statsCancel( )
+
+    azSvcBus.senderCtx   = azSvcBus.phases.SenderCtx( )
+    azSvcBus.receiverCtx = azSvcBus.phases.ReceiverCtx( )
+    azSvcBus.statsCtx    = statsCtx
+
+    clockEst, err := clocksync.Setup( azSvcBus.receiverCtx, azSvcBus.ClockSyncListen, azSvcBus.ClockSyncUrl, azSvcBus.ClockSyncSamples )
+    if err != nil {
+        return fmt.Errorf( "failed to synchronize clock: error %v", err )
+    }
+
+    if clockEst != nil {
+        azSvcBus.stats.SetClockEstimate( clockEst.Offset, clockEst.Uncertainty )
+    }
 
     err = azSvcBus.initMsgGen( )
     if err != nil {
-        glog.Fatalf( "failed to initialize message generator: error %v", err )
-        return
+        return fmt.Errorf( "failed to initialize message generator: error %v", err )
     }
 
     err = azSvcBus.initIdGen( )
     if err != nil {
-        glog.Fatalf( "failed to initialize id generator: error %v", err )
-        return
+        return fmt.Errorf( "failed to initialize id generator: error %v", err )
     }
 
+    azSvcBus.stats.SetConfig( "azsvcbus", azSvcBus )
     azSvcBus.stats.SetCtx( azSvcBus.statsCtx )
     azSvcBus.stats.SetIds( azSvcBus.idGen.Block )
+
+    err = azSvcBus.initTopology( )
+    if err != nil {
+        return fmt.Errorf( "failed to initialize topology: error %v", err )
+    }
+
+    if azSvcBus.isSubFilter( ) && !azSvcBus.SenderOnly {
+        err = azSvcBus.createSubscriptions( )
+        if err != nil {
+            azSvcBus.deleteSubscriptions( )
+            return fmt.Errorf( "failed to create filtered subscriptions: error %v", err )
+        }
+
+        defer azSvcBus.deleteSubscriptions( )
+    }
+
+    err = azSvcBus.connectClients( )
+    if err != nil {
+        return fmt.Errorf( "failed to connect to Azure Service Bus: error %v", err )
+    }
+
     azSvcBus.stats.SetStatsDumpInterval( azSvcBus.StatDumpInterval )
+
+    err = azSvcBus.initStatsSinks( )
+    if err != nil {
+        return fmt.Errorf( "failed to initialize stats sinks: error %v", err )
+    }
+
     azSvcBus.stats.StartDumper( )
 
+    var dashboardWg sync.WaitGroup
+    if azSvcBus.dashboard != nil {
+        dashboardWg.Add( 1 )
+        go func( ) {
+            defer dashboardWg.Done( )
+            azSvcBus.dashboard.Run( azSvcBus.statsCtx )
+        }( )
+    }
+
     if !azSvcBus.SenderOnly {
-        azSvcBus.receivers = make( [ ]*azservicebus.Receiver, azSvcBus.TotGateways )
+        azSvcBus.receiveStart = time.Now( )
+
+        azSvcBus.receivers     = make( [ ]messageReceiver, azSvcBus.TotGateways )
+        azSvcBus.workQueues    = make( [ ]chan prefetched, azSvcBus.TotGateways )
+        azSvcBus.rcvdSeqs      = make( [ ]map[ string ]int64, azSvcBus.TotGateways )
+        azSvcBus.pendingDefers = make( [ ][ ]pendingDefer, azSvcBus.TotGateways )
         azSvcBus.wg.Add( azSvcBus.TotGateways )
         for i := 0; i < azSvcBus.TotGateways; i++ {
             go func( idx int ) {
@@ -138,10 +426,32 @@ func ( azSvcBus *AzSvcBus )Start( ) {
                 azSvcBus.startReceiver( idx )
             }( i )
         }
+
+        if azSvcBus.DeadLetterCheck {
+            azSvcBus.wg.Add( azSvcBus.TotGateways )
+            for i := 0; i < azSvcBus.TotGateways; i++ {
+                go func( idx int ) {
+                    defer azSvcBus.wg.Done( )
+                    azSvcBus.startDeadLetterReceiver( idx )
+                }( i )
+            }
+        }
+
+        if azSvcBus.isDeferring( ) {
+            azSvcBus.wg.Add( azSvcBus.TotGateways )
+            for i := 0; i < azSvcBus.TotGateways; i++ {
+                go func( idx int ) {
+                    defer azSvcBus.wg.Done( )
+                    azSvcBus.startDeferredReceiver( idx )
+                }( i )
+            }
+        }
     }
 
     if !azSvcBus.ReceiverOnly {
-        azSvcBus.senders = make( [ ]*azservicebus.Sender, azSvcBus.TotGateways )
+        azSvcBus.senders     = make( [ ]*azservicebus.Sender, azSvcBus.TotGateways )
+        azSvcBus.sendSeqs    = make( [ ]int64, azSvcBus.TotGateways )
+        azSvcBus.pendingDups = make( [ ][ ]pendingDup, azSvcBus.TotGateways )
         azSvcBus.wg.Add( azSvcBus.TotGateways )
         for i := 0; i < azSvcBus.TotGateways; i++ {
             go func( idx int ) {
@@ -154,25 +464,47 @@ func ( azSvcBus *AzSvcBus )Start( ) {
     azSvcBus.wg.Add( 1 )
     go func( ) {
         defer azSvcBus.wg.Done( )
-        azSvcBus.trackWarmup( )
+        azSvcBus.trackPhases( )
     }( )
 
     azSvcBus.wg.Wait( )
+    azSvcBus.stopStats( statsCancel )
+    dashboardWg.Wait( )
+
+    azSvcBus.result = azSvcBus.stats.GetFinalResult( )
+
+    if len( azSvcBus.ReportFile ) > 0 {
+        err = report.WriteHtmlFile( azSvcBus.ReportFile, azSvcBus.result )
+        if err != nil {
+            glog.Errorf( "failed to write report file %v: error %v", azSvcBus.ReportFile, err )
+        }
+    }
+
+    return nil
+}
+
+// Fetches back what is still deferred once the receivers stopped, then has the dumper take the final snapshot
+func ( azSvcBus *AzSvcBus )stopStats( cancel context.CancelFunc ) {
+    azSvcBus.drainDeferred( )
+
+    cancel( )
     azSvcBus.stats.StopDumper( )
 }
 
-func ( azSvcBus *AzSvcBus )trackWarmup( ) {
-    warmupTimer := time.NewTimer( azSvcBus.WarmupDuration )
+func ( azSvcBus *AzSvcBus )GetResult( )( *stats.Result ) {
+    return azSvcBus.result
+}
 
-    select {
-        case <-warmupTimer.C:
-            azSvcBus.trackTest = true
-            return
+func ( azSvcBus *AzSvcBus )trackPhases( ) {
+    azSvcBus.phases.Run( func( p phase.Phase ) {
+        switch p {
+            case phase.Measure:
+                azSvcBus.stats.MarkMeasureStart( )
 
-        case <-azSvcBus.senderCtx.Done( ):
-            warmupTimer.Stop( )
-            return
-    }
+            case phase.Cooldown:
+                azSvcBus.stats.MarkMeasureEnd( )
+        }
+    } )
 }
 
 func ( azSvcBus *AzSvcBus )getSenderIdFromIdx( idx int )( id string, realIdx int, err error ) {
@@ -184,42 +516,179 @@ func ( azSvcBus *AzSvcBus )getSenderIdFromIdx( idx int )( id string, realIdx int
     return azSvcBus.idGen.Block[ realIdx ], realIdx, nil
 }
 
-func ( azSvcBus *AzSvcBus )sendMessage( idx int )( err error ) {
-    id, realIdx, err := azSvcBus.getSenderIdFromIdx( idx )
-    if err != nil {
-        glog.Errorf( "Failed to get index, error = %v", err )
-        return err
+// Body plus everything else that travels with each message
+func messageSize( message *azservicebus.Message )( size int ) {
+    size = len( message.Body ) + helpers.PropertiesSize( message.ApplicationProperties )
+
+    if message.ContentType != nil {
+        size += len( *message.ContentType )
+    }
+
+    if message.PartitionKey != nil {
+        size += len( *message.PartitionKey )
+    }
+
+    return size
+}
+
+func receivedMessageSize( message *azservicebus.ReceivedMessage, body [ ]byte )( size int ) {
+    size = len( body ) + helpers.PropertiesSize( message.ApplicationProperties )
+
+    if message.ContentType != nil {
+        size += len( *message.ContentType )
+    }
+
+    if message.PartitionKey != nil {
+        size += len( *message.PartitionKey )
     }
 
+    return size
+}
+
+func ( azSvcBus *AzSvcBus )newMessage( idx int, id string, realIdx int, sentPhase phase.Phase )( azsvcbusmsg *azservicebus.Message, err error ) {
+    azSvcBus.sendSeqs[ idx ]++
+    messageId := azSvcBus.messageId( id, azSvcBus.sendSeqs[ idx ] )
+
     appProps := map[ string ]interface{ }{
         azSvcBus.PropName : id,
         testIdPropName    : azSvcBus.TestId,
         idxPropName       : realIdx,
-        trackPropName     : strconv.FormatBool( azSvcBus.trackTest ),
+        phasePropName     : sentPhase.String( ),
+        seqPropName       : azSvcBus.sendSeqs[ idx ],
     }
 
-    azsvcbusmsg := &azservicebus.Message{
+    azsvcbusmsg = &azservicebus.Message{
+        MessageID               : &messageId,
         ApplicationProperties   : appProps,
         ContentType             : &msgContentType,
         PartitionKey            : &id,
     }
 
+    // Sessions are keyed per gateway, the partition key has to match the session id
+    if azSvcBus.isSession( ) {
+        azsvcbusmsg.SessionID = &id
+    }
+
+    if azSvcBus.MessageTtl > 0 {
+        ttl := azSvcBus.MessageTtl
+        azsvcbusmsg.TimeToLive = &ttl
+    }
+
     msg, err := azSvcBus.msgGen.GetMsgN( azSvcBus.MsgsPerSend, nil )
     if err != nil {
         glog.Errorf( "%v: Failed to get message, error = %v", id, err )
-        return err
+        return nil, err
     }
 
     azsvcbusmsg.Body = msg
+    return azsvcbusmsg, nil
+}
+
+func ( azSvcBus *AzSvcBus )sendMessage( idx int )( err error ) {
+    id, realIdx, err := azSvcBus.getSenderIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return err
+    }
+
+    // Read once so the tag and the accounting of the message always agree
+    sentPhase := azSvcBus.phases.Get( )
+
+    if azSvcBus.MsgsPerBatch > 1 {
+        return azSvcBus.sendMessageBatch( idx, id, realIdx, sentPhase )
+    }
+
+    azsvcbusmsg, err := azSvcBus.newMessage( idx, id, realIdx, sentPhase )
+    if err != nil {
+        return err
+    }
 
+    if azSvcBus.isScheduled( ) {
+        return azSvcBus.scheduleMessage( idx, id, realIdx, sentPhase, azsvcbusmsg )
+    }
+
+    sendStart := time.Now( )
     err = azSvcBus.senders[ idx ].SendMessage( azSvcBus.senderCtx, azsvcbusmsg, nil )
+    sendLatency := time.Since( sendStart )
     if err != nil {
         glog.Errorf( "%v: Failed to send message, error = %v", id, err )
+        if azSvcBus.senderCtx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSend )
+        }
+
         return err
     }
 
-    if azSvcBus.trackTest {
+    if sentPhase == phase.Measure {
         azSvcBus.stats.UpdateSenderStat( realIdx, uint64( azSvcBus.MsgsPerSend ) )
+        azSvcBus.stats.UpdateSendLatency( realIdx, sendLatency )
+        azSvcBus.stats.UpdateSenderBytes( realIdx, uint64( messageSize( azsvcbusmsg ) ) )
+        azSvcBus.stats.UpdateBrokerSentStat( realIdx, 1 )
+    }
+
+    return azSvcBus.maybeDuplicate( idx, id, realIdx, sentPhase, azsvcbusmsg )
+}
+
+// Sends MsgsPerBatch separate broker messages, whatever does not fit into one batch goes out in the next
+func ( azSvcBus *AzSvcBus )sendMessageBatch( idx int, id string, realIdx int, sentPhase phase.Phase )( err error ) {
+    var pending *azservicebus.Message
+
+    remaining := azSvcBus.MsgsPerBatch
+    for remaining > 0 {
+        batch, err := azSvcBus.senders[ idx ].NewMessageBatch( azSvcBus.senderCtx, nil )
+        if err != nil {
+            glog.Errorf( "%v: Failed to create message batch, error = %v", id, err )
+            if azSvcBus.senderCtx.Err( ) == nil {
+                azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSend )
+            }
+
+            return err
+        }
+
+        sizes := make( [ ]int, 0, remaining )
+        for remaining > 0 {
+            if nil == pending {
+                pending, err = azSvcBus.newMessage( idx, id, realIdx, sentPhase )
+                if err != nil {
+                    return err
+                }
+            }
+
+            err = batch.AddMessage( pending, nil )
+            if err == azservicebus.ErrMessageTooLarge && batch.NumMessages( ) > 0 {
+                break
+            }
+
+            if err != nil {
+                glog.Errorf( "%v: Failed to add message to batch, error = %v", id, err )
+                return err
+            }
+
+            sizes   = append( sizes, messageSize( pending ) )
+            pending = nil
+            remaining--
+        }
+
+        sendStart := time.Now( )
+        err = azSvcBus.senders[ idx ].SendMessageBatch( azSvcBus.senderCtx, batch, nil )
+        sendLatency := time.Since( sendStart )
+        if err != nil {
+            glog.Errorf( "%v: Failed to send message batch, error = %v", id, err )
+            if azSvcBus.senderCtx.Err( ) == nil {
+                azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSend )
+            }
+
+            return err
+        }
+
+        if sentPhase == phase.Measure {
+            azSvcBus.stats.UpdateSenderStat( realIdx, uint64( len( sizes ) * azSvcBus.MsgsPerSend ) )
+            azSvcBus.stats.UpdateSendLatency( realIdx, sendLatency )
+            azSvcBus.stats.UpdateBrokerSentStat( realIdx, uint64( len( sizes ) ) )
+            for _, size := range sizes {
+                azSvcBus.stats.UpdateSenderBytes( realIdx, uint64( size ) )
+            }
+        }
     }
 
     return nil
@@ -233,7 +702,7 @@ func ( azSvcBus *AzSvcBus )newSender( idx int )( err error ) {
             return err
         }
 
-        azSvcBusSender, err := azSvcBus.client.NewSender( azSvcBus.TopicName, nil )
+        azSvcBusSender, err := azSvcBus.clientFor( idx ).NewSender( azSvcBus.entityName( ), nil )
         if err != nil {
             glog.Errorf( "%v: Failed to create sender, error = %v", id, err )
             return err
@@ -265,6 +734,11 @@ func ( azSvcBus *AzSvcBus )startSender( idx int ) {
     }( )
 
     for {
+        err = azSvcBus.sendDuplicates( idx )
+        if err != nil {
+            return
+        }
+
         err = azSvcBus.sendMessage( idx )
         if err != nil {
             return
@@ -272,8 +746,6 @@ func ( azSvcBus *AzSvcBus )startSender( idx int ) {
 
         time.Sleep( azSvcBus.SendInterval )
     }
-
-    return
 }
 
 func ( azSvcBus *AzSvcBus )getReceiverIdFromIdx( idx int )( id string, realIdx int, err error ) {
@@ -288,30 +760,180 @@ func ( azSvcBus *AzSvcBus )getReceiverIdFromIdx( idx int )( id string, realIdx i
 type azSvcMsgCb func( idx int, message *azservicebus.ReceivedMessage )( err error )
 
 func ( azSvcBus *AzSvcBus )receiveMessages( idx int, cb azSvcMsgCb )( err error ) {
-    id, _, err := azSvcBus.getReceiverIdFromIdx( idx )
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
     if err != nil {
         glog.Errorf( "Failed to get index, error = %v", err )
         return err
     }
 
-    messages, err := azSvcBus.receivers[ idx ].PeekMessages( azSvcBus.receiverCtx, azSvcBus.MsgsPerReceive, nil )
+    ctx, cancel := azSvcBus.receiveCtx( )
+    defer cancel( )
+
+    receiver := azSvcBus.receivers[ idx ]
+
+    messages, err := receiver.ReceiveMessages( ctx, azSvcBus.MsgsPerReceive, nil )
+    if isSessionLockLost( err ) {
+        glog.Warningf( "%v: Lost session lock while receiving, error = %v", id, err )
+        azSvcBus.stats.UpdateSessionLockLostStat( realIdx )
+        return errSessionLost
+    }
+
     if err != nil {
         glog.Errorf( "%v: Failed to receive messages, error = %v", id, err )
+        if azSvcBus.receiverCtx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassReceive )
+        }
+
         return err
     }
 
-    for _, message := range messages {
-        if cb != nil {
-            err = cb( idx, message )
-            if err != nil {
-                return err
-            }
+    if len( messages ) == 0 && ctx.Err( ) != nil && azSvcBus.receiverCtx.Err( ) == nil {
+        return errSessionIdle
+    }
+
+    azSvcBus.stats.UpdateReceiveCallStat( realIdx, len( messages ) )
+    return azSvcBus.handleMessages( idx, receiver, messages, cb )
+}
+
+func isMeasured( message *azservicebus.ReceivedMessage )( bool ) {
+    phaseVal, exists := message.ApplicationProperties[ phasePropName ]
+    if !exists {
+        return true
+    }
+
+    sentPhase, ok := phaseVal.( string )
+    return !ok || sentPhase == measureName
+}
+
+func ( azSvcBus *AzSvcBus )pickSettleAction( )( action string ) {
+    r := rand.Float64( ) * 100
+
+    switch {
+        case r < azSvcBus.DeadLetterPct:
+            return stats.SettleDeadLetter
+
+        case r < azSvcBus.DeadLetterPct + azSvcBus.AbandonPct:
+            return stats.SettleAbandon
+
+        case r < azSvcBus.DeadLetterPct + azSvcBus.AbandonPct + azSvcBus.DeferPct:
+            return stats.SettleDefer
+    }
+
+    return stats.SettleComplete
+}
+
+// Messages that failed validation would fail again on every delivery, they are dead lettered
+// with the reason they failed instead of the settlement picked for the run
+func ( azSvcBus *AzSvcBus )settleMessage( idx int, receiver messageReceiver, message *azservicebus.ReceivedMessage, invalidErr error )( err error ) {
+    if azSvcBus.receiveMode != azservicebus.ReceiveModePeekLock {
+        return nil
+    }
+
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return err
+    }
+
+    action, deadLetterOpts := azSvcBus.pickSettleAction( ), azSvcBus.deadLetterOptions( id )
+    if invalidErr != nil {
+        action, deadLetterOpts = stats.SettleDeadLetter, invalidDeadLetterOptions( invalidErr )
+    }
+
+    settleStart := time.Now( )
+    switch action {
+        case stats.SettleComplete:
+            err = receiver.CompleteMessage( azSvcBus.receiverCtx, message, nil )
+
+        case stats.SettleAbandon:
+            err = receiver.AbandonMessage( azSvcBus.receiverCtx, message, nil )
+
+        case stats.SettleDeadLetter:
+            err = receiver.DeadLetterMessage( azSvcBus.receiverCtx, message, deadLetterOpts )
+
+        case stats.SettleDefer:
+            err = receiver.DeferMessage( azSvcBus.receiverCtx, message, nil )
+    }
+    settleLatency := time.Since( settleStart )
+
+    if isSessionLockLost( err ) {
+        glog.Warningf( "%v: Lost session lock while settling, error = %v", id, err )
+        azSvcBus.stats.UpdateSessionLockLostStat( realIdx )
+        return errSessionLost
+    }
+
+    // The broker hands the message out again, it is counted as redelivered then
+    if isMessageLockLost( err ) {
+        glog.Warningf( "%v: Lost lock of message %v before it could be settled, error = %v", id, message.MessageID, err )
+        azSvcBus.stats.UpdateMsgLockLostStat( realIdx )
+        return nil
+    }
+
+    if err != nil {
+        glog.Errorf( "%v: Failed to %v message, error = %v", id, action, err )
+        if azSvcBus.receiverCtx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSettle )
         }
+
+        return err
+    }
+
+    azSvcBus.forgetCounted( realIdx, message, action )
+
+    if action == stats.SettleDefer {
+        azSvcBus.recordDeferred( idx, message )
+    }
+
+    if isMeasured( message ) && invalidErr == nil {
+        azSvcBus.stats.UpdateSettleStat( realIdx, action, settleLatency )
     }
 
     return nil
 }
 
+// Past every lock the broker may hand the message out with a message is dead lettered, it cannot
+// come back after that
+func ( azSvcBus *AzSvcBus )countedTtl( )( time.Duration ) {
+    maxDeliveries := azSvcBus.MaxDeliveryCount
+    if maxDeliveries <= 0 {
+        maxDeliveries = defaultMaxDeliveryCount
+    }
+
+    return azSvcBus.lockDuration( ) * time.Duration( maxDeliveries )
+}
+
+func ( azSvcBus *AzSvcBus )countedIds( realIdx int )( *idSet ) {
+    return azSvcBus.counted.forEntity( azSvcBus.receiverEntity( realIdx ), azSvcBus.countedTtl( ) )
+}
+
+// Keeps the MessageIDs counted from each entity in this job until they are settled or could not
+// come back anymore. Without a MessageID a redelivery cannot be told apart and is taken as counted.
+func ( azSvcBus *AzSvcBus )isCounted( realIdx int, message *azservicebus.ReceivedMessage )( bool ) {
+    if 0 == len( message.MessageID ) {
+        return true
+    }
+
+    return azSvcBus.countedIds( realIdx ).contains( message.MessageID, time.Now( ) )
+}
+
+// Only peek lock receivers get messages again
+func ( azSvcBus *AzSvcBus )markCounted( realIdx int, message *azservicebus.ReceivedMessage ) {
+    if 0 == len( message.MessageID ) || azSvcBus.receiveMode != azservicebus.ReceiveModePeekLock {
+        return
+    }
+
+    azSvcBus.countedIds( realIdx ).add( message.MessageID, time.Now( ) )
+}
+
+// Settled messages other than abandoned ones are not handed out again
+func ( azSvcBus *AzSvcBus )forgetCounted( realIdx int, message *azservicebus.ReceivedMessage, action string ) {
+    if 0 == len( message.MessageID ) || action == stats.SettleAbandon {
+        return
+    }
+
+    azSvcBus.countedIds( realIdx ).remove( message.MessageID )
+}
+
 func ( azSvcBus *AzSvcBus )receivedMessageCallback( idx int, message *azservicebus.ReceivedMessage )( err error ) {
     id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
     if err != nil {
@@ -321,28 +943,66 @@ func ( azSvcBus *AzSvcBus )receivedMessageCallback( idx int, message *azserviceb
 
     if message.ContentType != nil && *message.ContentType != msgContentType {
         glog.Errorf( "%v: Ignoring message with unknown content type %v", id, message.ContentType )
+        azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassValidate )
         return fmt.Errorf( "%v: Ignoring message with unknown content type %v", id, message.ContentType )
     }
 
-    trackVal, exists := message.ApplicationProperties[ trackPropName ]
-    if exists {
-        track, ok := trackVal.( string )
-        if ok && track == strFalse {
+    // Only messages sent while measuring count, no matter when they arrive
+    if !isMeasured( message ) {
+        return nil
+    }
+
+    // Redeliveries after an abandon or an expired lock are counted only if their first delivery
+    // never got this far, because its lock expired before or the receive failed after locking it
+    if message.DeliveryCount > 1 {
+        azSvcBus.stats.UpdateRedeliveredStat( realIdx, 1 )
+        if azSvcBus.isCounted( realIdx, message ) {
             return nil
         }
     }
 
-    propVal, exists := message.ApplicationProperties[ azSvcBus.PropName ]
-    if exists {
-        sndid, ok := propVal.( string )
-        if ok && id == sndid {
-            return nil
+    defer func( ) {
+        if err == nil {
+            azSvcBus.markCounted( realIdx, message )
+        }
+    }( )
+
+    // Resends the broker let through are settled like any other message but not counted again
+    if azSvcBus.isDuplicating( ) && azSvcBus.isDuplicate( realIdx, message ) {
+        azSvcBus.stats.UpdateDupRcvdStat( realIdx, 1 )
+        return nil
+    }
+
+    if azSvcBus.MessageTtl > 0 && isExpired( message ) {
+        glog.Warningf( "%v: Received message %v after it expired at %v", id, message.MessageID, message.ExpiresAt )
+        azSvcBus.stats.UpdateExpiredRcvdStat( realIdx, 1 )
+    }
+
+    if isCancelled( message ) {
+        glog.Warningf( "%v: Received cancelled scheduled message %v", id, message.MessageID )
+        azSvcBus.stats.UpdateCancelledRcvdStat( realIdx, 1 )
+        return nil
+    }
+
+    if azSvcBus.isSession( ) {
+        azSvcBus.checkSessionOrder( idx, realIdx, message )
+    }
+
+    if azSvcBus.selfSkip( ) {
+        propVal, exists := message.ApplicationProperties[ azSvcBus.PropName ]
+        if exists {
+            sndid, ok := propVal.( string )
+            if ok && id == sndid {
+                azSvcBus.stats.UpdateSelfSkippedStat( realIdx, 1 )
+                return nil
+            }
         }
     }
 
     msg, err := message.Body( )
     if err != nil {
         glog.Errorf( "%v: Failed to get received message body, error = %v", id, err )
+        azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassValidate )
         return fmt.Errorf( "%v: Failed to get received message body, error = %v", id, err )
     }
 
@@ -352,6 +1012,7 @@ func ( azSvcBus *AzSvcBus )receivedMessageCallback( idx int, message *azserviceb
 
     msgList, err := azSvcBus.msgGen.ParseMsg( msg, msgCb )
     if err != nil {
+        azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassParse )
         glog.Errorf( "%v: Failed to parse message, error = %v", id, err )
         return fmt.Errorf( "%v: Failed to parse message, error = %v", id, err )
     }
@@ -360,6 +1021,7 @@ func ( azSvcBus *AzSvcBus )receivedMessageCallback( idx int, message *azserviceb
         testId, ok := testIdPropVal.( string )
         if !ok || testId != azSvcBus.TestId {
             glog.Errorf( "%v: Invalid test id in message application properties", id )
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassValidate )
             return fmt.Errorf( "%v: Invalid test id in message application properties", id )
         }
     }
@@ -367,13 +1029,32 @@ func ( azSvcBus *AzSvcBus )receivedMessageCallback( idx int, message *azserviceb
     if senderIdxPropVal, exists := message.ApplicationProperties[ idxPropName ]; exists {
         senderIdx, ok := senderIdxPropVal.( int64 )
         if ok {
-            azSvcBus.stats.UpdateReceiverStat( realIdx, int( senderIdx ), uint64( msgList.Count ), uint64( msgList.GetLatency( ) ) )
+            // Scheduled messages are only due at their scheduled time, the delay before that is not latency
+            latency := msgList.GetLatency( )
+            if skew, ok := scheduleSkew( message ); ok {
+                azSvcBus.stats.UpdateScheduleStat( realIdx, skew )
+                latency = 0
+                if skew > 0 {
+                    latency = skew
+                }
+            }
+
+            azSvcBus.stats.UpdateReceiverStat( realIdx, int( senderIdx ), uint64( msgList.Count ), uint64( latency ) )
+            azSvcBus.stats.UpdateReceiverBytes( realIdx, uint64( receivedMessageSize( message, msg ) ) )
+            azSvcBus.stats.UpdateBrokerRcvdStat( realIdx, 1 )
+            if azSvcBus.phases.Get( ) >= phase.Cooldown {
+                azSvcBus.stats.UpdateLateStat( realIdx, uint64( msgList.Count ) )
+            }
+
+            azSvcBus.stats.UpdateClockStat( realIdx, msgList.GetRawLatency( ), uint64( msgList.GetLatencyBound( ) ) )
         } else {
             glog.Errorf( "%v: Invalid sender index in message application properties", id )
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassValidate )
             return fmt.Errorf( "%v: Invalid sender index in message application properties", id )
         }
     } else {
         glog.Errorf( "%v: Did not find sender index in message application properties", id )
+        azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassValidate )
         return fmt.Errorf( "%v: Did not find sender index in message application properties", id )
     }
 
@@ -388,7 +1069,23 @@ func ( azSvcBus *AzSvcBus )newReceiver( idx int )( err error ) {
             return err
         }
 
-        azSvcBusReceiver, err := azSvcBus.client.NewReceiverForSubscription( azSvcBus.TopicName, azSvcBus.SubName, nil )
+        opts := &azservicebus.ReceiverOptions {
+            ReceiveMode :   azSvcBus.receiveMode,
+        }
+
+        if azSvcBus.isSession( ) {
+            sessionReceiver, err := azSvcBus.acceptSession( idx, &azservicebus.SessionReceiverOptions {
+                ReceiveMode :   azSvcBus.receiveMode,
+            } )
+            if err != nil {
+                return err
+            }
+
+            azSvcBus.receivers[ idx ] = sessionReceiver
+            return nil
+        }
+
+        azSvcBusReceiver, err := azSvcBus.newPlainReceiver( idx, opts )
         if err != nil {
             glog.Errorf( "%v: Failed to create receiver, error = %v", id, err )
             return err
@@ -400,6 +1097,19 @@ func ( azSvcBus *AzSvcBus )newReceiver( idx int )( err error ) {
     return nil
 }
 
+func ( azSvcBus *AzSvcBus )newPlainReceiver( idx int, opts *azservicebus.ReceiverOptions )( receiver *azservicebus.Receiver, err error ) {
+    _, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        return nil, err
+    }
+
+    if azSvcBus.isQueue( ) {
+        return azSvcBus.clientFor( idx ).NewReceiverForQueue( azSvcBus.QueueName, opts )
+    }
+
+    return azSvcBus.clientFor( idx ).NewReceiverForSubscription( azSvcBus.TopicName, azSvcBus.subscriptionName( realIdx ), opts )
+}
+
 func ( azSvcBus *AzSvcBus )closeReceiver( idx int )( err error ) {
     if azSvcBus.receivers[ idx ] != nil {
         azSvcBus.receivers[ idx ].Close( azSvcBus.receiverCtx )
@@ -410,6 +1120,20 @@ func ( azSvcBus *AzSvcBus )closeReceiver( idx int )( err error ) {
 }
 
 func ( azSvcBus *AzSvcBus )startReceiver( idx int ) {
+    cb := func( idx int, message *azservicebus.ReceivedMessage )( err error ) {
+        return azSvcBus.receivedMessageCallback( idx, message )
+    }
+
+    if azSvcBus.isSession( ) {
+        azSvcBus.startSessionReceiver( idx, cb )
+        return
+    }
+
+    if azSvcBus.ContinuousReceive {
+        azSvcBus.startContinuousReceiver( idx, cb )
+        return
+    }
+
     err := azSvcBus.newReceiver( idx )
     if err != nil {
         return
@@ -419,11 +1143,13 @@ func ( azSvcBus *AzSvcBus )startReceiver( idx int ) {
         azSvcBus.closeReceiver( idx )
     }( )
 
-    cb := func( idx int, message *azservicebus.ReceivedMessage )( err error ) {
-        return azSvcBus.receivedMessageCallback( idx, message )
-    }
+    // Workers settle with the receiver, so they finish before it is closed
+    stopWorkers := azSvcBus.startWorkers( idx, cb )
+    defer stopWorkers( )
 
     for {
+        azSvcBus.throttleReceiver( )
+
         err = azSvcBus.receiveMessages( idx, cb )
         if err != nil {
             break
@@ -431,6 +1157,4 @@ func ( azSvcBus *AzSvcBus )startReceiver( idx int ) {
 
         time.Sleep( azSvcBus.ReceiveInterval )
     }
-
-    return
 }
@@ -1,8 +1,965 @@
 package azsvcbus
 
 import (
+    "context"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
     "testing"
+    "time"
+
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/Azure/go-amqp"
+    "github.com/azsvcbusbench/internal/azadmin"
+    "github.com/azsvcbusbench/internal/azadmin/azadmintest"
+    "github.com/azsvcbusbench/internal/azauth"
+    "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/stats"
 )
 
 func TestNewAzSvcBus( t *testing.T ) {
 }
+
+func TestMessageSize( t *testing.T ) {
+    key := "gw0"
+
+    message := &azservicebus.Message {
+        Body                    : [ ]byte( "0123456789" ),
+        ContentType             : &msgContentType,
+        PartitionKey            : &key,
+        ApplicationProperties   : map[ string ]interface{ }{ "id" : key },
+    }
+
+    expected := 10 + len( msgContentType ) + 3 + 2 + 3
+    if size := messageSize( message ); size != expected {
+        t.Errorf( "messageSize - expected %v, got %v", expected, size )
+    }
+}
+
+func TestInitReceiveMode( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ ReceiveMode : "ReceiveAndDelete" }
+    if err := azSvcBus.initReceiveMode( ); err != nil || azSvcBus.receiveMode != azservicebus.ReceiveModeReceiveAndDelete {
+        t.Errorf( "initReceiveMode - expected receive and delete, got %v error %v", azSvcBus.receiveMode, err )
+    }
+
+    azSvcBus = &AzSvcBus{ ReceiveMode : "bogus" }
+    if err := azSvcBus.initReceiveMode( ); err == nil {
+        t.Errorf( "initReceiveMode - expected error for unknown mode" )
+    }
+
+    azSvcBus = &AzSvcBus{ ReceiveMode : ReceiveModeReceiveAndDelete, AbandonPct : 10 }
+    if err := azSvcBus.initReceiveMode( ); err == nil {
+        t.Errorf( "initReceiveMode - expected error for abandon without peeklock" )
+    }
+
+    azSvcBus = &AzSvcBus{ AbandonPct : 60, DeadLetterPct : 50 }
+    if err := azSvcBus.initReceiveMode( ); err == nil {
+        t.Errorf( "initReceiveMode - expected error for percentages above 100" )
+    }
+}
+
+func TestPickSettleAction( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ DeadLetterPct : 100 }
+    if action := azSvcBus.pickSettleAction( ); action != "deadletter" {
+        t.Errorf( "pickSettleAction - expected deadletter, got %v", action )
+    }
+
+    azSvcBus = &AzSvcBus{ AbandonPct : 100 }
+    if action := azSvcBus.pickSettleAction( ); action != "abandon" {
+        t.Errorf( "pickSettleAction - expected abandon, got %v", action )
+    }
+
+    azSvcBus = &AzSvcBus{ DeferPct : 100 }
+    if action := azSvcBus.pickSettleAction( ); action != "defer" {
+        t.Errorf( "pickSettleAction - expected defer, got %v", action )
+    }
+
+    azSvcBus = &AzSvcBus{ }
+    if action := azSvcBus.pickSettleAction( ); action != "complete" {
+        t.Errorf( "pickSettleAction - expected complete, got %v", action )
+    }
+}
+
+func TestInitEntity( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ QueueName : "q", SubPerGateway : true }
+    if err := azSvcBus.initEntity( ); err == nil {
+        t.Errorf( "initEntity - expected error for queue with subscriptions per gateway" )
+    }
+
+    azSvcBus = &AzSvcBus{ QueueName : "q" }
+    if err := azSvcBus.initEntity( ); err != nil || azSvcBus.selfSkip( ) {
+        t.Errorf( "initEntity - expected valid queue without self skip, got error %v", err )
+    }
+
+    azSvcBus = &AzSvcBus{ }
+    if err := azSvcBus.initEntity( ); err == nil {
+        t.Errorf( "initEntity - expected error without topic or queue" )
+    }
+}
+
+func TestInitSessionMode( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ SessionMode : "Next" }
+    if err := azSvcBus.initSessionMode( ); err != nil || azSvcBus.SessionMode != SessionModeNext || azSvcBus.SessionIdleTimeout != DefaultSessionIdleTimeout {
+        t.Errorf( "initSessionMode - expected next sessions with default idle timeout, got %v %v error %v", azSvcBus.SessionMode, azSvcBus.SessionIdleTimeout, err )
+    }
+
+    azSvcBus = &AzSvcBus{ SessionMode : SessionModeSpecific, SubPerGateway : true }
+    if err := azSvcBus.initSessionMode( ); err == nil {
+        t.Errorf( "initSessionMode - expected error for specific sessions with subscriptions per gateway" )
+    }
+
+    azSvcBus = &AzSvcBus{ SessionState : true }
+    if err := azSvcBus.initSessionMode( ); err == nil {
+        t.Errorf( "initSessionMode - expected error for session state without sessions" )
+    }
+}
+
+func TestIsSessionLockLost( t *testing.T ) {
+    detached := &amqp.DetachError{ RemoteError : &amqp.Error{ Condition : sessionLockLostCondition } }
+    if !isSessionLockLost( fmt.Errorf( "receive failed: %w", detached ) ) || !isSessionLockLost( detached.RemoteError ) {
+        t.Errorf( "isSessionLockLost - expected lock lost" )
+    }
+
+    // Only the condition counts, not what the message says
+    if isSessionLockLost( nil ) || isSessionLockLost( fmt.Errorf( "com.microsoft:session-lock-lost" ) ) ||
+        isSessionLockLost( &amqp.Error{ Condition : messageLockLostCondition } ) || isSessionLockLost( &amqp.DetachError{ } ) {
+        t.Errorf( "isSessionLockLost - expected no lock lost" )
+    }
+}
+
+func TestCheckSessionOrder( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ }
+    azSvcBus.stats    = stats.NewStats( [ ]string{ "gw0" }, context.Background( ) )
+    azSvcBus.rcvdSeqs = [ ]map[ string ]int64{ { } }
+
+    session := "gw0"
+    for _, seq := range [ ]int64{ 1, 2, 4, 3, 5 } {
+        message := &azservicebus.ReceivedMessage {
+            SessionID               : &session,
+            ApplicationProperties   : map[ string ]interface{ }{ seqPropName : seq },
+        }
+
+        azSvcBus.checkSessionOrder( 0, 0, message )
+    }
+
+    if result := azSvcBus.stats.GetResult( false ); result.OutOfOrder != 1 {
+        t.Errorf( "checkSessionOrder - expected 1 out of order, got %v", result.OutOfOrder )
+    }
+}
+
+func TestInitSchedule( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ ScheduleDelay : "uniform:1s,2s", CancelPct : 10, CooldownDuration : time.Minute }
+    if err := azSvcBus.initSchedule( ); err != nil || !azSvcBus.isScheduled( ) {
+        t.Errorf( "initSchedule - expected scheduling, got error %v", err )
+    }
+
+    azSvcBus = &AzSvcBus{ CancelPct : 10 }
+    if err := azSvcBus.initSchedule( ); err == nil {
+        t.Errorf( "initSchedule - expected error for cancelling without scheduling" )
+    }
+
+    azSvcBus = &AzSvcBus{ ScheduleDelay : "1s", MsgsPerBatch : 10 }
+    if err := azSvcBus.initSchedule( ); err == nil {
+        t.Errorf( "initSchedule - expected error for scheduled batches" )
+    }
+}
+
+func TestScheduleSkew( t *testing.T ) {
+    message := &azservicebus.ReceivedMessage{ }
+    if _, ok := scheduleSkew( message ); ok {
+        t.Errorf( "scheduleSkew - expected no skew for unscheduled message" )
+    }
+
+    scheduled := time.Now( ).Add( time.Hour )
+    message.ScheduledEnqueueTime = &scheduled
+    if skew, ok := scheduleSkew( message ); !ok || skew > -3500000 {
+        t.Errorf( "scheduleSkew - expected about an hour early, got %v", skew )
+    }
+
+    message.ApplicationProperties = map[ string ]interface{ }{ cancelPropName : true }
+    if !isCancelled( message ) {
+        t.Errorf( "isCancelled - expected cancelled message" )
+    }
+}
+
+func TestValidDeadLetter( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ TestId : "test" }
+
+    opts := azSvcBus.deadLetterOptions( "gw0" )
+    message := &azservicebus.ReceivedMessage {
+        DeadLetterReason            : opts.Reason,
+        DeadLetterErrorDescription  : opts.ErrorDescription,
+        ApplicationProperties       : opts.PropertiesToModify,
+    }
+
+    message.ApplicationProperties[ testIdPropName ] = "test"
+    if !azSvcBus.validDeadLetter( message ) {
+        t.Errorf( "validDeadLetter - expected valid dead letter" )
+    }
+
+    message.ApplicationProperties[ deadLetteredByPropName ] = "gw1"
+    if azSvcBus.validDeadLetter( message ) {
+        t.Errorf( "validDeadLetter - expected mismatched description to be invalid" )
+    }
+}
+
+func TestDeadLetterSource( t *testing.T ) {
+    src := &DeadLetterSource{ TopicName : "topic", SubName : "sub" }
+    if _, err := src.requeueEntity( ); src.String( ) != "topic/sub/$DeadLetterQueue" || err == nil {
+        t.Errorf( "DeadLetterSource - unexpected %v, expected error requeueing to the topic", src )
+    }
+
+    // Refused before anything is opened
+    if _, err := RequeueDeadLetters( context.Background( ), nil, src, 0 ); err == nil {
+        t.Errorf( "RequeueDeadLetters - expected error for a subscription" )
+    }
+
+    src = &DeadLetterSource{ QueueName : "queue" }
+    if entity, err := src.requeueEntity( ); src.String( ) != "queue/$DeadLetterQueue" || entity != "queue" || err != nil {
+        t.Errorf( "DeadLetterSource - unexpected %v %v error %v", src, entity, err )
+    }
+
+    sessionId := "session"
+    props := map[ string ]interface{ }{ "id" : "gw0" }
+    message := &azservicebus.ReceivedMessage{ MessageID : "msg-1", SessionID : &sessionId, ApplicationProperties : props }
+
+    requeued := requeuedMessage( message, [ ]byte( "body" ) )
+    if requeued.MessageID == nil || len( *requeued.MessageID ) == 0 || *requeued.MessageID == "msg-1" {
+        t.Errorf( "requeuedMessage - expected a new message id, got %v", requeued.MessageID )
+    }
+
+    if requeued.SessionID != &sessionId || string( requeued.Body ) != "body" || requeued.ApplicationProperties[ "id" ] != "gw0" {
+        t.Errorf( "requeuedMessage - expected session, body and properties kept, got %+v", requeued )
+    }
+
+    if requeued.ApplicationProperties[ requeuedFromPropName ] != "msg-1" || len( props ) != 1 {
+        t.Errorf( "requeuedMessage - expected the original id in a copy of the properties, got %v", requeued.ApplicationProperties )
+    }
+}
+
+func TestInitSubFilter( t *testing.T ) {
+    connStr := "Endpoint=sb://ns.servicebus.windows.net/;SharedAccessKeyName=key;SharedAccessKey=c2VjcmV0"
+
+    azSvcBus := &AzSvcBus{ SubFilter : "SQL", TopicName : "topic", ConnStr : connStr }
+    if err := azSvcBus.initSubFilter( ); err != nil || !azSvcBus.SubPerGateway || azSvcBus.admin == nil {
+        t.Errorf( "initSubFilter - expected subscriptions per gateway and an admin client, error %v", err )
+    }
+
+    azSvcBus = &AzSvcBus{ SubFilter : SubFilterCorrelation, QueueName : "queue", ConnStr : connStr }
+    if err := azSvcBus.initSubFilter( ); err == nil {
+        t.Errorf( "initSubFilter - expected error for a queue" )
+    }
+
+    azSvcBus = &AzSvcBus{ SubFilter : "bogus", TopicName : "topic", ConnStr : connStr }
+    if err := azSvcBus.initSubFilter( ); err == nil {
+        t.Errorf( "initSubFilter - expected error for unknown filter" )
+    }
+}
+
+func TestSubFilterRules( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ SubFilter : SubFilterSql, PropName : "senderid", TotGateways : 3 }
+    azSvcBus.idGen = &helpers.IdGen{ Block : [ ]string{ "gw0", "gw'1", "gw2" } }
+
+    rules, err := azSvcBus.subFilterRules( "gw'1", 1 )
+    if err != nil || len( rules ) != 1 {
+        t.Fatalf( "subFilterRules - expected one sql rule, got %v error %v", len( rules ), err )
+    }
+
+    if filter, ok := rules[ 0 ].Filter.( *azadmin.SqlFilter ); !ok || filter.Expression != "senderid <> 'gw''1'" {
+        t.Errorf( "subFilterRules - unexpected sql filter %v", rules[ 0 ].Filter )
+    }
+
+    azSvcBus.SubFilter = SubFilterCorrelation
+    rules, err = azSvcBus.subFilterRules( "gw'1", 1 )
+    if err != nil || len( rules ) != 2 {
+        t.Fatalf( "subFilterRules - expected two correlation rules, got %v error %v", len( rules ), err )
+    }
+
+    if rules[ 0 ].Name != azadmin.DefaultRuleName || rules[ 1 ].Name != "from-2" {
+        t.Errorf( "subFilterRules - unexpected rule names %v %v", rules[ 0 ].Name, rules[ 1 ].Name )
+    }
+
+    for _, rule := range rules {
+        filter, ok := rule.Filter.( *azadmin.CorrelationFilter )
+        if !ok || filter.Properties[ "senderid" ] == "gw'1" {
+            t.Errorf( "subFilterRules - rule %v lets own messages through", rule.Name )
+        }
+    }
+
+    azSvcBus.TotGateways = 1
+    azSvcBus.idGen.Block = azSvcBus.idGen.Block[ :1 ]
+    if _, err = azSvcBus.subFilterRules( "gw0", 0 ); err == nil {
+        t.Errorf( "subFilterRules - expected error without other senders" )
+    }
+}
+
+// The SDK admin client only speaks https to the host of the connection string and brings its own http
+// client, the fake gets a test certificate that the default transport is swapped to trust
+func newFakeAdmin( t *testing.T, azSvcBus *AzSvcBus )( fake *azadmintest.Fake ) {
+    fake = azadmintest.NewFake( "key", "c2VjcmV0" )
+    server := httptest.NewTLSServer( fake )
+    t.Cleanup( server.Close )
+
+    transport := http.DefaultTransport
+    http.DefaultTransport = server.Client( ).Transport
+    t.Cleanup( func( ) { http.DefaultTransport = transport } )
+
+    azSvcBus.ConnStr = "Endpoint=sb://" + strings.TrimPrefix( server.URL, "https://" ) + "/;SharedAccessKeyName=key;SharedAccessKey=c2VjcmV0"
+
+    var err error
+    azSvcBus.admin, err = azSvcBus.newAdmin( )
+    if err != nil {
+        t.Fatalf( "newAdmin - unexpected error %v", err )
+    }
+
+    azSvcBus.rules = azadmin.NewClient( server.URL, "key", "c2VjcmV0" )
+    return fake
+}
+
+func TestProvision( t *testing.T ) {
+    azSvcBus := &AzSvcBus {
+        TopicName           :   "topic",
+        SubName             :   "sub",
+        SubPerGateway       :   true,
+        TotGateways         :   2,
+        Index               :   1,
+        ReceiverJobs        :   "0-1",
+        SessionMode         :   SessionModeNext,
+        LockDuration        :   time.Minute,
+        DupDetectionWindow  :   10 * time.Minute,
+    }
+    fake := newFakeAdmin( t, azSvcBus )
+
+    err := azSvcBus.provision( )
+    if err != nil {
+        t.Fatalf( "provision - unexpected error %v", err )
+    }
+
+    topic, _, _ := fake.Entity( "/topic" )
+    want := "<RequiresDuplicateDetection>true</RequiresDuplicateDetection><DuplicateDetectionHistoryTimeWindow>PT600S</DuplicateDetectionHistoryTimeWindow>"
+    if !strings.Contains( topic, want ) || strings.Contains( topic, "EnablePartitioning" ) {
+        t.Errorf( "provision - expected duplicate detection on the topic, got %v", topic )
+    }
+
+    for _, name := range [ ]string{ "sub-2", "sub-3" } {
+        sub, _, ok := fake.Entity( "/topic/subscriptions/" + name )
+        if !ok || !strings.Contains( sub, "<LockDuration>PT60S</LockDuration><RequiresSession>true</RequiresSession>" ) {
+            t.Errorf( "provision - unexpected subscription %v: %v", name, sub )
+        }
+    }
+
+    // Entities created by another job are kept as they are
+    if err = azSvcBus.provision( ); err != nil {
+        t.Errorf( "provision - unexpected error for existing entities %v", err )
+    }
+
+    // Other jobs of the run may still be using the entities, they are left to Teardown
+    azSvcBus.Deprovision( false )
+    if fake.Count( ) != 3 {
+        t.Errorf( "Deprovision - expected entities kept for the other jobs, got %v", fake.Count( ) )
+    }
+
+    azSvcBus.ConnStr = "Endpoint=sb://bench.servicebus.windows.net/;SharedAccessKeyName=bench;SharedAccessKey=c2VjcmV0"
+    if err = azSvcBus.Teardown( ); err != nil || fake.Count( ) != 0 {
+        t.Errorf( "Teardown - expected entities deleted, got %v error %v", fake.Count( ), err )
+    }
+
+    if err = azSvcBus.Teardown( ); err != nil {
+        t.Errorf( "Teardown - unexpected error for deleted entities %v", err )
+    }
+
+    // A single job tears down on its own
+    if err = azSvcBus.provision( ); err != nil {
+        t.Fatalf( "provision - unexpected error %v", err )
+    }
+
+    azSvcBus.ReceiverJobs = "1"
+    azSvcBus.Deprovision( false )
+    if fake.Count( ) != 0 {
+        t.Errorf( "Deprovision - expected entities deleted, got %v", fake.Count( ) )
+    }
+}
+
+func TestProvisionFailed( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ TopicName : "topic", SubName : "sub", TotGateways : 1 }
+    fake := newFakeAdmin( t, azSvcBus )
+
+    // The topic created before the subscription was refused still has to be torn down
+    fake.Forbidden = "/topic/subscriptions/sub"
+    if err := azSvcBus.provision( ); err == nil || !azSvcBus.provisioned {
+        t.Fatalf( "provision - expected error after the topic was created, got %v provisioned %v", err, azSvcBus.provisioned )
+    }
+
+    azSvcBus.Deprovision( true )
+    if fake.Count( ) != 0 {
+        t.Errorf( "Deprovision - expected the topic of the failed run deleted, got %v", fake.Count( ) )
+    }
+}
+
+func TestCreateSubscriptions( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ TopicName : "topic", SubName : "sub", SubPerGateway : true, SubFilter : SubFilterSql, PropName : "senderid", TotGateways : 2 }
+    azSvcBus.idGen = &helpers.IdGen{ Block : [ ]string{ "gw0", "gw1" } }
+    azSvcBus.stats = stats.NewStats( azSvcBus.idGen.Block, context.Background( ) )
+    fake := newFakeAdmin( t, azSvcBus )
+
+    err := azSvcBus.createSubscriptions( )
+    if err != nil {
+        t.Fatalf( "createSubscriptions - unexpected error %v", err )
+    }
+
+    sub, _, ok := fake.Entity( "/topic/subscriptions/sub-0" )
+    rule, _, _ := fake.Entity( "/topic/subscriptions/sub-0/rules/$Default" )
+    if !ok || !strings.Contains( sub, "SubscriptionDescription" ) || !strings.Contains( rule, `i:type="SqlFilter"` ) {
+        t.Errorf( "createSubscriptions - expected the subscription with its filter, got %v rule %v", sub, rule )
+    }
+
+    // Leftovers are replaced
+    if err = azSvcBus.createSubscriptions( ); err != nil || fake.Count( ) != 4 {
+        t.Errorf( "createSubscriptions - expected leftovers replaced, got %v entities error %v", fake.Count( ), err )
+    }
+
+    azSvcBus.deleteSubscriptions( )
+    if fake.Count( ) != 0 {
+        t.Errorf( "deleteSubscriptions - expected nothing left, got %v", fake.Count( ) )
+    }
+}
+
+func TestThrottleReceiver( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ ReceivePauseAt : 0, ReceivePauseFor : 50 * time.Millisecond }
+    azSvcBus.receiverCtx  = context.Background( )
+    azSvcBus.receiveStart = time.Now( )
+
+    start := time.Now( )
+    azSvcBus.throttleReceiver( )
+    if elapsed := time.Since( start ); elapsed < 40 * time.Millisecond {
+        t.Errorf( "throttleReceiver - expected to pause, returned after %v", elapsed )
+    }
+
+    // Past the pause only the slowdown applies
+    start = time.Now( )
+    azSvcBus.throttleReceiver( )
+    if elapsed := time.Since( start ); elapsed > 20 * time.Millisecond {
+        t.Errorf( "throttleReceiver - expected no pause, returned after %v", elapsed )
+    }
+
+    ctx, cancel := context.WithCancel( context.Background( ) )
+    cancel( )
+    azSvcBus.receiverCtx     = ctx
+    azSvcBus.ReceiveSlowdown = time.Hour
+
+    start = time.Now( )
+    azSvcBus.throttleReceiver( )
+    if elapsed := time.Since( start ); elapsed > 20 * time.Millisecond {
+        t.Errorf( "throttleReceiver - expected stopped receivers not to wait, returned after %v", elapsed )
+    }
+}
+
+func TestIsExpired( t *testing.T ) {
+    past   := time.Now( ).Add( -time.Second )
+    future := time.Now( ).Add( time.Minute )
+    reason := ttlExpiredReason
+
+    if !isExpired( &azservicebus.ReceivedMessage{ ExpiresAt : &past } ) || isExpired( &azservicebus.ReceivedMessage{ ExpiresAt : &future } ) {
+        t.Errorf( "isExpired - unexpected result" )
+    }
+
+    if isExpired( &azservicebus.ReceivedMessage{ } ) {
+        t.Errorf( "isExpired - expected a message without expiry not to expire" )
+    }
+
+    if !isTtlExpired( &azservicebus.ReceivedMessage{ DeadLetterReason : &reason } ) || isTtlExpired( &azservicebus.ReceivedMessage{ DeadLetterReason : &deadLetterReason } ) {
+        t.Errorf( "isTtlExpired - unexpected result" )
+    }
+}
+
+func TestInitDuplicates( t *testing.T ) {
+    azSvcBus := NewAzSvcBus( )
+    azSvcBus.DupPct             = 10
+    azSvcBus.DupDelay           = time.Second
+    azSvcBus.DupDetectionWindow = time.Minute
+    azSvcBus.Duration           = time.Minute
+    if err := azSvcBus.initDuplicates( ); err != nil || !azSvcBus.isDuplicating( ) {
+        t.Errorf( "initDuplicates - expected duplicates, got error %v", err )
+    }
+
+    if result := azSvcBus.stats.GetResult( false ); result.DupDelay != 1000 || result.DupWindow != 60000 {
+        t.Errorf( "initDuplicates - got delay %v window %v", result.DupDelay, result.DupWindow )
+    }
+
+    azSvcBus = &AzSvcBus{ DupDelay : time.Second }
+    if err := azSvcBus.initDuplicates( ); err == nil {
+        t.Errorf( "initDuplicates - expected error for a delay without duplicates" )
+    }
+
+    azSvcBus = &AzSvcBus{ DupPct : 10, MsgsPerBatch : 10 }
+    if err := azSvcBus.initDuplicates( ); err == nil {
+        t.Errorf( "initDuplicates - expected error for duplicate batches" )
+    }
+
+    azSvcBus = &AzSvcBus{ DupPct : 101 }
+    if err := azSvcBus.initDuplicates( ); err == nil {
+        t.Errorf( "initDuplicates - expected error for a percentage above 100" )
+    }
+}
+
+func TestIsDuplicate( t *testing.T ) {
+    azSvcBus := NewAzSvcBus( )
+    azSvcBus.TestId        = "test"
+    azSvcBus.TopicName     = "topic"
+    azSvcBus.SubName       = "sub"
+    azSvcBus.SubPerGateway = true
+
+    if azSvcBus.messageId( "gw-0", 7 ) != "test-gw-0-7" {
+        t.Errorf( "messageId - got %v", azSvcBus.messageId( "gw-0", 7 ) )
+    }
+
+    message := &azservicebus.ReceivedMessage{ MessageID : azSvcBus.messageId( "gw-0", 7 ) }
+    if azSvcBus.isDuplicate( 1, message ) || azSvcBus.isDuplicate( 2, message ) {
+        t.Errorf( "isDuplicate - expected the first delivery to each subscription not to be a duplicate" )
+    }
+
+    if !azSvcBus.isDuplicate( 1, message ) {
+        t.Errorf( "isDuplicate - expected the second delivery to a subscription to be a duplicate" )
+    }
+
+    if azSvcBus.isDuplicate( 1, &azservicebus.ReceivedMessage{ } ) || azSvcBus.isDuplicate( 1, &azservicebus.ReceivedMessage{ } ) {
+        t.Errorf( "isDuplicate - expected messages without id never to be duplicates" )
+    }
+
+    // Ids are let go once no resend can follow them anymore
+    azSvcBus.DupDelay, azSvcBus.DupDetectionWindow = time.Second, time.Minute
+    if ttl := azSvcBus.dupTtl( ); ttl != time.Minute + time.Second {
+        t.Errorf( "dupTtl - expected the delay and window, got %v", ttl )
+    }
+
+    if azSvcBus.dupIds( 1 ).contains( message.MessageID, time.Now( ).Add( 12 * time.Minute ) ) || azSvcBus.dupIds( 1 ).len( ) != 0 {
+        t.Errorf( "isDuplicate - expected old ids pruned, %v left", azSvcBus.dupIds( 1 ).len( ) )
+    }
+}
+
+func TestInitProcessing( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ ProcessTime : "uniform:10ms,2m", LockDuration : 30 * time.Second }
+    if err := azSvcBus.initProcessing( ); err != nil || !azSvcBus.isProcessing( ) || azSvcBus.Workers != 1 {
+        t.Errorf( "initProcessing - expected processing with one worker, got error %v workers %v", err, azSvcBus.Workers )
+    }
+
+    if azSvcBus.lockRenewInterval( ) != 15 * time.Second {
+        t.Errorf( "lockRenewInterval - expected half the lock duration, got %v", azSvcBus.lockRenewInterval( ) )
+    }
+
+    azSvcBus = &AzSvcBus{ Workers : 4, SessionMode : SessionModeNext }
+    if err := azSvcBus.initProcessing( ); err == nil {
+        t.Errorf( "initProcessing - expected error for several workers on a session" )
+    }
+
+    azSvcBus = &AzSvcBus{ ProcessTime : "sometimes" }
+    if err := azSvcBus.initProcessing( ); err == nil {
+        t.Errorf( "initProcessing - expected error for an invalid processing time" )
+    }
+}
+
+// Stands in for the unexported error of the management link
+type rpcCodeError int
+
+func ( e rpcCodeError )Error( )( string ) {
+    return fmt.Sprintf( "rpc status %v", int( e ) )
+}
+
+func ( e rpcCodeError )RPCCode( )( int ) {
+    return int( e )
+}
+
+func TestIsMessageLockLost( t *testing.T ) {
+    if !isMessageLockLost( fmt.Errorf( "renewal failed: %w", rpcCodeError( http.StatusGone ) ) ) || isMessageLockLost( rpcCodeError( http.StatusNotFound ) ) {
+        t.Errorf( "isMessageLockLost - expected only a gone status to be a lost lock" )
+    }
+
+    if !isMessageLockLost( fmt.Errorf( "settlement failed: %w", &amqp.Error{ Condition : messageLockLostCondition } ) ) {
+        t.Errorf( "isMessageLockLost - expected a lost lock" )
+    }
+
+    if isMessageLockLost( nil ) || isMessageLockLost( fmt.Errorf( "amqp: com.microsoft:message-lock-lost" ) ) ||
+        isMessageLockLost( &amqp.Error{ Condition : sessionLockLostCondition } ) {
+        t.Errorf( "isMessageLockLost - expected no lost lock" )
+    }
+}
+
+func TestHandleMessages( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ ProcessTime : "50ms", Workers : 4 }
+    azSvcBus.idGen       = &helpers.IdGen{ Block : [ ]string{ "gw0" } }
+    azSvcBus.stats       = stats.NewStats( [ ]string{ "gw0" }, context.Background( ) )
+    azSvcBus.receiverCtx = context.Background( )
+    azSvcBus.receiveMode = azservicebus.ReceiveModeReceiveAndDelete
+    if err := azSvcBus.initProcessing( ); err != nil {
+        t.Fatalf( "initProcessing - unexpected error %v", err )
+    }
+
+    messages := make( [ ]*azservicebus.ReceivedMessage, 4 )
+    for i := range messages {
+        messages[ i ] = &azservicebus.ReceivedMessage{ }
+    }
+
+    // Handing over waits only for a free worker, processing happens once the workers stopped
+    azSvcBus.workQueues = make( [ ]chan prefetched, 1 )
+    stopWorkers := azSvcBus.startWorkers( 0, nil )
+
+    start := time.Now( )
+    err := azSvcBus.handleMessages( 0, nil, messages, nil )
+    stopWorkers( )
+    if elapsed := time.Since( start ); err != nil || elapsed < 50 * time.Millisecond || elapsed > 150 * time.Millisecond {
+        t.Errorf( "handleMessages - expected the workers to process in parallel, took %v error %v", elapsed, err )
+    }
+
+    if result := azSvcBus.stats.GetResult( false ); result.ProcessLatency.Count != 4 || result.ProcessLatency.Min < 50 {
+        t.Errorf( "handleMessages - unexpected processing latency %+v", result.ProcessLatency )
+    }
+
+    // Twice as many messages as workers, the second half waits for the first and the latency shows it
+    azSvcBus.stats = stats.NewStats( [ ]string{ "gw0" }, context.Background( ) )
+    stopWorkers = azSvcBus.startWorkers( 0, nil )
+    err = azSvcBus.handleMessages( 0, nil, append( messages, messages... ), nil )
+    stopWorkers( )
+
+    if result := azSvcBus.stats.GetResult( false ); err != nil || result.ProcessLatency.Count != 8 || result.ProcessLatency.Max < 100 {
+        t.Errorf( "handleMessages - expected the wait for a worker in the processing latency, got %+v error %v", result.ProcessLatency, err )
+    }
+
+    cb := func( idx int, message *azservicebus.ReceivedMessage )( err error ) {
+        return fmt.Errorf( "invalid" )
+    }
+
+    // Invalid messages are settled out of the way without processing, the receiver carries on
+    stopWorkers = azSvcBus.startWorkers( 0, cb )
+    err = azSvcBus.handleMessages( 0, nil, messages, cb )
+    stopWorkers( )
+    if err != nil {
+        t.Errorf( "handleMessages - expected invalid messages not to stop the receiver, got error %v", err )
+    }
+
+    if result := azSvcBus.stats.GetResult( false ); result.ProcessLatency.Count != 8 {
+        t.Errorf( "handleMessages - expected invalid messages not to be processed, got %+v", result.ProcessLatency )
+    }
+}
+
+func TestWorkersBatchOfOne( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ Workers : 4 }
+    azSvcBus.idGen       = &helpers.IdGen{ Block : [ ]string{ "gw0" } }
+    azSvcBus.stats       = stats.NewStats( [ ]string{ "gw0" }, context.Background( ) )
+    azSvcBus.receiverCtx = context.Background( )
+    azSvcBus.receiveMode = azservicebus.ReceiveModeReceiveAndDelete
+    azSvcBus.workQueues  = make( [ ]chan prefetched, 1 )
+
+    var lock sync.Mutex
+    running, most := 0, 0
+    cb := func( idx int, message *azservicebus.ReceivedMessage )( err error ) {
+        lock.Lock( )
+        running++
+        if running > most {
+            most = running
+        }
+        lock.Unlock( )
+
+        time.Sleep( 20 * time.Millisecond )
+
+        lock.Lock( )
+        running--
+        lock.Unlock( )
+        return nil
+    }
+
+    stopWorkers := azSvcBus.startWorkers( 0, cb )
+
+    // One message per receive call, like with -messages-per-receive=1
+    start := time.Now( )
+    for i := 0; i < 8; i++ {
+        azSvcBus.handleMessages( 0, nil, [ ]*azservicebus.ReceivedMessage{ { } }, cb )
+    }
+
+    stopWorkers( )
+    if elapsed := time.Since( start ); most != 4 || elapsed > 120 * time.Millisecond {
+        t.Errorf( "startWorkers - expected 4 messages at a time with batches of one, got %v taking %v", most, elapsed )
+    }
+}
+
+func TestIsCounted( t *testing.T ) {
+    azSvcBus := NewAzSvcBus( )
+    azSvcBus.QueueName   = "bench"
+    azSvcBus.receiveMode = azservicebus.ReceiveModePeekLock
+
+    message := &azservicebus.ReceivedMessage{ MessageID : "gw0-1", DeliveryCount : 2 }
+    if azSvcBus.isCounted( 0, message ) {
+        t.Errorf( "isCounted - redelivery of a message never counted taken as counted" )
+    }
+
+    azSvcBus.markCounted( 0, message )
+    if !azSvcBus.isCounted( 1, message ) {
+        t.Errorf( "isCounted - expected a competing receiver to see the message counted" )
+    }
+
+    // Abandoned messages come back, settled ones do not and are let go
+    azSvcBus.forgetCounted( 0, message, stats.SettleAbandon )
+    if !azSvcBus.isCounted( 0, message ) {
+        t.Errorf( "forgetCounted - expected an abandoned message to stay counted" )
+    }
+
+    azSvcBus.forgetCounted( 0, message, stats.SettleComplete )
+    if azSvcBus.isCounted( 0, message ) || azSvcBus.countedIds( 0 ).len( ) != 0 {
+        t.Errorf( "forgetCounted - expected a completed message let go" )
+    }
+
+    azSvcBus.LockDuration, azSvcBus.MaxDeliveryCount = 30 * time.Second, 4
+    if ttl := azSvcBus.countedTtl( ); ttl != 2 * time.Minute {
+        t.Errorf( "countedTtl - expected every lock of every delivery, got %v", ttl )
+    }
+
+    if !azSvcBus.isCounted( 0, &azservicebus.ReceivedMessage{ DeliveryCount : 2 } ) {
+        t.Errorf( "isCounted - expected a redelivery without MessageID to be taken as counted" )
+    }
+
+    azSvcBus.receiveMode = azservicebus.ReceiveModeReceiveAndDelete
+    azSvcBus.markCounted( 0, &azservicebus.ReceivedMessage{ MessageID : "gw0-2" } )
+    if azSvcBus.isCounted( 0, &azservicebus.ReceivedMessage{ MessageID : "gw0-2" } ) {
+        t.Errorf( "markCounted - expected nothing kept without redeliveries" )
+    }
+}
+
+func TestIdSet( t *testing.T ) {
+    set := newIdSet( 8 * time.Second )
+    start := time.Now( )
+
+    if set.add( "a", start ) || !set.add( "a", start.Add( time.Second ) ) {
+        t.Errorf( "add - expected only the second add of an id to find it" )
+    }
+
+    set.add( "b", start.Add( 5 * time.Second ) )
+    if !set.contains( "a", start.Add( 8 * time.Second ) ) || set.len( ) != 2 {
+        t.Errorf( "contains - expected ids kept for the ttl, got %v", set.len( ) )
+    }
+
+    // Ids age out with their bucket once the newest of them is older than the ttl
+    if set.contains( "a", start.Add( 10 * time.Second ) ) || !set.contains( "b", start.Add( 10 * time.Second ) ) || set.len( ) != 1 {
+        t.Errorf( "contains - expected only the old id pruned, %v left", set.len( ) )
+    }
+
+    set.remove( "b" )
+    if set.contains( "b", start.Add( 10 * time.Second ) ) {
+        t.Errorf( "remove - expected the id gone" )
+    }
+
+    sets := newEntityIdSets( )
+    if sets.forEntity( "queue", time.Minute ) != sets.forEntity( "queue", time.Hour ) || sets.forEntity( "queue", time.Minute ) == sets.forEntity( "topic/sub", time.Minute ) {
+        t.Errorf( "forEntity - expected one set per entity" )
+    }
+}
+
+func TestInitReceiveLoop( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ ContinuousReceive : true, Prefetch : 100, MaxWaitTime : time.Second }
+    if err := azSvcBus.initReceiveLoop( ); err != nil || azSvcBus.ReceiveCalls != 1 {
+        t.Errorf( "initReceiveLoop - expected one receive call, got error %v calls %v", err, azSvcBus.ReceiveCalls )
+    }
+
+    azSvcBus = &AzSvcBus{ ReceiveCalls : 4 }
+    if err := azSvcBus.initReceiveLoop( ); err == nil {
+        t.Errorf( "initReceiveLoop - expected error for concurrent receive calls without the continuous loop" )
+    }
+
+    azSvcBus = &AzSvcBus{ ContinuousReceive : true, SessionMode : SessionModeNext }
+    if err := azSvcBus.initReceiveLoop( ); err == nil {
+        t.Errorf( "initReceiveLoop - expected error for sessions" )
+    }
+
+    azSvcBus = &AzSvcBus{ ContinuousReceive : true, Prefetch : -1 }
+    if err := azSvcBus.initReceiveLoop( ); err == nil {
+        t.Errorf( "initReceiveLoop - expected error for a negative prefetch" )
+    }
+}
+
+func TestInitClientTopology( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ TotGateways : 4 }
+    if err := azSvcBus.initClientTopology( ); err != nil || azSvcBus.clientCount( ) != 1 {
+        t.Errorf( "initClientTopology - expected a single client, got error %v count %v", err, azSvcBus.clientCount( ) )
+    }
+
+    azSvcBus = &AzSvcBus{ TotGateways : 4, ClientTopology : "Per-Gateway" }
+    if err := azSvcBus.initClientTopology( ); err != nil || azSvcBus.clientCount( ) != 4 {
+        t.Errorf( "initClientTopology - expected a client per gateway, got error %v count %v", err, azSvcBus.clientCount( ) )
+    }
+
+    azSvcBus = &AzSvcBus{ TotGateways : 4, ClientTopology : ClientTopologyPool }
+    if err := azSvcBus.initClientTopology( ); err == nil {
+        t.Errorf( "initClientTopology - expected error for a pool without a size" )
+    }
+
+    azSvcBus = &AzSvcBus{ TotGateways : 4, ClientTopology : ClientTopologyPool, ClientPoolSize : 8 }
+    if err := azSvcBus.initClientTopology( ); err != nil || azSvcBus.clientCount( ) != 4 {
+        t.Errorf( "initClientTopology - expected the pool clamped to the gateways, got error %v count %v", err, azSvcBus.clientCount( ) )
+    }
+
+    azSvcBus = &AzSvcBus{ TotGateways : 4, ClientPoolSize : 2 }
+    if err := azSvcBus.initClientTopology( ); err == nil {
+        t.Errorf( "initClientTopology - expected error for a pool size without a pool" )
+    }
+
+    azSvcBus = &AzSvcBus{ TotGateways : 4, ClientTopology : "mesh" }
+    if err := azSvcBus.initClientTopology( ); err == nil {
+        t.Errorf( "initClientTopology - expected error for an unknown topology" )
+    }
+}
+
+func TestClientFor( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ }
+    azSvcBus.clients = [ ]*azservicebus.Client{ &azservicebus.Client{ }, &azservicebus.Client{ } }
+
+    if azSvcBus.clientFor( 0 ) != azSvcBus.clients[ 0 ] || azSvcBus.clientFor( 3 ) != azSvcBus.clients[ 1 ] {
+        t.Errorf( "clientFor - expected gateways spread over the clients round robin" )
+    }
+}
+
+func TestInitCredential( t *testing.T ) {
+    azSvcBus := NewAzSvcBus( )
+    if err := azSvcBus.initCredential( ); err == nil {
+        t.Errorf( "initCredential - expected error without a connection string or credential" )
+    }
+
+    azSvcBus = NewAzSvcBus( )
+    azSvcBus.Credential = azauth.Options{ Token : "token" }
+    if err := azSvcBus.initCredential( ); err == nil {
+        t.Errorf( "initCredential - expected error for a credential without a namespace" )
+    }
+
+    azSvcBus.Namespace = "bench"
+    if err := azSvcBus.initCredential( ); err != nil || azSvcBus.credential == nil {
+        t.Fatalf( "initCredential - failed for a token credential: %v", err )
+    }
+
+    if _, err := azSvcBus.newClient( ); err != nil {
+        t.Errorf( "newClient - failed with a token credential: %v", err )
+    }
+
+    fake := azadmintest.NewFake( "key", "c2VjcmV0" )
+    fake.Bearer = "token"
+    server := httptest.NewServer( fake )
+    defer server.Close( )
+
+    // The admin clients go to the namespace itself, one for the fake shares the credential instead
+    admin, err := azSvcBus.newAdmin( )
+    if err != nil || admin == nil {
+        t.Fatalf( "newAdmin - failed with a token credential: %v", err )
+    }
+
+    rules, err := azSvcBus.newRules( )
+    if err != nil || rules == nil {
+        t.Fatalf( "newRules - failed with a token credential: %v", err )
+    }
+
+    rules = azadmin.NewClientWithToken( server.URL, func( ctx context.Context )( string, error ) {
+        return azSvcBus.credential.Bearer( ctx, azauth.ServiceBusScope )
+    } )
+    rule := &azadmin.Rule{ Name : azadmin.DefaultRuleName, Filter : &azadmin.SqlFilter{ Expression : "1=1" } }
+    if err = rules.CreateRule( context.Background( ), "topic", "sub", rule ); err != nil {
+        t.Errorf( "CreateRule - failed with the bearer token: %v", err )
+    }
+
+    if result := azSvcBus.stats.GetResult( false ); result.Credential != azauth.CredentialToken || result.TokensAcquired != 1 {
+        t.Errorf( "initCredential - expected the token counted, got %v acquired %v", result.Credential, result.TokensAcquired )
+    }
+}
+
+func TestInitDeferral( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ DeferPct : 20, DeferDelay : time.Second }
+    azSvcBus.receiveMode = azservicebus.ReceiveModePeekLock
+    if err := azSvcBus.initDeferral( ); err != nil {
+        t.Errorf( "initDeferral - unexpected error %v", err )
+    }
+
+    azSvcBus = &AzSvcBus{ DeferDelay : time.Second }
+    if err := azSvcBus.initDeferral( ); err == nil {
+        t.Errorf( "initDeferral - expected error for a delay without a percentage" )
+    }
+
+    azSvcBus = &AzSvcBus{ DeferPct : 60, AbandonPct : 50 }
+    azSvcBus.receiveMode = azservicebus.ReceiveModePeekLock
+    if err := azSvcBus.initDeferral( ); err == nil {
+        t.Errorf( "initDeferral - expected error for percentages above 100" )
+    }
+
+    azSvcBus = &AzSvcBus{ DeferPct : 20 }
+    azSvcBus.receiveMode = azservicebus.ReceiveModeReceiveAndDelete
+    if err := azSvcBus.initDeferral( ); err == nil {
+        t.Errorf( "initDeferral - expected error for receive and delete" )
+    }
+
+    azSvcBus = &AzSvcBus{ DeferPct : 20, SessionMode : SessionModeNext }
+    azSvcBus.receiveMode = azservicebus.ReceiveModePeekLock
+    if err := azSvcBus.initDeferral( ); err == nil {
+        t.Errorf( "initDeferral - expected error for sessions" )
+    }
+}
+
+func TestTakeDeferred( t *testing.T ) {
+    azSvcBus := &AzSvcBus{ }
+    azSvcBus.pendingDefers = make( [ ][ ]pendingDefer, 2 )
+
+    for seq := int64( 1 ); seq <= 3; seq++ {
+        seq := seq
+        azSvcBus.recordDeferred( 1, &azservicebus.ReceivedMessage{ SequenceNumber : &seq } )
+    }
+
+    azSvcBus.recordDeferred( 1, &azservicebus.ReceivedMessage{ } )
+
+    if due := azSvcBus.takeDeferred( 1, time.Now( ).Add( -time.Minute ) ); len( due ) != 0 {
+        t.Errorf( "takeDeferred - expected nothing due yet, got %v", due )
+    }
+
+    due := azSvcBus.takeDeferred( 1, time.Now( ) )
+    if len( due ) != 3 || due[ 0 ].seq != 1 || !due[ 0 ].measured || len( azSvcBus.pendingDefers[ 1 ] ) != 0 || len( azSvcBus.pendingDefers[ 0 ] ) != 0 {
+        t.Errorf( "takeDeferred - expected the three sequence numbers of receiver 1, got %v", due )
+    }
+
+    azSvcBus.returnDeferred( 1, due[ 1: ] )
+    if left := azSvcBus.takeDeferred( 1, time.Now( ) ); len( left ) != 2 || left[ 0 ].seq != 2 {
+        t.Errorf( "returnDeferred - expected two sequence numbers back, got %v", left )
+    }
+}
+
+func TestIsMessageNotFound( t *testing.T ) {
+    if !isMessageNotFound( fmt.Errorf( "receive deferred: %w", rpcCodeError( http.StatusNotFound ) ) ) ||
+        !isMessageNotFound( fmt.Errorf( "receive deferred: %w", &amqp.Error{ Condition : messageNotFoundCondition } ) ) {
+        t.Errorf( "isMessageNotFound - expected a missing message" )
+    }
+
+    if isMessageNotFound( nil ) || isMessageNotFound( fmt.Errorf( "com.microsoft:message-not-found: MessageNotFound" ) ) ||
+        isMessageNotFound( rpcCodeError( http.StatusGone ) ) || isMessageNotFound( &amqp.Error{ Condition : messageLockLostCondition } ) {
+        t.Errorf( "isMessageNotFound - expected no missing message" )
+    }
+}
+
+func TestStopStatsDrainsDeferred( t *testing.T ) {
+    client, err := azservicebus.NewClientFromConnectionString( "Endpoint=sb://bench.servicebus.windows.net/;SharedAccessKeyName=bench;SharedAccessKey=c2VjcmV0", nil )
+    if err != nil {
+        t.Fatalf( "NewClientFromConnectionString - unexpected error %v", err )
+    }
+
+    // A closed client refuses new links so whatever is left deferred has to be counted as lost
+    client.Close( context.Background( ) )
+
+    statsCtx, statsCancel := context.WithCancel( context.Background( ) )
+    defer statsCancel( )
+
+    azSvcBus := &AzSvcBus{ TotGateways : 1, QueueName : "bench", DeferPct : 10 }
+    azSvcBus.clients       = [ ]*azservicebus.Client{ client }
+    azSvcBus.idGen         = &helpers.IdGen{ Block : [ ]string{ "gw0" } }
+    azSvcBus.stats         = stats.NewStats( azSvcBus.idGen.Block, statsCtx )
+    azSvcBus.pendingDefers = [ ][ ]pendingDefer{ { { seq : 1, measured : true }, { seq : 2, measured : true }, { seq : 3 } } }
+
+    azSvcBus.stats.SetStatsDumpInterval( time.Hour )
+    azSvcBus.stats.StartDumper( )
+    azSvcBus.stopStats( statsCancel )
+
+    result := azSvcBus.stats.GetFinalResult( )
+    if result == nil || result.DeferLost != 2 || result.Gateways[ 0 ].DeferLost != 2 {
+        t.Errorf( "stopStats - expected the 2 measured deferred messages lost in the final result, got %+v", result )
+    }
+}
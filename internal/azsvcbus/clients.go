@@ -0,0 +1,148 @@
+package azsvcbus
+
+import (
+    "context"
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+const (
+    ClientTopologySingle        = "single"
+    ClientTopologyPerGateway    = "per-gateway"
+    ClientTopologyPool          = "pool"
+
+    connectTimeout              = time.Minute
+)
+
+// Every client holds an AMQP connection of its own, shared by the senders and receivers of the
+// gateways it serves
+func ( azSvcBus *AzSvcBus )initClientTopology( )( err error ) {
+    azSvcBus.ClientTopology = strings.ToLower( azSvcBus.ClientTopology )
+
+    switch azSvcBus.ClientTopology {
+        case "":
+            azSvcBus.ClientTopology = ClientTopologySingle
+
+        case ClientTopologySingle, ClientTopologyPerGateway:
+
+        case ClientTopologyPool:
+            if azSvcBus.ClientPoolSize <= 0 {
+                return fmt.Errorf( "a client pool needs a pool size" )
+            }
+
+            if azSvcBus.ClientPoolSize > azSvcBus.TotGateways {
+                glog.Warningf( "Client pool of %v is larger than the %v gateways, using a client per gateway", azSvcBus.ClientPoolSize, azSvcBus.TotGateways )
+                azSvcBus.ClientPoolSize = azSvcBus.TotGateways
+            }
+
+            return nil
+
+        default:
+            return fmt.Errorf( "unknown client topology %v", azSvcBus.ClientTopology )
+    }
+
+    if azSvcBus.ClientPoolSize > 0 {
+        return fmt.Errorf( "client pool size needs the %v client topology", ClientTopologyPool )
+    }
+
+    return nil
+}
+
+func ( azSvcBus *AzSvcBus )clientCount( )( int ) {
+    switch azSvcBus.ClientTopology {
+        case ClientTopologyPerGateway:
+            return azSvcBus.TotGateways
+
+        case ClientTopologyPool:
+            return azSvcBus.ClientPoolSize
+    }
+
+    return 1
+}
+
+// Gateways are spread over the clients round robin
+func ( azSvcBus *AzSvcBus )clientFor( idx int )( *azservicebus.Client ) {
+    return azSvcBus.clients[ idx % len( azSvcBus.clients ) ]
+}
+
+func ( azSvcBus *AzSvcBus )newClients( )( err error ) {
+    azSvcBus.clients = make( [ ]*azservicebus.Client, azSvcBus.clientCount( ) )
+    for i := range azSvcBus.clients {
+        azSvcBus.clients[ i ], err = azSvcBus.newClient( )
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Clients connect lazily, a link to the entity of the first gateway they serve forces the connection.
+// Jobs that send attach a sender and receiver only jobs peek, so either needs no more rights than the
+// job has anyway.
+func ( azSvcBus *AzSvcBus )connectClient( ctx context.Context, idx int )( err error ) {
+    if !azSvcBus.ReceiverOnly {
+        sender, err := azSvcBus.clientFor( idx ).NewSender( azSvcBus.entityName( ), nil )
+        if err != nil {
+            return err
+        }
+
+        defer sender.Close( ctx )
+
+        _, err = sender.NewMessageBatch( ctx, nil )
+        return err
+    }
+
+    receiver, err := azSvcBus.newPlainReceiver( idx, nil )
+    if err != nil {
+        return err
+    }
+
+    defer receiver.Close( ctx )
+
+    _, err = receiver.PeekMessages( ctx, 1, nil )
+    return err
+}
+
+// Establishes all connections up front so their setup does not count against the measured run
+func ( azSvcBus *AzSvcBus )connectClients( )( err error ) {
+    ctx, cancel := context.WithTimeout( context.Background( ), connectTimeout )
+    defer cancel( )
+
+    errs := make( [ ]error, len( azSvcBus.clients ) )
+    var wg sync.WaitGroup
+    wg.Add( len( azSvcBus.clients ) )
+    for i := range azSvcBus.clients {
+        go func( idx int ) {
+            defer wg.Done( )
+
+            connectStart := time.Now( )
+            errs[ idx ] = azSvcBus.connectClient( ctx, idx )
+            if errs[ idx ] == nil {
+                azSvcBus.stats.UpdateConnectStat( time.Since( connectStart ) )
+            }
+        }( i )
+    }
+
+    wg.Wait( )
+
+    for idx, err := range errs {
+        if err != nil {
+            return fmt.Errorf( "client %v: error %v", idx, err )
+        }
+    }
+
+    azSvcBus.stats.SetClients( azSvcBus.ClientTopology, len( azSvcBus.clients ) )
+    return nil
+}
+
+func ( azSvcBus *AzSvcBus )closeClients( ) {
+    for _, client := range azSvcBus.clients {
+        client.Close( context.Background( ) )
+    }
+}
@@ -0,0 +1,70 @@
+package azsvcbus
+
+import (
+    "context"
+    "fmt"
+
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    sbadmin "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+    "github.com/azsvcbusbench/internal/azadmin"
+    "github.com/azsvcbusbench/internal/azauth"
+)
+
+// Connection strings carry their own key, every other credential needs the namespace to connect to
+func ( azSvcBus *AzSvcBus )initCredential( )( err error ) {
+    if 0 == len( azSvcBus.Credential.Kind ) && len( azSvcBus.ConnStr ) > 0 {
+        azSvcBus.Credential.Kind = azauth.CredentialConnStr
+    }
+
+    err = azSvcBus.Credential.Resolve( )
+    if err != nil {
+        return err
+    }
+
+    if azSvcBus.Credential.Kind == azauth.CredentialConnStr {
+        if 0 == len( azSvcBus.ConnStr ) {
+            return fmt.Errorf( "connection string cannot be empty" )
+        }
+
+        return nil
+    }
+
+    if 0 == len( azSvcBus.Namespace ) {
+        return fmt.Errorf( "%v credential needs a namespace", azSvcBus.Credential.Kind )
+    }
+
+    azSvcBus.credential, err = azauth.NewCredential( azSvcBus.Credential, azSvcBus.stats.UpdateTokenStat )
+    if err != nil {
+        return err
+    }
+
+    azSvcBus.stats.SetCredential( azSvcBus.Credential.Kind )
+    return nil
+}
+
+func ( azSvcBus *AzSvcBus )newClient( )( client *azservicebus.Client, err error ) {
+    if azSvcBus.credential == nil {
+        return azservicebus.NewClientFromConnectionString( azSvcBus.ConnStr, nil )
+    }
+
+    return azservicebus.NewClient( azauth.Host( azSvcBus.Namespace ), azSvcBus.credential, nil )
+}
+
+func ( azSvcBus *AzSvcBus )newAdmin( )( admin *sbadmin.Client, err error ) {
+    if azSvcBus.credential == nil {
+        return sbadmin.NewClientFromConnectionString( azSvcBus.ConnStr, nil )
+    }
+
+    return sbadmin.NewClient( azauth.Host( azSvcBus.Namespace ), azSvcBus.credential, nil )
+}
+
+// The SDK admin client has no calls for subscription rules
+func ( azSvcBus *AzSvcBus )newRules( )( rules *azadmin.Client, err error ) {
+    if azSvcBus.credential == nil {
+        return azadmin.NewClientFromConnectionString( azSvcBus.ConnStr )
+    }
+
+    return azadmin.NewClientWithToken( "https://" + azauth.Host( azSvcBus.Namespace ), func( ctx context.Context )( string, error ) {
+        return azSvcBus.credential.Bearer( ctx, azauth.ServiceBusScope )
+    } ), nil
+}
@@ -0,0 +1,302 @@
+package azsvcbus
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+const (
+    deferPollInterval   = time.Second
+    deferBatchSize      = 100
+    deferDrainTimeout   = 30 * time.Second
+)
+
+// Message deferred by a receiver, fetched back by its sequence number once DeferDelay passed
+type pendingDefer struct {
+    seq                 int64
+    deferredAt          time.Time
+    measured            bool
+}
+
+func ( azSvcBus *AzSvcBus )isDeferring( )( bool ) {
+    return azSvcBus.DeferPct > 0
+}
+
+func ( azSvcBus *AzSvcBus )initDeferral( )( err error ) {
+    if azSvcBus.DeferPct < 0 || azSvcBus.DeferPct > 100 {
+        return fmt.Errorf( "defer percentage %v must be between 0 and 100", azSvcBus.DeferPct )
+    }
+
+    if azSvcBus.DeferDelay < 0 {
+        return fmt.Errorf( "defer delay cannot be negative" )
+    }
+
+    if !azSvcBus.isDeferring( ) {
+        if azSvcBus.DeferDelay > 0 {
+            return fmt.Errorf( "defer delay needs a defer percentage" )
+        }
+
+        return nil
+    }
+
+    if azSvcBus.AbandonPct + azSvcBus.DeadLetterPct + azSvcBus.DeferPct > 100 {
+        return fmt.Errorf( "abandon %v%%, dead letter %v%% and defer %v%% must add up to at most 100%%", azSvcBus.AbandonPct, azSvcBus.DeadLetterPct, azSvcBus.DeferPct )
+    }
+
+    if azSvcBus.receiveMode != azservicebus.ReceiveModePeekLock {
+        return fmt.Errorf( "deferral needs the %v receive mode", ReceiveModePeekLock )
+    }
+
+    // Only the receiver holding a session can fetch its deferred messages, and next session
+    // receivers move on before they get to it
+    if azSvcBus.isSession( ) {
+        return fmt.Errorf( "deferral cannot be combined with sessions" )
+    }
+
+    return nil
+}
+
+// Remembers the sequence number of a message the receiver with the given index deferred
+func ( azSvcBus *AzSvcBus )recordDeferred( idx int, message *azservicebus.ReceivedMessage ) {
+    if message.SequenceNumber == nil {
+        return
+    }
+
+    deferred := pendingDefer {
+        seq         :   *message.SequenceNumber,
+        deferredAt  :   time.Now( ),
+        measured    :   isMeasured( message ),
+    }
+
+    azSvcBus.deferLock.Lock( )
+    defer azSvcBus.deferLock.Unlock( )
+
+    azSvcBus.pendingDefers[ idx ] = append( azSvcBus.pendingDefers[ idx ], deferred )
+}
+
+// Takes the messages deferred up to before off the list of the receiver with the given index
+func ( azSvcBus *AzSvcBus )takeDeferred( idx int, before time.Time )( due [ ]pendingDefer ) {
+    azSvcBus.deferLock.Lock( )
+    defer azSvcBus.deferLock.Unlock( )
+
+    kept := azSvcBus.pendingDefers[ idx ][ :0 ]
+    for _, deferred := range azSvcBus.pendingDefers[ idx ] {
+        if deferred.deferredAt.After( before ) {
+            kept = append( kept, deferred )
+            continue
+        }
+
+        due = append( due, deferred )
+    }
+
+    azSvcBus.pendingDefers[ idx ] = kept
+    return due
+}
+
+func ( azSvcBus *AzSvcBus )returnDeferred( idx int, deferred [ ]pendingDefer ) {
+    if len( deferred ) == 0 {
+        return
+    }
+
+    azSvcBus.deferLock.Lock( )
+    defer azSvcBus.deferLock.Unlock( )
+
+    azSvcBus.pendingDefers[ idx ] = append( azSvcBus.pendingDefers[ idx ], deferred... )
+}
+
+// The broker refuses a fetch by sequence number as a whole when it no longer has one of them
+func isMessageNotFound( err error )( bool ) {
+    if err == nil {
+        return false
+    }
+
+    var rpcErr interface{ RPCCode( )( int ) }
+    if errors.As( err, &rpcErr ) && rpcErr.RPCCode( ) == http.StatusNotFound {
+        return true
+    }
+
+    return amqpCondition( err ) == messageNotFoundCondition
+}
+
+func ( azSvcBus *AzSvcBus )countDeferredLost( realIdx int, lost [ ]pendingDefer ) {
+    for _, deferred := range lost {
+        if deferred.measured {
+            azSvcBus.stats.UpdateDeferLostStat( realIdx, 1 )
+        }
+    }
+}
+
+// Fetches one batch of deferred messages and completes them. A batch the broker refuses for a
+// missing message is fetched one by one to find it, whatever could not be fetched or completed
+// otherwise is handed back to try again.
+func ( azSvcBus *AzSvcBus )fetchDeferred( ctx context.Context, idx int, receiver *azservicebus.Receiver, batch [ ]pendingDefer )( retry [ ]pendingDefer ) {
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return batch
+    }
+
+    bySeq := make( map[ int64 ]pendingDefer, len( batch ) )
+    seqs  := make( [ ]int64, 0, len( batch ) )
+    for _, deferred := range batch {
+        bySeq[ deferred.seq ] = deferred
+        seqs = append( seqs, deferred.seq )
+    }
+
+    messages, err := receiver.ReceiveDeferredMessages( ctx, seqs, nil )
+    if isMessageNotFound( err ) {
+        if len( batch ) == 1 {
+            glog.Warningf( "%v: Deferred message %v is gone, error = %v", id, batch[ 0 ].seq, err )
+            azSvcBus.countDeferredLost( realIdx, batch )
+            return nil
+        }
+
+        for i := range batch {
+            retry = append( retry, azSvcBus.fetchDeferred( ctx, idx, receiver, batch[ i:i + 1 ] )... )
+        }
+
+        return retry
+    }
+
+    if err != nil {
+        glog.Errorf( "%v: Failed to receive deferred messages, error = %v", id, err )
+        if ctx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassReceive )
+        }
+
+        return batch
+    }
+
+    for _, message := range messages {
+        if message.SequenceNumber == nil {
+            continue
+        }
+
+        deferred, ok := bySeq[ *message.SequenceNumber ]
+        if !ok {
+            continue
+        }
+
+        delete( bySeq, deferred.seq )
+
+        err = receiver.CompleteMessage( ctx, message, nil )
+        if err != nil {
+            glog.Errorf( "%v: Failed to complete deferred message %v, error = %v", id, message.MessageID, err )
+            if ctx.Err( ) == nil {
+                azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSettle )
+            }
+
+            retry = append( retry, deferred )
+            continue
+        }
+
+        if deferred.measured {
+            azSvcBus.stats.UpdateDeferStat( realIdx, time.Since( deferred.deferredAt ) )
+        }
+    }
+
+    // What the broker leaves out of its answer it no longer has
+    for _, deferred := range bySeq {
+        glog.Warningf( "%v: Deferred message %v was not returned", id, deferred.seq )
+        azSvcBus.countDeferredLost( realIdx, [ ]pendingDefer{ deferred } )
+    }
+
+    return retry
+}
+
+func ( azSvcBus *AzSvcBus )retrieveDeferred( ctx context.Context, idx int, receiver *azservicebus.Receiver, deferred [ ]pendingDefer )( retry [ ]pendingDefer ) {
+    for len( deferred ) > 0 {
+        n := len( deferred )
+        if n > deferBatchSize {
+            n = deferBatchSize
+        }
+
+        retry = append( retry, azSvcBus.fetchDeferred( ctx, idx, receiver, deferred[ :n ] )... )
+        deferred = deferred[ n: ]
+    }
+
+    return retry
+}
+
+// Fetches back what this gateway's receiver deferred once DeferDelay passed, on a link of its own
+func ( azSvcBus *AzSvcBus )startDeferredReceiver( idx int ) {
+    id, _, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return
+    }
+
+    receiver, err := azSvcBus.newPlainReceiver( idx, &azservicebus.ReceiverOptions{ ReceiveMode : azservicebus.ReceiveModePeekLock } )
+    if err != nil {
+        glog.Errorf( "%v: Failed to create deferred message receiver, error = %v", id, err )
+        return
+    }
+
+    defer receiver.Close( context.Background( ) )
+
+    for {
+        azSvcBus.receiverSleep( deferPollInterval )
+        if azSvcBus.receiverCtx.Err( ) != nil {
+            return
+        }
+
+        due   := azSvcBus.takeDeferred( idx, time.Now( ).Add( -azSvcBus.DeferDelay ) )
+        retry := azSvcBus.retrieveDeferred( azSvcBus.receiverCtx, idx, receiver, due )
+        azSvcBus.returnDeferred( idx, retry )
+    }
+}
+
+// Fetches whatever is still deferred once all receivers stopped, no matter the delay. Anything that
+// cannot be fetched and completed now is counted as lost.
+func ( azSvcBus *AzSvcBus )drainDeferred( ) {
+    if !azSvcBus.isDeferring( ) || azSvcBus.SenderOnly {
+        return
+    }
+
+    ctx, cancel := context.WithTimeout( context.Background( ), deferDrainTimeout )
+    defer cancel( )
+
+    var wg sync.WaitGroup
+    wg.Add( azSvcBus.TotGateways )
+    for i := 0; i < azSvcBus.TotGateways; i++ {
+        go func( idx int ) {
+            defer wg.Done( )
+
+            id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+            if err != nil {
+                glog.Errorf( "Failed to get index, error = %v", err )
+                return
+            }
+
+            left := azSvcBus.takeDeferred( idx, time.Now( ) )
+            if len( left ) == 0 {
+                return
+            }
+
+            receiver, err := azSvcBus.newPlainReceiver( idx, &azservicebus.ReceiverOptions{ ReceiveMode : azservicebus.ReceiveModePeekLock } )
+            if err != nil {
+                glog.Errorf( "%v: Failed to create deferred message receiver, error = %v", id, err )
+                azSvcBus.countDeferredLost( realIdx, left )
+                return
+            }
+
+            defer receiver.Close( ctx )
+
+            left = azSvcBus.retrieveDeferred( ctx, idx, receiver, left )
+            if len( left ) > 0 {
+                glog.Warningf( "%v: %v deferred messages could not be fetched back", id, len( left ) )
+                azSvcBus.countDeferredLost( realIdx, left )
+            }
+        }( i )
+    }
+
+    wg.Wait( )
+}
@@ -0,0 +1,352 @@
+package azsvcbus
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/google/uuid"
+    "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+const (
+    deadLetteredAtPropName  = "deadLetteredAt"
+    deadLetteredByPropName  = "deadLetteredBy"
+    requeuedFromPropName    = "requeuedFrom"
+
+    dlqIdleTimeout          = 5 * time.Second
+)
+
+// Queue or topic subscription whose dead letter queue is read
+type DeadLetterSource struct {
+    QueueName       string
+    TopicName       string
+    SubName         string
+}
+
+func ( src *DeadLetterSource )String( )( string ) {
+    if len( src.QueueName ) > 0 {
+        return src.QueueName + "/$DeadLetterQueue"
+    }
+
+    return src.TopicName + "/" + src.SubName + "/$DeadLetterQueue"
+}
+
+func ( src *DeadLetterSource )newReceiver( client *azservicebus.Client, mode azservicebus.ReceiveMode )( receiver *azservicebus.Receiver, err error ) {
+    opts := &azservicebus.ReceiverOptions {
+        ReceiveMode :   mode,
+        SubQueue    :   azservicebus.SubQueueDeadLetter,
+    }
+
+    if len( src.QueueName ) > 0 {
+        return client.NewReceiverForQueue( src.QueueName, opts )
+    }
+
+    return client.NewReceiverForSubscription( src.TopicName, src.SubName, opts )
+}
+
+// Queue that dead letters go back to when requeued. A subscription has no entity of its own to send
+// to, sent to its topic they would reach every other subscription as well.
+func ( src *DeadLetterSource )requeueEntity( )( entity string, err error ) {
+    if 0 == len( src.QueueName ) {
+        return "", fmt.Errorf( "cannot requeue %v, the topic would deliver to all of its subscriptions", src )
+    }
+
+    return src.QueueName, nil
+}
+
+// Gets a new message id, duplicate detection would drop a resend with the original one inside its window
+// while the dead letter is already removed. The original id travels in the requeuedFrom property.
+func requeuedMessage( message *azservicebus.ReceivedMessage, body [ ]byte )( *azservicebus.Message ) {
+    messageId := uuid.NewString( )
+
+    props := make( map[ string ]interface{ }, len( message.ApplicationProperties ) + 1 )
+    for key, value := range message.ApplicationProperties {
+        props[ key ] = value
+    }
+
+    props[ requeuedFromPropName ] = message.MessageID
+
+    return &azservicebus.Message {
+        MessageID               :   &messageId,
+        Body                    :   body,
+        ApplicationProperties   :   props,
+        ContentType             :   message.ContentType,
+        CorrelationID           :   message.CorrelationID,
+        PartitionKey            :   message.PartitionKey,
+        SessionID               :   message.SessionID,
+        Subject                 :   message.Subject,
+    }
+}
+
+func deadLetterDescription( id string )( string ) {
+    return "dead lettered by " + id
+}
+
+func ( azSvcBus *AzSvcBus )deadLetterOptions( id string )( *azservicebus.DeadLetterOptions ) {
+    description := deadLetterDescription( id )
+
+    return &azservicebus.DeadLetterOptions {
+        Reason              :   &deadLetterReason,
+        ErrorDescription    :   &description,
+        PropertiesToModify  :   map[ string ]interface{ }{
+            deadLetteredAtPropName : helpers.GetCurTimeStamp( ),
+            deadLetteredByPropName : id,
+        },
+    }
+}
+
+// Reason and description tell a message that failed validation apart from one the bench meant to dead letter
+func invalidDeadLetterOptions( invalidErr error )( *azservicebus.DeadLetterOptions ) {
+    description := invalidErr.Error( )
+
+    return &azservicebus.DeadLetterOptions {
+        Reason              :   &invalidDeadLetterReason,
+        ErrorDescription    :   &description,
+    }
+}
+
+// Checks that a message read back from the dead letter queue carries what deadLetterOptions put on it
+func ( azSvcBus *AzSvcBus )validDeadLetter( message *azservicebus.ReceivedMessage )( valid bool ) {
+    if nil == message.DeadLetterReason || *message.DeadLetterReason != deadLetterReason {
+        return false
+    }
+
+    by, ok := message.ApplicationProperties[ deadLetteredByPropName ].( string )
+    if !ok || nil == message.DeadLetterErrorDescription || *message.DeadLetterErrorDescription != deadLetterDescription( by ) {
+        return false
+    }
+
+    testId, ok := message.ApplicationProperties[ testIdPropName ].( string )
+    return ok && testId == azSvcBus.TestId
+}
+
+func ( azSvcBus *AzSvcBus )deadLetterSource( realIdx int )( *DeadLetterSource ) {
+    return &DeadLetterSource {
+        QueueName   :   azSvcBus.QueueName,
+        TopicName   :   azSvcBus.TopicName,
+        SubName     :   azSvcBus.subscriptionName( realIdx ),
+    }
+}
+
+// Reads back what this gateway's receiver entity dead lettered, removing every message it reads
+func ( azSvcBus *AzSvcBus )startDeadLetterReceiver( idx int ) {
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return
+    }
+
+    receiver, err := azSvcBus.deadLetterSource( realIdx ).newReceiver( azSvcBus.clientFor( idx ), azservicebus.ReceiveModeReceiveAndDelete )
+    if err != nil {
+        glog.Errorf( "%v: Failed to create dead letter receiver, error = %v", id, err )
+        return
+    }
+
+    defer receiver.Close( context.Background( ) )
+
+    for azSvcBus.receiverCtx.Err( ) == nil {
+        messages, err := receiver.ReceiveMessages( azSvcBus.receiverCtx, azSvcBus.MsgsPerReceive, nil )
+        if err != nil {
+            glog.Errorf( "%v: Failed to receive dead lettered messages, error = %v", id, err )
+            if azSvcBus.receiverCtx.Err( ) == nil {
+                azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassReceive )
+            }
+
+            return
+        }
+
+        for _, message := range messages {
+            if !isMeasured( message ) {
+                continue
+            }
+
+            // Expired messages are dead lettered by the broker, not by a receiver
+            if isTtlExpired( message ) {
+                azSvcBus.stats.UpdateDlqExpiredStat( realIdx, 1 )
+                continue
+            }
+
+            latency := int64( 0 )
+            if at, ok := message.ApplicationProperties[ deadLetteredAtPropName ].( int64 ); ok {
+                latency = helpers.GetCurTimeStamp( ) - at
+            }
+
+            if latency < 0 {
+                latency = 0
+            }
+
+            valid := azSvcBus.validDeadLetter( message )
+            if !valid {
+                glog.Warningf( "%v: Dead lettered message %v has unexpected properties", id, message.MessageID )
+            }
+
+            azSvcBus.stats.UpdateDlqStat( realIdx, uint64( latency ), valid )
+        }
+    }
+}
+
+type DeadLetterRecord struct {
+    MessageId           string                      `json:"messageId"`
+    SequenceNumber      int64                       `json:"sequenceNumber"`
+    EnqueuedTime        time.Time                   `json:"enqueuedTime"`
+    DeliveryCount       uint32                      `json:"deliveryCount"`
+    Reason              string                      `json:"reason,omitempty"`
+    Description         string                      `json:"description,omitempty"`
+    Source              string                      `json:"source,omitempty"`
+    Properties          map[ string ]interface{ }   `json:"properties,omitempty"`
+    Body                string                      `json:"body"`
+}
+
+func stringOrEmpty( s *string )( string ) {
+    if nil == s {
+        return ""
+    }
+
+    return *s
+}
+
+func newDeadLetterRecord( message *azservicebus.ReceivedMessage )( record *DeadLetterRecord, err error ) {
+    body, err := message.Body( )
+    if err != nil {
+        return nil, err
+    }
+
+    record = &DeadLetterRecord {
+        MessageId       :   message.MessageID,
+        DeliveryCount   :   message.DeliveryCount,
+        Reason          :   stringOrEmpty( message.DeadLetterReason ),
+        Description     :   stringOrEmpty( message.DeadLetterErrorDescription ),
+        Source          :   stringOrEmpty( message.DeadLetterSource ),
+        Properties      :   message.ApplicationProperties,
+        Body            :   string( body ),
+    }
+
+    if message.SequenceNumber != nil {
+        record.SequenceNumber = *message.SequenceNumber
+    }
+
+    if message.EnqueuedTime != nil {
+        record.EnqueuedTime = *message.EnqueuedTime
+    }
+
+    return record, nil
+}
+
+// Writes up to max dead lettered messages as json lines without removing them, 0 for all of them
+func DumpDeadLetters( ctx context.Context, client *azservicebus.Client, src *DeadLetterSource, max int, w io.Writer )( count int, err error ) {
+    receiver, err := src.newReceiver( client, azservicebus.ReceiveModePeekLock )
+    if err != nil {
+        return 0, fmt.Errorf( "failed to open %v: error %v", src, err )
+    }
+
+    defer receiver.Close( ctx )
+
+    enc := json.NewEncoder( w )
+
+    var from *int64
+    for max <= 0 || count < max {
+        messages, err := receiver.PeekMessages( ctx, 100, &azservicebus.PeekMessagesOptions{ FromSequenceNumber : from } )
+        if err != nil {
+            return count, fmt.Errorf( "failed to peek %v: error %v", src, err )
+        }
+
+        if len( messages ) == 0 {
+            break
+        }
+
+        for _, message := range messages {
+            if max > 0 && count >= max {
+                break
+            }
+
+            record, err := newDeadLetterRecord( message )
+            if err != nil {
+                return count, err
+            }
+
+            err = enc.Encode( record )
+            if err != nil {
+                return count, err
+            }
+
+            count++
+
+            next := record.SequenceNumber + 1
+            from = &next
+        }
+    }
+
+    return count, nil
+}
+
+// Sends up to max dead lettered messages back to the queue they were dead lettered from and removes
+// them from the dead letter queue, 0 for all of them. Stops once the queue stays empty for a while.
+func RequeueDeadLetters( ctx context.Context, client *azservicebus.Client, src *DeadLetterSource, max int )( count int, err error ) {
+    entity, err := src.requeueEntity( )
+    if err != nil {
+        return 0, err
+    }
+
+    receiver, err := src.newReceiver( client, azservicebus.ReceiveModePeekLock )
+    if err != nil {
+        return 0, fmt.Errorf( "failed to open %v: error %v", src, err )
+    }
+
+    defer receiver.Close( ctx )
+
+    sender, err := client.NewSender( entity, nil )
+    if err != nil {
+        return 0, fmt.Errorf( "failed to open %v: error %v", entity, err )
+    }
+
+    defer sender.Close( ctx )
+
+    for max <= 0 || count < max {
+        receiveCtx, cancel := context.WithTimeout( ctx, dlqIdleTimeout )
+        messages, err := receiver.ReceiveMessages( receiveCtx, 100, nil )
+        cancel( )
+        if err != nil {
+            return count, fmt.Errorf( "failed to receive from %v: error %v", src, err )
+        }
+
+        if len( messages ) == 0 {
+            break
+        }
+
+        for _, message := range messages {
+            if max > 0 && count >= max {
+                err = receiver.AbandonMessage( ctx, message, nil )
+                if err != nil {
+                    return count, err
+                }
+
+                continue
+            }
+
+            body, err := message.Body( )
+            if err != nil {
+                return count, err
+            }
+
+            err = sender.SendMessage( ctx, requeuedMessage( message, body ), nil )
+            if err != nil {
+                return count, fmt.Errorf( "failed to requeue %v to %v: error %v", message.MessageID, entity, err )
+            }
+
+            err = receiver.CompleteMessage( ctx, message, nil )
+            if err != nil {
+                return count, fmt.Errorf( "failed to remove %v from %v: error %v", message.MessageID, src, err )
+            }
+
+            count++
+        }
+    }
+
+    return count, nil
+}
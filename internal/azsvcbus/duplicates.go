@@ -0,0 +1,170 @@
+package azsvcbus
+
+import (
+    "fmt"
+    "math/rand"
+    "strconv"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/azsvcbusbench/internal/phase"
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+// Duplicate detection window of entities the bench did not provision, the service default
+const defaultDupDetectionWindow = 10 * time.Minute
+
+// Message waiting to be sent again under the MessageID it was first sent with
+type pendingDup struct {
+    due                 time.Time
+    sentPhase           phase.Phase
+    message            *azservicebus.Message
+}
+
+func ( azSvcBus *AzSvcBus )isDuplicating( )( bool ) {
+    return azSvcBus.DupPct > 0
+}
+
+func ( azSvcBus *AzSvcBus )initDuplicates( )( err error ) {
+    if azSvcBus.DupPct < 0 || azSvcBus.DupPct > 100 {
+        return fmt.Errorf( "duplicate percentage %v must be between 0 and 100", azSvcBus.DupPct )
+    }
+
+    if azSvcBus.DupDelay < 0 {
+        return fmt.Errorf( "duplicate delay cannot be negative" )
+    }
+
+    if !azSvcBus.isDuplicating( ) {
+        if azSvcBus.DupDelay > 0 {
+            return fmt.Errorf( "duplicate delay needs a duplicate percentage" )
+        }
+
+        return nil
+    }
+
+    if azSvcBus.MsgsPerBatch > 1 || len( azSvcBus.ScheduleDelay ) > 0 {
+        return fmt.Errorf( "duplicates cannot be combined with batches or scheduled messages" )
+    }
+
+    switch {
+        case azSvcBus.DupDetectionWindow <= 0:
+            glog.Warningf( "No duplicate detection window given, whether resends should get through depends on the entity" )
+
+        case !azSvcBus.Provision:
+            glog.Infof( "Assuming the entity detects duplicates within %v", azSvcBus.DupDetectionWindow )
+    }
+
+    if azSvcBus.DupDelay >= azSvcBus.Duration {
+        glog.Warningf( "Duplicate delay %v is not shorter than the test duration %v, resends due after the senders stop are dropped", azSvcBus.DupDelay, azSvcBus.Duration )
+    }
+
+    azSvcBus.stats.SetDuplicates( azSvcBus.DupDelay, azSvcBus.DupDetectionWindow )
+    return nil
+}
+
+// Deterministic per test, sender and sequence number, like a producer retrying the same message
+func ( azSvcBus *AzSvcBus )messageId( id string, seq int64 )( string ) {
+    return azSvcBus.TestId + "-" + id + "-" + strconv.FormatInt( seq, 10 )
+}
+
+// Picks DupPct of the sent messages for a resend, right away without a delay and otherwise once
+// the sender gets to it after the delay
+func ( azSvcBus *AzSvcBus )maybeDuplicate( idx int, id string, realIdx int, sentPhase phase.Phase, azsvcbusmsg *azservicebus.Message )( err error ) {
+    if !azSvcBus.isDuplicating( ) || rand.Float64( ) * 100 >= azSvcBus.DupPct {
+        return nil
+    }
+
+    if azSvcBus.DupDelay <= 0 {
+        return azSvcBus.sendDuplicate( idx, id, realIdx, sentPhase, azsvcbusmsg )
+    }
+
+    dup := pendingDup {
+        due         :   time.Now( ).Add( azSvcBus.DupDelay ),
+        sentPhase   :   sentPhase,
+        message     :   azsvcbusmsg,
+    }
+
+    azSvcBus.pendingDups[ idx ] = append( azSvcBus.pendingDups[ idx ], dup )
+    return nil
+}
+
+// Resends whatever is due, in the order it was sent. Only the sender goroutine touches its list.
+func ( azSvcBus *AzSvcBus )sendDuplicates( idx int )( err error ) {
+    pending := azSvcBus.pendingDups[ idx ]
+    if len( pending ) == 0 || time.Now( ).Before( pending[ 0 ].due ) {
+        return nil
+    }
+
+    id, realIdx, err := azSvcBus.getSenderIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return err
+    }
+
+    now := time.Now( )
+    for len( pending ) > 0 && !now.Before( pending[ 0 ].due ) {
+        err = azSvcBus.sendDuplicate( idx, id, realIdx, pending[ 0 ].sentPhase, pending[ 0 ].message )
+        if err != nil {
+            return err
+        }
+
+        pending = pending[ 1: ]
+    }
+
+    azSvcBus.pendingDups[ idx ] = pending
+    return nil
+}
+
+// Resends are not counted as sent, the broker is expected to drop them
+func ( azSvcBus *AzSvcBus )sendDuplicate( idx int, id string, realIdx int, sentPhase phase.Phase, azsvcbusmsg *azservicebus.Message )( err error ) {
+    err = azSvcBus.senders[ idx ].SendMessage( azSvcBus.senderCtx, azsvcbusmsg, nil )
+    if err != nil {
+        glog.Errorf( "%v: Failed to resend message %v, error = %v", id, *azsvcbusmsg.MessageID, err )
+        if azSvcBus.senderCtx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSend )
+        }
+
+        return err
+    }
+
+    if sentPhase == phase.Measure {
+        azSvcBus.stats.UpdateDupSentStat( realIdx, 1 )
+    }
+
+    return nil
+}
+
+// Entity the receiver with the given index reads from, receivers sharing it see each message once
+func ( azSvcBus *AzSvcBus )receiverEntity( realIdx int )( string ) {
+    if azSvcBus.isQueue( ) {
+        return azSvcBus.QueueName
+    }
+
+    return azSvcBus.TopicName + "/" + azSvcBus.subscriptionName( realIdx )
+}
+
+// A resend arrives DupDelay after its original, if the entity lets it through at all it does so
+// after the detection window
+func ( azSvcBus *AzSvcBus )dupTtl( )( time.Duration ) {
+    window := azSvcBus.DupDetectionWindow
+    if window <= 0 {
+        window = defaultDupDetectionWindow
+    }
+
+    return azSvcBus.DupDelay + window
+}
+
+func ( azSvcBus *AzSvcBus )dupIds( realIdx int )( *idSet ) {
+    return azSvcBus.dupSeen.forEntity( azSvcBus.receiverEntity( realIdx ), azSvcBus.dupTtl( ) )
+}
+
+// Remembers the MessageIDs delivered from an entity in this job for as long as a resend may follow,
+// receivers competing for the same entity in other jobs do not see each other's deliveries
+func ( azSvcBus *AzSvcBus )isDuplicate( realIdx int, message *azservicebus.ReceivedMessage )( bool ) {
+    if 0 == len( message.MessageID ) {
+        return false
+    }
+
+    return azSvcBus.dupIds( realIdx ).add( message.MessageID, time.Now( ) )
+}
@@ -0,0 +1,65 @@
+package azsvcbus
+
+import (
+    "fmt"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+)
+
+// Reason the broker gives messages it dead letters on expiry
+const ttlExpiredReason = "TTLExpiredException"
+
+func ( azSvcBus *AzSvcBus )initExpiry( )( err error ) {
+    if azSvcBus.MessageTtl < 0 || azSvcBus.ReceivePauseAt < 0 || azSvcBus.ReceivePauseFor < 0 || azSvcBus.ReceiveSlowdown < 0 {
+        return fmt.Errorf( "message ttl and receiver pause and slowdown cannot be negative" )
+    }
+
+    if azSvcBus.DeadLetterOnExpiry && !azSvcBus.Provision {
+        glog.Warningf( "Dead lettering on expiry is an entity setting and only applies to provisioned entities" )
+    }
+
+    azSvcBus.stats.SetMessageTtl( azSvcBus.MessageTtl )
+    return nil
+}
+
+// Sleeps for d unless the receivers are stopped first
+func ( azSvcBus *AzSvcBus )receiverSleep( d time.Duration ) {
+    if d <= 0 {
+        return
+    }
+
+    timer := time.NewTimer( d )
+    defer timer.Stop( )
+
+    select {
+        case <-timer.C:
+        case <-azSvcBus.receiverCtx.Done( ):
+    }
+}
+
+// Holds receivers back so a backlog builds up, ReceivePauseAt into the run they stop receiving for
+// ReceivePauseFor and every receive call is followed by an extra ReceiveSlowdown
+func ( azSvcBus *AzSvcBus )throttleReceiver( ) {
+    if azSvcBus.ReceivePauseFor > 0 {
+        pauseStart := azSvcBus.receiveStart.Add( azSvcBus.ReceivePauseAt )
+        pauseEnd   := pauseStart.Add( azSvcBus.ReceivePauseFor )
+
+        now := time.Now( )
+        if !now.Before( pauseStart ) && now.Before( pauseEnd ) {
+            azSvcBus.receiverSleep( pauseEnd.Sub( now ) )
+        }
+    }
+
+    azSvcBus.receiverSleep( azSvcBus.ReceiveSlowdown )
+}
+
+// The broker should never hand out a message past its expiry, the check is against the local clock
+func isExpired( message *azservicebus.ReceivedMessage )( bool ) {
+    return message.ExpiresAt != nil && time.Now( ).After( *message.ExpiresAt )
+}
+
+func isTtlExpired( message *azservicebus.ReceivedMessage )( bool ) {
+    return message.DeadLetterReason != nil && *message.DeadLetterReason == ttlExpiredReason
+}
@@ -0,0 +1,203 @@
+package azsvcbus
+
+import (
+    "context"
+    "fmt"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    sbadmin "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+    "github.com/golang/glog"
+    "github.com/azsvcbusbench/internal/azadmin"
+)
+
+const (
+    SubFilterNone           = ""
+    SubFilterSql            = "sql"
+    SubFilterCorrelation    = "correlation"
+
+    subFilterTimeout        = 5 * time.Minute
+)
+
+// With a subscription filter the broker keeps a gateway's own messages out of its subscription
+// instead of the receiver downloading and discarding them
+func ( azSvcBus *AzSvcBus )isSubFilter( )( bool ) {
+    return azSvcBus.SubFilter != SubFilterNone
+}
+
+func ( azSvcBus *AzSvcBus )initSubFilter( )( err error ) {
+    azSvcBus.SubFilter = strings.ToLower( azSvcBus.SubFilter )
+
+    switch azSvcBus.SubFilter {
+        case SubFilterNone:
+            return nil
+
+        case SubFilterSql, SubFilterCorrelation:
+
+        default:
+            return fmt.Errorf( "unknown subscription filter %v", azSvcBus.SubFilter )
+    }
+
+    if azSvcBus.isQueue( ) {
+        return fmt.Errorf( "subscription filters need a topic" )
+    }
+
+    // Filtered subscriptions are created per gateway
+    azSvcBus.SubPerGateway = true
+
+    return azSvcBus.initAdmin( )
+}
+
+// Indexes and ids of the senders of every gateway but the one with the given index
+func ( azSvcBus *AzSvcBus )otherSenders( realIdx int )( idxs [ ]int, ids [ ]string, err error ) {
+    jobs, err := azSvcBus.parseJobs( azSvcBus.SenderJobs )
+    if err != nil {
+        return nil, nil, fmt.Errorf( "invalid sender jobs: error %v", err )
+    }
+
+    for _, job := range jobs {
+        for i := 0; i < azSvcBus.TotGateways; i++ {
+            senderIdx := i + ( job * azSvcBus.TotGateways )
+            if senderIdx == realIdx {
+                continue
+            }
+
+            if senderIdx >= len( azSvcBus.idGen.Block ) {
+                return nil, nil, fmt.Errorf( "did not find id for sender index %v", senderIdx )
+            }
+
+            idxs = append( idxs, senderIdx )
+            ids  = append( ids, azSvcBus.idGen.Block[ senderIdx ] )
+        }
+    }
+
+    return idxs, ids, nil
+}
+
+// A SQL filter excludes the own gateway in one rule. Correlation filters only match equal values,
+// so they take one rule per other sender, any of which lets a message through.
+func ( azSvcBus *AzSvcBus )subFilterRules( id string, realIdx int )( rules [ ]*azadmin.Rule, err error ) {
+    if azSvcBus.SubFilter == SubFilterSql {
+        expr := fmt.Sprintf( "%v <> '%v'", azSvcBus.PropName, strings.ReplaceAll( id, "'", "''" ) )
+        return [ ]*azadmin.Rule{ { Name : azadmin.DefaultRuleName, Filter : &azadmin.SqlFilter{ Expression : expr } } }, nil
+    }
+
+    idxs, ids, err := azSvcBus.otherSenders( realIdx )
+    if err != nil {
+        return nil, err
+    }
+
+    if len( ids ) == 0 {
+        return nil, fmt.Errorf( "%v: no other senders to receive from", id )
+    }
+
+    if len( ids ) > azadmin.MaxRules {
+        return nil, fmt.Errorf( "%v: %v senders exceed the limit of %v correlation rules", id, len( ids ), azadmin.MaxRules )
+    }
+
+    for i, senderId := range ids {
+        rule := &azadmin.Rule {
+            Name    :   "from-" + strconv.Itoa( idxs[ i ] ),
+            Filter  :   &azadmin.CorrelationFilter{ Properties : map[ string ]string{ azSvcBus.PropName : senderId } },
+        }
+
+        rules = append( rules, rule )
+    }
+
+    rules[ 0 ].Name = azadmin.DefaultRuleName
+    return rules, nil
+}
+
+// Subscriptions left over from an earlier run that did not get to delete them are replaced. The SDK
+// creates them with the default rule that lets every message through, it is swapped for the filter
+// before anything is sent.
+func ( azSvcBus *AzSvcBus )createSubscription( ctx context.Context, idx int )( err error ) {
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        return err
+    }
+
+    rules, err := azSvcBus.subFilterRules( id, realIdx )
+    if err != nil {
+        return err
+    }
+
+    name := azSvcBus.subscriptionName( realIdx )
+    opts := &sbadmin.CreateSubscriptionOptions{ Properties : azSvcBus.subscriptionProperties( ) }
+
+    _, err = azSvcBus.admin.CreateSubscription( ctx, azSvcBus.TopicName, name, opts )
+    if isConflict( err ) {
+        glog.Warningf( "%v: Replacing leftover subscription %v", id, name )
+        _, err = azSvcBus.admin.DeleteSubscription( ctx, azSvcBus.TopicName, name, nil )
+        if err == nil {
+            _, err = azSvcBus.admin.CreateSubscription( ctx, azSvcBus.TopicName, name, opts )
+        }
+    }
+
+    if err != nil {
+        return fmt.Errorf( "%v: failed to create subscription %v: error %v", id, name, err )
+    }
+
+    err = azSvcBus.rules.DeleteRule( ctx, azSvcBus.TopicName, name, azadmin.DefaultRuleName )
+    if err != nil && !azadmin.IsNotFound( err ) {
+        return fmt.Errorf( "%v: failed to delete default rule of subscription %v: error %v", id, name, err )
+    }
+
+    for _, rule := range rules {
+        err = azSvcBus.rules.CreateRule( ctx, azSvcBus.TopicName, name, rule )
+        if err != nil {
+            return fmt.Errorf( "%v: failed to create rule %v of subscription %v: error %v", id, rule.Name, name, err )
+        }
+    }
+
+    return nil
+}
+
+// Creates the filtered subscriptions of all receivers of this job before anything is sent
+func ( azSvcBus *AzSvcBus )createSubscriptions( )( err error ) {
+    ctx, cancel := context.WithTimeout( context.Background( ), subFilterTimeout )
+    defer cancel( )
+
+    start := time.Now( )
+
+    errs := make( [ ]error, azSvcBus.TotGateways )
+    var wg sync.WaitGroup
+    wg.Add( azSvcBus.TotGateways )
+    for i := 0; i < azSvcBus.TotGateways; i++ {
+        go func( idx int ) {
+            defer wg.Done( )
+            errs[ idx ] = azSvcBus.createSubscription( ctx, idx )
+        }( i )
+    }
+
+    wg.Wait( )
+
+    for _, err := range errs {
+        if err != nil {
+            return err
+        }
+    }
+
+    azSvcBus.stats.SetSubFilter( azSvcBus.SubFilter, time.Since( start ) )
+    return nil
+}
+
+func ( azSvcBus *AzSvcBus )deleteSubscriptions( ) {
+    ctx, cancel := context.WithTimeout( context.Background( ), subFilterTimeout )
+    defer cancel( )
+
+    for i := 0; i < azSvcBus.TotGateways; i++ {
+        id, realIdx, err := azSvcBus.getReceiverIdFromIdx( i )
+        if err != nil {
+            continue
+        }
+
+        name := azSvcBus.subscriptionName( realIdx )
+        _, err = azSvcBus.admin.DeleteSubscription( ctx, azSvcBus.TopicName, name, nil )
+        if err != nil && !isNotFound( err ) {
+            glog.Errorf( "%v: Failed to delete subscription %v, error = %v", id, name, err )
+        }
+    }
+}
@@ -0,0 +1,135 @@
+package azsvcbus
+
+import (
+    "sync"
+    "time"
+)
+
+const (
+    idSetBuckets    = 8
+)
+
+// MessageIDs added within the same slice of time, they age out together
+type idBucket struct {
+    start               time.Time
+    ids                 map[ string ]struct{ }
+}
+
+// MessageIDs kept for at least ttl after they were added and at most a bucket width longer, so that
+// a long run does not hold on to every id it ever saw
+type idSet struct {
+    lock                sync.Mutex
+    ttl                 time.Duration
+    width               time.Duration
+    buckets         [ ]*idBucket
+}
+
+func newIdSet( ttl time.Duration )( *idSet ) {
+    width := ttl / idSetBuckets
+    if width < time.Millisecond {
+        width = time.Millisecond
+    }
+
+    return &idSet{ ttl : ttl, width : width }
+}
+
+// Buckets are oldest first, a bucket goes once its newest id is older than ttl
+func ( set *idSet )prune( now time.Time ) {
+    n := 0
+    for n < len( set.buckets ) && !now.Before( set.buckets[ n ].start.Add( set.width + set.ttl ) ) {
+        set.buckets[ n ] = nil
+        n++
+    }
+
+    set.buckets = set.buckets[ n: ]
+}
+
+func ( set *idSet )has( id string )( bool ) {
+    for _, bucket := range set.buckets {
+        if _, ok := bucket.ids[ id ]; ok {
+            return true
+        }
+    }
+
+    return false
+}
+
+func ( set *idSet )contains( id string, now time.Time )( bool ) {
+    set.lock.Lock( )
+    defer set.lock.Unlock( )
+
+    set.prune( now )
+    return set.has( id )
+}
+
+// Adds the id unless it is there already, existed tells which
+func ( set *idSet )add( id string, now time.Time )( existed bool ) {
+    set.lock.Lock( )
+    defer set.lock.Unlock( )
+
+    set.prune( now )
+    if set.has( id ) {
+        return true
+    }
+
+    last := len( set.buckets ) - 1
+    if last < 0 || !now.Before( set.buckets[ last ].start.Add( set.width ) ) {
+        set.buckets = append( set.buckets, &idBucket{ start : now, ids : make( map[ string ]struct{ } ) } )
+        last++
+    }
+
+    set.buckets[ last ].ids[ id ] = struct{ }{ }
+    return false
+}
+
+func ( set *idSet )remove( id string ) {
+    set.lock.Lock( )
+    defer set.lock.Unlock( )
+
+    for _, bucket := range set.buckets {
+        delete( bucket.ids, id )
+    }
+}
+
+func ( set *idSet )len( )( count int ) {
+    set.lock.Lock( )
+    defer set.lock.Unlock( )
+
+    for _, bucket := range set.buckets {
+        count += len( bucket.ids )
+    }
+
+    return count
+}
+
+// One idSet per receiving entity, each with a lock of its own so that receivers of different
+// entities do not wait for each other
+type entityIdSets struct {
+    lock                sync.RWMutex
+    sets                map[ string ]*idSet
+}
+
+func newEntityIdSets( )( *entityIdSets ) {
+    return &entityIdSets{ sets : make( map[ string ]*idSet ) }
+}
+
+// The ttl only applies when the entity is seen for the first time
+func ( sets *entityIdSets )forEntity( entity string, ttl time.Duration )( set *idSet ) {
+    sets.lock.RLock( )
+    set, ok := sets.sets[ entity ]
+    sets.lock.RUnlock( )
+    if ok {
+        return set
+    }
+
+    sets.lock.Lock( )
+    defer sets.lock.Unlock( )
+
+    set, ok = sets.sets[ entity ]
+    if !ok {
+        set = newIdSet( ttl )
+        sets.sets[ entity ] = set
+    }
+
+    return set
+}
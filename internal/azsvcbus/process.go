@@ -0,0 +1,259 @@
+package azsvcbus
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+// Lock duration and delivery count of entities the bench did not provision, the service defaults
+const (
+    defaultLockDuration     = time.Minute
+    defaultMaxDeliveryCount = 10
+)
+
+var errLockLost = errors.New( "message lock lost" )
+
+func ( azSvcBus *AzSvcBus )isProcessing( )( bool ) {
+    return azSvcBus.processTime != nil
+}
+
+func ( azSvcBus *AzSvcBus )initProcessing( )( err error ) {
+    if azSvcBus.Workers <= 0 {
+        azSvcBus.Workers = 1
+    }
+
+    if azSvcBus.Workers > 1 && azSvcBus.isSession( ) {
+        return fmt.Errorf( "messages of a session are processed in order by a single worker" )
+    }
+
+    if 0 == len( azSvcBus.ProcessTime ) {
+        return nil
+    }
+
+    azSvcBus.processTime, err = helpers.ParseDistribution( azSvcBus.ProcessTime )
+    if err != nil {
+        return err
+    }
+
+    if azSvcBus.receiveMode == azservicebus.ReceiveModePeekLock && !azSvcBus.LockRenewal && azSvcBus.processTime.Max( ) >= azSvcBus.lockDuration( ) {
+        glog.Warningf( "Processing for up to %v without lock renewal outlasts the lock duration of %v, locks will be lost", azSvcBus.processTime.Max( ), azSvcBus.lockDuration( ) )
+    }
+
+    return nil
+}
+
+func ( azSvcBus *AzSvcBus )lockDuration( )( time.Duration ) {
+    if azSvcBus.LockDuration > 0 {
+        return azSvcBus.LockDuration
+    }
+
+    return defaultLockDuration
+}
+
+// Message locks are broker side and time out with the broker clock, renewing at half the lock
+// duration keeps clear of it without relying on the local clock
+func ( azSvcBus *AzSvcBus )lockRenewInterval( )( time.Duration ) {
+    return azSvcBus.lockDuration( ) / 2
+}
+
+// The broker answers a renewal or settlement of a message whose lock expired with a gone status over
+// the management link or a lock lost condition over the receive link
+func isMessageLockLost( err error )( bool ) {
+    if err == nil {
+        return false
+    }
+
+    var rpcErr interface{ RPCCode( )( int ) }
+    if errors.As( err, &rpcErr ) && rpcErr.RPCCode( ) == http.StatusGone {
+        return true
+    }
+
+    return amqpCondition( err ) == messageLockLostCondition
+}
+
+// Messages of a session are locked with the session, plain receivers lock each message
+func ( azSvcBus *AzSvcBus )renewLock( receiver messageReceiver, message *azservicebus.ReceivedMessage )( err error ) {
+    switch receiver := receiver.( type ) {
+        case *azservicebus.Receiver:
+            return receiver.RenewMessageLock( azSvcBus.receiverCtx, message, nil )
+
+        case *azservicebus.SessionReceiver:
+            return receiver.RenewSessionLock( azSvcBus.receiverCtx, nil )
+    }
+
+    return nil
+}
+
+// Simulates processing for a time drawn from the processing distribution, renewing the lock for as
+// long as it takes. A message that lost its lock is handed out again and must not be settled.
+func ( azSvcBus *AzSvcBus )process( idx int, receiver messageReceiver, message *azservicebus.ReceivedMessage )( err error ) {
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return err
+    }
+
+    end := time.Now( ).Add( azSvcBus.processTime.Sample( ) )
+    if !azSvcBus.LockRenewal || azSvcBus.receiveMode != azservicebus.ReceiveModePeekLock {
+        azSvcBus.receiverSleep( time.Until( end ) )
+        return nil
+    }
+
+    interval := azSvcBus.lockRenewInterval( )
+    for {
+        left := time.Until( end )
+        if left <= interval {
+            azSvcBus.receiverSleep( left )
+            return nil
+        }
+
+        azSvcBus.receiverSleep( interval )
+        if azSvcBus.receiverCtx.Err( ) != nil {
+            return nil
+        }
+
+        err = azSvcBus.renewLock( receiver, message )
+        if isSessionLockLost( err ) {
+            glog.Warningf( "%v: Lost session lock while processing, error = %v", id, err )
+            azSvcBus.stats.UpdateSessionLockLostStat( realIdx )
+            return errSessionLost
+        }
+
+        if isMessageLockLost( err ) {
+            glog.Warningf( "%v: Lost lock of message %v while processing, error = %v", id, message.MessageID, err )
+            azSvcBus.stats.UpdateMsgLockLostStat( realIdx )
+            return errLockLost
+        }
+
+        if err != nil {
+            glog.Errorf( "%v: Failed to renew lock of message %v, error = %v", id, message.MessageID, err )
+            if azSvcBus.receiverCtx.Err( ) == nil {
+                azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassRenew )
+            }
+
+            continue
+        }
+
+        azSvcBus.stats.UpdateLockRenewStat( realIdx )
+    }
+}
+
+// Validates, processes and settles one message with the receiver it came from, the processing latency
+// runs from rcvdTime so that it includes the wait for a worker
+func ( azSvcBus *AzSvcBus )handleMessage( idx int, receiver messageReceiver, message *azservicebus.ReceivedMessage, rcvdTime time.Time, cb azSvcMsgCb )( err error ) {
+    _, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return err
+    }
+
+    if cb != nil {
+        err = cb( idx, message )
+    }
+
+    if err != nil {
+        return azSvcBus.settleInvalid( idx, receiver, message, err )
+    }
+
+    if azSvcBus.isProcessing( ) {
+        procErr := azSvcBus.process( idx, receiver, message )
+        if procErr == errLockLost {
+            return nil
+        }
+
+        if procErr == errSessionLost {
+            return procErr
+        }
+    }
+
+    settleErr := azSvcBus.settleMessage( idx, receiver, message, nil )
+
+    if azSvcBus.isProcessing( ) && isMeasured( message ) {
+        azSvcBus.stats.UpdateProcessStat( realIdx, time.Since( rcvdTime ) )
+    }
+
+    if settleErr == errSessionLost {
+        return settleErr
+    }
+
+    return nil
+}
+
+// A message that failed validation was counted as an error already, it is settled out of the way so
+// that the receiver carries on with the next one
+func ( azSvcBus *AzSvcBus )settleInvalid( idx int, receiver messageReceiver, message *azservicebus.ReceivedMessage, invalidErr error )( err error ) {
+    err = azSvcBus.settleMessage( idx, receiver, message, invalidErr )
+    if err == errSessionLost {
+        return err
+    }
+
+    return nil
+}
+
+// Starts Workers workers for the receiver with the given index that take messages off its work queue
+// for as long as it runs, so that they stay busy however few messages a receive call returns. The
+// returned function closes the queue and waits for the workers to finish what they have.
+func ( azSvcBus *AzSvcBus )startWorkers( idx int, cb azSvcMsgCb )( stop func( ) ) {
+    if azSvcBus.Workers <= 1 {
+        return func( ) { }
+    }
+
+    queue := make( chan prefetched )
+    azSvcBus.workQueues[ idx ] = queue
+
+    var wg sync.WaitGroup
+    wg.Add( azSvcBus.Workers )
+    for w := 0; w < azSvcBus.Workers; w++ {
+        go func( ) {
+            defer wg.Done( )
+            for p := range queue {
+                azSvcBus.handleMessage( idx, p.receiver, p.message, p.rcvdTime, cb )
+            }
+        }( )
+    }
+
+    return func( ) {
+        azSvcBus.workQueues[ idx ] = nil
+        close( queue )
+        wg.Wait( )
+    }
+}
+
+func ( azSvcBus *AzSvcBus )workQueue( idx int )( chan<- prefetched ) {
+    if idx >= len( azSvcBus.workQueues ) {
+        return nil
+    }
+
+    return azSvcBus.workQueues[ idx ]
+}
+
+// Hands the messages to the workers of the receiver, waiting for one to be free, or with a single
+// worker goes through them one after the other. Only a lost session stops a single worker, the rest
+// of the batch is left to the broker to hand out again.
+func ( azSvcBus *AzSvcBus )handleMessages( idx int, receiver messageReceiver, messages [ ]*azservicebus.ReceivedMessage, cb azSvcMsgCb )( err error ) {
+    if queue := azSvcBus.workQueue( idx ); queue != nil {
+        rcvdTime := time.Now( )
+        for _, message := range messages {
+            queue <- prefetched{ receiver : receiver, message : message, rcvdTime : rcvdTime }
+        }
+
+        return nil
+    }
+
+    for _, message := range messages {
+        err = azSvcBus.handleMessage( idx, receiver, message, time.Now( ), cb )
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
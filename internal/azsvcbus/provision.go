@@ -0,0 +1,244 @@
+package azsvcbus
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net/http"
+    "time"
+
+    "github.com/Azure/azure-sdk-for-go/sdk/azcore"
+    sbadmin "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+    "github.com/golang/glog"
+)
+
+const (
+    provisionTimeout    = 5 * time.Minute
+)
+
+func ( azSvcBus *AzSvcBus )initAdmin( )( err error ) {
+    if azSvcBus.admin == nil {
+        azSvcBus.admin, err = azSvcBus.newAdmin( )
+        if err != nil {
+            return err
+        }
+    }
+
+    if azSvcBus.rules == nil {
+        azSvcBus.rules, err = azSvcBus.newRules( )
+    }
+
+    return err
+}
+
+// Zero values keep the service defaults, which the SDK wants as nil
+func isoDuration( d time.Duration )( *string ) {
+    if d <= 0 {
+        return nil
+    }
+
+    iso := fmt.Sprintf( "PT%vS", int64( d / time.Second ) )
+    return &iso
+}
+
+func optionalBool( v bool )( *bool ) {
+    if !v {
+        return nil
+    }
+
+    return &v
+}
+
+func optionalInt32( v int )( *int32 ) {
+    if v <= 0 {
+        return nil
+    }
+
+    count := int32( v )
+    return &count
+}
+
+func ( azSvcBus *AzSvcBus )queueProperties( )( *sbadmin.QueueProperties ) {
+    return &sbadmin.QueueProperties {
+        LockDuration                        :   isoDuration( azSvcBus.LockDuration ),
+        RequiresDuplicateDetection          :   optionalBool( azSvcBus.DupDetectionWindow > 0 ),
+        RequiresSession                     :   optionalBool( azSvcBus.isSession( ) ),
+        DefaultMessageTimeToLive            :   isoDuration( azSvcBus.DefaultTtl ),
+        DeadLetteringOnMessageExpiration    :   optionalBool( azSvcBus.DeadLetterOnExpiry ),
+        DuplicateDetectionHistoryTimeWindow :   isoDuration( azSvcBus.DupDetectionWindow ),
+        MaxDeliveryCount                    :   optionalInt32( azSvcBus.MaxDeliveryCount ),
+        EnablePartitioning                  :   optionalBool( azSvcBus.EnablePartitioning ),
+    }
+}
+
+func ( azSvcBus *AzSvcBus )topicProperties( )( *sbadmin.TopicProperties ) {
+    return &sbadmin.TopicProperties {
+        DefaultMessageTimeToLive            :   isoDuration( azSvcBus.DefaultTtl ),
+        RequiresDuplicateDetection          :   optionalBool( azSvcBus.DupDetectionWindow > 0 ),
+        DuplicateDetectionHistoryTimeWindow :   isoDuration( azSvcBus.DupDetectionWindow ),
+        EnablePartitioning                  :   optionalBool( azSvcBus.EnablePartitioning ),
+    }
+}
+
+func ( azSvcBus *AzSvcBus )subscriptionProperties( )( *sbadmin.SubscriptionProperties ) {
+    return &sbadmin.SubscriptionProperties {
+        LockDuration                        :   isoDuration( azSvcBus.LockDuration ),
+        RequiresSession                     :   optionalBool( azSvcBus.isSession( ) ),
+        DefaultMessageTimeToLive            :   isoDuration( azSvcBus.DefaultTtl ),
+        DeadLetteringOnMessageExpiration    :   optionalBool( azSvcBus.DeadLetterOnExpiry ),
+        MaxDeliveryCount                    :   optionalInt32( azSvcBus.MaxDeliveryCount ),
+    }
+}
+
+func hasStatus( err error, status int )( bool ) {
+    var respErr *azcore.ResponseError
+    return errors.As( err, &respErr ) && respErr.StatusCode == status
+}
+
+func isConflict( err error )( bool ) {
+    return hasStatus( err, http.StatusConflict )
+}
+
+func isNotFound( err error )( bool ) {
+    return hasStatus( err, http.StatusNotFound )
+}
+
+// Another job of the same run may have created the entity first
+func created( err error, kind, name string )( error ) {
+    if isConflict( err ) {
+        glog.Warningf( "%v %v exists already, keeping its settings", kind, name )
+        return nil
+    }
+
+    return err
+}
+
+// Jobs do not know when the others finish, whichever tore down first would delete the entities
+// from under the ones still running. Only a run of a single job tears down on its own.
+func ( azSvcBus *AzSvcBus )isOnlyJob( )( bool ) {
+    senderJobs, _   := azSvcBus.parseJobs( azSvcBus.SenderJobs )
+    receiverJobs, _ := azSvcBus.parseJobs( azSvcBus.ReceiverJobs )
+
+    for _, job := range append( senderJobs, receiverJobs... ) {
+        if job != azSvcBus.Index {
+            return false
+        }
+    }
+
+    return true
+}
+
+// Creates the queue or topic and the subscriptions of this job's receivers unless they exist.
+// Filtered subscriptions are left to createSubscriptions.
+func ( azSvcBus *AzSvcBus )provision( )( err error ) {
+    err = azSvcBus.initAdmin( )
+    if err != nil {
+        return err
+    }
+
+    ctx, cancel := context.WithTimeout( context.Background( ), provisionTimeout )
+    defer cancel( )
+
+    start := time.Now( )
+
+    // Deprovision takes down whatever got created should the rest fail
+    if azSvcBus.isQueue( ) {
+        _, err = azSvcBus.admin.CreateQueue( ctx, azSvcBus.QueueName, &sbadmin.CreateQueueOptions{ Properties : azSvcBus.queueProperties( ) } )
+        err = created( err, "queue", azSvcBus.QueueName )
+        if err != nil {
+            return err
+        }
+
+        azSvcBus.provisioned = true
+    } else {
+        _, err = azSvcBus.admin.CreateTopic( ctx, azSvcBus.TopicName, &sbadmin.CreateTopicOptions{ Properties : azSvcBus.topicProperties( ) } )
+        err = created( err, "topic", azSvcBus.TopicName )
+        if err != nil {
+            return err
+        }
+
+        azSvcBus.provisioned = true
+
+        if !azSvcBus.SenderOnly && !azSvcBus.isSubFilter( ) {
+            names := map[ string ]bool{ }
+            for i := 0; i < azSvcBus.TotGateways; i++ {
+                names[ azSvcBus.subscriptionName( i + ( azSvcBus.Index * azSvcBus.TotGateways ) ) ] = true
+            }
+
+            for name := range names {
+                opts := &sbadmin.CreateSubscriptionOptions{ Properties : azSvcBus.subscriptionProperties( ) }
+                _, err = azSvcBus.admin.CreateSubscription( ctx, azSvcBus.TopicName, name, opts )
+                err = created( err, "subscription", name )
+                if err != nil {
+                    return err
+                }
+            }
+        }
+    }
+
+    glog.Infof( "Provisioned entities in %v", time.Since( start ) )
+    return nil
+}
+
+// Deleting the topic deletes its subscriptions along with it
+func ( azSvcBus *AzSvcBus )deleteEntities( )( err error ) {
+    ctx, cancel := context.WithTimeout( context.Background( ), provisionTimeout )
+    defer cancel( )
+
+    if azSvcBus.isQueue( ) {
+        _, err = azSvcBus.admin.DeleteQueue( ctx, azSvcBus.QueueName, nil )
+    } else {
+        _, err = azSvcBus.admin.DeleteTopic( ctx, azSvcBus.TopicName, nil )
+    }
+
+    if isNotFound( err ) {
+        return nil
+    }
+
+    return err
+}
+
+// Deletes the provisioned queue or topic along with its subscriptions, unless the run failed and
+// they are kept to look into. Has to be called after Start, whether it failed or not. Runs of
+// several jobs keep them, the other jobs may still be using them, and leave them to Teardown.
+func ( azSvcBus *AzSvcBus )Deprovision( failed bool ) {
+    if !azSvcBus.provisioned {
+        return
+    }
+
+    if !azSvcBus.isOnlyJob( ) {
+        glog.Infof( "Keeping provisioned entities for a teardown once every job of the run finished" )
+        return
+    }
+
+    if failed && azSvcBus.KeepOnFailure {
+        glog.Infof( "Keeping provisioned entities of the failed run" )
+        return
+    }
+
+    err := azSvcBus.deleteEntities( )
+    if err != nil {
+        glog.Errorf( "Failed to delete provisioned entities, error = %v", err )
+    }
+}
+
+// Deletes the queue or topic a run of several jobs provisioned, in place of Start once every job
+// of the run finished
+func ( azSvcBus *AzSvcBus )Teardown( )( err error ) {
+    err = azSvcBus.initCredential( )
+    if err != nil {
+        return fmt.Errorf( "invalid credential settings: error %v", err )
+    }
+
+    err = azSvcBus.initEntity( )
+    if err != nil {
+        return fmt.Errorf( "invalid entity settings: error %v", err )
+    }
+
+    err = azSvcBus.initAdmin( )
+    if err != nil {
+        return fmt.Errorf( "failed to setup admin client: error %v", err )
+    }
+
+    return azSvcBus.deleteEntities( )
+}
@@ -0,0 +1,152 @@
+package azsvcbus
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+// Received message waiting in the prefetch buffer or a work queue for a worker
+type prefetched struct {
+    receiver            messageReceiver
+    message            *azservicebus.ReceivedMessage
+    rcvdTime            time.Time
+}
+
+func ( azSvcBus *AzSvcBus )initReceiveLoop( )( err error ) {
+    if azSvcBus.ReceiveCalls <= 0 {
+        azSvcBus.ReceiveCalls = 1
+    }
+
+    if azSvcBus.Prefetch < 0 || azSvcBus.MaxWaitTime < 0 {
+        return fmt.Errorf( "prefetch and max wait time cannot be negative" )
+    }
+
+    if !azSvcBus.ContinuousReceive {
+        if azSvcBus.Prefetch > 0 || azSvcBus.ReceiveCalls > 1 || azSvcBus.MaxWaitTime > 0 {
+            return fmt.Errorf( "prefetch, concurrent receive calls and max wait time need the continuous receive loop" )
+        }
+
+        return nil
+    }
+
+    if azSvcBus.isSession( ) {
+        return fmt.Errorf( "the continuous receive loop does not take sessions" )
+    }
+
+    return nil
+}
+
+// Receives on one link after the other without a pause, whatever a call returns is handed to the
+// workers through the prefetch buffer. MsgsPerReceive is the credit each call issues and MaxWaitTime
+// how long a call waits for the first message, without it a call waits for as long as it takes.
+func ( azSvcBus *AzSvcBus )pumpMessages( ctx context.Context, idx int, receiver *azservicebus.Receiver, buffer chan<- prefetched )( err error ) {
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return err
+    }
+
+    for ctx.Err( ) == nil {
+        azSvcBus.throttleReceiver( )
+
+        callCtx, cancel := ctx, context.CancelFunc( func( ) { } )
+        if azSvcBus.MaxWaitTime > 0 {
+            callCtx, cancel = context.WithTimeout( ctx, azSvcBus.MaxWaitTime )
+        }
+
+        messages, err := receiver.ReceiveMessages( callCtx, azSvcBus.MsgsPerReceive, nil )
+        cancel( )
+        if err != nil {
+            glog.Errorf( "%v: Failed to receive messages, error = %v", id, err )
+            if ctx.Err( ) == nil {
+                azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassReceive )
+            }
+
+            return err
+        }
+
+        azSvcBus.stats.UpdateReceiveCallStat( realIdx, len( messages ) )
+
+        // Workers drain the buffer until it is closed, so nothing received is left behind
+        rcvdTime := time.Now( )
+        for _, message := range messages {
+            buffer <- prefetched{ receiver : receiver, message : message, rcvdTime : rcvdTime }
+        }
+    }
+
+    return nil
+}
+
+// ReceiveCalls links of their own receive concurrently into a buffer of Prefetch messages that
+// Workers take them from. A message failing validation is settled out of the way like in the plain loop.
+func ( azSvcBus *AzSvcBus )startContinuousReceiver( idx int, cb azSvcMsgCb ) {
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return
+    }
+
+    ctx, cancel := context.WithCancel( azSvcBus.receiverCtx )
+    defer cancel( )
+
+    opts := &azservicebus.ReceiverOptions {
+        ReceiveMode :   azSvcBus.receiveMode,
+    }
+
+    receivers := make( [ ]*azservicebus.Receiver, 0, azSvcBus.ReceiveCalls )
+    defer func( ) {
+        for _, receiver := range receivers {
+            receiver.Close( azSvcBus.receiverCtx )
+        }
+    }( )
+
+    for i := 0; i < azSvcBus.ReceiveCalls; i++ {
+        receiver, err := azSvcBus.newPlainReceiver( idx, opts )
+        if err != nil {
+            glog.Errorf( "%v: Failed to create receiver, error = %v", id, err )
+            return
+        }
+
+        receivers = append( receivers, receiver )
+    }
+
+    buffer := make( chan prefetched, azSvcBus.Prefetch )
+
+    var pumps sync.WaitGroup
+    pumps.Add( len( receivers ) )
+    for _, receiver := range receivers {
+        go func( receiver *azservicebus.Receiver ) {
+            defer pumps.Done( )
+            azSvcBus.pumpMessages( ctx, idx, receiver, buffer )
+        }( receiver )
+    }
+
+    go func( ) {
+        pumps.Wait( )
+        close( buffer )
+    }( )
+
+    var workers sync.WaitGroup
+    workers.Add( azSvcBus.Workers )
+    for w := 0; w < azSvcBus.Workers; w++ {
+        go func( ) {
+            defer workers.Done( )
+            for p := range buffer {
+                azSvcBus.stats.UpdatePrefetchWaitStat( realIdx, time.Since( p.rcvdTime ) )
+
+                err := azSvcBus.handleMessage( idx, p.receiver, p.message, p.rcvdTime, cb )
+                if err != nil {
+                    cancel( )
+                }
+            }
+        }( )
+    }
+
+    workers.Wait( )
+}
@@ -0,0 +1,111 @@
+package azsvcbus
+
+import (
+    "fmt"
+    "math/rand"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/phase"
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+func ( azSvcBus *AzSvcBus )isScheduled( )( bool ) {
+    return azSvcBus.scheduleDelay != nil
+}
+
+func ( azSvcBus *AzSvcBus )initSchedule( )( err error ) {
+    if 0 == len( azSvcBus.ScheduleDelay ) {
+        if azSvcBus.CancelPct > 0 {
+            return fmt.Errorf( "cancelling needs a schedule delay" )
+        }
+
+        return nil
+    }
+
+    azSvcBus.scheduleDelay, err = helpers.ParseDistribution( azSvcBus.ScheduleDelay )
+    if err != nil {
+        return err
+    }
+
+    if azSvcBus.CancelPct < 0 || azSvcBus.CancelPct > 100 {
+        return fmt.Errorf( "cancel percentage %v must be between 0 and 100", azSvcBus.CancelPct )
+    }
+
+    if azSvcBus.MsgsPerBatch > 1 {
+        return fmt.Errorf( "scheduled messages cannot be sent in batches" )
+    }
+
+    if max := azSvcBus.scheduleDelay.Max( ); azSvcBus.CooldownDuration < max {
+        glog.Warningf( "Cooldown %v is shorter than the schedule delay of up to %v, late deliveries will be lost", azSvcBus.CooldownDuration, max )
+    }
+
+    return nil
+}
+
+// Schedules the message at a delay drawn from the schedule distribution on the reference clock, so that
+// receivers on other hosts can tell how far off the delivery was. Cancelled messages are tagged before
+// they are scheduled, any of them that turns up at a receiver is counted there.
+func ( azSvcBus *AzSvcBus )scheduleMessage( idx int, id string, realIdx int, sentPhase phase.Phase, azsvcbusmsg *azservicebus.Message )( err error ) {
+    cancel := rand.Float64( ) * 100 < azSvcBus.CancelPct
+    if cancel {
+        azsvcbusmsg.ApplicationProperties[ cancelPropName ] = true
+    }
+
+    scheduledTime := time.UnixMilli( helpers.GetCurTimeStamp( ) ).Add( azSvcBus.scheduleDelay.Sample( ) )
+
+    sendStart := time.Now( )
+    seqs, err := azSvcBus.senders[ idx ].ScheduleMessages( azSvcBus.senderCtx, [ ]*azservicebus.Message{ azsvcbusmsg }, scheduledTime, nil )
+    sendLatency := time.Since( sendStart )
+    if err != nil {
+        glog.Errorf( "%v: Failed to schedule message, error = %v", id, err )
+        if azSvcBus.senderCtx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSend )
+        }
+
+        return err
+    }
+
+    if cancel {
+        err = azSvcBus.senders[ idx ].CancelScheduledMessages( azSvcBus.senderCtx, seqs, nil )
+        if err != nil {
+            glog.Errorf( "%v: Failed to cancel scheduled message, error = %v", id, err )
+            if azSvcBus.senderCtx.Err( ) == nil {
+                azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassCancel )
+            }
+
+            return err
+        }
+
+        if sentPhase == phase.Measure {
+            azSvcBus.stats.UpdateCancelledStat( realIdx, uint64( azSvcBus.MsgsPerSend ) )
+        }
+
+        return nil
+    }
+
+    if sentPhase == phase.Measure {
+        azSvcBus.stats.UpdateSenderStat( realIdx, uint64( azSvcBus.MsgsPerSend ) )
+        azSvcBus.stats.UpdateSendLatency( realIdx, sendLatency )
+        azSvcBus.stats.UpdateSenderBytes( realIdx, uint64( messageSize( azsvcbusmsg ) ) )
+        azSvcBus.stats.UpdateBrokerSentStat( realIdx, 1 )
+    }
+
+    return nil
+}
+
+func isCancelled( message *azservicebus.ReceivedMessage )( bool ) {
+    cancelled, ok := message.ApplicationProperties[ cancelPropName ].( bool )
+    return ok && cancelled
+}
+
+// Milliseconds between the scheduled time and now on the reference clock, negative when early
+func scheduleSkew( message *azservicebus.ReceivedMessage )( skew int64, ok bool ) {
+    if nil == message.ScheduledEnqueueTime {
+        return 0, false
+    }
+
+    return helpers.GetCurTimeStamp( ) - message.ScheduledEnqueueTime.UnixMilli( ), true
+}
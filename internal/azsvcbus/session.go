@@ -0,0 +1,255 @@
+package azsvcbus
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    "github.com/Azure/go-amqp"
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+const (
+    SessionModeNone     = ""
+    SessionModeSpecific = "specific"
+    SessionModeNext     = "next"
+
+    DefaultSessionIdleTimeout = 10 * time.Second
+)
+
+var (
+    errSessionIdle = errors.New( "session idle" )
+    errSessionLost = errors.New( "session lock lost" )
+)
+
+// Common to plain and session receivers so that receiving and settling does not care which one it has
+type messageReceiver interface {
+    ReceiveMessages( ctx context.Context, maxMessages int, options *azservicebus.ReceiveMessagesOptions )( [ ]*azservicebus.ReceivedMessage, error )
+    CompleteMessage( ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.CompleteMessageOptions )( error )
+    AbandonMessage( ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.AbandonMessageOptions )( error )
+    DeadLetterMessage( ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeadLetterOptions )( error )
+    DeferMessage( ctx context.Context, message *azservicebus.ReceivedMessage, options *azservicebus.DeferMessageOptions )( error )
+    Close( ctx context.Context )( error )
+}
+
+func ( azSvcBus *AzSvcBus )isSession( )( bool ) {
+    return azSvcBus.SessionMode != SessionModeNone
+}
+
+func ( azSvcBus *AzSvcBus )initSessionMode( )( err error ) {
+    azSvcBus.SessionMode = strings.ToLower( azSvcBus.SessionMode )
+
+    switch azSvcBus.SessionMode {
+        case SessionModeNone:
+            if azSvcBus.SessionState {
+                return fmt.Errorf( "session state needs a session mode" )
+            }
+
+        case SessionModeSpecific:
+            if azSvcBus.SubPerGateway {
+                return fmt.Errorf( "%v sessions cannot be combined with subscriptions per gateway", SessionModeSpecific )
+            }
+
+        case SessionModeNext:
+
+        default:
+            return fmt.Errorf( "unknown session mode %v", azSvcBus.SessionMode )
+    }
+
+    if azSvcBus.SessionIdleTimeout <= 0 {
+        azSvcBus.SessionIdleTimeout = DefaultSessionIdleTimeout
+    }
+
+    return nil
+}
+
+// Conditions the broker detaches a link or rejects a settlement with, the SDK has no error codes for them yet
+const (
+    sessionLockLostCondition    amqp.ErrorCondition = "com.microsoft:session-lock-lost"
+    messageLockLostCondition    amqp.ErrorCondition = "com.microsoft:message-lock-lost"
+    messageNotFoundCondition    amqp.ErrorCondition = "com.microsoft:message-not-found"
+)
+
+// Condition of the amqp error wrapped in err, either on its own or as the reason of a link detach
+func amqpCondition( err error )( condition amqp.ErrorCondition ) {
+    var amqpErr *amqp.Error
+    if errors.As( err, &amqpErr ) {
+        return amqpErr.Condition
+    }
+
+    var detachErr *amqp.DetachError
+    if errors.As( err, &detachErr ) && detachErr.RemoteError != nil {
+        return detachErr.RemoteError.Condition
+    }
+
+    return ""
+}
+
+// The broker reports a lost session lock only through the amqp error condition
+func isSessionLockLost( err error )( bool ) {
+    return amqpCondition( err ) == sessionLockLostCondition
+}
+
+// Next session receivers give up an idle session after SessionIdleTimeout so they can move on to another one
+func ( azSvcBus *AzSvcBus )receiveCtx( )( ctx context.Context, cancel context.CancelFunc ) {
+    if azSvcBus.SessionMode != SessionModeNext {
+        return azSvcBus.receiverCtx, func( ) { }
+    }
+
+    return context.WithTimeout( azSvcBus.receiverCtx, azSvcBus.SessionIdleTimeout )
+}
+
+// Specific session receivers accept the session of the gateway with their own index, next session
+// receivers take whatever session the broker hands out
+func ( azSvcBus *AzSvcBus )acceptSession( idx int, opts *azservicebus.SessionReceiverOptions )( receiver *azservicebus.SessionReceiver, err error ) {
+    id, realIdx, err := azSvcBus.getReceiverIdFromIdx( idx )
+    if err != nil {
+        glog.Errorf( "Failed to get index, error = %v", err )
+        return nil, err
+    }
+
+    acceptStart := time.Now( )
+    switch {
+        case azSvcBus.SessionMode == SessionModeSpecific && azSvcBus.isQueue( ):
+            receiver, err = azSvcBus.clientFor( idx ).AcceptSessionForQueue( azSvcBus.receiverCtx, azSvcBus.QueueName, id, opts )
+
+        case azSvcBus.SessionMode == SessionModeSpecific:
+            receiver, err = azSvcBus.clientFor( idx ).AcceptSessionForSubscription( azSvcBus.receiverCtx, azSvcBus.TopicName, azSvcBus.subscriptionName( realIdx ), id, opts )
+
+        case azSvcBus.isQueue( ):
+            receiver, err = azSvcBus.clientFor( idx ).AcceptNextSessionForQueue( azSvcBus.receiverCtx, azSvcBus.QueueName, opts )
+
+        default:
+            receiver, err = azSvcBus.clientFor( idx ).AcceptNextSessionForSubscription( azSvcBus.receiverCtx, azSvcBus.TopicName, azSvcBus.subscriptionName( realIdx ), opts )
+    }
+    acceptLatency := time.Since( acceptStart )
+
+    if err != nil {
+        glog.Errorf( "%v: Failed to accept session, error = %v", id, err )
+        if azSvcBus.receiverCtx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSession )
+        }
+
+        return nil, err
+    }
+
+    azSvcBus.stats.UpdateSessionAcceptStat( realIdx, acceptLatency )
+
+    if azSvcBus.SessionState {
+        azSvcBus.loadSessionState( idx, receiver )
+    }
+
+    return receiver, nil
+}
+
+// Session state holds the last sequence number received, so ordering is checked across receivers
+func ( azSvcBus *AzSvcBus )loadSessionState( idx int, receiver *azservicebus.SessionReceiver ) {
+    id, realIdx, _ := azSvcBus.getReceiverIdFromIdx( idx )
+
+    state, err := receiver.GetSessionState( azSvcBus.receiverCtx, nil )
+    if err != nil {
+        glog.Errorf( "%v: Failed to get state of session %v, error = %v", id, receiver.SessionID( ), err )
+        if azSvcBus.receiverCtx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSession )
+        }
+
+        return
+    }
+
+    if len( state ) == 0 {
+        return
+    }
+
+    seq, err := strconv.ParseInt( string( state ), 10, 64 )
+    if err != nil {
+        glog.Errorf( "%v: Ignoring invalid state %q of session %v", id, state, receiver.SessionID( ) )
+        return
+    }
+
+    if seq > azSvcBus.rcvdSeqs[ idx ][ receiver.SessionID( ) ] {
+        azSvcBus.rcvdSeqs[ idx ][ receiver.SessionID( ) ] = seq
+    }
+}
+
+func ( azSvcBus *AzSvcBus )storeSessionState( idx int ) {
+    receiver, ok := azSvcBus.receivers[ idx ].( *azservicebus.SessionReceiver )
+    if !ok || !azSvcBus.SessionState {
+        return
+    }
+
+    seq, exists := azSvcBus.rcvdSeqs[ idx ][ receiver.SessionID( ) ]
+    if !exists {
+        return
+    }
+
+    err := receiver.SetSessionState( azSvcBus.receiverCtx, [ ]byte( strconv.FormatInt( seq, 10 ) ), nil )
+    if err != nil {
+        id, realIdx, _ := azSvcBus.getReceiverIdFromIdx( idx )
+        glog.Errorf( "%v: Failed to set state of session %v, error = %v", id, receiver.SessionID( ), err )
+        if azSvcBus.receiverCtx.Err( ) == nil {
+            azSvcBus.stats.UpdateErrorStat( realIdx, stats.ErrorClassSession )
+        }
+    }
+}
+
+// Messages within a session arrive in the order they were sent, anything older than the newest
+// sequence number seen so far in the same session is out of order
+func ( azSvcBus *AzSvcBus )checkSessionOrder( idx, realIdx int, message *azservicebus.ReceivedMessage ) {
+    if nil == message.SessionID {
+        return
+    }
+
+    seqVal, exists := message.ApplicationProperties[ seqPropName ]
+    if !exists {
+        return
+    }
+
+    seq, ok := seqVal.( int64 )
+    if !ok {
+        return
+    }
+
+    last, seen := azSvcBus.rcvdSeqs[ idx ][ *message.SessionID ]
+    if seen && seq <= last {
+        azSvcBus.stats.UpdateOutOfOrderStat( realIdx, 1 )
+        return
+    }
+
+    azSvcBus.rcvdSeqs[ idx ][ *message.SessionID ] = seq
+}
+
+// Accepts sessions one after the other until the receiver context is done or receiving fails for
+// another reason than an idle session or a lost session lock
+func ( azSvcBus *AzSvcBus )startSessionReceiver( idx int, cb azSvcMsgCb ) {
+    azSvcBus.rcvdSeqs[ idx ] = make( map[ string ]int64 )
+
+    for azSvcBus.receiverCtx.Err( ) == nil {
+        err := azSvcBus.newReceiver( idx )
+        if err != nil {
+            return
+        }
+
+        for {
+            azSvcBus.throttleReceiver( )
+
+            err = azSvcBus.receiveMessages( idx, cb )
+            if err != nil || azSvcBus.receiverCtx.Err( ) != nil {
+                break
+            }
+
+            azSvcBus.storeSessionState( idx )
+            time.Sleep( azSvcBus.ReceiveInterval )
+        }
+
+        azSvcBus.closeReceiver( idx )
+
+        if err != errSessionIdle && err != errSessionLost {
+            return
+        }
+    }
+}
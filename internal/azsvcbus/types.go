@@ -6,53 +6,147 @@ import (
     "context"
 
     "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+    sbadmin "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+    "github.com/azsvcbusbench/internal/azadmin"
+    "github.com/azsvcbusbench/internal/azauth"
+    "github.com/azsvcbusbench/internal/dashboard"
     "github.com/azsvcbusbench/internal/helpers"
+    "github.com/azsvcbusbench/internal/phase"
     "github.com/azsvcbusbench/internal/stats"
 )
 
 type azSvcBusCtx struct {
-    client             *azservicebus.Client
+    clients         [ ]*azservicebus.Client
+    credential         *azauth.Credential
+    admin              *sbadmin.Client
+    rules              *azadmin.Client
+    provisioned         bool
     senders         [ ]*azservicebus.Sender
-    receivers       [ ]*azservicebus.Receiver
+    receivers       [ ]messageReceiver
+    workQueues      [ ]chan prefetched
+    receiveMode         azservicebus.ReceiveMode
 
     senderCtx           context.Context
     receiverCtx         context.Context
+    receiveStart        time.Time
 
     stats              *stats.Stats
     statsCtx            context.Context
+    result             *stats.Result
+    dashboard          *dashboard.Dashboard
+
+    // Last sequence number sent by each sender and received per session by each receiver
+    sendSeqs        [ ]int64
+    rcvdSeqs        [ ]map[ string ]int64
+
+    // Resends waiting for their delay per sender and the MessageIDs delivered per receiving entity
+    pendingDups     [ ][ ]pendingDup
+    dupSeen            *entityIdSets
+
+    // MessageIDs counted per receiving entity and not settled yet, so that redeliveries are not counted twice
+    counted            *entityIdSets
+
+    // Messages deferred by each receiver and waiting to be fetched back
+    deferLock           sync.Mutex
+    pendingDefers   [ ][ ]pendingDefer
+
+    scheduleDelay      *helpers.Distribution
+    processTime        *helpers.Distribution
 
     msgGen             *helpers.MsgGen
     idGen              *helpers.IdGen
 
     wg                 *sync.WaitGroup
 
-    trackTest           bool
+    phases             *phase.Tracker
 }
 
 type AzSvcBus struct {
     TestId              string
     ConnStr             string
+    Namespace           string
+    Credential          azauth.Options
     TopicName           string
+    QueueName           string
     SubName             string
     PropName            string
+    SubPerGateway       bool
+    SubFilter           string
+    ClientTopology      string
+    ClientPoolSize      int
 
     IpsFile             string
     IdsFile             string
 
+    StatsText           bool
+    Dashboard           bool
+    DashboardTopN       int
+    StatsCsvFile        string
+    ResultFile          string
+    ReportFile          string
+
+    ClockSyncListen     string
+    ClockSyncUrl        string
+    ClockSyncSamples    int
+
     TotGateways         int
     MsgsPerReceive      int
     MsgsPerSend         int
+    MsgsPerBatch        int
+
+    ReceiveMode         string
+    AbandonPct          float64
+    DeadLetterPct       float64
+    DeadLetterCheck     bool
+    DeferPct            float64
+    DeferDelay          time.Duration
+
+    ProcessTime         string
+    Workers             int
+    LockRenewal         bool
+
+    ContinuousReceive   bool
+    Prefetch            int
+    ReceiveCalls        int
+    MaxWaitTime         time.Duration
+
+    SessionMode         string
+    SessionState        bool
+    SessionIdleTimeout  time.Duration
+
+    ScheduleDelay       string
+    CancelPct           float64
+
+    MessageTtl          time.Duration
+    DeadLetterOnExpiry  bool
+    ReceivePauseAt      time.Duration
+    ReceivePauseFor     time.Duration
+    ReceiveSlowdown     time.Duration
+
+    DupPct              float64
+    DupDelay            time.Duration
+
+    Provision           bool
+    KeepOnFailure       bool
+    EnablePartitioning  bool
+    LockDuration        time.Duration
+    DefaultTtl          time.Duration
+    DupDetectionWindow  time.Duration
+    MaxDeliveryCount    int
 
     SenderOnly          bool
     ReceiverOnly        bool
 
     WarmupDuration      time.Duration
     Duration            time.Duration
+    CooldownDuration    time.Duration
     SendInterval        time.Duration
     ReceiveInterval     time.Duration
     StatDumpInterval    time.Duration
 
     Index               int
+    SenderJobs          string
+    ReceiverJobs        string
 
     azSvcBusCtx
 }
@@ -0,0 +1,174 @@
+package clocksync
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "time"
+
+    "github.com/golang/glog"
+    "github.com/azsvcbusbench/internal/helpers"
+)
+
+const (
+    timePath        = "/time"
+    DefaultSamples  = 16
+)
+
+type timeResponse struct {
+    Received        int64       `json:"rcvd"`
+    Sent            int64       `json:"sent"`
+}
+
+// Offset is the coordinator clock minus the local clock, the true offset lies within
+// Offset +/- Uncertainty
+type Estimate struct {
+    Offset          time.Duration
+    Uncertainty     time.Duration
+    RoundTrip       time.Duration
+    Samples         int
+}
+
+func handleTime( w http.ResponseWriter, r *http.Request ) {
+    resp := timeResponse {
+        Received    :   time.Now( ).UnixNano( ),
+    }
+
+    w.Header( ).Set( "Content-Type", "application/json" )
+
+    resp.Sent = time.Now( ).UnixNano( )
+    json.NewEncoder( w ).Encode( &resp )
+}
+
+func NewHandler( )( http.Handler ) {
+    mux := http.NewServeMux( )
+    mux.HandleFunc( timePath, handleTime )
+    return mux
+}
+
+// Serves the coordinator clock on addr until ctx is done
+func Serve( ctx context.Context, addr string )( err error ) {
+    listener, err := net.Listen( "tcp", addr )
+    if err != nil {
+        return err
+    }
+
+    server := &http.Server {
+        Handler     :   NewHandler( ),
+    }
+
+    go func( ) {
+        <-ctx.Done( )
+        server.Close( )
+    }( )
+
+    go func( ) {
+        err := server.Serve( listener )
+        if err != nil && err != http.ErrServerClosed {
+            glog.Errorf( "clock sync server on %v failed: %v", addr, err )
+        }
+    }( )
+
+    return nil
+}
+
+func exchange( ctx context.Context, client *http.Client, url string )( offset, roundTrip time.Duration, err error ) {
+    req, err := http.NewRequestWithContext( ctx, http.MethodGet, url + timePath, nil )
+    if err != nil {
+        return 0, 0, err
+    }
+
+    t0 := time.Now( ).UnixNano( )
+
+    resp, err := client.Do( req )
+    if err != nil {
+        return 0, 0, err
+    }
+
+    defer func( ) {
+        resp.Body.Close( )
+    }( )
+
+    var tr timeResponse
+    err = json.NewDecoder( resp.Body ).Decode( &tr )
+
+    t3 := time.Now( ).UnixNano( )
+
+    if err != nil {
+        return 0, 0, err
+    }
+
+    if resp.StatusCode != http.StatusOK {
+        return 0, 0, fmt.Errorf( "unexpected status %v from %v", resp.StatusCode, url )
+    }
+
+    // Same math as NTP, the server processing time is excluded from the round trip
+    offset    = time.Duration( ( ( tr.Received - t0 ) + ( tr.Sent - t3 ) ) / 2 )
+    roundTrip = time.Duration( ( t3 - t0 ) - ( tr.Sent - tr.Received ) )
+
+    return offset, roundTrip, nil
+}
+
+// Runs samples exchanges against the coordinator at url and keeps the one with the shortest round trip
+func EstimateOffset( ctx context.Context, url string, samples int )( est *Estimate, err error ) {
+    if samples <= 0 {
+        samples = DefaultSamples
+    }
+
+    client := &http.Client {
+        Timeout     :   5 * time.Second,
+    }
+
+    succeeded := 0
+    for i := 0; i < samples; i++ {
+        offset, roundTrip, err := exchange( ctx, client, url )
+        if err != nil {
+            glog.Errorf( "clock sync exchange with %v failed: %v", url, err )
+            continue
+        }
+
+        succeeded++
+
+        if nil == est || roundTrip < est.RoundTrip {
+            est = &Estimate {
+                Offset      :   offset,
+                RoundTrip   :   roundTrip,
+                Uncertainty :   roundTrip / 2,
+            }
+        }
+    }
+
+    if nil == est {
+        return nil, fmt.Errorf( "no successful clock sync exchange with %v", url )
+    }
+
+    est.Samples = succeeded
+    return est, nil
+}
+
+// Serves the coordinator clock when listen is set and corrects the local clock against
+// the coordinator at url when that is set. The estimate is nil if there is nothing to correct.
+func Setup( ctx context.Context, listen, url string, samples int )( est *Estimate, err error ) {
+    if len( listen ) > 0 {
+        err = Serve( ctx, listen )
+        if err != nil {
+            return nil, fmt.Errorf( "failed to serve clock on %v: error %v", listen, err )
+        }
+    }
+
+    if len( url ) == 0 {
+        return nil, nil
+    }
+
+    est, err = EstimateOffset( ctx, url, samples )
+    if err != nil {
+        return nil, err
+    }
+
+    helpers.SetClockOffset( est.Offset, est.Uncertainty )
+
+    glog.Infof( "Clock offset to %v is %v +/- %v over %v samples", url, est.Offset, est.Uncertainty, est.Samples )
+    return est, nil
+}
@@ -0,0 +1,43 @@
+package clocksync
+
+import (
+    "context"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestEstimateOffset( t *testing.T ) {
+    server := httptest.NewServer( NewHandler( ) )
+    defer server.Close( )
+
+    est, err := EstimateOffset( context.Background( ), server.URL, 8 )
+    if err != nil {
+        t.Fatalf( "EstimateOffset - failed with error %v", err )
+    }
+
+    if est.Samples != 8 {
+        t.Fatalf( "EstimateOffset - used %v samples instead of 8", est.Samples )
+    }
+
+    // Same host so the offset has to be within the round trip
+    if est.Offset > est.RoundTrip + time.Millisecond || est.Offset < -est.RoundTrip - time.Millisecond {
+        t.Fatalf( "EstimateOffset - offset %v larger than round trip %v on the same host", est.Offset, est.RoundTrip )
+    }
+
+    if est.Uncertainty != est.RoundTrip / 2 {
+        t.Fatalf( "EstimateOffset - uncertainty %v is not half the round trip %v", est.Uncertainty, est.RoundTrip )
+    }
+
+    _, err = EstimateOffset( context.Background( ), "http://127.0.0.1:1", 2 )
+    if err == nil {
+        t.Fatalf( "EstimateOffset - succeeded without a coordinator" )
+    }
+}
+
+func TestSetup( t *testing.T ) {
+    est, err := Setup( context.Background( ), "", "", 0 )
+    if err != nil || est != nil {
+        t.Fatalf( "Setup - returned %v, %v with nothing to do", est, err )
+    }
+}
@@ -0,0 +1,295 @@
+package dashboard
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+const (
+    RefreshInterval = time.Second
+    DefaultTopN     = 5
+    historyLen      = 60
+    bytesPerMB      = 1 << 20
+
+    ansiHome        = "\x1b[H"
+    ansiClear       = "\x1b[2J"
+    ansiClearLine   = "\x1b[K"
+    ansiClearDown   = "\x1b[J"
+    ansiHideCursor  = "\x1b[?25l"
+    ansiShowCursor  = "\x1b[?25h"
+    ansiBold        = "\x1b[1m"
+    ansiReset       = "\x1b[0m"
+)
+
+var sparkRunes = [ ]rune( "▁▂▃▄▅▆▇█" )
+
+type Source interface {
+    GetResult( final bool )( *stats.Result )
+}
+
+type Dashboard struct {
+    w               io.Writer
+    source          Source
+    topN            int
+
+    prev           *stats.Result
+    sendRates    [ ]float64
+    rcvdRates    [ ]float64
+    sendMBps     [ ]float64
+    rcvdMBps     [ ]float64
+}
+
+// Only a character device gets the full screen view, anything else gets plain output
+func IsTerminal( f *os.File )( bool ) {
+    fi, err := f.Stat( )
+    if err != nil {
+        return false
+    }
+
+    return fi.Mode( ) & os.ModeCharDevice != 0
+}
+
+func New( w io.Writer, source Source, topN int )( *Dashboard ) {
+    if topN <= 0 {
+        topN = DefaultTopN
+    }
+
+    return &Dashboard {
+        w       :   w,
+        source  :   source,
+        topN    :   topN,
+    }
+}
+
+// Redraws the dashboard every RefreshInterval until ctx is done
+func ( dash *Dashboard )Run( ctx context.Context ) {
+    ticker := time.NewTicker( RefreshInterval )
+    defer ticker.Stop( )
+
+    fmt.Fprint( dash.w, ansiHideCursor + ansiClear )
+    defer fmt.Fprint( dash.w, ansiShowCursor )
+
+    for {
+        select {
+            case <-ctx.Done( ):
+                return
+
+            case <-ticker.C:
+                dash.Update( dash.source.GetResult( false ) )
+                fmt.Fprint( dash.w, ansiHome + dash.Render( ) )
+        }
+    }
+}
+
+func appendHistory( history [ ]float64, v float64 )( [ ]float64 ) {
+    history = append( history, v )
+    if len( history ) > historyLen {
+        history = history[ len( history ) - historyLen : ]
+    }
+
+    return history
+}
+
+func ( dash *Dashboard )Update( result *stats.Result ) {
+    if dash.prev != nil {
+        dt := float64( result.EndTime - dash.prev.EndTime ) / 1000
+        if dt > 0 {
+            dash.sendRates = appendHistory( dash.sendRates, float64( result.Sent - dash.prev.Sent ) / dt )
+            dash.rcvdRates = appendHistory( dash.rcvdRates, float64( result.Rcvd - dash.prev.Rcvd ) / dt )
+            dash.sendMBps  = appendHistory( dash.sendMBps, float64( result.SentBytes - dash.prev.SentBytes ) / dt / bytesPerMB )
+            dash.rcvdMBps  = appendHistory( dash.rcvdMBps, float64( result.RcvdBytes - dash.prev.RcvdBytes ) / dt / bytesPerMB )
+        }
+    }
+
+    dash.prev = result
+}
+
+func sparkline( history [ ]float64 )( string ) {
+    max := 0.0
+    for _, v := range history {
+        if v > max {
+            max = v
+        }
+    }
+
+    var sb strings.Builder
+    for _, v := range history {
+        idx := 0
+        if max > 0 {
+            idx = int( v / max * float64( len( sparkRunes ) - 1 ) + 0.5 )
+        }
+
+        sb.WriteRune( sparkRunes[ idx ] )
+    }
+
+    return sb.String( )
+}
+
+func lastRate( history [ ]float64 )( float64 ) {
+    if len( history ) == 0 {
+        return 0
+    }
+
+    return history[ len( history ) - 1 ]
+}
+
+func ( dash *Dashboard )line( sb *strings.Builder, format string, args ...interface{ } ) {
+    fmt.Fprintf( sb, format, args... )
+    sb.WriteString( ansiClearLine + "\n" )
+}
+
+func ( dash *Dashboard )Render( )( string ) {
+    var sb strings.Builder
+
+    result := dash.prev
+    if nil == result {
+        dash.line( &sb, "Waiting for statistics" )
+        return sb.String( )
+    }
+
+    elapsed := time.Duration( result.EndTime - result.StartTime ) * time.Millisecond
+
+    dash.line( &sb, "%s%v%s  stage %v  elapsed %v  gateways %v", ansiBold, result.Name, ansiReset, result.Stage, elapsed.Round( time.Second ), len( result.Gateways ) )
+    dash.line( &sb, "" )
+    dash.line( &sb, "Send    %10.1f msgs/s %8.2f MB/s  %v", lastRate( dash.sendRates ), lastRate( dash.sendMBps ), sparkline( dash.sendRates ) )
+    dash.line( &sb, "Receive %10.1f msgs/s %8.2f MB/s  %v", lastRate( dash.rcvdRates ), lastRate( dash.rcvdMBps ), sparkline( dash.rcvdRates ) )
+    dash.line( &sb, "Totals  sent %v received %v late %v errors %v", result.Sent, result.Rcvd, result.Late, result.Errors )
+    if result.Topology != nil {
+        dash.line( &sb, "Delivery %v of %v expected, ratio %.4f", result.Delivery.Delivered, result.Delivery.Expected, result.Delivery.Ratio( ) )
+    }
+
+    if balance := &result.Balance; balance.Receivers > 1 {
+        dash.line( &sb, "Balance %v receivers, min %v max %v cv %.4f jain %.4f", balance.Receivers, balance.Min, balance.Max, balance.Cv, balance.Jain )
+    }
+
+    dash.line( &sb, "" )
+
+    lat := result.Latency
+    dash.line( &sb, "Latency ms       p50 %-6v p90 %-6v p95 %-6v p99 %-6v p99.9 %-6v max %v", lat.P50, lat.P90, lat.P95, lat.P99, lat.P999, lat.Max )
+
+    lat = result.SendLatency
+    dash.line( &sb, "Send call us     p50 %-6v p90 %-6v p95 %-6v p99 %-6v p99.9 %-6v max %v", lat.P50, lat.P90, lat.P95, lat.P99, lat.P999, lat.Max )
+
+    if len( result.Settled ) > 0 {
+        lat = result.SettleLatency
+        dash.line( &sb, "Settle call us   p50 %-6v p90 %-6v p95 %-6v p99 %-6v p99.9 %-6v max %v", lat.P50, lat.P90, lat.P95, lat.P99, lat.P999, lat.Max )
+        dash.line( &sb, "Settled          complete %v abandon %v deadletter %v defer %v redelivered %v",
+            result.Settled[ stats.SettleComplete ], result.Settled[ stats.SettleAbandon ], result.Settled[ stats.SettleDeadLetter ],
+            result.Settled[ stats.SettleDefer ], result.Redelivered )
+    }
+
+    if result.Connections > 0 {
+        dash.line( &sb, "Connections      %v %v connect p50 %vms max %vms", result.Connections, result.ClientTopology, result.ConnectTime.P50, result.ConnectTime.Max )
+    }
+
+    if len( result.Credential ) > 0 {
+        dash.line( &sb, "Tokens           %v acquired %v refreshed %v failed (%v)", result.TokensAcquired, result.TokenRefreshes, result.TokenFailures, result.Credential )
+    }
+
+    if len( result.SelfSkipMode ) > 0 || result.SelfSkipped > 0 {
+        dash.line( &sb, "Self skipped     %v filter %q %v at %.0f msgs/s", result.SelfSkipped, result.SubFilter, result.SelfSkipMode, result.SelfSkipRcvdRate )
+    }
+
+    if result.MessageTtl > 0 {
+        dash.line( &sb, "Expiry           ttl %vms undelivered %v after expiry %v dead lettered %v", result.MessageTtl, result.Undelivered, result.ExpiredRcvd, result.DlqExpired )
+    }
+
+    if result.ReceiveCalls > 0 {
+        dash.line( &sb, "Receive calls    %v empty %v batch p50 %v p99 %v prefetch wait p99 %vus",
+            result.ReceiveCalls, result.EmptyReceives, result.ReceiveBatch.P50, result.ReceiveBatch.P99, result.PrefetchWait.P99 )
+    }
+
+    if result.ProcessLatency.Count > 0 || result.MsgLocksLost > 0 {
+        lat = result.ProcessLatency
+        dash.line( &sb, "Processing ms    p50 %-6v p90 %-6v p95 %-6v p99 %-6v p99.9 %-6v max %v", lat.P50, lat.P90, lat.P95, lat.P99, lat.P999, lat.Max )
+        dash.line( &sb, "Message locks    renewed %v lost %v", result.LockRenewals, result.MsgLocksLost )
+    }
+
+    if result.DupSent > 0 || result.DupRcvd > 0 {
+        dash.line( &sb, "Duplicates       delay %vms window %vms resent %v got through %v", result.DupDelay, result.DupWindow, result.DupSent, result.DupRcvd )
+    }
+
+    if result.DeferRcvd > 0 || result.DeferLost > 0 {
+        dash.line( &sb, "Deferred         retrieved %v lost %v round trip p99 %vms", result.DeferRcvd, result.DeferLost, result.DeferLatency.P99 )
+    }
+
+    if result.DlqRcvd > 0 {
+        dash.line( &sb, "Dead letters     read back %v invalid %v round trip p99 %vms", result.DlqRcvd, result.DlqInvalid, result.DlqLatency.P99 )
+    }
+
+    if result.SessionAccept.Count > 0 {
+        lat = result.SessionAccept
+        dash.line( &sb, "Accept call us   p50 %-6v p90 %-6v p95 %-6v p99 %-6v p99.9 %-6v max %v", lat.P50, lat.P90, lat.P95, lat.P99, lat.P999, lat.Max )
+        dash.line( &sb, "Sessions         accepted %v locks lost %v out of order %v", lat.Count, result.SessionLocksLost, result.OutOfOrder )
+    }
+
+    if result.ScheduleEarly.Count > 0 || result.ScheduleLate.Count > 0 || result.Cancelled > 0 {
+        lat = result.ScheduleLate
+        dash.line( &sb, "Sched late ms    p50 %-6v p90 %-6v p95 %-6v p99 %-6v p99.9 %-6v max %v", lat.P50, lat.P90, lat.P95, lat.P99, lat.P999, lat.Max )
+        dash.line( &sb, "Scheduled        early %v max early %vms cancelled %v cancelled arrived %v", result.ScheduleEarly.Count, result.ScheduleEarly.Max, result.Cancelled, result.CancelledRcvd )
+    }
+
+    lat = result.MsgSize
+    dash.line( &sb, "Msg size bytes   p50 %-6v p90 %-6v p95 %-6v p99 %-6v p99.9 %-6v max %v", lat.P50, lat.P90, lat.P95, lat.P99, lat.P999, lat.Max )
+    dash.line( &sb, "" )
+
+    classes := make( [ ]string, 0, len( result.ErrorsByClass ) )
+    for class := range result.ErrorsByClass {
+        classes = append( classes, fmt.Sprintf( "%v %v", class, result.ErrorsByClass[ class ] ) )
+    }
+
+    sort.Strings( classes )
+    if len( classes ) == 0 {
+        classes = append( classes, "none" )
+    }
+
+    dash.line( &sb, "Errors  %v", strings.Join( classes, "  " ) )
+    dash.line( &sb, "" )
+
+    rt := &result.Runtime
+    if n := len( rt.Samples ); n > 0 {
+        last := rt.Samples[ n - 1 ]
+        dash.line( &sb, "Harness cpu %.0f%% of %v cores  rss %vMB  goroutines %v  gc p99 %vus  sched p99 %vus",
+            last.CpuPct, rt.MaxProcs, last.RssBytes >> 20, last.Goroutines, rt.GcPause.P99, rt.SchedLatency.P99 )
+    }
+
+    for _, warning := range rt.Warnings {
+        dash.line( &sb, "%sWarning%s %v", ansiBold, ansiReset, warning )
+    }
+
+    dash.line( &sb, "" )
+
+    gateways := make( [ ]stats.GatewayResult, len( result.Gateways ) )
+    copy( gateways, result.Gateways )
+
+    sort.SliceStable( gateways, func( i, j int )( bool ) {
+        return gateways[ i ].Latency.P99 > gateways[ j ].Latency.P99
+    } )
+
+    dash.line( &sb, "%sTop %v slowest gateways%s", ansiBold, dash.topN, ansiReset )
+    for i := 0; i < dash.topN && i < len( gateways ) && gateways[ i ].Latency.Count > 0; i++ {
+        dash.line( &sb, "  %-40v p99 %-6v max %-6v rcvd %v", gateways[ i ].Id, gateways[ i ].Latency.P99, gateways[ i ].Latency.Max, gateways[ i ].Rcvd )
+    }
+
+    sort.SliceStable( gateways, func( i, j int )( bool ) {
+        return gateways[ i ].Errors > gateways[ j ].Errors
+    } )
+
+    dash.line( &sb, "" )
+    dash.line( &sb, "%sTop %v failing gateways%s", ansiBold, dash.topN, ansiReset )
+    for i := 0; i < dash.topN && i < len( gateways ) && gateways[ i ].Errors > 0; i++ {
+        dash.line( &sb, "  %-40v errors %-6v sent %-8v rcvd %v", gateways[ i ].Id, gateways[ i ].Errors, gateways[ i ].Sent, gateways[ i ].Rcvd )
+    }
+
+    // Wipe whatever a previous, longer frame left behind
+    sb.WriteString( ansiClearDown )
+
+    return sb.String( )
+}
@@ -0,0 +1,70 @@
+package dashboard
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+func TestRender( t *testing.T ) {
+    dash := New( nil, nil, 1 )
+
+    if !strings.Contains( dash.Render( ), "Waiting" ) {
+        t.Errorf( "Render - expected waiting message before the first update" )
+    }
+
+    dash.Update( &stats.Result {
+        Name        :   "bench",
+        StartTime   :   0,
+        EndTime     :   1000,
+        Sent        :   100,
+        Rcvd        :   90,
+    } )
+    dash.Update( &stats.Result {
+        Name            :   "bench",
+        Stage           :   stats.StageMeasure,
+        StartTime       :   0,
+        EndTime         :   2000,
+        Sent            :   300,
+        Rcvd            :   290,
+        Errors          :   3,
+        ErrorsByClass   :   map[ string ]uint64{ stats.ErrorClassSend : 3 },
+        Gateways        :   [ ]stats.GatewayResult {
+            { Id : "fast", Rcvd : 10, Latency : stats.HistogramSnapshot{ Count : 10, P99 : 5 } },
+            { Id : "slow", Rcvd : 10, Errors : 3, Latency : stats.HistogramSnapshot{ Count : 10, P99 : 50 } },
+        },
+    } )
+
+    if rate := lastRate( dash.sendRates ); rate != 200 {
+        t.Errorf( "Update - expected send rate 200, got %v", rate )
+    }
+
+    out := dash.Render( )
+
+    for _, want := range [ ]string{ "bench", stats.StageMeasure, "send 3", "slow" } {
+        if !strings.Contains( out, want ) {
+            t.Errorf( "Render - expected %q in output:\n%v", want, out )
+        }
+    }
+
+    // Only the top gateway of each list is shown
+    if strings.Contains( out, "fast" ) {
+        t.Errorf( "Render - expected fast gateway to be cut by top n:\n%v", out )
+    }
+}
+
+func TestIsTerminal( t *testing.T ) {
+    fh, err := os.Create( filepath.Join( t.TempDir( ), "out" ) )
+    if err != nil {
+        t.Fatalf( "os.Create - failed with error %v", err )
+    }
+
+    defer fh.Close( )
+
+    if IsTerminal( fh ) {
+        t.Errorf( "IsTerminal - regular file reported as a terminal" )
+    }
+}
@@ -0,0 +1,118 @@
+package helpers
+
+import (
+    "fmt"
+    "math/rand"
+    "strings"
+    "time"
+)
+
+const (
+    DistributionFixed       = "fixed"
+    DistributionUniform     = "uniform"
+    DistributionNormal      = "normal"
+    DistributionExponential = "exp"
+)
+
+// Random durations, A is the value, lower bound or mean and B the upper bound or standard deviation
+type Distribution struct {
+    Kind            string
+    A               time.Duration
+    B               time.Duration
+}
+
+// Parses "30s" or "fixed:30s", "uniform:10s,60s", "normal:30s,5s" and "exp:30s"
+func ParseDistribution( spec string )( dist *Distribution, err error ) {
+    kind, args := DistributionFixed, strings.TrimSpace( spec )
+    if colon := strings.Index( args, ":" ); colon >= 0 {
+        kind, args = strings.ToLower( strings.TrimSpace( args[ :colon ] ) ), args[ colon + 1: ]
+    }
+
+    var values [ ]time.Duration
+    for _, arg := range strings.Split( args, "," ) {
+        value, err := time.ParseDuration( strings.TrimSpace( arg ) )
+        if err != nil || value < 0 {
+            return nil, fmt.Errorf( "invalid duration %v in %v", arg, spec )
+        }
+
+        values = append( values, value )
+    }
+
+    expected := 1
+    if kind == DistributionUniform || kind == DistributionNormal {
+        expected = 2
+    }
+
+    switch kind {
+        case DistributionFixed, DistributionUniform, DistributionNormal, DistributionExponential:
+
+        default:
+            return nil, fmt.Errorf( "unknown distribution %v in %v", kind, spec )
+    }
+
+    if len( values ) != expected {
+        return nil, fmt.Errorf( "%v distribution needs %v durations, got %v", kind, expected, spec )
+    }
+
+    dist = &Distribution {
+        Kind    :   kind,
+        A       :   values[ 0 ],
+    }
+
+    if expected > 1 {
+        dist.B = values[ 1 ]
+    }
+
+    if kind == DistributionUniform && dist.B < dist.A {
+        return nil, fmt.Errorf( "uniform distribution upper bound below lower bound in %v", spec )
+    }
+
+    return dist, nil
+}
+
+// Never negative, normal samples below zero are cut off at zero
+func ( dist *Distribution )Sample( )( d time.Duration ) {
+    switch dist.Kind {
+        case DistributionUniform:
+            d = dist.A + time.Duration( rand.Int63n( int64( dist.B - dist.A ) + 1 ) )
+
+        case DistributionNormal:
+            d = dist.A + time.Duration( rand.NormFloat64( ) * float64( dist.B ) )
+
+        case DistributionExponential:
+            d = time.Duration( rand.ExpFloat64( ) * float64( dist.A ) )
+
+        default:
+            d = dist.A
+    }
+
+    if d < 0 {
+        d = 0
+    }
+
+    return d
+}
+
+// Largest value worth waiting for, used to size the cooldown
+func ( dist *Distribution )Max( )( time.Duration ) {
+    switch dist.Kind {
+        case DistributionUniform:
+            return dist.B
+
+        case DistributionNormal:
+            return dist.A + 3 * dist.B
+
+        case DistributionExponential:
+            return 5 * dist.A
+    }
+
+    return dist.A
+}
+
+func ( dist *Distribution )String( )( string ) {
+    if dist.Kind == DistributionUniform || dist.Kind == DistributionNormal {
+        return fmt.Sprintf( "%v:%v,%v", dist.Kind, dist.A, dist.B )
+    }
+
+    return fmt.Sprintf( "%v:%v", dist.Kind, dist.A )
+}
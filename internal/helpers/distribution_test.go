@@ -0,0 +1,49 @@
+package helpers
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseDistribution( t *testing.T ) {
+    tests := map[ string ]Distribution {
+        "30s"               :   { Kind : DistributionFixed, A : 30 * time.Second },
+        "Uniform:10s, 1m"   :   { Kind : DistributionUniform, A : 10 * time.Second, B : time.Minute },
+        "normal:30s,5s"     :   { Kind : DistributionNormal, A : 30 * time.Second, B : 5 * time.Second },
+        "exp:2s"            :   { Kind : DistributionExponential, A : 2 * time.Second },
+    }
+
+    for spec, expected := range tests {
+        dist, err := ParseDistribution( spec )
+        if err != nil || *dist != expected {
+            t.Errorf( "ParseDistribution - %q expected %+v, got %+v error %v", spec, expected, dist, err )
+        }
+    }
+
+    for _, spec := range [ ]string{ "", "x", "uniform:1m,10s", "normal:30s", "pareto:1s", "-1s", "fixed:1s,2s" } {
+        if _, err := ParseDistribution( spec ); err == nil {
+            t.Errorf( "ParseDistribution - expected error for %q", spec )
+        }
+    }
+}
+
+func TestDistributionSample( t *testing.T ) {
+    dist := &Distribution{ Kind : DistributionUniform, A : time.Second, B : 2 * time.Second }
+    for i := 0; i < 1000; i++ {
+        if d := dist.Sample( ); d < dist.A || d > dist.B {
+            t.Errorf( "Sample - %v outside of %v", d, dist )
+        }
+    }
+
+    dist = &Distribution{ Kind : DistributionNormal, A : 0, B : time.Second }
+    for i := 0; i < 1000; i++ {
+        if d := dist.Sample( ); d < 0 {
+            t.Errorf( "Sample - negative %v from %v", d, dist )
+        }
+    }
+
+    dist = &Distribution{ Kind : DistributionFixed, A : time.Second }
+    if d := dist.Sample( ); d != time.Second {
+        t.Errorf( "Sample - expected 1s, got %v", d )
+    }
+}
@@ -0,0 +1,45 @@
+package helpers
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Parses a list of indices such as "0-3,5,7" into a sorted list without duplicates
+func ParseIndexList( list string )( indices [ ]int, err error ) {
+    seen := make( map[ int ]bool )
+
+    for _, part := range strings.Split( list, "," ) {
+        part = strings.TrimSpace( part )
+        if len( part ) == 0 {
+            continue
+        }
+
+        first, last := part, part
+        if dash := strings.Index( part, "-" ); dash > 0 {
+            first, last = part[ :dash ], part[ dash + 1: ]
+        }
+
+        lo, err := strconv.Atoi( strings.TrimSpace( first ) )
+        if err != nil || lo < 0 {
+            return nil, fmt.Errorf( "invalid index %v in %v", first, list )
+        }
+
+        hi, err := strconv.Atoi( strings.TrimSpace( last ) )
+        if err != nil || hi < lo {
+            return nil, fmt.Errorf( "invalid index range %v in %v", part, list )
+        }
+
+        for i := lo; i <= hi; i++ {
+            if !seen[ i ] {
+                seen[ i ] = true
+                indices = append( indices, i )
+            }
+        }
+    }
+
+    sort.Ints( indices )
+    return indices, nil
+}
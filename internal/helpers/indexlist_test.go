@@ -0,0 +1,28 @@
+package helpers
+
+import (
+    "reflect"
+    "testing"
+)
+
+func TestParseIndexList( t *testing.T ) {
+    tests := map[ string ][ ]int {
+        ""              :   nil,
+        "3"             :   [ ]int{ 3 },
+        "0-3,5"         :   [ ]int{ 0, 1, 2, 3, 5 },
+        " 5, 1-2 ,2 "   :   [ ]int{ 1, 2, 5 },
+    }
+
+    for list, expected := range tests {
+        indices, err := ParseIndexList( list )
+        if err != nil || !reflect.DeepEqual( indices, expected ) {
+            t.Errorf( "ParseIndexList - %q expected %v, got %v error %v", list, expected, indices, err )
+        }
+    }
+
+    for _, list := range [ ]string{ "a", "3-1", "-1", "1-x" } {
+        if _, err := ParseIndexList( list ); err == nil {
+            t.Errorf( "ParseIndexList - expected error for %q", list )
+        }
+    }
+}
@@ -6,6 +6,7 @@ import (
     "io"
     "encoding/json"
     "math/rand"
+    "sync/atomic"
 )
 
 type MsgType int
@@ -49,10 +50,28 @@ type Msgs struct {
     List     [ ]Msg                         `json:"messages"`
     Count       int                         `json:"count"`
     TimeStamp   int64                       `json:"ts"`
+    ClockErr    int64                       `json:"clkerr,omitempty"`
+}
+
+// Offset to the shared reference clock and its uncertainty, both in milliseconds
+var (
+    clockOffset         int64
+    clockUncertainty    int64
+)
+
+// Shifts every time stamp handed out by GetCurTimeStamp onto the reference clock so that
+// time stamps from different hosts can be compared
+func SetClockOffset( offset, uncertainty time.Duration ) {
+    atomic.StoreInt64( &clockOffset, offset.Milliseconds( ) )
+    atomic.StoreInt64( &clockUncertainty, int64( ( uncertainty + time.Millisecond - 1 ) / time.Millisecond ) )
+}
+
+func GetClockUncertainty( )( int64 ) {
+    return atomic.LoadInt64( &clockUncertainty )
 }
 
 func GetCurTimeStamp( )( int64 ) {
-    return time.Now( ).UnixMilli( )
+    return time.Now( ).UnixMilli( ) + atomic.LoadInt64( &clockOffset )
 }
 
 func getRandomInt( n int )( r int ) {
@@ -135,6 +154,7 @@ func ( msgGen *MsgGen )getMsgNInternal( n int, attributes map[ string ]interface
         Count       :   n,
         List        :   make( [ ]Msg, n ),
         TimeStamp   :   GetCurTimeStamp( ),
+        ClockErr    :   GetClockUncertainty( ),
     }
 
     for i := 0; i < n; i++ {
@@ -240,6 +260,17 @@ func ( msgList *Msgs )GetLatency( )( latency int64 ) {
     return 0
 }
 
+// Unlike GetLatency this keeps negative values which show up when the clocks of
+// sender and receiver disagree by more than the delivery time
+func ( msgList *Msgs )GetRawLatency( )( latency int64 ) {
+    return GetCurTimeStamp( ) - msgList.TimeStamp
+}
+
+// Worst case error of the latency given the clock offset estimates on both ends
+func ( msgList *Msgs )GetLatencyBound( )( bound int64 ) {
+    return msgList.ClockErr + GetClockUncertainty( )
+}
+
 func jsonMsgTypeGenerator( msgList *Msgs )( msg [ ]byte, err error ) {
     if nil == msgList {
         return nil, fmt.Errorf( "message not set" )
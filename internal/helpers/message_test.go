@@ -4,6 +4,7 @@ import (
     "testing"
     "fmt"
     "strings"
+    "time"
 )
 
 const (
@@ -285,3 +286,35 @@ func TestGetMsg( t *testing.T ) {
         "key3"  :   3.14,
     } )
 }
+
+func TestClockOffset( t *testing.T ) {
+    defer SetClockOffset( 0, 0 )
+
+    before := GetCurTimeStamp( )
+    SetClockOffset( time.Hour, 1500 * time.Microsecond )
+
+    if GetCurTimeStamp( ) - before < time.Hour.Milliseconds( ) {
+        t.Fatalf( "SetClockOffset - time stamps not shifted by the offset" )
+    }
+
+    if GetClockUncertainty( ) != 2 {
+        t.Fatalf( "SetClockOffset - uncertainty %v not rounded up to 2ms", GetClockUncertainty( ) )
+    }
+
+    msgList := &Msgs {
+        TimeStamp   :   GetCurTimeStamp( ) + 1000,
+        ClockErr    :   3,
+    }
+
+    if msgList.GetLatency( ) != 0 {
+        t.Fatalf( "GetLatency - negative latency not clamped to 0" )
+    }
+
+    if msgList.GetRawLatency( ) >= 0 {
+        t.Fatalf( "GetRawLatency - negative latency hidden" )
+    }
+
+    if msgList.GetLatencyBound( ) != 5 {
+        t.Fatalf( "GetLatencyBound - bound %v instead of 5", msgList.GetLatencyBound( ) )
+    }
+}
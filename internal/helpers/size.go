@@ -0,0 +1,49 @@
+package helpers
+
+import (
+    "fmt"
+)
+
+// Approximate wire size of message properties, keys plus values with numbers counted at their
+// fixed encoded width. Brokers add framing on top so this is a lower bound of the real overhead.
+func PropertiesSize( props map[ string ]interface{ } )( size int ) {
+    for key, val := range props {
+        size += len( key )
+
+        switch v := val.( type ) {
+            case string:
+                size += len( v )
+
+            case [ ]byte:
+                size += len( v )
+
+            case bool, int8, uint8:
+                size += 1
+
+            case int16, uint16:
+                size += 2
+
+            case int32, uint32, float32:
+                size += 4
+
+            case int, int64, uint, uint64, float64:
+                size += 8
+
+            case nil:
+
+            default:
+                size += len( fmt.Sprint( v ) )
+        }
+    }
+
+    return size
+}
+
+// Size of a flat string map such as a redis hash, field names included
+func StringMapSize( fields map[ string ]string )( size int ) {
+    for key, val := range fields {
+        size += len( key ) + len( val )
+    }
+
+    return size
+}
@@ -0,0 +1,23 @@
+package helpers
+
+import (
+    "testing"
+)
+
+func TestPropertiesSize( t *testing.T ) {
+    props := map[ string ]interface{ } {
+        "id"    :   "abcd",
+        "idx"   :   int64( 3 ),
+        "ok"    :   true,
+        "raw"   :   [ ]byte{ 1, 2 },
+        "none"  :   nil,
+    }
+
+    if size := PropertiesSize( props ); size != 2 + 4 + 3 + 8 + 2 + 1 + 3 + 2 + 4 {
+        t.Errorf( "PropertiesSize - unexpected size %v", size )
+    }
+
+    if size := StringMapSize( map[ string ]string{ "body" : "12345", "ct" : "" } ); size != 11 {
+        t.Errorf( "StringMapSize - unexpected size %v", size )
+    }
+}
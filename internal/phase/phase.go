@@ -0,0 +1,144 @@
+package phase
+
+import (
+    "context"
+    "fmt"
+    "sync/atomic"
+    "time"
+)
+
+// A run goes through the phases in order. Only messages sent while measuring are counted,
+// cooldown leaves time for those still in flight to be delivered.
+type Phase int32
+
+const (
+    Warmup      Phase = iota
+    Measure
+    Cooldown
+    Done
+)
+
+var phaseNames = [ ]string {
+    Warmup      :   "warmup",
+    Measure     :   "measure",
+    Cooldown    :   "cooldown",
+    Done        :   "done",
+}
+
+func ( p Phase )String( )( string ) {
+    if p < 0 || int( p ) >= len( phaseNames ) {
+        return fmt.Sprintf( "phase(%d)", int32( p ) )
+    }
+
+    return phaseNames[ p ]
+}
+
+func Parse( name string )( p Phase, err error ) {
+    for i, phaseName := range phaseNames {
+        if phaseName == name {
+            return Phase( i ), nil
+        }
+    }
+
+    return Warmup, fmt.Errorf( "unknown phase %v", name )
+}
+
+type ChangeFn func( p Phase )
+
+// Tracks the phase of a run, Get is safe to call from any goroutine. Senders stop when the
+// measure phase ends and receivers when the cooldown phase ends.
+type Tracker struct {
+    cur             int32
+
+    warmup          time.Duration
+    measure         time.Duration
+    cooldown        time.Duration
+
+    senderCtx       context.Context
+    senderCancel    context.CancelFunc
+    receiverCtx     context.Context
+    receiverCancel  context.CancelFunc
+}
+
+func NewTracker( warmup, measure, cooldown time.Duration )( tracker *Tracker ) {
+    tracker = &Tracker {
+        warmup      :   warmup,
+        measure     :   measure,
+        cooldown    :   cooldown,
+    }
+
+    tracker.receiverCtx, tracker.receiverCancel = context.WithCancel( context.Background( ) )
+    tracker.senderCtx, tracker.senderCancel     = context.WithCancel( tracker.receiverCtx )
+
+    return tracker
+}
+
+func ( tracker *Tracker )Get( )( Phase ) {
+    return Phase( atomic.LoadInt32( &tracker.cur ) )
+}
+
+func ( tracker *Tracker )IsMeasuring( )( bool ) {
+    return tracker.Get( ) == Measure
+}
+
+// Done once the measure phase is over
+func ( tracker *Tracker )SenderCtx( )( context.Context ) {
+    return tracker.senderCtx
+}
+
+// Done once the cooldown phase is over
+func ( tracker *Tracker )ReceiverCtx( )( context.Context ) {
+    return tracker.receiverCtx
+}
+
+// Ends the run early, also releases the contexts if Run was never called
+func ( tracker *Tracker )Stop( ) {
+    tracker.receiverCancel( )
+    tracker.senderCancel( )
+}
+
+// The phase is switched before the contexts are canceled so that anything that observes
+// a canceled context also observes the new phase
+func ( tracker *Tracker )set( p Phase, onChange ChangeFn ) {
+    atomic.StoreInt32( &tracker.cur, int32( p ) )
+
+    switch p {
+        case Cooldown:
+            tracker.senderCancel( )
+
+        case Done:
+            tracker.receiverCancel( )
+            tracker.senderCancel( )
+    }
+
+    if onChange != nil {
+        onChange( p )
+    }
+}
+
+// Walks through the phases starting now, blocks until the run is done or Stop is called
+func ( tracker *Tracker )Run( onChange ChangeFn ) {
+    durations := [ ]time.Duration {
+        Warmup      :   tracker.warmup,
+        Measure     :   tracker.measure,
+        Cooldown    :   tracker.cooldown,
+    }
+
+    if onChange != nil {
+        onChange( Warmup )
+    }
+
+    for p := Warmup; p < Done; p++ {
+        timer := time.NewTimer( durations[ p ] )
+
+        select {
+            case <-timer.C:
+                tracker.set( p + 1, onChange )
+
+            case <-tracker.receiverCtx.Done( ):
+                timer.Stop( )
+                tracker.set( Done, onChange )
+                return
+        }
+    }
+}
@@ -0,0 +1,82 @@
+package phase
+
+import (
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestParse( t *testing.T ) {
+    for _, p := range [ ]Phase{ Warmup, Measure, Cooldown, Done } {
+        parsed, err := Parse( p.String( ) )
+        if err != nil || parsed != p {
+            t.Errorf( "Parse - expected %v, got %v error %v", p, parsed, err )
+        }
+    }
+
+    if _, err := Parse( "track" ); err == nil {
+        t.Errorf( "Parse - expected error for unknown phase" )
+    }
+}
+
+func TestTracker( t *testing.T ) {
+    tracker := NewTracker( 20 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond )
+
+    var lock sync.Mutex
+    var seen [ ]Phase
+
+    onChange := func( p Phase ) {
+        lock.Lock( )
+        seen = append( seen, p )
+        lock.Unlock( )
+
+        // Phase has to be visible by the time the contexts are canceled
+        if p == Cooldown && tracker.SenderCtx( ).Err( ) == nil {
+            t.Errorf( "Run - sender context still active in cooldown" )
+        }
+
+        if p == Cooldown && tracker.ReceiverCtx( ).Err( ) != nil {
+            t.Errorf( "Run - receiver context canceled in cooldown" )
+        }
+    }
+
+    done := make( chan struct{ } )
+    go func( ) {
+        tracker.Run( onChange )
+        close( done )
+    }( )
+
+    // Readers on other goroutines, run with -race
+    for tracker.Get( ) != Done {
+        tracker.IsMeasuring( )
+        time.Sleep( time.Millisecond )
+    }
+
+    <-done
+
+    expected := [ ]Phase{ Warmup, Measure, Cooldown, Done }
+    if len( seen ) != len( expected ) {
+        t.Fatalf( "Run - expected phases %v, got %v", expected, seen )
+    }
+
+    for i := range expected {
+        if seen[ i ] != expected[ i ] {
+            t.Errorf( "Run - expected phases %v, got %v", expected, seen )
+        }
+    }
+
+    if tracker.ReceiverCtx( ).Err( ) == nil {
+        t.Errorf( "Run - receiver context still active once done" )
+    }
+}
+
+func TestTrackerStop( t *testing.T ) {
+    tracker := NewTracker( time.Hour, time.Hour, time.Hour )
+
+    go tracker.Stop( )
+    tracker.Run( nil )
+
+    if tracker.Get( ) != Done || tracker.SenderCtx( ).Err( ) == nil {
+        t.Errorf( "Stop - expected run to be done, phase %v", tracker.Get( ) )
+    }
+}
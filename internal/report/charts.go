@@ -0,0 +1,324 @@
+package report
+
+import (
+    "fmt"
+    "html"
+    "math"
+    "sort"
+    "strings"
+
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+const (
+    chartWidth      = 800
+    chartHeight     = 260
+    chartMarginL    = 70
+    chartMarginR    = 20
+    chartMarginT    = 20
+    chartMarginB    = 40
+
+    heatmapMaxSize  = 800
+    heatmapMinCell  = 2
+    heatmapMaxCell  = 24
+
+    bytesPerMB      = 1 << 20
+)
+
+type series struct {
+    name            string
+    color           string
+    points       [ ]point
+}
+
+type point struct {
+    x               float64
+    y               float64
+}
+
+type bar struct {
+    label           string
+    value           float64
+}
+
+func niceMax( v float64 )( float64 ) {
+    if v <= 0 {
+        return 1
+    }
+
+    exp  := math.Pow( 10, math.Floor( math.Log10( v ) ) )
+    frac := v / exp
+
+    switch {
+        case frac <= 1:
+            return exp
+        case frac <= 2:
+            return 2 * exp
+        case frac <= 5:
+            return 5 * exp
+    }
+
+    return 10 * exp
+}
+
+func formatValue( v float64 )( string ) {
+    switch {
+        case v >= 1e9:
+            return fmt.Sprintf( "%.1fG", v / 1e9 )
+        case v >= 1e6:
+            return fmt.Sprintf( "%.1fM", v / 1e6 )
+        case v >= 1e4:
+            return fmt.Sprintf( "%.1fk", v / 1e3 )
+        case v == math.Trunc( v ):
+            return fmt.Sprintf( "%.0f", v )
+    }
+
+    return fmt.Sprintf( "%.2f", v )
+}
+
+func svgOpen( sb *strings.Builder, width, height int ) {
+    fmt.Fprintf( sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height )
+}
+
+func yAxis( sb *strings.Builder, yMax float64, unit string ) {
+    plotH := float64( chartHeight - chartMarginT - chartMarginB )
+
+    for i := 0; i <= 4; i++ {
+        y := float64( chartMarginT ) + plotH - plotH * float64( i ) / 4
+        fmt.Fprintf( sb, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" class="grid"/>`, chartMarginL, y, chartWidth - chartMarginR, y )
+        fmt.Fprintf( sb, `<text x="%d" y="%.1f" class="axis" text-anchor="end">%s</text>`, chartMarginL - 6, y + 4, formatValue( yMax * float64( i ) / 4 ) )
+    }
+
+    fmt.Fprintf( sb, `<text x="12" y="%d" class="axis" transform="rotate(-90 12 %d)" text-anchor="middle">%s</text>`,
+        chartHeight / 2, chartHeight / 2, html.EscapeString( unit ) )
+}
+
+// Renders a line chart, x values are seconds since the start of the run
+func lineChart( all [ ]series, unit string )( string ) {
+    var sb strings.Builder
+
+    xMax, yMax := 0.0, 0.0
+    for _, s := range all {
+        for _, p := range s.points {
+            xMax = math.Max( xMax, p.x )
+            yMax = math.Max( yMax, p.y )
+        }
+    }
+
+    if xMax <= 0 {
+        xMax = 1
+    }
+
+    yMax   = niceMax( yMax )
+    plotW := float64( chartWidth - chartMarginL - chartMarginR )
+    plotH := float64( chartHeight - chartMarginT - chartMarginB )
+
+    svgOpen( &sb, chartWidth, chartHeight )
+    yAxis( &sb, yMax, unit )
+
+    for i := 0; i <= 4; i++ {
+        x := float64( chartMarginL ) + plotW * float64( i ) / 4
+        fmt.Fprintf( &sb, `<text x="%.1f" y="%d" class="axis" text-anchor="middle">%ss</text>`, x, chartHeight - chartMarginB + 16, formatValue( math.Round( xMax * float64( i ) / 4 ) ) )
+    }
+
+    for i, s := range all {
+        if len( s.points ) == 0 {
+            continue
+        }
+
+        coords := make( [ ]string, len( s.points ) )
+        for j, p := range s.points {
+            coords[ j ] = fmt.Sprintf( "%.1f,%.1f", float64( chartMarginL ) + plotW * p.x / xMax, float64( chartMarginT ) + plotH - plotH * p.y / yMax )
+        }
+
+        fmt.Fprintf( &sb, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`, strings.Join( coords, " " ), s.color )
+
+        lx := chartMarginL + 10 + i * 140
+        fmt.Fprintf( &sb, `<rect x="%d" y="%d" width="10" height="10" fill="%s"/>`, lx, chartHeight - 14, s.color )
+        fmt.Fprintf( &sb, `<text x="%d" y="%d" class="axis">%s</text>`, lx + 14, chartHeight - 5, html.EscapeString( s.name ) )
+    }
+
+    sb.WriteString( "</svg>" )
+    return sb.String( )
+}
+
+func barChart( bars [ ]bar, unit, color string )( string ) {
+    var sb strings.Builder
+
+    yMax := 0.0
+    for _, b := range bars {
+        yMax = math.Max( yMax, b.value )
+    }
+
+    yMax   = niceMax( yMax )
+    plotW := float64( chartWidth - chartMarginL - chartMarginR )
+    plotH := float64( chartHeight - chartMarginT - chartMarginB )
+
+    svgOpen( &sb, chartWidth, chartHeight )
+    yAxis( &sb, yMax, unit )
+
+    if len( bars ) > 0 {
+        slot := plotW / float64( len( bars ) )
+        for i, b := range bars {
+            h := plotH * b.value / yMax
+            x := float64( chartMarginL ) + slot * float64( i ) + slot * 0.15
+            y := float64( chartMarginT ) + plotH - h
+
+            fmt.Fprintf( &sb, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"><title>%s: %s</title></rect>`,
+                x, y, slot * 0.7, h, color, html.EscapeString( b.label ), formatValue( b.value ) )
+            fmt.Fprintf( &sb, `<text x="%.1f" y="%.1f" class="axis" text-anchor="middle">%s</text>`, x + slot * 0.35, y - 4, formatValue( b.value ) )
+            fmt.Fprintf( &sb, `<text x="%.1f" y="%d" class="axis" text-anchor="middle">%s</text>`, x + slot * 0.35, chartHeight - chartMarginB + 16, html.EscapeString( b.label ) )
+        }
+    }
+
+    sb.WriteString( "</svg>" )
+    return sb.String( )
+}
+
+// Per interval send and receive rates derived from the cumulative timeline
+func throughputSeries( result *stats.Result )( [ ]series ) {
+    sent := series{ name : "sent msgs/s", color : "#1f77b4" }
+    rcvd := series{ name : "received msgs/s", color : "#ff7f0e" }
+
+    for i := 1; i < len( result.Timeline ); i++ {
+        prev, cur := result.Timeline[ i - 1 ], result.Timeline[ i ]
+
+        dt := float64( cur.TimeStamp - prev.TimeStamp ) / 1000
+        if dt <= 0 {
+            continue
+        }
+
+        x := float64( cur.TimeStamp - result.StartTime ) / 1000
+
+        sent.points = append( sent.points, point{ x, float64( cur.Sent - prev.Sent ) / dt } )
+        rcvd.points = append( rcvd.points, point{ x, float64( cur.Rcvd - prev.Rcvd ) / dt } )
+    }
+
+    return [ ]series{ sent, rcvd }
+}
+
+// Cpu of the bench process over time, scaled to the whole usable capacity so 100% means saturated
+func cpuSeries( result *stats.Result )( [ ]series ) {
+    cpu := series{ name : "harness cpu %", color : "#8c564b" }
+
+    capacity := float64( result.Runtime.MaxProcs )
+    if capacity <= 0 {
+        capacity = 1
+    }
+
+    for _, s := range result.Runtime.Samples {
+        cpu.points = append( cpu.points, point{ float64( s.TimeStamp - result.StartTime ) / 1000, s.CpuPct / capacity } )
+    }
+
+    return [ ]series{ cpu }
+}
+
+func byteThroughputSeries( result *stats.Result )( [ ]series ) {
+    sent := series{ name : "sent MB/s", color : "#1f77b4" }
+    rcvd := series{ name : "received MB/s", color : "#ff7f0e" }
+
+    for i := 1; i < len( result.Timeline ); i++ {
+        prev, cur := result.Timeline[ i - 1 ], result.Timeline[ i ]
+
+        dt := float64( cur.TimeStamp - prev.TimeStamp ) / 1000
+        if dt <= 0 {
+            continue
+        }
+
+        x := float64( cur.TimeStamp - result.StartTime ) / 1000
+
+        sent.points = append( sent.points, point{ x, float64( cur.SentBytes - prev.SentBytes ) / dt / bytesPerMB } )
+        rcvd.points = append( rcvd.points, point{ x, float64( cur.RcvdBytes - prev.RcvdBytes ) / dt / bytesPerMB } )
+    }
+
+    return [ ]series{ sent, rcvd }
+}
+
+func latencyBars( hist stats.HistogramSnapshot )( [ ]bar ) {
+    return [ ]bar {
+        { "p50", float64( hist.P50 ) },
+        { "p90", float64( hist.P90 ) },
+        { "p95", float64( hist.P95 ) },
+        { "p99", float64( hist.P99 ) },
+        { "p99.9", float64( hist.P999 ) },
+        { "max", float64( hist.Max ) },
+    }
+}
+
+func errorBars( errorsByClass map[ string ]uint64 )( [ ]bar ) {
+    classes := make( [ ]string, 0, len( errorsByClass ) )
+    for class := range errorsByClass {
+        classes = append( classes, class )
+    }
+
+    sort.Strings( classes )
+
+    bars := make( [ ]bar, len( classes ) )
+    for i, class := range classes {
+        bars[ i ] = bar{ class, float64( errorsByClass[ class ] ) }
+    }
+
+    return bars
+}
+
+// Renders the receiver by sender delivery matrix, rows are receivers and columns are senders
+func heatmap( result *stats.Result )( string ) {
+    var sb strings.Builder
+
+    n := len( result.RcvdById )
+    if n == 0 {
+        return ""
+    }
+
+    cell := heatmapMaxSize / n
+    if cell > heatmapMaxCell {
+        cell = heatmapMaxCell
+    }
+
+    if cell < heatmapMinCell {
+        cell = heatmapMinCell
+    }
+
+    maxVal := uint64( 0 )
+    for _, row := range result.RcvdById {
+        for _, v := range row {
+            if v > maxVal {
+                maxVal = v
+            }
+        }
+    }
+
+    size := n * cell
+    svgOpen( &sb, size + 1, size + 1 )
+
+    for r, row := range result.RcvdById {
+        for s, v := range row {
+            intensity := 0.0
+            if maxVal > 0 {
+                intensity = float64( v ) / float64( maxVal )
+            }
+
+            // White for nothing delivered through to dark blue for the busiest cell
+            red   := int( 255 - intensity * 225 )
+            green := int( 255 - intensity * 165 )
+            blue  := int( 255 - intensity * 75 )
+
+            fmt.Fprintf( &sb, `<rect x="%d" y="%d" width="%d" height="%d" fill="rgb(%d,%d,%d)"><title>%s from %s: %d</title></rect>`,
+                s * cell, r * cell, cell, cell, red, green, blue,
+                html.EscapeString( gatewayId( result, r ) ), html.EscapeString( gatewayId( result, s ) ), v )
+        }
+    }
+
+    fmt.Fprintf( &sb, `<rect x="0" y="0" width="%d" height="%d" fill="none" stroke="#999"/>`, size, size )
+    sb.WriteString( "</svg>" )
+
+    return sb.String( )
+}
+
+func gatewayId( result *stats.Result, idx int )( string ) {
+    if idx < len( result.Gateways ) {
+        return result.Gateways[ idx ].Id
+    }
+
+    return fmt.Sprint( idx )
+}
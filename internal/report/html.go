@@ -0,0 +1,266 @@
+package report
+
+import (
+    "fmt"
+    "html/template"
+    "io"
+    "time"
+
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+// Everything is inlined so that the report can be attached to a ticket as a single file
+const htmlTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { font-family: sans-serif; margin: 24px; color: #222; }
+h1 { font-size: 22px; }
+h2 { font-size: 18px; margin-top: 32px; border-bottom: 1px solid #ddd; }
+table { border-collapse: collapse; font-size: 13px; }
+th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: left; }
+th { background: #f4f4f4; }
+td.num { text-align: right; }
+.grid { stroke: #eee; }
+.axis { font-size: 11px; fill: #555; }
+.summary td { min-width: 120px; }
+.warn { color: #d62728; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>{{ .Title }}</h1>
+
+<h2>Summary</h2>
+<table class="summary">
+<tr><th>Start</th><td>{{ .Start }}</td><th>End</th><td>{{ .End }}</td></tr>
+<tr><th>Measured duration</th><td>{{ .Duration }}</td><th>Gateways</th><td class="num">{{ len .Result.Gateways }}</td></tr>
+<tr><th>Sent</th><td class="num">{{ .Result.Sent }}</td><th>Received</th><td class="num">{{ .Result.Rcvd }}</td></tr>
+<tr><th>Send rate</th><td class="num">{{ .SendRate }} msgs/s, {{ .SendMBps }} MB/s</td><th>Receive rate</th><td class="num">{{ .RcvdRate }} msgs/s, {{ .RcvdMBps }} MB/s</td></tr>
+<tr><th>Sent bytes</th><td class="num">{{ .Result.SentBytes }}</td><th>Received bytes</th><td class="num">{{ .Result.RcvdBytes }}</td></tr>
+{{ if or .Result.BrokerSent .Result.BrokerRcvd }}<tr><th>Broker messages sent</th><td class="num">{{ .Result.BrokerSent }}</td><th>Broker messages received</th><td class="num">{{ .Result.BrokerRcvd }}</td></tr>
+{{ end }}{{ if or .Result.SelfSkipMode .Result.SelfSkipped }}<tr><th>Self skip</th><td>{{ .Result.SelfSkipMode }}{{ if .Result.SubFilter }}, {{ .Result.SubFilter }} filter set up in {{ .Result.SubFilterSetup }} ms{{ end }}</td><th>Own messages skipped by receivers</th><td class="num">{{ .Result.SelfSkipped }}</td></tr>
+{{ end }}{{ if .Result.Connections }}<tr><th>Client topology</th><td>{{ .Result.ClientTopology }}, {{ .Result.Connections }} connections</td><th>Connection setup p50 / max</th><td class="num">{{ .Result.ConnectTime.P50 }} ms / {{ .Result.ConnectTime.Max }} ms</td></tr>
+{{ end }}{{ if .Result.Credential }}<tr><th>Credential</th><td>{{ .Result.Credential }}, {{ .Result.TokensAcquired }} acquired / {{ .Result.TokenRefreshes }} refreshed / {{ .Result.TokenFailures }} failed</td><th>Token request p50 / max</th><td class="num">{{ .Result.TokenTime.P50 }} ms / {{ .Result.TokenTime.Max }} ms</td></tr>
+{{ end }}<tr><th>Errors</th><td class="num">{{ .Result.Errors }}</td><th>Mean latency</th><td class="num">{{ printf "%.1f" .Result.Latency.Mean }} ms</td></tr>
+<tr><th>p99 latency</th><td class="num">{{ .Result.Latency.P99 }} ms &plusmn; {{ .Result.LatencyBound.P99 }} ms</td><th>p99 send call latency</th><td class="num">{{ .Result.SendLatency.P99 }} us</td></tr>
+<tr><th>Delivered in cooldown</th><td class="num">{{ .Result.Late }}</td><th>Stage</th><td>{{ .Result.Stage }}</td></tr>
+<tr><th>Clock offset</th><td class="num">{{ .Result.ClockOffset }} ms &plusmn; {{ .Result.ClockUncertainty }} ms</td><th>Negative raw latencies</th><td class="num">{{ .Result.NegLatencies }}</td></tr>
+</table>
+
+<h2>Configuration</h2>
+<table>
+{{ range .Result.Config }}<tr><th>{{ .Name }}</th><td>{{ .Value }}</td></tr>
+{{ end }}</table>
+
+<h2>Throughput over time</h2>
+{{ .ThroughputChart }}
+
+<h2>Byte throughput over time</h2>
+<p>Payload and properties, what broker quotas and pricing are based on.</p>
+{{ .ByteThroughputChart }}
+
+<h2>Message size percentiles</h2>
+{{ .MsgSizeChart }}
+
+<h2>End to end latency percentiles</h2>
+{{ .LatencyChart }}
+
+<h2>Send call latency percentiles</h2>
+<p>Duration of the publish call alone, separating broker ingress from delivery.</p>
+{{ .SendLatencyChart }}
+
+{{ if .Result.Settled }}<h2>Settlement</h2>
+<p>Settlement calls are timed separately from the receive, redeliveries are not counted as received.</p>
+<table>
+<tr><th>Action</th><th>Count</th></tr>
+{{ range $action, $count := .Result.Settled }}<tr><td>{{ $action }}</td><td class="num">{{ $count }}</td></tr>
+{{ end }}<tr><td>redelivered</td><td class="num">{{ .Result.Redelivered }}</td></tr>
+</table>
+{{ .SettleLatencyChart }}
+{{ if .Result.DlqRcvd }}<p>Read back {{ .Result.DlqRcvd }} messages from the dead letter queue{{ if .Result.DlqInvalid }}, <span class="warn">{{ .Result.DlqInvalid }} of them with unexpected properties</span>{{ end }}.
+Time from dead lettering to reading back, in milliseconds:</p>
+{{ .DlqLatencyChart }}
+{{ end }}{{ if or .Result.DeferRcvd .Result.DeferLost }}<p>Fetched back and completed {{ .Result.DeferRcvd }} deferred messages,
+{{ if .Result.DeferLost }}<span class="warn">{{ .Result.DeferLost }} deferred messages were lost</span>{{ else }}none was lost{{ end }}.
+Time from deferring to completing, in milliseconds:</p>
+{{ .DeferLatencyChart }}
+{{ end }}
+{{ end }}{{ if .Result.ReceiveCalls }}<h2>Receive calls</h2>
+<p>{{ .Result.ReceiveCalls }} receive calls, {{ .Result.EmptyReceives }} of them came back empty. Fewer, fuller calls raise throughput,
+time spent waiting for a call to fill up or for a worker adds to the end to end latency.</p>
+<p>Messages per receive call</p>
+{{ .ReceiveBatchChart }}
+{{ if .Result.PrefetchWait.Count }}<p>Wait in the prefetch buffer for a worker, in microseconds</p>
+{{ .PrefetchWaitChart }}
+{{ end }}
+{{ end }}{{ if or .Result.ProcessLatency.Count .Result.MsgLocksLost }}<h2>Processing</h2>
+<p>Time from receiving a message to settling it, including the wait for a worker and the simulated processing.
+Message locks were renewed {{ .Result.LockRenewals }} times{{ if .Result.MsgLocksLost }}, <span class="warn">{{ .Result.MsgLocksLost }} locks were lost and their messages handed out again</span>{{ else }} and no lock was lost{{ end }}.</p>
+{{ .ProcessLatencyChart }}
+
+{{ end }}{{ if or .Result.ScheduleEarly.Count .Result.ScheduleLate.Count .Result.Cancelled }}<h2>Scheduled delivery</h2>
+<p>Delivery time minus scheduled time on the reference clock. {{ .Result.ScheduleEarly.Count }} messages arrived early and {{ .Result.ScheduleLate.Count }} on time or late.
+{{ .Result.Cancelled }} scheduled messages were cancelled{{ if .Result.CancelledRcvd }}, <span class="warn">{{ .Result.CancelledRcvd }} of them arrived anyway</span>{{ else }} and none of them arrived{{ end }}.</p>
+<p>Late by, in milliseconds</p>
+{{ .ScheduleLateChart }}
+<p>Early by, in milliseconds</p>
+{{ .ScheduleEarlyChart }}
+
+{{ end }}{{ if .Result.MessageTtl }}<h2>Expiry</h2>
+<p>Messages were sent with a time to live of {{ .Result.MessageTtl }} ms. Of {{ .Result.Delivery.Expected }} expected deliveries {{ .Result.Delivery.Delivered }} happened and {{ .Result.Undelivered }} did not.
+{{ if .Result.ExpiredRcvd }}<span class="warn">{{ .Result.ExpiredRcvd }} messages were delivered after they expired.</span>
+{{ end }}{{ if .Result.DlqExpired }}{{ .Result.DlqExpired }} messages were read back from the dead letter queue after the broker dead lettered them on expiry.
+{{ end }}</p>
+
+{{ end }}{{ if or .Result.DupSent .Result.DupRcvd }}<h2>Duplicate detection</h2>
+<p>{{ .Result.DupSent }} messages were resent with the MessageID they were first sent with, {{ .Result.DupDelay }} ms later.
+{{ if .Result.DupWindow }}{{ if lt .Result.DupDelay .Result.DupWindow }}The resends fall inside the duplicate detection window of {{ .Result.DupWindow }} ms and none should get through{{ else }}The resends fall outside the duplicate detection window of {{ .Result.DupWindow }} ms and all of them should get through{{ end }}.
+{{ else }}The duplicate detection window of the entity is not known.
+{{ end }}{{ if .Result.DupRcvd }}<span class="warn">{{ .Result.DupRcvd }} duplicates got through.</span>{{ else }}No duplicates got through.{{ end }}</p>
+
+{{ end }}{{ if .Result.SessionAccept.Count }}<h2>Sessions</h2>
+<p>Accepted {{ .Result.SessionAccept.Count }} sessions, lost {{ .Result.SessionLocksLost }} session locks and received {{ .Result.OutOfOrder }} messages out of order within a session.</p>
+{{ .SessionAcceptChart }}
+
+{{ end }}<h2>Harness resources</h2>
+<p>Resource usage of the bench process itself, to tell a broker limit from a harness limit.</p>
+{{ range .Result.Runtime.Warnings }}<p class="warn">{{ . }}</p>
+{{ end }}<table class="summary">
+<tr><th>Usable cores</th><td class="num">{{ .Result.Runtime.MaxProcs }}</td><th>Cpu mean / max</th><td class="num">{{ printf "%.0f" .Result.Runtime.CpuPctMean }}% / {{ printf "%.0f" .Result.Runtime.CpuPctMax }}%</td></tr>
+<tr><th>Max rss</th><td class="num">{{ .RssMax }}</td><th>Max goroutines</th><td class="num">{{ .Result.Runtime.GoroutinesMax }}</td></tr>
+<tr><th>Gc cycles</th><td class="num">{{ .Result.Runtime.GcCycles }}</td><th>p99 gc pause</th><td class="num">{{ .Result.Runtime.GcPause.P99 }} us</td></tr>
+<tr><th>p99 scheduling latency</th><td class="num">{{ .Result.Runtime.SchedLatency.P99 }} us</td><th>Max scheduling latency</th><td class="num">{{ .Result.Runtime.SchedLatency.Max }} us</td></tr>
+</table>
+{{ .CpuChart }}
+
+<h2>Errors</h2>
+{{ if .Result.ErrorsByClass }}{{ .ErrorChart }}
+<table>
+<tr><th>Class</th><th>Count</th></tr>
+{{ range $class, $count := .Result.ErrorsByClass }}<tr><td>{{ $class }}</td><td class="num">{{ $count }}</td></tr>
+{{ end }}</table>{{ else }}<p>No errors</p>{{ end }}
+
+<h2>Delivery matrix</h2>
+<p>Rows are receivers, columns are senders. Hover over a cell for the exact count.</p>
+{{ .Heatmap }}
+
+<h2>Delivery</h2>
+{{ if .Result.Topology }}<p>Delivered {{ .Result.Delivery.Delivered }} of {{ .Result.Delivery.Expected }} expected, ratio {{ printf "%.4f" .Result.Delivery.Ratio }}.
+Only pairs where both the sender and the receiver contributed to this result are checked, {{ .Result.Topology.Delivery }} delivery{{ if .Result.Topology.SelfSkip }} skipping own messages{{ end }}.</p>
+<table>
+<tr><th>Id</th><th>Delivered as sender</th><th>Expected as sender</th><th>Ratio</th><th>Received as receiver</th><th>Expected as receiver</th><th>Ratio</th></tr>
+{{ range .Result.Gateways }}<tr><td>{{ .Id }}</td><td class="num">{{ .AsSender.Delivered }}</td><td class="num">{{ .AsSender.Expected }}</td><td class="num">{{ printf "%.4f" .AsSender.Ratio }}</td><td class="num">{{ .AsReceiver.Delivered }}</td><td class="num">{{ .AsReceiver.Expected }}</td><td class="num">{{ printf "%.4f" .AsReceiver.Ratio }}</td></tr>
+{{ end }}</table>{{ else }}<p>No topology recorded, expected deliveries unknown</p>{{ end }}
+
+<h2>Receiver balance</h2>
+{{ with .Result.Balance }}{{ if gt .Receivers 1 }}<table>
+<tr><th>Receivers</th><th>Min received</th><th>Max received</th><th>Mean</th><th>Std dev</th><th>Coefficient of variation</th><th>Jain index</th></tr>
+<tr><td class="num">{{ .Receivers }}</td><td class="num">{{ .Min }}</td><td class="num">{{ .Max }}</td><td class="num">{{ printf "%.1f" .Mean }}</td><td class="num">{{ printf "%.1f" .StdDev }}</td><td class="num">{{ printf "%.4f" .Cv }}</td><td class="num">{{ printf "%.4f" .Jain }}</td></tr>
+</table>
+<p>A Jain index of 1 means every receiver got the same share of the messages.</p>{{ else }}<p>Fewer than two receivers, nothing to balance</p>{{ end }}{{ end }}
+
+<h2>Gateways</h2>
+<table>
+<tr><th>Id</th><th>Sent</th><th>Received</th><th>Retries</th><th>Errors</th><th>p50 ms</th><th>p99 ms</th><th>Max ms</th><th>Send p50 us</th><th>Send p99 us</th><th>Sent bytes</th><th>Received bytes</th><th>Size p99</th></tr>
+{{ range .Result.Gateways }}<tr><td>{{ .Id }}</td><td class="num">{{ .Sent }}</td><td class="num">{{ .Rcvd }}</td><td class="num">{{ .Retries }}</td><td class="num">{{ .Errors }}</td><td class="num">{{ .Latency.P50 }}</td><td class="num">{{ .Latency.P99 }}</td><td class="num">{{ .Latency.Max }}</td><td class="num">{{ .SendLatency.P50 }}</td><td class="num">{{ .SendLatency.P99 }}</td><td class="num">{{ .SentBytes }}</td><td class="num">{{ .RcvdBytes }}</td><td class="num">{{ .MsgSize.P99 }}</td></tr>
+{{ end }}</table>
+</body>
+</html>
+`
+
+var reportTemplate = template.Must( template.New( "report" ).Parse( htmlTemplate ) )
+
+type htmlReport struct {
+    Title               string
+    Start               string
+    End                 string
+    Duration            string
+    SendRate            string
+    RcvdRate            string
+    SendMBps            string
+    RcvdMBps            string
+    RssMax              string
+
+    ThroughputChart     template.HTML
+    ByteThroughputChart template.HTML
+    MsgSizeChart        template.HTML
+    LatencyChart        template.HTML
+    SendLatencyChart    template.HTML
+    SettleLatencyChart  template.HTML
+    SessionAcceptChart  template.HTML
+    ScheduleLateChart   template.HTML
+    ScheduleEarlyChart  template.HTML
+    DlqLatencyChart     template.HTML
+    DeferLatencyChart   template.HTML
+    ProcessLatencyChart template.HTML
+    ReceiveBatchChart   template.HTML
+    PrefetchWaitChart   template.HTML
+    ErrorChart          template.HTML
+    CpuChart            template.HTML
+    Heatmap             template.HTML
+
+    Result             *stats.Result
+}
+
+func formatTimeStamp( ts int64 )( string ) {
+    if ts == 0 {
+        return "-"
+    }
+
+    return time.UnixMilli( ts ).UTC( ).Format( time.RFC3339 )
+}
+
+func WriteHtml( w io.Writer, result *stats.Result )( err error ) {
+    if nil == result {
+        return fmt.Errorf( "invalid result" )
+    }
+
+    duration := result.DurationSeconds( )
+
+    sendRate, rcvdRate, sendMBps, rcvdMBps := 0.0, 0.0, 0.0, 0.0
+    if duration > 0 {
+        sendRate = float64( result.Sent ) / duration
+        rcvdRate = float64( result.Rcvd ) / duration
+        sendMBps = float64( result.SentBytes ) / duration / bytesPerMB
+        rcvdMBps = float64( result.RcvdBytes ) / duration / bytesPerMB
+    }
+
+    title := "Benchmark report"
+    if len( result.Name ) > 0 {
+        title = result.Name + " benchmark report"
+    }
+
+    rpt := &htmlReport {
+        Title               :   title,
+        Start               :   formatTimeStamp( result.StartTime ),
+        End                 :   formatTimeStamp( result.EndTime ),
+        Duration            :   ( time.Duration( duration * float64( time.Second ) ) ).Round( time.Second ).String( ),
+        SendRate            :   formatValue( sendRate ),
+        RcvdRate            :   formatValue( rcvdRate ),
+        SendMBps            :   fmt.Sprintf( "%.3f", sendMBps ),
+        RcvdMBps            :   fmt.Sprintf( "%.3f", rcvdMBps ),
+        RssMax              :   fmt.Sprintf( "%v MB", result.Runtime.RssMax >> 20 ),
+        ThroughputChart     :   template.HTML( lineChart( throughputSeries( result ), "msgs/s" ) ),
+        ByteThroughputChart :   template.HTML( lineChart( byteThroughputSeries( result ), "MB/s" ) ),
+        MsgSizeChart        :   template.HTML( barChart( latencyBars( result.MsgSize ), "bytes", "#17becf" ) ),
+        LatencyChart        :   template.HTML( barChart( latencyBars( result.Latency ), "ms", "#2ca02c" ) ),
+        SendLatencyChart    :   template.HTML( barChart( latencyBars( result.SendLatency ), "us", "#9467bd" ) ),
+        SettleLatencyChart  :   template.HTML( barChart( latencyBars( result.SettleLatency ), "us", "#bcbd22" ) ),
+        SessionAcceptChart  :   template.HTML( barChart( latencyBars( result.SessionAccept ), "us", "#8c564b" ) ),
+        ScheduleLateChart   :   template.HTML( barChart( latencyBars( result.ScheduleLate ), "ms", "#ff7f0e" ) ),
+        ScheduleEarlyChart  :   template.HTML( barChart( latencyBars( result.ScheduleEarly ), "ms", "#1f77b4" ) ),
+        DlqLatencyChart     :   template.HTML( barChart( latencyBars( result.DlqLatency ), "ms", "#7f7f7f" ) ),
+        DeferLatencyChart   :   template.HTML( barChart( latencyBars( result.DeferLatency ), "ms", "#c5b0d5" ) ),
+        ProcessLatencyChart :   template.HTML( barChart( latencyBars( result.ProcessLatency ), "ms", "#e377c2" ) ),
+        ReceiveBatchChart   :   template.HTML( barChart( latencyBars( result.ReceiveBatch ), "msgs", "#aec7e8" ) ),
+        PrefetchWaitChart   :   template.HTML( barChart( latencyBars( result.PrefetchWait ), "us", "#ffbb78" ) ),
+        ErrorChart          :   template.HTML( barChart( errorBars( result.ErrorsByClass ), "errors", "#d62728" ) ),
+        CpuChart            :   template.HTML( lineChart( cpuSeries( result ), "%" ) ),
+        Heatmap             :   template.HTML( heatmap( result ) ),
+        Result              :   result,
+    }
+
+    return reportTemplate.Execute( w, rpt )
+}
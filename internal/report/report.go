@@ -0,0 +1,70 @@
+package report
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+func WriteJson( w io.Writer, result *stats.Result )( err error ) {
+    if nil == result {
+        return fmt.Errorf( "invalid result" )
+    }
+
+    encoder := json.NewEncoder( w )
+    encoder.SetIndent( "", "  " )
+
+    return encoder.Encode( result )
+}
+
+func ReadJson( r io.Reader )( result *stats.Result, err error ) {
+    result = &stats.Result{ }
+
+    err = json.NewDecoder( r ).Decode( result )
+    if err != nil {
+        return nil, err
+    }
+
+    return result, nil
+}
+
+type writeFn func( io.Writer, *stats.Result )( error )
+
+func writeFile( file string, result *stats.Result, fn writeFn )( err error ) {
+    fh, err := os.Create( file )
+    if err != nil {
+        return err
+    }
+
+    err = fn( fh, result )
+    if err != nil {
+        fh.Close( )
+        return err
+    }
+
+    return fh.Close( )
+}
+
+func WriteJsonFile( file string, result *stats.Result )( err error ) {
+    return writeFile( file, result, WriteJson )
+}
+
+func WriteHtmlFile( file string, result *stats.Result )( err error ) {
+    return writeFile( file, result, WriteHtml )
+}
+
+func ReadJsonFile( file string )( result *stats.Result, err error ) {
+    fh, err := os.Open( file )
+    if err != nil {
+        return nil, err
+    }
+
+    defer func( ) {
+        fh.Close( )
+    }( )
+
+    return ReadJson( fh )
+}
@@ -0,0 +1,87 @@
+package report
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+func testResult( )( *stats.Result ) {
+    return &stats.Result {
+        Name            :   "test",
+        StartTime       :   1000,
+        EndTime         :   61000,
+        Config          :   [ ]stats.ConfigEntry{ { Name : "TopicName", Value : "<topic>" } },
+        Sent            :   200,
+        Rcvd            :   180,
+        Errors          :   3,
+        ErrorsByClass   :   map[ string ]uint64{ stats.ErrorClassSend : 2, stats.ErrorClassParse : 1 },
+        Gateways        :   [ ]stats.GatewayResult{ { Id : "gw0", Sent : 100, Rcvd : 90 }, { Id : "gw1", Sent : 100, Rcvd : 90 } },
+        RcvdById        :   [ ][ ]uint64{ { 0, 90 }, { 90, 0 } },
+        Timeline        :   [ ]stats.Sample{ { TimeStamp : 1000 }, { TimeStamp : 31000, Sent : 100, Rcvd : 90 }, { TimeStamp : 61000, Sent : 200, Rcvd : 180 } },
+    }
+}
+
+func TestWriteHtml( t *testing.T ) {
+    var buf bytes.Buffer
+
+    err := WriteHtml( &buf, testResult( ) )
+    if err != nil {
+        t.Fatalf( "WriteHtml - failed with error %v", err )
+    }
+
+    out := buf.String( )
+    for _, expected := range [ ]string{ "<svg", "polyline", "gw0 from gw1: 90", "&lt;topic&gt;", "parse" } {
+        if !strings.Contains( out, expected ) {
+            t.Fatalf( "WriteHtml - report does not contain %v", expected )
+        }
+    }
+
+    if strings.Contains( out, "<script" ) || strings.Contains( out, "http://" ) && !strings.Contains( out, "http://www.w3.org/2000/svg" ) {
+        t.Fatalf( "WriteHtml - report references external assets" )
+    }
+
+    err = WriteHtml( &buf, nil )
+    if err == nil {
+        t.Fatalf( "WriteHtml - accepted nil result" )
+    }
+}
+
+func TestJsonRoundTrip( t *testing.T ) {
+    var buf bytes.Buffer
+
+    err := WriteJson( &buf, testResult( ) )
+    if err != nil {
+        t.Fatalf( "WriteJson - failed with error %v", err )
+    }
+
+    result, err := ReadJson( &buf )
+    if err != nil {
+        t.Fatalf( "ReadJson - failed with error %v", err )
+    }
+
+    if result.Sent != 200 || len( result.RcvdById ) != 2 || result.RcvdById[ 1 ][ 0 ] != 90 {
+        t.Fatalf( "ReadJson - result does not match %+v", result )
+    }
+}
+
+func TestWriteHtmlDelivery( t *testing.T ) {
+    var buf bytes.Buffer
+
+    result := testResult( )
+    result.Topology = &stats.Topology{ GatewaysPerJob : 2, SenderJobs : [ ]int{ 0 }, ReceiverJobs : [ ]int{ 0 }, Delivery : stats.DeliveryFanout, SelfSkip : true }
+    result.Gateways[ 0 ].Sending, result.Gateways[ 0 ].Receiving = true, true
+    result.Gateways[ 1 ].Sending, result.Gateways[ 1 ].Receiving = true, true
+    result.UpdateDelivery( )
+
+    err := WriteHtml( &buf, result )
+    if err != nil {
+        t.Fatalf( "WriteHtml - failed with error %v", err )
+    }
+
+    if !strings.Contains( buf.String( ), "Delivered 180 of 200 expected, ratio 0.9000" ) {
+        t.Fatalf( "WriteHtml - report does not contain the delivery ratio" )
+    }
+}
@@ -0,0 +1,92 @@
+package slo
+
+import (
+    "encoding/xml"
+    "fmt"
+    "io"
+    "os"
+)
+
+type junitTestSuites struct {
+    XMLName         xml.Name            `xml:"testsuites"`
+    Suites       [ ]junitTestSuite      `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+    Name            string              `xml:"name,attr"`
+    Tests           int                 `xml:"tests,attr"`
+    Failures        int                 `xml:"failures,attr"`
+    Skipped         int                 `xml:"skipped,attr"`
+    Cases        [ ]junitTestCase       `xml:"testcase"`
+}
+
+type junitTestCase struct {
+    Name            string              `xml:"name,attr"`
+    ClassName       string              `xml:"classname,attr"`
+    Failure        *junitMessage        `xml:"failure,omitempty"`
+    Skipped        *junitMessage        `xml:"skipped,omitempty"`
+    SystemOut       string              `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+    Message         string              `xml:"message,attr"`
+}
+
+func WriteJUnit( w io.Writer, suite string, outcomes [ ]Outcome )( err error ) {
+    testSuite := junitTestSuite {
+        Name    :   suite,
+        Tests   :   len( outcomes ),
+        Cases   :   make( [ ]junitTestCase, len( outcomes ) ),
+    }
+
+    for i, outcome := range outcomes {
+        detail := fmt.Sprintf( "expected %v actual %v", outcome.Expected, outcome.Actual )
+
+        testCase := junitTestCase {
+            Name        :   outcome.Name,
+            ClassName   :   suite,
+            SystemOut   :   detail,
+        }
+
+        if outcome.Skipped {
+            testCase.Skipped = &junitMessage{ Message : outcome.Actual }
+            testSuite.Skipped++
+        } else if !outcome.Passed {
+            testCase.Failure = &junitMessage{ Message : detail }
+            testSuite.Failures++
+        }
+
+        testSuite.Cases[ i ] = testCase
+    }
+
+    _, err = io.WriteString( w, xml.Header )
+    if err != nil {
+        return err
+    }
+
+    encoder := xml.NewEncoder( w )
+    encoder.Indent( "", "  " )
+
+    err = encoder.Encode( &junitTestSuites{ Suites : [ ]junitTestSuite{ testSuite } } )
+    if err != nil {
+        return err
+    }
+
+    _, err = io.WriteString( w, "\n" )
+    return err
+}
+
+func WriteJUnitFile( file, suite string, outcomes [ ]Outcome )( err error ) {
+    fh, err := os.Create( file )
+    if err != nil {
+        return err
+    }
+
+    err = WriteJUnit( fh, suite, outcomes )
+    if err != nil {
+        fh.Close( )
+        return err
+    }
+
+    return fh.Close( )
+}
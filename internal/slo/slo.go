@@ -0,0 +1,327 @@
+package slo
+
+import (
+    "fmt"
+    "io"
+    "time"
+
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+const (
+    ExitCodePass    = 0
+    ExitCodeFail    = 1
+)
+
+// Negative thresholds and a non positive latency disable the corresponding assertion
+type Assertions struct {
+    MinThroughput       float64
+    MaxP99Latency       time.Duration
+    MaxLossPct          float64
+    MaxErrorPct         float64
+    MinCellDelivery     float64
+}
+
+type Outcome struct {
+    Name                string
+    Passed              bool
+    Skipped             bool
+    Expected            string
+    Actual              string
+}
+
+func NewAssertions( )( *Assertions ) {
+    return &Assertions {
+        MinThroughput   :   -1,
+        MaxLossPct      :   -1,
+        MaxErrorPct     :   -1,
+        MinCellDelivery :   -1,
+    }
+}
+
+func skipped( name, expected, reason string )( Outcome ) {
+    return Outcome {
+        Name        :   name,
+        Skipped     :   true,
+        Expected    :   expected,
+        Actual      :   reason,
+    }
+}
+
+// Receivers are active when the topology has them receive and they ran in the processes behind the
+// result, whether they got anything or not. Results from before topologies only have the traffic to go by.
+func activeReceivers( result *stats.Result )( active [ ]bool ) {
+    active = make( [ ]bool, len( result.RcvdById ) )
+    for r := range result.Gateways {
+        if r >= len( active ) {
+            continue
+        }
+
+        if result.Topology != nil {
+            active[ r ] = result.Gateways[ r ].Receiving && result.Topology.IsReceiver( r )
+        } else {
+            active[ r ] = result.Gateways[ r ].Rcvd > 0
+        }
+    }
+
+    return active
+}
+
+func hasActiveReceivers( result *stats.Result )( bool ) {
+    for _, active := range activeReceivers( result ) {
+        if active {
+            return true
+        }
+    }
+
+    return false
+}
+
+func expectedCell( result *stats.Result, receiver, sender int )( uint64 ) {
+    if receiver == sender || sender >= len( result.Gateways ) {
+        return 0
+    }
+
+    return result.Gateways[ sender ].Sent
+}
+
+// Results with a topology know what every cell should hold, older ones fall back to assuming
+// fan-out to every receiver that got anything
+func cellExpectation( result *stats.Result, active [ ]bool, receiver, sender int )( expected uint64 ) {
+    if !active[ receiver ] {
+        return 0
+    }
+
+    if result.Topology != nil {
+        expected, _ = result.ExpectedCell( receiver, sender )
+        return expected
+    }
+
+    return expectedCell( result, receiver, sender )
+}
+
+// Competing receivers split every message between them, no single receiver is owed a share
+func isCompeting( result *stats.Result )( bool ) {
+    return result.Topology != nil && result.Topology.Delivery == stats.DeliveryCompeting
+}
+
+func evalThroughput( result *stats.Result, min float64 )( Outcome ) {
+    name     := "min-throughput"
+    expected := fmt.Sprintf( ">= %.2f msgs/s", min )
+
+    duration := result.DurationSeconds( )
+    if duration <= 0 {
+        return skipped( name, expected, "run duration unknown" )
+    }
+
+    // Receive rate is what matters, only runs without receivers fall back to the send rate. Receivers
+    // that ran and got nothing have a rate of 0.
+    count, what := result.Rcvd, "received"
+    if !hasActiveReceivers( result ) {
+        count, what = result.Sent, "sent"
+    }
+
+    rate := float64( count ) / duration
+
+    return Outcome {
+        Name        :   name,
+        Passed      :   rate >= min,
+        Expected    :   expected,
+        Actual      :   fmt.Sprintf( "%.2f msgs/s %v", rate, what ),
+    }
+}
+
+func evalP99Latency( result *stats.Result, max time.Duration )( Outcome ) {
+    name     := "max-p99-latency"
+    expected := fmt.Sprintf( "<= %v", max )
+
+    if result.Latency.Count == 0 {
+        return skipped( name, expected, "no latency samples" )
+    }
+
+    p99 := time.Duration( result.Latency.P99 ) * time.Millisecond
+
+    return Outcome {
+        Name        :   name,
+        Passed      :   p99 <= max,
+        Expected    :   expected,
+        Actual      :   p99.String( ),
+    }
+}
+
+// Competing receivers are only checked over all of them, otherwise every expected cell adds up
+func deliveryTotals( result *stats.Result )( expected, delivered uint64 ) {
+    if isCompeting( result ) {
+        return result.Delivery.Expected, result.Delivery.Delivered
+    }
+
+    active := activeReceivers( result )
+    for r, row := range result.RcvdById {
+        for s, v := range row {
+            if exp := cellExpectation( result, active, r, s ); exp > 0 {
+                expected  += exp
+                delivered += v
+            }
+        }
+    }
+
+    return expected, delivered
+}
+
+func evalLoss( result *stats.Result, max float64 )( Outcome ) {
+    name     := "max-loss-pct"
+    expected := fmt.Sprintf( "<= %.3f%%", max )
+
+    expectedTotal, delivered := deliveryTotals( result )
+    if expectedTotal == 0 {
+        return skipped( name, expected, "no expected deliveries" )
+    }
+
+    loss := 0.0
+    if delivered < expectedTotal {
+        loss = 100 * float64( expectedTotal - delivered ) / float64( expectedTotal )
+    }
+
+    return Outcome {
+        Name        :   name,
+        Passed      :   loss <= max,
+        Expected    :   expected,
+        Actual      :   fmt.Sprintf( "%.3f%% (%v of %v delivered)", loss, delivered, expectedTotal ),
+    }
+}
+
+// Errors are measured against every send and receive attempt
+func evalErrors( result *stats.Result, max float64 )( Outcome ) {
+    name     := "max-error-pct"
+    expected := fmt.Sprintf( "<= %.3f%%", max )
+
+    attempts := result.Sent + result.Rcvd + result.Errors
+    if attempts == 0 {
+        return skipped( name, expected, "no send or receive attempts" )
+    }
+
+    errPct := 100 * float64( result.Errors ) / float64( attempts )
+
+    return Outcome {
+        Name        :   name,
+        Passed      :   errPct <= max,
+        Expected    :   expected,
+        Actual      :   fmt.Sprintf( "%.3f%% (%v errors)", errPct, result.Errors ),
+    }
+}
+
+func evalCellDelivery( result *stats.Result, min float64 )( Outcome ) {
+    name     := "min-cell-delivery"
+    expected := fmt.Sprintf( ">= %.3f", min )
+
+    // Failing rather than skipping keeps a run that asked for the check from looking verified
+    if isCompeting( result ) {
+        return Outcome {
+            Name        :   name,
+            Passed      :   false,
+            Expected    :   expected,
+            Actual      :   "not applicable to competing delivery, use max-loss-pct",
+        }
+    }
+
+    active := activeReceivers( result )
+
+    worst, worstR, worstS, cells := 1.0, -1, -1, 0
+    for r, row := range result.RcvdById {
+        for s, v := range row {
+            exp := cellExpectation( result, active, r, s )
+            if exp == 0 {
+                continue
+            }
+
+            cells++
+
+            fraction := float64( v ) / float64( exp )
+            if fraction < worst {
+                worst, worstR, worstS = fraction, r, s
+            }
+        }
+    }
+
+    if cells == 0 {
+        return skipped( name, expected, "no expected deliveries" )
+    }
+
+    actual := fmt.Sprintf( "%.3f over %v cells", worst, cells )
+    if worstR >= 0 {
+        actual = fmt.Sprintf( "%.3f (%v from %v)", worst, result.Gateways[ worstR ].Id, result.Gateways[ worstS ].Id )
+    }
+
+    return Outcome {
+        Name        :   name,
+        Passed      :   worst >= min,
+        Expected    :   expected,
+        Actual      :   actual,
+    }
+}
+
+func Evaluate( result *stats.Result, assertions *Assertions )( outcomes [ ]Outcome ) {
+    if nil == result || nil == assertions {
+        return nil
+    }
+
+    if assertions.MinThroughput >= 0 {
+        outcomes = append( outcomes, evalThroughput( result, assertions.MinThroughput ) )
+    }
+
+    if assertions.MaxP99Latency > 0 {
+        outcomes = append( outcomes, evalP99Latency( result, assertions.MaxP99Latency ) )
+    }
+
+    if assertions.MaxLossPct >= 0 {
+        outcomes = append( outcomes, evalLoss( result, assertions.MaxLossPct ) )
+    }
+
+    if assertions.MaxErrorPct >= 0 {
+        outcomes = append( outcomes, evalErrors( result, assertions.MaxErrorPct ) )
+    }
+
+    if assertions.MinCellDelivery >= 0 {
+        outcomes = append( outcomes, evalCellDelivery( result, assertions.MinCellDelivery ) )
+    }
+
+    return outcomes
+}
+
+func Passed( outcomes [ ]Outcome )( bool ) {
+    for _, outcome := range outcomes {
+        if !outcome.Passed && !outcome.Skipped {
+            return false
+        }
+    }
+
+    return true
+}
+
+func Print( w io.Writer, outcomes [ ]Outcome ) {
+    for _, outcome := range outcomes {
+        status := "FAIL"
+        if outcome.Skipped {
+            status = "SKIP"
+        } else if outcome.Passed {
+            status = "PASS"
+        }
+
+        fmt.Fprintf( w, "%v: %v expected %v actual %v\n", status, outcome.Name, outcome.Expected, outcome.Actual )
+    }
+}
+
+// Prints the outcomes, writes the junit file if one is set and returns the exit code for the run
+func Conclude( w io.Writer, suite string, outcomes [ ]Outcome, junitFile string )( exitCode int, err error ) {
+    Print( w, outcomes )
+
+    if len( junitFile ) > 0 {
+        err = WriteJUnitFile( junitFile, suite, outcomes )
+    }
+
+    if !Passed( outcomes ) {
+        return ExitCodeFail, err
+    }
+
+    return ExitCodePass, err
+}
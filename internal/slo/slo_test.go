@@ -0,0 +1,212 @@
+package slo
+
+import (
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+
+    "github.com/azsvcbusbench/internal/stats"
+)
+
+func testResult( )( *stats.Result ) {
+    return &stats.Result {
+        StartTime   :   0,
+        EndTime     :   10000,
+        Sent        :   200,
+        Rcvd        :   190,
+        Errors      :   2,
+        Latency     :   stats.HistogramSnapshot{ Count : 190, P99 : 250 },
+        Gateways    :   [ ]stats.GatewayResult{ { Id : "gw0", Sent : 100, Rcvd : 100 }, { Id : "gw1", Sent : 100, Rcvd : 90 } },
+        RcvdById    :   [ ][ ]uint64{ { 0, 100 }, { 90, 0 } },
+    }
+}
+
+func findOutcome( t *testing.T, outcomes [ ]Outcome, name string )( Outcome ) {
+    for _, outcome := range outcomes {
+        if outcome.Name == name {
+            return outcome
+        }
+    }
+
+    t.Fatalf( "Evaluate - no outcome for %v", name )
+    return Outcome{ }
+}
+
+func TestEvaluate( t *testing.T ) {
+    if len( Evaluate( testResult( ), NewAssertions( ) ) ) != 0 {
+        t.Fatalf( "Evaluate - returned outcomes with all assertions disabled" )
+    }
+
+    assertions := &Assertions {
+        MinThroughput   :   19,
+        MaxP99Latency   :   200 * time.Millisecond,
+        MaxLossPct      :   10,
+        MaxErrorPct     :   0.1,
+        MinCellDelivery :   0.95,
+    }
+
+    outcomes := Evaluate( testResult( ), assertions )
+    if len( outcomes ) != 5 {
+        t.Fatalf( "Evaluate - expected 5 outcomes, got %v", len( outcomes ) )
+    }
+
+    expected := map[ string ]bool {
+        "min-throughput"    :   true,
+        "max-p99-latency"   :   false,
+        "max-loss-pct"      :   true,
+        "max-error-pct"     :   false,
+        "min-cell-delivery" :   false,
+    }
+
+    for name, passed := range expected {
+        if outcome := findOutcome( t, outcomes, name ); outcome.Passed != passed {
+            t.Fatalf( "Evaluate - %v passed %v, expected %v: %+v", name, outcome.Passed, passed, outcome )
+        }
+    }
+
+    if Passed( outcomes ) {
+        t.Fatalf( "Passed - returned true with failed assertions" )
+    }
+
+    result := testResult( )
+    result.RcvdById = [ ][ ]uint64{ { 0, 0 }, { 0, 0 } }
+    result.Gateways[ 0 ].Rcvd, result.Gateways[ 1 ].Rcvd, result.Rcvd = 0, 0, 0
+    result.Latency = stats.HistogramSnapshot{ }
+
+    outcomes = Evaluate( result, assertions )
+    if outcome := findOutcome( t, outcomes, "max-loss-pct" ); !outcome.Skipped {
+        t.Fatalf( "Evaluate - loss not skipped for sender only run" )
+    }
+
+    if outcome := findOutcome( t, outcomes, "max-p99-latency" ); !outcome.Skipped {
+        t.Fatalf( "Evaluate - latency not skipped without samples" )
+    }
+}
+
+func TestConclude( t *testing.T ) {
+    var out, junit bytes.Buffer
+
+    outcomes := [ ]Outcome {
+        { Name : "a", Passed : true, Expected : "x", Actual : "y" },
+        { Name : "b", Passed : false, Expected : "x", Actual : "y" },
+        { Name : "c", Skipped : true, Expected : "x", Actual : "y" },
+    }
+
+    exitCode, err := Conclude( &out, "suite", outcomes, "" )
+    if err != nil || exitCode != ExitCodeFail {
+        t.Fatalf( "Conclude - returned %v, %v for failed assertions", exitCode, err )
+    }
+
+    for _, expected := range [ ]string{ "PASS: a", "FAIL: b", "SKIP: c" } {
+        if !strings.Contains( out.String( ), expected ) {
+            t.Fatalf( "Conclude - output does not contain %v", expected )
+        }
+    }
+
+    exitCode, _ = Conclude( &out, "suite", outcomes[ : 1 ], "" )
+    if exitCode != ExitCodePass {
+        t.Fatalf( "Conclude - returned %v for passed assertions", exitCode )
+    }
+
+    err = WriteJUnit( &junit, "suite", outcomes )
+    if err != nil {
+        t.Fatalf( "WriteJUnit - failed with error %v", err )
+    }
+
+    for _, expected := range [ ]string{ `tests="3"`, `failures="1"`, `skipped="1"`, "<failure", "<skipped" } {
+        if !strings.Contains( junit.String( ), expected ) {
+            t.Fatalf( "WriteJUnit - output does not contain %v", expected )
+        }
+    }
+}
+
+func TestEvaluateTopology( t *testing.T ) {
+    // Gateway 1 only receives, so nothing from it is expected at gateway 0
+    result := testResult( )
+    result.Topology = &stats.Topology {
+        GatewaysPerJob  :   1,
+        SenderJobs      :   [ ]int{ 0 },
+        ReceiverJobs    :   [ ]int{ 0, 1 },
+        Delivery        :   stats.DeliveryFanout,
+        SelfSkip        :   true,
+    }
+
+    result.Gateways[ 0 ].Sending, result.Gateways[ 0 ].Receiving = true, true
+    result.Gateways[ 1 ].Receiving = true
+    result.RcvdById = [ ][ ]uint64{ { 0, 0 }, { 99, 0 } }
+    result.UpdateDelivery( )
+
+    assertions := NewAssertions( )
+    assertions.MaxLossPct      = 0.5
+    assertions.MinCellDelivery = 0.99
+
+    outcomes := Evaluate( result, assertions )
+    if outcome := findOutcome( t, outcomes, "max-loss-pct" ); outcome.Passed || !strings.Contains( outcome.Actual, "99 of 100" ) {
+        t.Fatalf( "Evaluate - unexpected loss outcome %+v", outcome )
+    }
+
+    if outcome := findOutcome( t, outcomes, "min-cell-delivery" ); !outcome.Passed {
+        t.Fatalf( "Evaluate - unexpected cell delivery outcome %+v", outcome )
+    }
+
+    // A receiver the topology has receive is owed its share even when it got nothing at all
+    result.RcvdById = [ ][ ]uint64{ { 0, 0 }, { 0, 0 } }
+    result.Gateways[ 1 ].Rcvd = 0
+    result.UpdateDelivery( )
+
+    outcomes = Evaluate( result, assertions )
+    if outcome := findOutcome( t, outcomes, "max-loss-pct" ); outcome.Passed || outcome.Skipped || !strings.Contains( outcome.Actual, "0 of 100" ) {
+        t.Fatalf( "Evaluate - unexpected loss outcome for a silent receiver %+v", outcome )
+    }
+
+    if outcome := findOutcome( t, outcomes, "min-cell-delivery" ); outcome.Passed || outcome.Skipped {
+        t.Fatalf( "Evaluate - unexpected cell delivery outcome for a silent receiver %+v", outcome )
+    }
+
+    // Receivers that ran and got nothing fail the throughput however much was sent
+    result.Gateways[ 0 ].Rcvd, result.Rcvd, result.Sent = 0, 0, 100000
+    assertions.MinThroughput = 10
+
+    outcomes = Evaluate( result, assertions )
+    if outcome := findOutcome( t, outcomes, "min-throughput" ); outcome.Passed || !strings.Contains( outcome.Actual, "received" ) {
+        t.Fatalf( "Evaluate - unexpected throughput outcome for silent receivers %+v", outcome )
+    }
+
+    // Without receivers the send rate counts
+    result.Gateways[ 0 ].Receiving, result.Gateways[ 1 ].Receiving = false, false
+
+    outcomes = Evaluate( result, assertions )
+    if outcome := findOutcome( t, outcomes, "min-throughput" ); !outcome.Passed || !strings.Contains( outcome.Actual, "sent" ) {
+        t.Fatalf( "Evaluate - unexpected throughput outcome for a sender only run %+v", outcome )
+    }
+}
+
+func TestEvaluateCompeting( t *testing.T ) {
+    // Both gateways send 100 and share a queue, 185 of the 200 messages made it to one of them
+    result := testResult( )
+    result.Topology = &stats.Topology {
+        GatewaysPerJob  :   2,
+        SenderJobs      :   [ ]int{ 0 },
+        ReceiverJobs    :   [ ]int{ 0 },
+        Delivery        :   stats.DeliveryCompeting,
+    }
+
+    result.Gateways[ 0 ].Sending, result.Gateways[ 0 ].Receiving = true, true
+    result.Gateways[ 1 ].Sending, result.Gateways[ 1 ].Receiving = true, true
+    result.RcvdById = [ ][ ]uint64{ { 60, 40 }, { 35, 50 } }
+    result.UpdateDelivery( )
+
+    assertions := NewAssertions( )
+    assertions.MaxLossPct      = 5
+    assertions.MinCellDelivery = 0.5
+
+    outcomes := Evaluate( result, assertions )
+    if outcome := findOutcome( t, outcomes, "max-loss-pct" ); outcome.Passed || outcome.Skipped || !strings.Contains( outcome.Actual, "185 of 200" ) {
+        t.Fatalf( "Evaluate - unexpected competing loss outcome %+v", outcome )
+    }
+
+    if outcome := findOutcome( t, outcomes, "min-cell-delivery" ); outcome.Passed || outcome.Skipped {
+        t.Fatalf( "Evaluate - cell delivery passed for competing receivers %+v", outcome )
+    }
+}
@@ -0,0 +1,66 @@
+package stats
+
+import (
+    "math"
+)
+
+// How evenly received messages are spread across the receiving gateways. Jain is Jain's
+// fairness index, 1 when every receiver got the same share and 1 / Receivers when one got all
+type ReceiverBalance struct {
+    Receivers        int                    `json:"receivers"`
+    Min              uint64                 `json:"min"`
+    Max              uint64                 `json:"max"`
+    Mean             float64                `json:"mean"`
+    StdDev           float64                `json:"stdDev"`
+    Cv               float64                `json:"cv"`
+    Jain             float64                `json:"jain"`
+}
+
+func ( result *Result )isBalanceReceiver( idx int )( bool ) {
+    if !result.Gateways[ idx ].Receiving {
+        return false
+    }
+
+    return nil == result.Topology || result.Topology.IsReceiver( idx )
+}
+
+// Fills Balance from the receive counts of every gateway that received in this result
+func ( result *Result )UpdateBalance( ) {
+    balance := ReceiverBalance{ }
+
+    sum, sumSq := 0.0, 0.0
+    for i := range result.Gateways {
+        if !result.isBalanceReceiver( i ) {
+            continue
+        }
+
+        rcvd := result.Gateways[ i ].Rcvd
+        if balance.Receivers == 0 || rcvd < balance.Min {
+            balance.Min = rcvd
+        }
+
+        if rcvd > balance.Max {
+            balance.Max = rcvd
+        }
+
+        balance.Receivers++
+        sum   += float64( rcvd )
+        sumSq += float64( rcvd ) * float64( rcvd )
+    }
+
+    if balance.Receivers > 0 {
+        n := float64( balance.Receivers )
+        balance.Mean   = sum / n
+        balance.StdDev = math.Sqrt( math.Max( sumSq / n - balance.Mean * balance.Mean, 0 ) )
+    }
+
+    if balance.Mean > 0 {
+        balance.Cv = balance.StdDev / balance.Mean
+    }
+
+    if sumSq > 0 {
+        balance.Jain = sum * sum / ( float64( balance.Receivers ) * sumSq )
+    }
+
+    result.Balance = balance
+}
@@ -0,0 +1,37 @@
+package stats
+
+import (
+    "math"
+    "testing"
+)
+
+func TestUpdateBalance( t *testing.T ) {
+    result := &Result {
+        Gateways    :   [ ]GatewayResult {
+            { Rcvd : 10, Receiving : true },
+            { Rcvd : 30, Receiving : true },
+            { Rcvd : 99, Receiving : false },
+        },
+    }
+
+    result.UpdateBalance( )
+
+    balance := result.Balance
+    if balance.Receivers != 2 || balance.Min != 10 || balance.Max != 30 || balance.Mean != 20 {
+        t.Errorf( "UpdateBalance - unexpected counts %+v", balance )
+    }
+
+    if balance.StdDev != 10 || balance.Cv != 0.5 {
+        t.Errorf( "UpdateBalance - expected stddev 10 cv 0.5, got %v %v", balance.StdDev, balance.Cv )
+    }
+
+    if math.Abs( balance.Jain - 0.8 ) > 1e-9 {
+        t.Errorf( "UpdateBalance - expected jain 0.8, got %v", balance.Jain )
+    }
+
+    result.Topology = &Topology{ GatewaysPerJob : 1, ReceiverJobs : [ ]int{ 0 } }
+    result.UpdateBalance( )
+    if result.Balance.Receivers != 1 || result.Balance.Jain != 1 {
+        t.Errorf( "UpdateBalance - expected a single fair receiver, got %+v", result.Balance )
+    }
+}
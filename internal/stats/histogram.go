@@ -0,0 +1,151 @@
+package stats
+
+import (
+    "math/bits"
+    "sync/atomic"
+)
+
+// Values below histSubBuckets get a bucket each, larger values are split into
+// histSubBuckets buckets per power of two which bounds the error to 12.5%
+const (
+    histSubBucketBits   = 3
+    histSubBuckets      = 1 << histSubBucketBits
+    histBuckets         = ( 64 - histSubBucketBits + 1 ) * histSubBuckets
+)
+
+type Histogram struct {
+    counts        [ histBuckets ]uint64
+    count            uint64
+    sum              uint64
+    minPlusOne       uint64
+    max              uint64
+}
+
+type HistogramSnapshot struct {
+    Count            uint64     `json:"count"`
+    Min              uint64     `json:"min"`
+    Max              uint64     `json:"max"`
+    Mean             float64    `json:"mean"`
+    P50              uint64     `json:"p50"`
+    P90              uint64     `json:"p90"`
+    P95              uint64     `json:"p95"`
+    P99              uint64     `json:"p99"`
+    P999             uint64     `json:"p999"`
+}
+
+func histBucket( v uint64 )( int ) {
+    if v < histSubBuckets {
+        return int( v )
+    }
+
+    exp := bits.Len64( v ) - 1
+    sub := ( v >> uint( exp - histSubBucketBits ) ) & ( histSubBuckets - 1 )
+
+    return ( exp - histSubBucketBits + 1 ) * histSubBuckets + int( sub )
+}
+
+func histBucketUpperBound( idx int )( uint64 ) {
+    if idx < histSubBuckets {
+        return uint64( idx )
+    }
+
+    exp := idx / histSubBuckets - 1 + histSubBucketBits
+    sub := uint64( idx % histSubBuckets )
+    lo  := ( histSubBuckets + sub ) << uint( exp - histSubBucketBits )
+
+    return lo + ( uint64( 1 ) << uint( exp - histSubBucketBits ) ) - 1
+}
+
+func ( hist *Histogram )Record( v uint64 ) {
+    atomic.AddUint64( &hist.counts[ histBucket( v ) ], 1 )
+    atomic.AddUint64( &hist.sum, v )
+
+    // Minimum is stored off by one so that the zero value means no samples yet
+    for {
+        minPlusOne := atomic.LoadUint64( &hist.minPlusOne )
+        if minPlusOne != 0 && v + 1 >= minPlusOne {
+            break
+        }
+
+        if atomic.CompareAndSwapUint64( &hist.minPlusOne, minPlusOne, v + 1 ) {
+            break
+        }
+    }
+
+    for {
+        max := atomic.LoadUint64( &hist.max )
+        if v <= max || atomic.CompareAndSwapUint64( &hist.max, max, v ) {
+            break
+        }
+    }
+
+    atomic.AddUint64( &hist.count, 1 )
+}
+
+func ( hist *Histogram )Count( )( uint64 ) {
+    return atomic.LoadUint64( &hist.count )
+}
+
+func ( hist *Histogram )loadCounts( counts *[ histBuckets ]uint64 )( total uint64 ) {
+    for i := range hist.counts {
+        counts[ i ] = atomic.LoadUint64( &hist.counts[ i ] )
+        total      += counts[ i ]
+    }
+
+    return total
+}
+
+// Returns an approximation of the value at percentile p (0-100)
+func ( hist *Histogram )Percentile( p float64 )( uint64 ) {
+    var counts [ histBuckets ]uint64
+
+    total := hist.loadCounts( &counts )
+    return percentileFromCounts( &counts, total, p, atomic.LoadUint64( &hist.max ) )
+}
+
+func percentileFromCounts( counts *[ histBuckets ]uint64, total uint64, p float64, max uint64 )( uint64 ) {
+    if total == 0 {
+        return 0
+    }
+
+    rank := uint64( float64( total ) * p / 100 )
+    if rank >= total {
+        rank = total - 1
+    }
+
+    seen := uint64( 0 )
+    for i, c := range counts {
+        seen += c
+        if seen > rank {
+            v := histBucketUpperBound( i )
+            if v > max {
+                v = max
+            }
+
+            return v
+        }
+    }
+
+    return max
+}
+
+func ( hist *Histogram )Snapshot( )( snap HistogramSnapshot ) {
+    var counts [ histBuckets ]uint64
+
+    total := hist.loadCounts( &counts )
+    if total == 0 {
+        return snap
+    }
+
+    snap.Count = total
+    snap.Min   = atomic.LoadUint64( &hist.minPlusOne ) - 1
+    snap.Max   = atomic.LoadUint64( &hist.max )
+    snap.Mean  = float64( atomic.LoadUint64( &hist.sum ) ) / float64( total )
+    snap.P50   = percentileFromCounts( &counts, total, 50, snap.Max )
+    snap.P90   = percentileFromCounts( &counts, total, 90, snap.Max )
+    snap.P95   = percentileFromCounts( &counts, total, 95, snap.Max )
+    snap.P99   = percentileFromCounts( &counts, total, 99, snap.Max )
+    snap.P999  = percentileFromCounts( &counts, total, 99.9, snap.Max )
+
+    return snap
+}
@@ -0,0 +1,71 @@
+package stats
+
+import (
+    "testing"
+)
+
+func TestHistogramBuckets( t *testing.T ) {
+    for _, v := range [ ]uint64{ 0, 1, 7, 8, 15, 16, 100, 1000, 123456789, 1 << 62 } {
+        idx := histBucket( v )
+        if idx < 0 || idx >= histBuckets {
+            t.Fatalf( "histBucket - bucket %v out of range for %v", idx, v )
+        }
+
+        upper := histBucketUpperBound( idx )
+        if upper < v {
+            t.Fatalf( "histBucketUpperBound - upper bound %v below value %v", upper, v )
+        }
+
+        if float64( upper - v ) > float64( v ) / histSubBuckets {
+            t.Fatalf( "histBucketUpperBound - upper bound %v too far from value %v", upper, v )
+        }
+    }
+}
+
+func TestHistogramSnapshot( t *testing.T ) {
+    var hist Histogram
+
+    snap := hist.Snapshot( )
+    if snap.Count != 0 || snap.Min != 0 || snap.Max != 0 {
+        t.Fatalf( "Snapshot - empty histogram returned %+v", snap )
+    }
+
+    for v := uint64( 1 ); v <= 1000; v++ {
+        hist.Record( v )
+    }
+
+    snap = hist.Snapshot( )
+    if snap.Count != 1000 {
+        t.Fatalf( "Snapshot - count %v instead of 1000", snap.Count )
+    }
+
+    if snap.Min != 1 || snap.Max != 1000 {
+        t.Fatalf( "Snapshot - min %v max %v instead of 1 and 1000", snap.Min, snap.Max )
+    }
+
+    if snap.Mean != 500.5 {
+        t.Fatalf( "Snapshot - mean %v instead of 500.5", snap.Mean )
+    }
+
+    checks := map[ float64 ]uint64 {
+        50  :   snap.P50,
+        90  :   snap.P90,
+        99  :   snap.P99,
+    }
+
+    for p, v := range checks {
+        expected := p * 10
+        if float64( v ) < expected || float64( v ) > expected * 1.125 {
+            t.Fatalf( "Snapshot - p%v is %v, expected about %v", p, v, expected )
+        }
+    }
+
+    if snap.P999 > snap.Max {
+        t.Fatalf( "Snapshot - p99.9 %v above max %v", snap.P999, snap.Max )
+    }
+
+    hist.Record( 0 )
+    if hist.Snapshot( ).Min != 0 {
+        t.Fatalf( "Snapshot - min not updated for 0" )
+    }
+}
@@ -0,0 +1,326 @@
+package stats
+
+import (
+    "fmt"
+    "sort"
+)
+
+// Snapshots cannot be merged exactly, the percentiles of the merged snapshot are the worst
+// of the inputs which makes them an upper bound
+func mergeSnapshot( a, b HistogramSnapshot )( HistogramSnapshot ) {
+    if a.Count == 0 {
+        return b
+    }
+
+    if b.Count == 0 {
+        return a
+    }
+
+    merged := HistogramSnapshot {
+        Count   :   a.Count + b.Count,
+        Min     :   a.Min,
+        Max     :   a.Max,
+        Mean    :   ( a.Mean * float64( a.Count ) + b.Mean * float64( b.Count ) ) / float64( a.Count + b.Count ),
+        P50     :   a.P50,
+        P90     :   a.P90,
+        P95     :   a.P95,
+        P99     :   a.P99,
+        P999    :   a.P999,
+    }
+
+    if b.Min < merged.Min {
+        merged.Min = b.Min
+    }
+
+    for _, pair := range [ ][ 2 ]*uint64 {
+        { &merged.Max, &b.Max },
+        { &merged.P50, &b.P50 },
+        { &merged.P90, &b.P90 },
+        { &merged.P95, &b.P95 },
+        { &merged.P99, &b.P99 },
+        { &merged.P999, &b.P999 },
+    } {
+        if *pair[ 1 ] > *pair[ 0 ] {
+            *pair[ 0 ] = *pair[ 1 ]
+        }
+    }
+
+    return merged
+}
+
+func mergeGateway( into *GatewayResult, gw *GatewayResult ) {
+    into.Sent             += gw.Sent
+    into.Rcvd             += gw.Rcvd
+    into.Late             += gw.Late
+    into.SentBytes        += gw.SentBytes
+    into.RcvdBytes        += gw.RcvdBytes
+    into.BrokerSent       += gw.BrokerSent
+    into.BrokerRcvd       += gw.BrokerRcvd
+    into.Redelivered      += gw.Redelivered
+    into.OutOfOrder       += gw.OutOfOrder
+    into.SessionLocksLost += gw.SessionLocksLost
+    into.Cancelled        += gw.Cancelled
+    into.CancelledRcvd    += gw.CancelledRcvd
+    into.DlqRcvd          += gw.DlqRcvd
+    into.DlqInvalid       += gw.DlqInvalid
+    into.DeferRcvd        += gw.DeferRcvd
+    into.DeferLost        += gw.DeferLost
+    into.SelfSkipped      += gw.SelfSkipped
+    into.ExpiredRcvd      += gw.ExpiredRcvd
+    into.DlqExpired       += gw.DlqExpired
+    into.DupSent          += gw.DupSent
+    into.DupRcvd          += gw.DupRcvd
+    into.LockRenewals     += gw.LockRenewals
+    into.MsgLocksLost     += gw.MsgLocksLost
+    into.ReceiveCalls     += gw.ReceiveCalls
+    into.EmptyReceives    += gw.EmptyReceives
+    into.Retries          += gw.Retries
+    into.Errors           += gw.Errors
+    into.NegLatencies     += gw.NegLatencies
+    into.Sending          = into.Sending || gw.Sending
+    into.Receiving        = into.Receiving || gw.Receiving
+    into.Latency          = mergeSnapshot( into.Latency, gw.Latency )
+    into.SendLatency      = mergeSnapshot( into.SendLatency, gw.SendLatency )
+    into.MsgSize          = mergeSnapshot( into.MsgSize, gw.MsgSize )
+    into.SettleLatency    = mergeSnapshot( into.SettleLatency, gw.SettleLatency )
+    into.SessionAccept    = mergeSnapshot( into.SessionAccept, gw.SessionAccept )
+
+    if gw.MaxRetries > into.MaxRetries {
+        into.MaxRetries = gw.MaxRetries
+    }
+}
+
+// Value of a cumulative timeline at ts, carrying the last sample forward
+func sampleAt( timeline [ ]Sample, ts int64 )( sample Sample ) {
+    for _, s := range timeline {
+        if s.TimeStamp > ts {
+            break
+        }
+
+        sample = s
+    }
+
+    return sample
+}
+
+func mergeTimelines( results [ ]*Result )( merged [ ]Sample ) {
+    var stamps [ ]int64
+    for _, result := range results {
+        for _, s := range result.Timeline {
+            stamps = append( stamps, s.TimeStamp )
+        }
+    }
+
+    sort.Slice( stamps, func( i, j int )( bool ) { return stamps[ i ] < stamps[ j ] } )
+
+    for i, ts := range stamps {
+        if i > 0 && ts == stamps[ i - 1 ] {
+            continue
+        }
+
+        sample := Sample{ TimeStamp : ts }
+        for _, result := range results {
+            s := sampleAt( result.Timeline, ts )
+            sample.Sent   += s.Sent
+            sample.Rcvd   += s.Rcvd
+            sample.Errors += s.Errors
+
+            sample.SentBytes += s.SentBytes
+            sample.RcvdBytes += s.RcvdBytes
+        }
+
+        merged = append( merged, sample )
+    }
+
+    return merged
+}
+
+// Combines the results of the jobs of one deployment into one. All of them must cover the
+// same gateway block, counts are summed and latencies merged as upper bounds. Runtime metrics
+// are those of the busiest process since that is the one that may limit throughput.
+func MergeResults( results [ ]*Result )( merged *Result, err error ) {
+    if len( results ) == 0 {
+        return nil, fmt.Errorf( "no results to merge" )
+    }
+
+    first := results[ 0 ]
+    for _, result := range results[ 1: ] {
+        if len( result.Gateways ) != len( first.Gateways ) {
+            return nil, fmt.Errorf( "results cover %v and %v gateways", len( first.Gateways ), len( result.Gateways ) )
+        }
+    }
+
+    merged = &Result {
+        Name             :   first.Name,
+        StartTime        :   first.StartTime,
+        EndTime          :   first.EndTime,
+        MeasureStart     :   first.MeasureStart,
+        MeasureEnd       :   first.MeasureEnd,
+        Final            :   true,
+        Stage            :   first.Stage,
+        Config           :   first.Config,
+        ClockOffset      :   first.ClockOffset,
+        ClockUncertainty :   first.ClockUncertainty,
+        ErrorsByClass    :   make( map[ string ]uint64 ),
+        Gateways         :   make( [ ]GatewayResult, len( first.Gateways ) ),
+        RcvdById         :   make( [ ][ ]uint64, len( first.Gateways ) ),
+        Topology         :   first.Topology,
+        Runtime          :   first.Runtime,
+    }
+
+    for i := range merged.Gateways {
+        merged.Gateways[ i ].Id = first.Gateways[ i ].Id
+        merged.RcvdById[ i ]    = make( [ ]uint64, len( first.Gateways ) )
+    }
+
+    warnings := make( map[ string ]bool )
+
+    for _, result := range results {
+        if result.StartTime < merged.StartTime {
+            merged.StartTime = result.StartTime
+        }
+
+        if result.EndTime > merged.EndTime {
+            merged.EndTime = result.EndTime
+        }
+
+        if result.MeasureStart > 0 && ( merged.MeasureStart == 0 || result.MeasureStart < merged.MeasureStart ) {
+            merged.MeasureStart = result.MeasureStart
+        }
+
+        if result.MeasureEnd > merged.MeasureEnd {
+            merged.MeasureEnd = result.MeasureEnd
+        }
+
+        merged.Final = merged.Final && result.Final
+
+        // Only jobs with receivers set up filtered subscriptions, they did so in parallel
+        if len( result.SubFilter ) > 0 {
+            merged.SubFilter = result.SubFilter
+        }
+
+        if result.SubFilterSetup > merged.SubFilterSetup {
+            merged.SubFilterSetup = result.SubFilterSetup
+        }
+
+        // Every job opens connections of its own
+        if len( result.ClientTopology ) > 0 {
+            merged.ClientTopology = result.ClientTopology
+        }
+
+        merged.Connections += result.Connections
+
+        if len( result.Credential ) > 0 {
+            merged.Credential = result.Credential
+        }
+
+        merged.TokensAcquired += result.TokensAcquired
+        merged.TokenRefreshes += result.TokenRefreshes
+        merged.TokenFailures  += result.TokenFailures
+
+        if result.MessageTtl > merged.MessageTtl {
+            merged.MessageTtl = result.MessageTtl
+        }
+
+        if result.DupDelay > merged.DupDelay {
+            merged.DupDelay = result.DupDelay
+        }
+
+        if result.DupWindow > merged.DupWindow {
+            merged.DupWindow = result.DupWindow
+        }
+
+        merged.Latency        = mergeSnapshot( merged.Latency, result.Latency )
+        merged.SendLatency    = mergeSnapshot( merged.SendLatency, result.SendLatency )
+        merged.LatencyBound   = mergeSnapshot( merged.LatencyBound, result.LatencyBound )
+        merged.MsgSize        = mergeSnapshot( merged.MsgSize, result.MsgSize )
+        merged.SettleLatency  = mergeSnapshot( merged.SettleLatency, result.SettleLatency )
+        merged.SessionAccept  = mergeSnapshot( merged.SessionAccept, result.SessionAccept )
+        merged.ScheduleEarly  = mergeSnapshot( merged.ScheduleEarly, result.ScheduleEarly )
+        merged.ScheduleLate   = mergeSnapshot( merged.ScheduleLate, result.ScheduleLate )
+        merged.DlqLatency     = mergeSnapshot( merged.DlqLatency, result.DlqLatency )
+        merged.DeferLatency   = mergeSnapshot( merged.DeferLatency, result.DeferLatency )
+        merged.ProcessLatency = mergeSnapshot( merged.ProcessLatency, result.ProcessLatency )
+        merged.ReceiveBatch   = mergeSnapshot( merged.ReceiveBatch, result.ReceiveBatch )
+        merged.PrefetchWait   = mergeSnapshot( merged.PrefetchWait, result.PrefetchWait )
+        merged.ConnectTime    = mergeSnapshot( merged.ConnectTime, result.ConnectTime )
+        merged.TokenTime      = mergeSnapshot( merged.TokenTime, result.TokenTime )
+
+        for class, count := range result.ErrorsByClass {
+            merged.ErrorsByClass[ class ] += count
+        }
+
+        for action, count := range result.Settled {
+            if nil == merged.Settled {
+                merged.Settled = make( map[ string ]uint64 )
+            }
+
+            merged.Settled[ action ] += count
+        }
+
+        for i := range result.Gateways {
+            mergeGateway( &merged.Gateways[ i ], &result.Gateways[ i ] )
+        }
+
+        for r, row := range result.RcvdById {
+            for s, v := range row {
+                if r < len( merged.RcvdById ) && s < len( merged.RcvdById[ r ] ) {
+                    merged.RcvdById[ r ][ s ] += v
+                }
+            }
+        }
+
+        if result.Runtime.CpuPctMean > merged.Runtime.CpuPctMean {
+            merged.Runtime = result.Runtime
+        }
+
+        for _, warning := range result.Runtime.Warnings {
+            warnings[ warning ] = true
+        }
+    }
+
+    for _, gw := range merged.Gateways {
+        merged.Sent             += gw.Sent
+        merged.Rcvd             += gw.Rcvd
+        merged.Late             += gw.Late
+        merged.SentBytes        += gw.SentBytes
+        merged.RcvdBytes        += gw.RcvdBytes
+        merged.BrokerSent       += gw.BrokerSent
+        merged.BrokerRcvd       += gw.BrokerRcvd
+        merged.Redelivered      += gw.Redelivered
+        merged.OutOfOrder       += gw.OutOfOrder
+        merged.SessionLocksLost += gw.SessionLocksLost
+        merged.Cancelled        += gw.Cancelled
+        merged.CancelledRcvd    += gw.CancelledRcvd
+        merged.DlqRcvd          += gw.DlqRcvd
+        merged.DlqInvalid       += gw.DlqInvalid
+        merged.DeferRcvd        += gw.DeferRcvd
+        merged.DeferLost        += gw.DeferLost
+        merged.SelfSkipped      += gw.SelfSkipped
+        merged.ExpiredRcvd      += gw.ExpiredRcvd
+        merged.DlqExpired       += gw.DlqExpired
+        merged.DupSent          += gw.DupSent
+        merged.DupRcvd          += gw.DupRcvd
+        merged.LockRenewals     += gw.LockRenewals
+        merged.MsgLocksLost     += gw.MsgLocksLost
+        merged.ReceiveCalls     += gw.ReceiveCalls
+        merged.EmptyReceives    += gw.EmptyReceives
+        merged.Errors           += gw.Errors
+        merged.NegLatencies     += gw.NegLatencies
+    }
+
+    merged.Runtime.Warnings = nil
+    for warning := range warnings {
+        merged.Runtime.Warnings = append( merged.Runtime.Warnings, warning )
+    }
+
+    sort.Strings( merged.Runtime.Warnings )
+
+    merged.Timeline = mergeTimelines( results )
+    merged.UpdateDelivery( )
+    merged.UpdateUndelivered( )
+    merged.UpdateBalance( )
+    merged.UpdateSelfSkip( )
+
+    return merged, nil
+}
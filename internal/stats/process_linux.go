@@ -0,0 +1,40 @@
+package stats
+
+import (
+    "bytes"
+    "os"
+    "strconv"
+    "syscall"
+    "time"
+)
+
+func processCpuTime( )( time.Duration ) {
+    var ru syscall.Rusage
+
+    err := syscall.Getrusage( syscall.RUSAGE_SELF, &ru )
+    if err != nil {
+        return 0
+    }
+
+    return time.Duration( ru.Utime.Nano( ) + ru.Stime.Nano( ) )
+}
+
+// Resident set size from the second field of /proc/self/statm, in pages
+func processRss( )( uint64 ) {
+    data, err := os.ReadFile( "/proc/self/statm" )
+    if err != nil {
+        return 0
+    }
+
+    fields := bytes.Fields( data )
+    if len( fields ) < 2 {
+        return 0
+    }
+
+    pages, err := strconv.ParseUint( string( fields[ 1 ] ), 10, 64 )
+    if err != nil {
+        return 0
+    }
+
+    return pages * uint64( os.Getpagesize( ) )
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package stats
+
+import (
+    "time"
+)
+
+// Process metrics are only collected on linux, the bench image target
+func processCpuTime( )( time.Duration ) {
+    return 0
+}
+
+func processRss( )( uint64 ) {
+    return 0
+}
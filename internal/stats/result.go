@@ -0,0 +1,291 @@
+package stats
+
+import (
+    "fmt"
+    "reflect"
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// Fields that must never end up in a report
+var secretConfigFields = [ ]string {
+    "ConnStr",
+    "Password",
+}
+
+func isSecretConfigField( name string )( bool ) {
+    for _, secret := range secretConfigFields {
+        if strings.EqualFold( name, secret ) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// Records the exported fields of cfg, which must be a struct or a pointer to one, as the run configuration
+func ( stats *Stats )SetConfig( name string, cfg interface{ } ) {
+    stats.name   = name
+    stats.config = nil
+
+    val := reflect.Indirect( reflect.ValueOf( cfg ) )
+    if val.Kind( ) != reflect.Struct {
+        return
+    }
+
+    typ := val.Type( )
+    for i := 0; i < typ.NumField( ); i++ {
+        field := typ.Field( i )
+        if len( field.PkgPath ) > 0 || field.Anonymous || isSecretConfigField( field.Name ) {
+            continue
+        }
+
+        stats.config = append( stats.config, ConfigEntry {
+            Name    :   field.Name,
+            Value   :   fmt.Sprint( val.Field( i ).Interface( ) ),
+        } )
+    }
+}
+
+func ( stats *Stats )SetStage( stage string ) {
+    stats.stage.Store( stage )
+}
+
+func ( stats *Stats )GetStage( )( string ) {
+    stage, _ := stats.stage.Load( ).( string )
+    return stage
+}
+
+func ( stats *Stats )MarkMeasureStart( ) {
+    atomic.StoreInt64( &stats.measureStart, time.Now( ).UnixMilli( ) )
+    stats.SetStage( StageMeasure )
+}
+
+func ( stats *Stats )MarkMeasureEnd( ) {
+    atomic.StoreInt64( &stats.measureEnd, time.Now( ).UnixMilli( ) )
+    stats.SetStage( StageCooldown )
+}
+
+func ( stats *Stats )recordSample( ) {
+    sample := Sample {
+        TimeStamp   :   time.Now( ).UnixMilli( ),
+    }
+
+    for i := range stats.elems {
+        sample.Sent   += atomic.LoadUint64( &stats.elems[ i ].sent )
+        sample.Rcvd   += atomic.LoadUint64( &stats.elems[ i ].rcvd )
+        sample.Errors += atomic.LoadUint64( &stats.elems[ i ].errors )
+
+        sample.SentBytes += atomic.LoadUint64( &stats.elems[ i ].sentBytes )
+        sample.RcvdBytes += atomic.LoadUint64( &stats.elems[ i ].rcvdBytes )
+    }
+
+    stats.timelineLock.Lock( )
+    stats.timeline = append( stats.timeline, sample )
+    stats.timelineLock.Unlock( )
+
+    stats.runtimeLock.Lock( )
+    if stats.runtime != nil {
+        stats.runtime.sample( )
+    }
+    stats.runtimeLock.Unlock( )
+}
+
+func ( stats *Stats )GetResult( final bool )( result *Result ) {
+    result = &Result {
+        Name             :   stats.name,
+        StartTime        :   stats.startTime.UnixMilli( ),
+        EndTime          :   time.Now( ).UnixMilli( ),
+        MeasureStart     :   atomic.LoadInt64( &stats.measureStart ),
+        MeasureEnd       :   atomic.LoadInt64( &stats.measureEnd ),
+        Final            :   final,
+        Stage            :   stats.GetStage( ),
+        Config           :   stats.config,
+        Latency          :   stats.latencyHist.Snapshot( ),
+        SendLatency      :   stats.sendLatencyHist.Snapshot( ),
+        MsgSize          :   stats.msgSizeHist.Snapshot( ),
+        SettleLatency    :   stats.settleHist.Snapshot( ),
+        SessionAccept    :   stats.acceptHist.Snapshot( ),
+        ScheduleEarly    :   stats.earlyHist.Snapshot( ),
+        ScheduleLate     :   stats.lateHist.Snapshot( ),
+        DlqLatency       :   stats.dlqHist.Snapshot( ),
+        DeferLatency     :   stats.deferHist.Snapshot( ),
+        ProcessLatency   :   stats.processHist.Snapshot( ),
+        ReceiveBatch     :   stats.rcvBatchHist.Snapshot( ),
+        PrefetchWait     :   stats.prefetchHist.Snapshot( ),
+        ClockOffset      :   stats.clockOffset,
+        ClockUncertainty :   stats.clockUncertainty,
+        SubFilter        :   stats.subFilter,
+        SubFilterSetup   :   stats.subFilterSetup,
+        ClientTopology   :   stats.clientTopology,
+        Connections      :   stats.connections,
+        ConnectTime      :   stats.connectHist.Snapshot( ),
+        Credential       :   stats.credential,
+        TokensAcquired   :   atomic.LoadUint64( &stats.tokensAcquired ),
+        TokenRefreshes   :   atomic.LoadUint64( &stats.tokenRefreshes ),
+        TokenFailures    :   atomic.LoadUint64( &stats.tokenFailures ),
+        TokenTime        :   stats.tokenHist.Snapshot( ),
+        MessageTtl       :   stats.messageTtl,
+        DupDelay         :   stats.dupDelay,
+        DupWindow        :   stats.dupWindow,
+        LatencyBound     :   stats.latencyBoundHist.Snapshot( ),
+        ErrorsByClass    :   make( map[ string ]uint64 ),
+        Gateways         :   make( [ ]GatewayResult, len( stats.elems ) ),
+        RcvdById         :   make( [ ][ ]uint64, len( stats.elems ) ),
+        Topology         :   stats.topology,
+    }
+
+    for i := range stats.elems {
+        v := &stats.elems[ i ]
+
+        result.Gateways[ i ] = GatewayResult {
+            Id               :   stats.ids[ i ],
+            Sent             :   atomic.LoadUint64( &v.sent ),
+            Rcvd             :   atomic.LoadUint64( &v.rcvd ),
+            Late             :   atomic.LoadUint64( &v.late ),
+            SentBytes        :   atomic.LoadUint64( &v.sentBytes ),
+            RcvdBytes        :   atomic.LoadUint64( &v.rcvdBytes ),
+            MsgSize          :   v.msgSizeHist.Snapshot( ),
+            BrokerSent       :   atomic.LoadUint64( &v.brokerSent ),
+            BrokerRcvd       :   atomic.LoadUint64( &v.brokerRcvd ),
+            Redelivered      :   atomic.LoadUint64( &v.redelivered ),
+            SettleLatency    :   v.settleHist.Snapshot( ),
+            OutOfOrder       :   atomic.LoadUint64( &v.outOfOrder ),
+            SessionLocksLost :   atomic.LoadUint64( &v.locksLost ),
+            SessionAccept    :   v.acceptHist.Snapshot( ),
+            Cancelled        :   atomic.LoadUint64( &v.cancelled ),
+            CancelledRcvd    :   atomic.LoadUint64( &v.cancelledRcvd ),
+            DlqRcvd          :   atomic.LoadUint64( &v.dlqRcvd ),
+            DlqInvalid       :   atomic.LoadUint64( &v.dlqInvalid ),
+            DeferRcvd        :   atomic.LoadUint64( &v.deferRcvd ),
+            DeferLost        :   atomic.LoadUint64( &v.deferLost ),
+            SelfSkipped      :   atomic.LoadUint64( &v.selfSkipped ),
+            ExpiredRcvd      :   atomic.LoadUint64( &v.expiredRcvd ),
+            DlqExpired       :   atomic.LoadUint64( &v.dlqExpired ),
+            DupSent          :   atomic.LoadUint64( &v.dupSent ),
+            DupRcvd          :   atomic.LoadUint64( &v.dupRcvd ),
+            LockRenewals     :   atomic.LoadUint64( &v.lockRenewals ),
+            MsgLocksLost     :   atomic.LoadUint64( &v.msgLocksLost ),
+            ReceiveCalls     :   atomic.LoadUint64( &v.rcvCalls ),
+            EmptyReceives    :   atomic.LoadUint64( &v.emptyRcvCalls ),
+            Retries          :   atomic.LoadUint64( &v.retries ),
+            MaxRetries       :   atomic.LoadUint64( &v.maxRetries ),
+            Errors           :   atomic.LoadUint64( &v.errors ),
+            Latency          :   v.latencyHist.Snapshot( ),
+            SendLatency      :   v.sendLatencyHist.Snapshot( ),
+            NegLatencies     :   atomic.LoadUint64( &v.negLatencies ),
+            Sending          :   v.sending,
+            Receiving        :   v.receiving,
+        }
+
+        result.Sent   += result.Gateways[ i ].Sent
+        result.Rcvd   += result.Gateways[ i ].Rcvd
+        result.Errors += result.Gateways[ i ].Errors
+        result.Late   += result.Gateways[ i ].Late
+
+        result.Redelivered      += result.Gateways[ i ].Redelivered
+        result.OutOfOrder       += result.Gateways[ i ].OutOfOrder
+        result.SessionLocksLost += result.Gateways[ i ].SessionLocksLost
+        result.Cancelled        += result.Gateways[ i ].Cancelled
+        result.CancelledRcvd    += result.Gateways[ i ].CancelledRcvd
+        result.DlqRcvd          += result.Gateways[ i ].DlqRcvd
+        result.DlqInvalid       += result.Gateways[ i ].DlqInvalid
+        result.DeferRcvd        += result.Gateways[ i ].DeferRcvd
+        result.DeferLost        += result.Gateways[ i ].DeferLost
+        result.SelfSkipped      += result.Gateways[ i ].SelfSkipped
+        result.ExpiredRcvd      += result.Gateways[ i ].ExpiredRcvd
+        result.DlqExpired       += result.Gateways[ i ].DlqExpired
+        result.DupSent          += result.Gateways[ i ].DupSent
+        result.DupRcvd          += result.Gateways[ i ].DupRcvd
+        result.LockRenewals     += result.Gateways[ i ].LockRenewals
+        result.MsgLocksLost     += result.Gateways[ i ].MsgLocksLost
+        result.ReceiveCalls     += result.Gateways[ i ].ReceiveCalls
+        result.EmptyReceives    += result.Gateways[ i ].EmptyReceives
+
+        result.SentBytes  += result.Gateways[ i ].SentBytes
+        result.RcvdBytes  += result.Gateways[ i ].RcvdBytes
+        result.BrokerSent += result.Gateways[ i ].BrokerSent
+        result.BrokerRcvd += result.Gateways[ i ].BrokerRcvd
+
+        result.NegLatencies += result.Gateways[ i ].NegLatencies
+
+        result.RcvdById[ i ] = make( [ ]uint64, len( v.rcvdById ) )
+        for j := range v.rcvdById {
+            result.RcvdById[ i ][ j ] = atomic.LoadUint64( &v.rcvdById[ j ] )
+        }
+    }
+
+    result.UpdateDelivery( )
+    result.UpdateUndelivered( )
+    result.UpdateBalance( )
+    result.UpdateSelfSkip( )
+
+    stats.errorsLock.Lock( )
+    for class, count := range stats.errorsByClass {
+        result.ErrorsByClass[ class ] = count
+    }
+    stats.errorsLock.Unlock( )
+
+    stats.settledLock.Lock( )
+    if len( stats.settled ) > 0 {
+        result.Settled = make( map[ string ]uint64, len( stats.settled ) )
+        for action, count := range stats.settled {
+            result.Settled[ action ] = count
+        }
+    }
+    stats.settledLock.Unlock( )
+
+    stats.timelineLock.Lock( )
+    result.Timeline = make( [ ]Sample, len( stats.timeline ) )
+    copy( result.Timeline, stats.timeline )
+    stats.timelineLock.Unlock( )
+
+    stats.runtimeLock.Lock( )
+    if stats.runtime != nil {
+        result.Runtime = stats.runtime.result( result.MeasureStart, result.MeasureEnd )
+    }
+    stats.runtimeLock.Unlock( )
+
+    return result
+}
+
+// Duration of the measured part of the run in seconds
+func ( result *Result )DurationSeconds( )( float64 ) {
+    start := result.MeasureStart
+    if start == 0 {
+        start = result.StartTime
+    }
+
+    end := result.MeasureEnd
+    if end == 0 {
+        end = result.EndTime
+    }
+
+    if end <= start {
+        return 0
+    }
+
+    return float64( end - start ) / 1000
+}
+
+// Tags the receive rate with how own messages are skipped, so that runs with and without subscription
+// filters can be compared. Runs where receivers get their own messages have no mode.
+func ( result *Result )UpdateSelfSkip( ) {
+    result.SelfSkipMode, result.SelfSkipRcvdRate = "", 0
+
+    switch {
+        case len( result.SubFilter ) > 0:
+            result.SelfSkipMode = SelfSkipFiltered
+
+        case result.Topology != nil && result.Topology.SelfSkip:
+            result.SelfSkipMode = SelfSkipClient
+
+        default:
+            return
+    }
+
+    if duration := result.DurationSeconds( ); duration > 0 {
+        result.SelfSkipRcvdRate = float64( result.Rcvd ) / duration
+    }
+}
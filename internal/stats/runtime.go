@@ -0,0 +1,271 @@
+package stats
+
+import (
+    "fmt"
+    "math"
+    "runtime"
+    "runtime/metrics"
+    "sort"
+    "time"
+)
+
+const (
+    metricGcPauses      = "/gc/pauses:seconds"
+    metricSchedLatency  = "/sched/latencies:seconds"
+    metricGoroutines    = "/sched/goroutines:goroutines"
+    metricGcCycles      = "/gc/cycles/total:gc-cycles"
+    metricHeap          = "/memory/classes/heap/objects:bytes"
+)
+
+// Thresholds above which the bench process itself, not the broker, is likely limiting throughput
+var (
+    WarnCpuFraction     = 0.9
+    WarnSchedLatencyUs  = uint64( 5000 )
+    WarnGcPauseUs       = uint64( 5000 )
+)
+
+// Cpu is in percent of a single core, same as top, so it may go up to MaxProcs * 100
+type RuntimeSample struct {
+    TimeStamp        int64                  `json:"ts"`
+    CpuPct           float64                `json:"cpuPct"`
+    RssBytes         uint64                 `json:"rssBytes"`
+    HeapBytes        uint64                 `json:"heapBytes"`
+    Goroutines       uint64                 `json:"goroutines"`
+}
+
+// Pause and scheduling latencies are in microseconds and cover the time since the dumper was started
+type RuntimeResult struct {
+    MaxProcs         int                    `json:"maxProcs"`
+    CpuPctMean       float64                `json:"cpuPctMean"`
+    CpuPctMax        float64                `json:"cpuPctMax"`
+    RssMax           uint64                 `json:"rssMax"`
+    GoroutinesMax    uint64                 `json:"goroutinesMax"`
+    GcCycles         uint64                 `json:"gcCycles"`
+    GcPause          HistogramSnapshot      `json:"gcPauseUs"`
+    SchedLatency     HistogramSnapshot      `json:"schedLatencyUs"`
+    Samples       [ ]RuntimeSample          `json:"samples"`
+    Warnings      [ ]string                 `json:"warnings,omitempty"`
+}
+
+type runtimeSampler struct {
+    metrics       [ ]metrics.Sample
+
+    lastWall         time.Time
+    lastCpu          time.Duration
+
+    baseGcCycles     uint64
+    baseGcPauses  [ ]uint64
+    baseSchedLat  [ ]uint64
+
+    samples       [ ]RuntimeSample
+}
+
+func newRuntimeSampler( )( sampler *runtimeSampler ) {
+    sampler = &runtimeSampler {
+        metrics     :   [ ]metrics.Sample {
+            { Name : metricGcPauses },
+            { Name : metricSchedLatency },
+            { Name : metricGoroutines },
+            { Name : metricGcCycles },
+            { Name : metricHeap },
+        },
+        lastWall    :   time.Now( ),
+        lastCpu     :   processCpuTime( ),
+    }
+
+    // Only what happens while the bench runs is of interest
+    metrics.Read( sampler.metrics )
+    sampler.baseGcPauses = histCounts( sampler.metrics[ 0 ].Value )
+    sampler.baseSchedLat = histCounts( sampler.metrics[ 1 ].Value )
+    sampler.baseGcCycles = uintValue( sampler.metrics[ 3 ].Value )
+
+    return sampler
+}
+
+func histCounts( value metrics.Value )( counts [ ]uint64 ) {
+    if value.Kind( ) != metrics.KindFloat64Histogram {
+        return nil
+    }
+
+    hist := value.Float64Histogram( )
+    counts = make( [ ]uint64, len( hist.Counts ) )
+    copy( counts, hist.Counts )
+
+    return counts
+}
+
+func uintValue( value metrics.Value )( uint64 ) {
+    if value.Kind( ) != metrics.KindUint64 {
+        return 0
+    }
+
+    return value.Uint64( )
+}
+
+func ( sampler *runtimeSampler )sample( ) {
+    now := time.Now( )
+    cpu := processCpuTime( )
+
+    metrics.Read( sampler.metrics )
+
+    sample := RuntimeSample {
+        TimeStamp   :   now.UnixMilli( ),
+        RssBytes    :   processRss( ),
+        HeapBytes   :   uintValue( sampler.metrics[ 4 ].Value ),
+        Goroutines  :   uintValue( sampler.metrics[ 2 ].Value ),
+    }
+
+    wall := now.Sub( sampler.lastWall )
+    if wall > 0 {
+        sample.CpuPct = float64( cpu - sampler.lastCpu ) / float64( wall ) * 100
+    }
+
+    sampler.lastWall = now
+    sampler.lastCpu  = cpu
+    sampler.samples  = append( sampler.samples, sample )
+}
+
+// Snapshot of a runtime histogram in microseconds, minus the counts present at base
+func runtimeHistSnapshot( value metrics.Value, base [ ]uint64 )( snap HistogramSnapshot ) {
+    if value.Kind( ) != metrics.KindFloat64Histogram {
+        return snap
+    }
+
+    hist   := value.Float64Histogram( )
+    counts := make( [ ]uint64, len( hist.Counts ) )
+
+    sum := 0.0
+    for i := range hist.Counts {
+        counts[ i ] = hist.Counts[ i ]
+        if i < len( base ) {
+            counts[ i ] -= base[ i ]
+        }
+
+        if counts[ i ] > 0 {
+            snap.Count += counts[ i ]
+            sum        += float64( counts[ i ] ) * bucketUs( hist.Buckets, i )
+        }
+    }
+
+    if snap.Count == 0 {
+        return snap
+    }
+
+    snap.Mean = sum / float64( snap.Count )
+
+    percentile := func( p float64 )( uint64 ) {
+        rank := uint64( math.Ceil( p / 100 * float64( snap.Count ) ) )
+
+        var seen uint64
+        for i, c := range counts {
+            seen += c
+            if seen >= rank {
+                return uint64( bucketUs( hist.Buckets, i ) )
+            }
+        }
+
+        return 0
+    }
+
+    for i, c := range counts {
+        if c > 0 {
+            snap.Min = uint64( bucketUs( hist.Buckets, i ) )
+            break
+        }
+    }
+
+    for i := len( counts ) - 1; i >= 0; i-- {
+        if counts[ i ] > 0 {
+            snap.Max = uint64( bucketUs( hist.Buckets, i ) )
+            break
+        }
+    }
+
+    snap.P50  = percentile( 50 )
+    snap.P90  = percentile( 90 )
+    snap.P95  = percentile( 95 )
+    snap.P99  = percentile( 99 )
+    snap.P999 = percentile( 99.9 )
+
+    return snap
+}
+
+// Upper bound of bucket i in microseconds, the lower bound when the bucket is open ended
+func bucketUs( buckets [ ]float64, i int )( float64 ) {
+    v := buckets[ i + 1 ]
+    if math.IsInf( v, 1 ) {
+        v = buckets[ i ]
+    }
+
+    return v * 1e6
+}
+
+func ( sampler *runtimeSampler )result( measureStart, measureEnd int64 )( result RuntimeResult ) {
+    result = RuntimeResult {
+        MaxProcs        :   runtime.GOMAXPROCS( 0 ),
+        GcCycles        :   uintValue( sampler.metrics[ 3 ].Value ) - sampler.baseGcCycles,
+        GcPause         :   runtimeHistSnapshot( sampler.metrics[ 0 ].Value, sampler.baseGcPauses ),
+        SchedLatency    :   runtimeHistSnapshot( sampler.metrics[ 1 ].Value, sampler.baseSchedLat ),
+        Samples         :   make( [ ]RuntimeSample, len( sampler.samples ) ),
+    }
+
+    copy( result.Samples, sampler.samples )
+
+    // Ramp up and drain are not representative of the load, only look at the measured window if known
+    n, sum := 0, 0.0
+    for _, s := range result.Samples {
+        result.RssMax        = max64( result.RssMax, s.RssBytes )
+        result.GoroutinesMax = max64( result.GoroutinesMax, s.Goroutines )
+
+        if ( measureStart > 0 && s.TimeStamp < measureStart ) || ( measureEnd > 0 && s.TimeStamp > measureEnd ) {
+            continue
+        }
+
+        n++
+        sum += s.CpuPct
+        result.CpuPctMax = math.Max( result.CpuPctMax, s.CpuPct )
+    }
+
+    if n > 0 {
+        result.CpuPctMean = sum / float64( n )
+    }
+
+    result.Warnings = result.bottlenecks( )
+    return result
+}
+
+func max64( a, b uint64 )( uint64 ) {
+    if a > b {
+        return a
+    }
+
+    return b
+}
+
+// Reasons to believe the bench process rather than the broker limits throughput
+func ( result *RuntimeResult )bottlenecks( )( warnings [ ]string ) {
+    capacity := float64( result.MaxProcs ) * 100
+    if capacity > 0 && result.CpuPctMean >= WarnCpuFraction * capacity {
+        warnings = append( warnings, fmt.Sprintf(
+            "harness cpu usage averaged %.0f%% of %v usable cores, throughput is likely limited by the bench process",
+            result.CpuPctMean, result.MaxProcs,
+        ) )
+    }
+
+    if result.SchedLatency.P99 >= WarnSchedLatencyUs {
+        warnings = append( warnings, fmt.Sprintf(
+            "goroutines waited %vus at p99 to get scheduled, the bench process is oversubscribed and latencies include harness delay",
+            result.SchedLatency.P99,
+        ) )
+    }
+
+    if result.GcPause.P99 >= WarnGcPauseUs {
+        warnings = append( warnings, fmt.Sprintf(
+            "gc pauses reached %vus at p99 over %v cycles, latencies include harness delay",
+            result.GcPause.P99, result.GcCycles,
+        ) )
+    }
+
+    sort.Strings( warnings )
+    return warnings
+}
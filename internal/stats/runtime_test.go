@@ -0,0 +1,59 @@
+package stats
+
+import (
+    "runtime"
+    "strings"
+    "testing"
+)
+
+func TestRuntimeSampler( t *testing.T ) {
+    sampler := newRuntimeSampler( )
+
+    // Burn some cpu and garbage so there is something to measure
+    var keep [ ][ ]byte
+    for i := 0; i < 1000; i++ {
+        keep = append( keep, make( [ ]byte, 4096 ) )
+    }
+
+    sampler.sample( )
+    sampler.sample( )
+
+    result := sampler.result( 0, 0 )
+    if len( result.Samples ) != 2 {
+        t.Fatalf( "result - expected 2 samples, got %v", len( result.Samples ) )
+    }
+
+    if result.MaxProcs <= 0 || result.GoroutinesMax == 0 {
+        t.Errorf( "result - expected procs and goroutines, got %+v", result )
+    }
+
+    if runtime.GOOS == "linux" && result.RssMax == 0 {
+        t.Errorf( "result - expected rss to be reported" )
+    }
+
+    _ = keep
+}
+
+func TestRuntimeBottlenecks( t *testing.T ) {
+    result := RuntimeResult {
+        MaxProcs    :   2,
+        CpuPctMean  :   50,
+    }
+
+    if warnings := result.bottlenecks( ); len( warnings ) != 0 {
+        t.Errorf( "bottlenecks - expected no warnings for an idle harness, got %v", warnings )
+    }
+
+    result.CpuPctMean       = 195
+    result.SchedLatency.P99 = WarnSchedLatencyUs
+    result.GcPause.P99      = WarnGcPauseUs
+
+    warnings := result.bottlenecks( )
+    if len( warnings ) != 3 {
+        t.Fatalf( "bottlenecks - expected 3 warnings, got %v", warnings )
+    }
+
+    if !strings.Contains( strings.Join( warnings, "\n" ), "cpu usage" ) {
+        t.Errorf( "bottlenecks - expected a cpu warning, got %v", warnings )
+    }
+}
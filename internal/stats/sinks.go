@@ -0,0 +1,368 @@
+package stats
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "sync"
+)
+
+// Sinks get a snapshot every dump interval and a final one, with Final set, once the run
+// is over. Writes happen on the dumper goroutine so implementations need not be thread safe.
+type Sink interface {
+    Write( result *Result )( error )
+    Close( )( error )
+}
+
+type TextSink struct {
+    w               io.Writer
+}
+
+type JsonFileSink struct {
+    file            string
+}
+
+type CsvSink struct {
+    fh             *os.File
+    w              *csv.Writer
+}
+
+type MemorySink struct {
+    lock            sync.Mutex
+    results      [ ]*Result
+}
+
+func NewTextSink( w io.Writer )( *TextSink ) {
+    return &TextSink {
+        w   :   w,
+    }
+}
+
+func ( sink *TextSink )Write( result *Result )( err error ) {
+    fmt.Fprintf( sink.w, "---\n" )
+
+    for i, gw := range result.Gateways {
+        _, err = fmt.Fprintf(
+            sink.w,
+            "%v: Sent %v Rcvd %v Late %v Sent Bytes %v Rcvd Bytes %v Retries %v Max Retries %v Avg Latency %.0f Max Latency %v P99 Latency %v P99 Send Latency %vus Negative Latencies %v Errors %v\n",
+            gw.Id, gw.Sent, gw.Rcvd, gw.Late, gw.SentBytes, gw.RcvdBytes, gw.Retries, gw.MaxRetries, gw.Latency.Mean, gw.Latency.Max, gw.Latency.P99,
+            gw.SendLatency.P99, gw.NegLatencies, gw.Errors,
+        )
+        if err != nil {
+            return err
+        }
+
+        if result.Final && i < len( result.RcvdById ) {
+            for j, count := range result.RcvdById[ i ] {
+                fmt.Fprintf( sink.w, "%v: Received %v\n", result.Gateways[ j ].Id, count )
+            }
+        }
+
+        if result.Final && result.Topology != nil {
+            fmt.Fprintf(
+                sink.w,
+                "%v: Delivered %v of %v expected as sender, received %v of %v expected as receiver\n",
+                gw.Id, gw.AsSender.Delivered, gw.AsSender.Expected, gw.AsReceiver.Delivered, gw.AsReceiver.Expected,
+            )
+        }
+    }
+
+    rt := &result.Runtime
+    if n := len( rt.Samples ); n > 0 {
+        last := rt.Samples[ n - 1 ]
+        fmt.Fprintf(
+            sink.w,
+            "Harness: Cpu %.0f%% Rss %vMB Goroutines %v Gc Cycles %v P99 Gc Pause %vus P99 Sched Latency %vus\n",
+            last.CpuPct, last.RssBytes >> 20, last.Goroutines, rt.GcCycles, rt.GcPause.P99, rt.SchedLatency.P99,
+        )
+    }
+
+    if result.BrokerSent > 0 || result.BrokerRcvd > 0 {
+        fmt.Fprintf( sink.w, "Broker Messages: Sent %v Rcvd %v\n", result.BrokerSent, result.BrokerRcvd )
+    }
+
+    if result.Connections > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Connections: Topology %v Count %v P50 Connect %vms Max Connect %vms\n",
+            result.ClientTopology, result.Connections, result.ConnectTime.P50, result.ConnectTime.Max,
+        )
+    }
+
+    if len( result.Credential ) > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Credential: %v Tokens Acquired %v Refreshed %v Failed %v P50 Token %vms Max Token %vms\n",
+            result.Credential, result.TokensAcquired, result.TokenRefreshes, result.TokenFailures, result.TokenTime.P50, result.TokenTime.Max,
+        )
+    }
+
+    if len( result.SelfSkipMode ) > 0 || result.SelfSkipped > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Self Skip: Mode %v Subscription Filter %q Setup %vms Skipped By Receivers %v Receive Rate %.2f msgs/s\n",
+            result.SelfSkipMode, result.SubFilter, result.SubFilterSetup, result.SelfSkipped, result.SelfSkipRcvdRate,
+        )
+    }
+
+    if len( result.Settled ) > 0 || result.Redelivered > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Settlement: Complete %v Abandon %v Dead Letter %v Defer %v Redelivered %v P99 Settle Latency %vus\n",
+            result.Settled[ SettleComplete ], result.Settled[ SettleAbandon ], result.Settled[ SettleDeadLetter ],
+            result.Settled[ SettleDefer ], result.Redelivered, result.SettleLatency.P99,
+        )
+    }
+
+    if result.Settled[ SettleDefer ] > 0 || result.DeferRcvd > 0 || result.DeferLost > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Deferred: Deferred %v Retrieved %v Lost %v P50 Round Trip %vms P99 Round Trip %vms\n",
+            result.Settled[ SettleDefer ], result.DeferRcvd, result.DeferLost, result.DeferLatency.P50, result.DeferLatency.P99,
+        )
+    }
+
+    if result.DlqRcvd > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Dead Letters: Dead Lettered %v Read Back %v Invalid %v P99 Round Trip %vms\n",
+            result.Settled[ SettleDeadLetter ], result.DlqRcvd, result.DlqInvalid, result.DlqLatency.P99,
+        )
+    }
+
+    if result.ReceiveCalls > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Receive Calls: Calls %v Empty %v P50 Batch %v P99 Batch %v P99 Prefetch Wait %vus\n",
+            result.ReceiveCalls, result.EmptyReceives, result.ReceiveBatch.P50, result.ReceiveBatch.P99, result.PrefetchWait.P99,
+        )
+    }
+
+    if result.ProcessLatency.Count > 0 || result.MsgLocksLost > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Processing: Processed %v P50 %vms P99 %vms Max %vms Lock Renewals %v Locks Lost %v\n",
+            result.ProcessLatency.Count, result.ProcessLatency.P50, result.ProcessLatency.P99, result.ProcessLatency.Max,
+            result.LockRenewals, result.MsgLocksLost,
+        )
+    }
+
+    if result.SessionAccept.Count > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Sessions: Accepted %v P99 Accept Latency %vus Locks Lost %v Out Of Order %v\n",
+            result.SessionAccept.Count, result.SessionAccept.P99, result.SessionLocksLost, result.OutOfOrder,
+        )
+    }
+
+    if result.ScheduleEarly.Count > 0 || result.ScheduleLate.Count > 0 || result.Cancelled > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Scheduled: Early %v P99 Early %vms Late %v P99 Late %vms Max Late %vms Cancelled %v Cancelled Arrived %v\n",
+            result.ScheduleEarly.Count, result.ScheduleEarly.P99, result.ScheduleLate.Count, result.ScheduleLate.P99, result.ScheduleLate.Max,
+            result.Cancelled, result.CancelledRcvd,
+        )
+    }
+
+    if result.Final && result.Topology != nil {
+        fmt.Fprintf( sink.w, "Delivery: %v of %v expected, ratio %.4f\n", result.Delivery.Delivered, result.Delivery.Expected, result.Delivery.Ratio( ) )
+    }
+
+    if result.MessageTtl > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Expiry: Ttl %vms Delivered %v Undelivered %v Delivered After Expiry %v Dead Lettered On Expiry %v\n",
+            result.MessageTtl, result.Delivery.Delivered, result.Undelivered, result.ExpiredRcvd, result.DlqExpired,
+        )
+    }
+
+    if result.DupSent > 0 || result.DupRcvd > 0 {
+        fmt.Fprintf(
+            sink.w,
+            "Duplicates: Delay %vms Window %vms Resent %v Got Through %v\n",
+            result.DupDelay, result.DupWindow, result.DupSent, result.DupRcvd,
+        )
+    }
+
+    if result.Final && result.Balance.Receivers > 1 {
+        balance := &result.Balance
+        fmt.Fprintf(
+            sink.w,
+            "Receiver Balance: Receivers %v Min %v Max %v Mean %.1f Cv %.4f Jain %.4f\n",
+            balance.Receivers, balance.Min, balance.Max, balance.Mean, balance.Cv, balance.Jain,
+        )
+    }
+
+    if result.Final {
+        for _, warning := range rt.Warnings {
+            fmt.Fprintf( sink.w, "Warning: %v\n", warning )
+        }
+    }
+
+    _, err = fmt.Fprintf( sink.w, "---\n" )
+    return err
+}
+
+func ( sink *TextSink )Close( )( err error ) {
+    return nil
+}
+
+// Keeps file holding the latest snapshot, it is replaced atomically so readers never see a partial result
+func NewJsonFileSink( file string )( *JsonFileSink ) {
+    return &JsonFileSink {
+        file    :   file,
+    }
+}
+
+func ( sink *JsonFileSink )Write( result *Result )( err error ) {
+    fh, err := os.CreateTemp( filepath.Dir( sink.file ), filepath.Base( sink.file ) + ".tmp" )
+    if err != nil {
+        return err
+    }
+
+    encoder := json.NewEncoder( fh )
+    encoder.SetIndent( "", "  " )
+
+    err = encoder.Encode( result )
+    if err != nil {
+        fh.Close( )
+        os.Remove( fh.Name( ) )
+        return err
+    }
+
+    err = fh.Close( )
+    if err != nil {
+        os.Remove( fh.Name( ) )
+        return err
+    }
+
+    return os.Rename( fh.Name( ), sink.file )
+}
+
+func ( sink *JsonFileSink )Close( )( err error ) {
+    return nil
+}
+
+var csvHeader = [ ]string {
+    "ts", "final", "id", "sent", "rcvd", "late", "retries", "errors", "negativeLatencies",
+    "latencyP50", "latencyP99", "latencyMax", "sendLatencyP50Us", "sendLatencyP99Us",
+    "sentBytes", "rcvdBytes", "msgSizeP50", "msgSizeP99", "redelivered", "settleLatencyP99Us",
+    "brokerSent", "brokerRcvd", "cancelled", "cancelledRcvd",
+    "dlqRcvd", "dlqInvalid", "deferRcvd", "deferLost", "selfSkipped", "expiredRcvd", "dlqExpired",
+    "dupSent", "dupRcvd", "lockRenewals", "msgLocksLost",
+    "receiveCalls", "emptyReceives",
+}
+
+// Appends one row per gateway for every snapshot
+func NewCsvSink( file string )( sink *CsvSink, err error ) {
+    fh, err := os.Create( file )
+    if err != nil {
+        return nil, err
+    }
+
+    sink = &CsvSink {
+        fh  :   fh,
+        w   :   csv.NewWriter( fh ),
+    }
+
+    err = sink.w.Write( csvHeader )
+    if err != nil {
+        fh.Close( )
+        return nil, err
+    }
+
+    return sink, nil
+}
+
+func ( sink *CsvSink )Write( result *Result )( err error ) {
+    ts    := strconv.FormatInt( result.EndTime, 10 )
+    final := strconv.FormatBool( result.Final )
+
+    for _, gw := range result.Gateways {
+        err = sink.w.Write( [ ]string {
+            ts, final, gw.Id,
+            strconv.FormatUint( gw.Sent, 10 ),
+            strconv.FormatUint( gw.Rcvd, 10 ),
+            strconv.FormatUint( gw.Late, 10 ),
+            strconv.FormatUint( gw.Retries, 10 ),
+            strconv.FormatUint( gw.Errors, 10 ),
+            strconv.FormatUint( gw.NegLatencies, 10 ),
+            strconv.FormatUint( gw.Latency.P50, 10 ),
+            strconv.FormatUint( gw.Latency.P99, 10 ),
+            strconv.FormatUint( gw.Latency.Max, 10 ),
+            strconv.FormatUint( gw.SendLatency.P50, 10 ),
+            strconv.FormatUint( gw.SendLatency.P99, 10 ),
+            strconv.FormatUint( gw.SentBytes, 10 ),
+            strconv.FormatUint( gw.RcvdBytes, 10 ),
+            strconv.FormatUint( gw.MsgSize.P50, 10 ),
+            strconv.FormatUint( gw.MsgSize.P99, 10 ),
+            strconv.FormatUint( gw.Redelivered, 10 ),
+            strconv.FormatUint( gw.SettleLatency.P99, 10 ),
+            strconv.FormatUint( gw.BrokerSent, 10 ),
+            strconv.FormatUint( gw.BrokerRcvd, 10 ),
+            strconv.FormatUint( gw.Cancelled, 10 ),
+            strconv.FormatUint( gw.CancelledRcvd, 10 ),
+            strconv.FormatUint( gw.DlqRcvd, 10 ),
+            strconv.FormatUint( gw.DlqInvalid, 10 ),
+            strconv.FormatUint( gw.DeferRcvd, 10 ),
+            strconv.FormatUint( gw.DeferLost, 10 ),
+            strconv.FormatUint( gw.SelfSkipped, 10 ),
+            strconv.FormatUint( gw.ExpiredRcvd, 10 ),
+            strconv.FormatUint( gw.DlqExpired, 10 ),
+            strconv.FormatUint( gw.DupSent, 10 ),
+            strconv.FormatUint( gw.DupRcvd, 10 ),
+            strconv.FormatUint( gw.LockRenewals, 10 ),
+            strconv.FormatUint( gw.MsgLocksLost, 10 ),
+            strconv.FormatUint( gw.ReceiveCalls, 10 ),
+            strconv.FormatUint( gw.EmptyReceives, 10 ),
+        } )
+        if err != nil {
+            return err
+        }
+    }
+
+    sink.w.Flush( )
+    return sink.w.Error( )
+}
+
+func ( sink *CsvSink )Close( )( err error ) {
+    sink.w.Flush( )
+
+    err = sink.w.Error( )
+    if err != nil {
+        sink.fh.Close( )
+        return err
+    }
+
+    return sink.fh.Close( )
+}
+
+func NewMemorySink( )( *MemorySink ) {
+    return &MemorySink{ }
+}
+
+func ( sink *MemorySink )Write( result *Result )( err error ) {
+    sink.lock.Lock( )
+    sink.results = append( sink.results, result )
+    sink.lock.Unlock( )
+
+    return nil
+}
+
+func ( sink *MemorySink )Close( )( err error ) {
+    return nil
+}
+
+func ( sink *MemorySink )Results( )( results [ ]*Result ) {
+    sink.lock.Lock( )
+    defer sink.lock.Unlock( )
+
+    results = make( [ ]*Result, len( sink.results ) )
+    copy( results, sink.results )
+
+    return results
+}
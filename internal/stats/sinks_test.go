@@ -0,0 +1,132 @@
+package stats
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+type failingSink struct {
+    closed          bool
+}
+
+func ( sink *failingSink )Write( result *Result )( err error ) {
+    return os.ErrInvalid
+}
+
+func ( sink *failingSink )Close( )( err error ) {
+    sink.closed = true
+    return nil
+}
+
+func TestSinks( t *testing.T ) {
+    ctx, cancel := context.WithCancel( context.Background( ) )
+
+    stats := NewStats( [ ]string{ "gw0", "gw1" }, ctx )
+    stats.SetStatsDumpInterval( 10 * time.Millisecond )
+    stats.SetSampleInterval( 5 * time.Millisecond )
+
+    var text bytes.Buffer
+    dir := t.TempDir( )
+
+    csvSink, err := NewCsvSink( filepath.Join( dir, "stats.csv" ) )
+    if err != nil {
+        t.Fatalf( "NewCsvSink - failed with error %v", err )
+    }
+
+    memSink  := NewMemorySink( )
+    failSink := &failingSink{ }
+
+    stats.AddSink( NewTextSink( &text ) )
+    stats.AddSink( NewJsonFileSink( filepath.Join( dir, "result.json" ) ) )
+    stats.AddSink( csvSink )
+    stats.AddSink( failSink )
+    stats.AddSink( memSink )
+
+    stats.StartDumper( )
+
+    stats.UpdateSenderStat( 0, 5 )
+    stats.UpdateReceiverStat( 1, 0, 4, 20 )
+    stats.UpdateErrorStat( 1, ErrorClassParse )
+    stats.UpdateReceiveCallStat( 1, 4 )
+    stats.UpdateReceiveCallStat( 1, 0 )
+    stats.UpdateSettleStat( 1, SettleDefer, time.Millisecond )
+    stats.UpdateDeferStat( 1, 40 * time.Millisecond )
+    stats.UpdateDeferLostStat( 1, 1 )
+    stats.SetCredential( "client-secret" )
+    stats.UpdateTokenStat( false, 20 * time.Millisecond, nil )
+    stats.UpdateTokenStat( true, 10 * time.Millisecond, nil )
+    stats.UpdateTokenStat( true, 0, fmt.Errorf( "invalid_client" ) )
+
+    time.Sleep( 30 * time.Millisecond )
+    cancel( )
+    stats.StopDumper( )
+
+    results := memSink.Results( )
+    if len( results ) < 2 {
+        t.Fatalf( "MemorySink - expected periodic and final snapshots, got %v", len( results ) )
+    }
+
+    final := results[ len( results ) - 1 ]
+    if !final.Final || final != stats.GetFinalResult( ) {
+        t.Fatalf( "MemorySink - last snapshot is not the final result" )
+    }
+
+    if final.Sent != 5 || final.Rcvd != 4 || final.RcvdById[ 1 ][ 0 ] != 4 || final.ErrorsByClass[ ErrorClassParse ] != 1 {
+        t.Fatalf( "MemorySink - unexpected final result %+v", final )
+    }
+
+    if final.ReceiveCalls != 2 || final.EmptyReceives != 1 || final.ReceiveBatch.Max != 4 {
+        t.Fatalf( "MemorySink - unexpected receive calls %v empty %v batch %+v", final.ReceiveCalls, final.EmptyReceives, final.ReceiveBatch )
+    }
+
+    if final.Credential != "client-secret" || final.TokensAcquired != 1 || final.TokenRefreshes != 1 || final.TokenFailures != 1 || final.TokenTime.Max != 20 {
+        t.Fatalf( "MemorySink - unexpected tokens %v acquired %v refreshed %v failed %v time %+v", final.Credential, final.TokensAcquired, final.TokenRefreshes, final.TokenFailures, final.TokenTime )
+    }
+
+    if final.DeferRcvd != 1 || final.DeferLost != 1 || final.Gateways[ 1 ].DeferRcvd != 1 || final.DeferLatency.Max != 40 {
+        t.Fatalf( "MemorySink - unexpected deferred retrieved %v lost %v latency %+v", final.DeferRcvd, final.DeferLost, final.DeferLatency )
+    }
+
+    if !failSink.closed {
+        t.Fatalf( "dump - failing sink not closed or blocked other sinks" )
+    }
+
+    if !strings.Contains( text.String( ), "Credential: client-secret Tokens Acquired 1 Refreshed 1 Failed 1" ) {
+        t.Fatalf( "TextSink - missing credential line in %v", text.String( ) )
+    }
+
+    if !strings.Contains( text.String( ), "Deferred: Deferred 1 Retrieved 1 Lost 1" ) {
+        t.Fatalf( "TextSink - missing deferred line in %v", text.String( ) )
+    }
+
+    if !strings.Contains( text.String( ), "gw1: Sent 0 Rcvd 4" ) || !strings.Contains( text.String( ), "gw0: Received 4" ) {
+        t.Fatalf( "TextSink - unexpected output %v", text.String( ) )
+    }
+
+    data, err := os.ReadFile( filepath.Join( dir, "result.json" ) )
+    if err != nil {
+        t.Fatalf( "JsonFileSink - failed to read result file %v", err )
+    }
+
+    var fromFile Result
+    if err = json.Unmarshal( data, &fromFile ); err != nil || !fromFile.Final || fromFile.Rcvd != 4 {
+        t.Fatalf( "JsonFileSink - result file does not hold the final result: %v", err )
+    }
+
+    data, err = os.ReadFile( filepath.Join( dir, "stats.csv" ) )
+    if err != nil {
+        t.Fatalf( "CsvSink - failed to read csv file %v", err )
+    }
+
+    lines := strings.Split( strings.TrimSpace( string( data ) ), "\n" )
+    if lines[ 0 ] != strings.Join( csvHeader, "," ) || ( len( lines ) - 1 ) != 2 * len( results ) {
+        t.Fatalf( "CsvSink - unexpected csv contents %v", string( data ) )
+    }
+}
@@ -12,8 +12,11 @@ import (
 
 func NewStats( ids [ ]string, ctx context.Context )( stats *Stats ) {
     stats = &Stats{
-        count  :    uint64( len( ids ) ),
-        wg     :    &sync.WaitGroup{ },
+        count           :   uint64( len( ids ) ),
+        wg              :   &sync.WaitGroup{ },
+        sampleInterval  :   time.Second,
+        errorsByClass   :   make( map[ string ]uint64 ),
+        settled         :   make( map[ string ]uint64 ),
     }
 
     stats.SetIds( ids )
@@ -43,11 +46,38 @@ func ( stats *Stats )SetCtx( ctx context.Context ) {
     stats.ctx = ctx
 }
 
+// Marks the gateways of job jobIndex as sending and receiving in this process, has to be called after SetIds
+func ( stats *Stats )SetTopology( topology *Topology, jobIndex int, sends, receives bool ) {
+    stats.topology = topology
+
+    for i := range stats.elems {
+        local := topology.jobOf( i ) == jobIndex
+        stats.elems[ i ].sending   = local && sends
+        stats.elems[ i ].receiving = local && receives
+    }
+}
+
 func ( stats *Stats )SetStatsDumpInterval( intvl time.Duration ) {
     stats.dumpInterval = intvl
 }
 
+func ( stats *Stats )SetSampleInterval( intvl time.Duration ) {
+    stats.sampleInterval = intvl
+}
+
+// Sinks have to be added before the dumper is started
+func ( stats *Stats )AddSink( sink Sink ) {
+    stats.sinks = append( stats.sinks, sink )
+}
+
 func ( stats *Stats )StartDumper( ) {
+    stats.startTime = time.Now( )
+    stats.SetStage( StageWarmup )
+
+    stats.runtimeLock.Lock( )
+    stats.runtime = newRuntimeSampler( )
+    stats.runtimeLock.Unlock( )
+
     stats.wg.Add( 1 )
     go func( ) {
         stats.dumpStats( )
@@ -59,15 +89,51 @@ func ( stats *Stats )StopDumper( ) {
     stats.wg.Wait( )
 }
 
+// Returns the snapshot handed to the sinks at the end of the run, only valid after StopDumper
+func ( stats *Stats )GetFinalResult( )( *Result ) {
+    return stats.finalResult
+}
+
 func ( stats *Stats )UpdateSenderStat( idx int, incrBy uint64 ) {
     atomic.AddUint64( &stats.elems[ idx ].sent, incrBy )
 }
 
+// Records the size of a single broker message, body and properties included
+func ( stats *Stats )UpdateSenderBytes( idx int, size uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].sentBytes, size )
+
+    stats.elems[ idx ].msgSizeHist.Record( size )
+    stats.msgSizeHist.Record( size )
+}
+
+func ( stats *Stats )UpdateReceiverBytes( idx int, size uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].rcvdBytes, size )
+}
+
+func ( stats *Stats )UpdateBrokerSentStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].brokerSent, incrBy )
+}
+
+func ( stats *Stats )UpdateBrokerRcvdStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].brokerRcvd, incrBy )
+}
+
+// Records the duration of a single send call, kept in microseconds since broker ingress is often sub millisecond
+func ( stats *Stats )UpdateSendLatency( idx int, latency time.Duration ) {
+    us := uint64( latency.Microseconds( ) )
+
+    stats.elems[ idx ].sendLatencyHist.Record( us )
+    stats.sendLatencyHist.Record( us )
+}
+
 func ( stats *Stats )UpdateReceiverStat( idx, fromIdx int, incrBy, lIncrBy uint64 ) {
     atomic.AddUint64( &stats.elems[ idx ].rcvd, incrBy )
     atomic.AddUint64( &stats.elems[ idx ].rcvdById[ fromIdx ], incrBy )
     atomic.AddUint64( &stats.elems[ idx ].latency, lIncrBy )
 
+    stats.elems[ idx ].latencyHist.Record( lIncrBy )
+    stats.latencyHist.Record( lIncrBy )
+
     // Not perfect but we can live with this
     maxLatency := stats.elems[ idx ].maxLatency
     if lIncrBy > maxLatency {
@@ -75,6 +141,194 @@ func ( stats *Stats )UpdateReceiverStat( idx, fromIdx int, incrBy, lIncrBy uint6
     }
 }
 
+// Counts messages already included by UpdateReceiverStat that arrived after the measure phase
+func ( stats *Stats )UpdateLateStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].late, incrBy )
+}
+
+func ( stats *Stats )SetClockEstimate( offset, uncertainty time.Duration ) {
+    stats.clockOffset      = offset.Milliseconds( )
+    stats.clockUncertainty = int64( ( uncertainty + time.Millisecond - 1 ) / time.Millisecond )
+}
+
+// Negative raw latencies are counted rather than folded into the latency statistics
+func ( stats *Stats )UpdateClockStat( idx int, rawLatency int64, bound uint64 ) {
+    if rawLatency < 0 {
+        atomic.AddUint64( &stats.elems[ idx ].negLatencies, 1 )
+    }
+
+    stats.latencyBoundHist.Record( bound )
+}
+
+// Records how a received message was settled and how long the settlement call took
+func ( stats *Stats )UpdateSettleStat( idx int, action string, latency time.Duration ) {
+    us := uint64( latency.Microseconds( ) )
+
+    stats.elems[ idx ].settleHist.Record( us )
+    stats.settleHist.Record( us )
+
+    stats.settledLock.Lock( )
+    stats.settled[ action ]++
+    stats.settledLock.Unlock( )
+}
+
+func ( stats *Stats )UpdateRedeliveredStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].redelivered, incrBy )
+}
+
+func ( stats *Stats )UpdateSessionAcceptStat( idx int, latency time.Duration ) {
+    us := uint64( latency.Microseconds( ) )
+
+    stats.elems[ idx ].acceptHist.Record( us )
+    stats.acceptHist.Record( us )
+}
+
+func ( stats *Stats )UpdateSessionLockLostStat( idx int ) {
+    atomic.AddUint64( &stats.elems[ idx ].locksLost, 1 )
+}
+
+func ( stats *Stats )UpdateOutOfOrderStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].outOfOrder, incrBy )
+}
+
+// Records the delivery time of a scheduled message minus its scheduled time in milliseconds
+func ( stats *Stats )UpdateScheduleStat( idx int, skew int64 ) {
+    if skew < 0 {
+        stats.earlyHist.Record( uint64( -skew ) )
+        return
+    }
+
+    stats.lateHist.Record( uint64( skew ) )
+}
+
+// Counts messages the receiver discarded because they came from its own gateway
+func ( stats *Stats )UpdateSelfSkippedStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].selfSkipped, incrBy )
+}
+
+func ( stats *Stats )SetSubFilter( mode string, setup time.Duration ) {
+    stats.subFilter      = mode
+    stats.subFilterSetup = setup.Milliseconds( )
+}
+
+func ( stats *Stats )SetClients( topology string, connections int ) {
+    stats.clientTopology = topology
+    stats.connections    = connections
+}
+
+// Records the time it took to establish a client connection
+func ( stats *Stats )UpdateConnectStat( latency time.Duration ) {
+    stats.connectHist.Record( uint64( latency.Milliseconds( ) ) )
+}
+
+func ( stats *Stats )SetCredential( kind string ) {
+    stats.credential = kind
+}
+
+// Records a token request of the credential, failed ones are counted but not timed
+func ( stats *Stats )UpdateTokenStat( refresh bool, latency time.Duration, err error ) {
+    switch {
+        case err != nil:
+            atomic.AddUint64( &stats.tokenFailures, 1 )
+            return
+
+        case refresh:
+            atomic.AddUint64( &stats.tokenRefreshes, 1 )
+
+        default:
+            atomic.AddUint64( &stats.tokensAcquired, 1 )
+    }
+
+    stats.tokenHist.Record( uint64( latency.Milliseconds( ) ) )
+}
+
+func ( stats *Stats )SetMessageTtl( ttl time.Duration ) {
+    stats.messageTtl = ttl.Milliseconds( )
+}
+
+// Counts messages delivered although their time to live had run out
+func ( stats *Stats )UpdateExpiredRcvdStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].expiredRcvd, incrBy )
+}
+
+// Counts messages read back from the dead letter queue that the broker dead lettered on expiry
+func ( stats *Stats )UpdateDlqExpiredStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].dlqExpired, incrBy )
+}
+
+func ( stats *Stats )SetDuplicates( delay, window time.Duration ) {
+    stats.dupDelay  = delay.Milliseconds( )
+    stats.dupWindow = window.Milliseconds( )
+}
+
+// Counts resends of a message with the MessageID it was first sent with
+func ( stats *Stats )UpdateDupSentStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].dupSent, incrBy )
+}
+
+// Counts messages delivered again under a MessageID the receiving entity already delivered
+func ( stats *Stats )UpdateDupRcvdStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].dupRcvd, incrBy )
+}
+
+// Records the time from receiving a message to settling it after processing
+func ( stats *Stats )UpdateProcessStat( idx int, latency time.Duration ) {
+    stats.processHist.Record( uint64( latency.Milliseconds( ) ) )
+}
+
+func ( stats *Stats )UpdateLockRenewStat( idx int ) {
+    atomic.AddUint64( &stats.elems[ idx ].lockRenewals, 1 )
+}
+
+// Counts messages whose lock expired before they were settled
+func ( stats *Stats )UpdateMsgLockLostStat( idx int ) {
+    atomic.AddUint64( &stats.elems[ idx ].msgLocksLost, 1 )
+}
+
+// Records a receive call and the number of messages it returned
+func ( stats *Stats )UpdateReceiveCallStat( idx int, count int ) {
+    atomic.AddUint64( &stats.elems[ idx ].rcvCalls, 1 )
+    if count == 0 {
+        atomic.AddUint64( &stats.elems[ idx ].emptyRcvCalls, 1 )
+        return
+    }
+
+    stats.rcvBatchHist.Record( uint64( count ) )
+}
+
+// Records how long a received message waited in the prefetch buffer
+func ( stats *Stats )UpdatePrefetchWaitStat( idx int, wait time.Duration ) {
+    stats.prefetchHist.Record( uint64( wait.Microseconds( ) ) )
+}
+
+// Records a message read back from the dead letter queue and the time since it was dead lettered
+func ( stats *Stats )UpdateDlqStat( idx int, latency uint64, valid bool ) {
+    atomic.AddUint64( &stats.elems[ idx ].dlqRcvd, 1 )
+    if !valid {
+        atomic.AddUint64( &stats.elems[ idx ].dlqInvalid, 1 )
+    }
+
+    stats.dlqHist.Record( latency )
+}
+
+// Records a deferred message fetched back and completed and the time since it was deferred
+func ( stats *Stats )UpdateDeferStat( idx int, latency time.Duration ) {
+    atomic.AddUint64( &stats.elems[ idx ].deferRcvd, 1 )
+    stats.deferHist.Record( uint64( latency.Milliseconds( ) ) )
+}
+
+func ( stats *Stats )UpdateDeferLostStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].deferLost, incrBy )
+}
+
+func ( stats *Stats )UpdateCancelledStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].cancelled, incrBy )
+}
+
+func ( stats *Stats )UpdateCancelledRcvdStat( idx int, incrBy uint64 ) {
+    atomic.AddUint64( &stats.elems[ idx ].cancelledRcvd, incrBy )
+}
+
 func ( stats *Stats )UpdateReceiverStatRetries( idx int, retries uint64 ) {
     atomic.AddUint64( &stats.elems[ idx ].retries, retries )
 
@@ -85,42 +339,65 @@ func ( stats *Stats )UpdateReceiverStatRetries( idx int, retries uint64 ) {
 }
 
 func ( stats *Stats )UpdateReceiverStatErrors( idx int, errors uint64 ) {
+    stats.updateErrorStat( idx, ErrorClassReceive, errors )
+}
+
+func ( stats *Stats )UpdateErrorStat( idx int, class string ) {
+    stats.updateErrorStat( idx, class, 1 )
+}
+
+func ( stats *Stats )updateErrorStat( idx int, class string, errors uint64 ) {
     atomic.AddUint64( &stats.elems[ idx ].errors, errors )
+
+    stats.errorsLock.Lock( )
+    stats.errorsByClass[ class ] += errors
+    stats.errorsLock.Unlock( )
 }
 
 func ( stats *Stats )dumpStats( ) {
     ticker := time.NewTicker( stats.dumpInterval )
+    defer ticker.Stop( )
+
+    sampler := time.NewTicker( stats.sampleInterval )
+    defer sampler.Stop( )
 
     for {
         select {
             case <-stats.ctx.Done( ):
+                stats.recordSample( )
                 stats.dump( true )
                 return
 
+            case <-sampler.C:
+                stats.recordSample( )
+
             case <-ticker.C:
                 stats.dump( false )
         }
     }
 }
 
-func ( stats *Stats )dump( byId bool ) {
-    glog.Infof( "---" )
-    for i, v := range stats.elems {
-        avgLatency := uint64( 0 )
-        if v.rcvd > 0 {
-            avgLatency = v.latency / v.rcvd
+func ( stats *Stats )dump( final bool ) {
+    result := stats.GetResult( final )
+    if final {
+        stats.finalResult = result
+
+        for _, warning := range result.Runtime.Warnings {
+            glog.Warningf( "%v", warning )
         }
+    }
 
-        fmt.Printf(
-            "%v: Sent %v Rcvd %v Retries %v Max Retries %v Avg Latency %v Max Latency %v Errors %v\n",
-            stats.ids[ i ], v.sent, v.rcvd, v.retries, v.maxRetries, avgLatency, v.maxLatency, v.errors,
-        )
+    for _, sink := range stats.sinks {
+        err := sink.Write( result )
+        if err != nil {
+            glog.Errorf( "failed to write stats to sink: error %v", err )
+        }
 
-        if byId {
-            for j, jv := range v.rcvdById {
-                fmt.Printf( "%v: Received %v\n", stats.ids[ j ], jv )
+        if final {
+            err = sink.Close( )
+            if err != nil {
+                glog.Errorf( "failed to close stats sink: error %v", err )
             }
         }
     }
-    glog.Infof( "---" )
 }
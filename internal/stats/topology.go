@@ -0,0 +1,188 @@
+package stats
+
+const (
+    // Every receiver gets every message, except from its own sender when SelfSkip is set
+    DeliveryFanout      = "fanout"
+
+    // Every gateway receives only what it sent itself
+    DeliveryLoopback    = "loopback"
+
+    // Receivers share one entity and each message goes to exactly one of them
+    DeliveryCompeting   = "competing"
+)
+
+// Deployment wide layout of the gateways. Job i runs the gateways from i * GatewaysPerJob
+// up to ( i + 1 ) * GatewaysPerJob, jobs in SenderJobs send for their gateways and jobs in
+// ReceiverJobs receive for them. A sender only and a receiver only job may share an index.
+type Topology struct {
+    GatewaysPerJob   int                    `json:"gatewaysPerJob"`
+    SenderJobs    [ ]int                    `json:"senderJobs"`
+    ReceiverJobs  [ ]int                    `json:"receiverJobs"`
+    Delivery         string                 `json:"delivery"`
+    SelfSkip         bool                   `json:"selfSkip"`
+}
+
+type DeliveryCount struct {
+    Expected         uint64                 `json:"expected"`
+    Delivered        uint64                 `json:"delivered"`
+}
+
+func ( count *DeliveryCount )add( expected, delivered uint64 ) {
+    count.Expected  += expected
+    count.Delivered += delivered
+}
+
+// Delivered over expected, 0 when nothing was expected
+func ( count DeliveryCount )Ratio( )( float64 ) {
+    if count.Expected == 0 {
+        return 0
+    }
+
+    return float64( count.Delivered ) / float64( count.Expected )
+}
+
+func ( topology *Topology )jobOf( idx int )( int ) {
+    if topology.GatewaysPerJob <= 0 {
+        return 0
+    }
+
+    return idx / topology.GatewaysPerJob
+}
+
+func containsInt( list [ ]int, v int )( bool ) {
+    for _, i := range list {
+        if i == v {
+            return true
+        }
+    }
+
+    return false
+}
+
+func ( topology *Topology )IsSender( idx int )( bool ) {
+    return containsInt( topology.SenderJobs, topology.jobOf( idx ) )
+}
+
+func ( topology *Topology )IsReceiver( idx int )( bool ) {
+    return containsInt( topology.ReceiverJobs, topology.jobOf( idx ) )
+}
+
+// Number of copies receiver should get of every message from sender
+func ( topology *Topology )Copies( receiver, sender int )( uint64 ) {
+    if !topology.IsSender( sender ) || !topology.IsReceiver( receiver ) {
+        return 0
+    }
+
+    switch topology.Delivery {
+        case DeliveryLoopback:
+            if receiver == sender {
+                return 1
+            }
+
+        case DeliveryFanout:
+            if receiver != sender || !topology.SelfSkip {
+                return 1
+            }
+    }
+
+    return 0
+}
+
+// Competing receivers can only be checked as a whole, so every receiver has to have run
+// in the processes that contributed to the result
+func ( result *Result )allReceiversObservable( )( bool ) {
+    for i := range result.Gateways {
+        if result.Topology.IsReceiver( i ) && !result.Gateways[ i ].Receiving {
+            return false
+        }
+    }
+
+    return true
+}
+
+// A cell can only be checked when the sender and the receiver both ran in the processes
+// that contributed to this result, observable tells whether that is the case
+func ( result *Result )ExpectedCell( receiver, sender int )( expected uint64, observable bool ) {
+    if nil == result.Topology || receiver >= len( result.Gateways ) || sender >= len( result.Gateways ) {
+        return 0, false
+    }
+
+    if !result.Gateways[ receiver ].Receiving || !result.Gateways[ sender ].Sending {
+        return 0, false
+    }
+
+    return result.Gateways[ sender ].Sent * result.Topology.Copies( receiver, sender ), true
+}
+
+// Fills the per gateway and overall delivery counts from the delivery matrix and the topology,
+// has to be called again whenever counts change such as after merging results
+func ( result *Result )UpdateDelivery( ) {
+    result.Delivery = DeliveryCount{ }
+
+    for i := range result.Gateways {
+        result.Gateways[ i ].AsSender   = DeliveryCount{ }
+        result.Gateways[ i ].AsReceiver = DeliveryCount{ }
+    }
+
+    if nil == result.Topology {
+        return
+    }
+
+    if result.Topology.Delivery == DeliveryCompeting {
+        result.updateCompetingDelivery( )
+        return
+    }
+
+    for r, row := range result.RcvdById {
+        for s, delivered := range row {
+            expected, observable := result.ExpectedCell( r, s )
+            if !observable {
+                continue
+            }
+
+            result.Gateways[ s ].AsSender.add( expected, delivered )
+            result.Gateways[ r ].AsReceiver.add( expected, delivered )
+            result.Delivery.add( expected, delivered )
+        }
+    }
+}
+
+// Expected deliveries that did not happen by the end of the run, before that they may still be on
+// their way. Whether they expired is not known, they may as well have been lost.
+func ( result *Result )UpdateUndelivered( ) {
+    result.Undelivered = 0
+    if result.Final && result.MessageTtl > 0 && result.Delivery.Expected > result.Delivery.Delivered {
+        result.Undelivered = result.Delivery.Expected - result.Delivery.Delivered
+    }
+}
+
+// Each sent message is expected once across all receivers, receivers have no expectation of their own
+func ( result *Result )updateCompetingDelivery( ) {
+    if !result.allReceiversObservable( ) {
+        return
+    }
+
+    for s := range result.Gateways {
+        if !result.Gateways[ s ].Sending || !result.Topology.IsSender( s ) {
+            continue
+        }
+
+        delivered := uint64( 0 )
+        for r := range result.RcvdById {
+            if s < len( result.RcvdById[ r ] ) {
+                delivered += result.RcvdById[ r ][ s ]
+            }
+        }
+
+        result.Gateways[ s ].AsSender.add( result.Gateways[ s ].Sent, delivered )
+        result.Delivery.add( result.Gateways[ s ].Sent, delivered )
+    }
+
+    for r, row := range result.RcvdById {
+        for s, delivered := range row {
+            if result.Gateways[ s ].Sending && result.Topology.IsSender( s ) {
+                result.Gateways[ r ].AsReceiver.add( 0, delivered )
+            }
+        }
+    }
+}
@@ -0,0 +1,166 @@
+package stats
+
+import (
+    "testing"
+    "time"
+)
+
+func TestTopologyCopies( t *testing.T ) {
+    topology := &Topology {
+        GatewaysPerJob  :   2,
+        SenderJobs      :   [ ]int{ 0 },
+        ReceiverJobs    :   [ ]int{ 0, 1 },
+        Delivery        :   DeliveryFanout,
+        SelfSkip        :   true,
+    }
+
+    tests := [ ]struct {
+        receiver, sender    int
+        copies              uint64
+    } {
+        { 0, 0, 0 },
+        { 1, 0, 1 },
+        { 3, 1, 1 },
+        { 0, 2, 0 },
+    }
+
+    for _, test := range tests {
+        if copies := topology.Copies( test.receiver, test.sender ); copies != test.copies {
+            t.Errorf( "Copies - %v from %v expected %v, got %v", test.receiver, test.sender, test.copies, copies )
+        }
+    }
+
+    topology.Delivery = DeliveryLoopback
+    if topology.Copies( 0, 0 ) != 1 || topology.Copies( 1, 0 ) != 0 {
+        t.Errorf( "Copies - loopback delivers to other gateways" )
+    }
+}
+
+// Two jobs of a sender only / receiver only split only see the full picture once merged
+func TestMergeResults( t *testing.T ) {
+    topology := &Topology {
+        GatewaysPerJob  :   2,
+        SenderJobs      :   [ ]int{ 0 },
+        ReceiverJobs    :   [ ]int{ 0 },
+        Delivery        :   DeliveryFanout,
+        SelfSkip        :   true,
+    }
+
+    ids := [ ]string{ "gw0", "gw1" }
+
+    senders := NewStats( ids, nil )
+    senders.SetTopology( topology, 0, true, false )
+    senders.UpdateSenderStat( 0, 10 )
+    senders.UpdateSenderStat( 1, 20 )
+
+    receivers := NewStats( ids, nil )
+    receivers.SetTopology( topology, 0, false, true )
+    receivers.UpdateReceiverStat( 0, 1, 20, 5 )
+    receivers.UpdateReceiverStat( 1, 0, 9, 7 )
+
+    sent := senders.GetResult( true )
+    if sent.Delivery.Expected != 0 {
+        t.Fatalf( "GetResult - sender only job expects %v deliveries it cannot observe", sent.Delivery.Expected )
+    }
+
+    merged, err := MergeResults( [ ]*Result{ sent, receivers.GetResult( true ) } )
+    if err != nil {
+        t.Fatalf( "MergeResults - failed with error %v", err )
+    }
+
+    if merged.Sent != 30 || merged.Rcvd != 29 {
+        t.Errorf( "MergeResults - expected 30 sent and 29 received, got %v and %v", merged.Sent, merged.Rcvd )
+    }
+
+    if merged.Delivery.Expected != 30 || merged.Delivery.Delivered != 29 {
+        t.Errorf( "MergeResults - expected 29 of 30 delivered, got %+v", merged.Delivery )
+    }
+
+    if gw := merged.Gateways[ 0 ]; gw.AsSender.Expected != 10 || gw.AsSender.Delivered != 9 || gw.AsReceiver.Delivered != 20 {
+        t.Errorf( "MergeResults - unexpected delivery for gw0 %+v %+v", gw.AsSender, gw.AsReceiver )
+    }
+
+    if merged.Latency.Count != 2 || merged.Latency.Max != 7 {
+        t.Errorf( "MergeResults - unexpected merged latency %+v", merged.Latency )
+    }
+
+    _, err = MergeResults( [ ]*Result{ sent, NewStats( ids[ :1 ], nil ).GetResult( true ) } )
+    if err == nil {
+        t.Errorf( "MergeResults - expected error for different gateway blocks" )
+    }
+}
+
+func TestCompetingDelivery( t *testing.T ) {
+    stats := NewStats( [ ]string{ "gw0", "gw1", "gw2" }, nil )
+    stats.SetTopology( &Topology {
+        GatewaysPerJob  :   3,
+        SenderJobs      :   [ ]int{ 0 },
+        ReceiverJobs    :   [ ]int{ 0 },
+        Delivery        :   DeliveryCompeting,
+    }, 0, true, true )
+
+    stats.UpdateSenderStat( 0, 10 )
+    stats.UpdateReceiverStat( 1, 0, 6, 1 )
+    stats.UpdateReceiverStat( 2, 0, 3, 1 )
+
+    result := stats.GetResult( true )
+    if result.Delivery.Expected != 10 || result.Delivery.Delivered != 9 {
+        t.Errorf( "GetResult - expected 9 of 10 delivered, got %+v", result.Delivery )
+    }
+
+    if result.Gateways[ 1 ].AsReceiver.Delivered != 6 || result.Gateways[ 1 ].AsReceiver.Expected != 0 {
+        t.Errorf( "GetResult - unexpected receiver delivery %+v", result.Gateways[ 1 ].AsReceiver )
+    }
+}
+
+func TestUpdateUndelivered( t *testing.T ) {
+    stats := NewStats( [ ]string{ "gw0", "gw1" }, nil )
+    stats.SetTopology( &Topology {
+        GatewaysPerJob  :   2,
+        SenderJobs      :   [ ]int{ 0 },
+        ReceiverJobs    :   [ ]int{ 0 },
+        Delivery        :   DeliveryCompeting,
+    }, 0, true, true )
+    stats.SetMessageTtl( time.Minute )
+
+    stats.UpdateSenderStat( 0, 10 )
+    stats.UpdateReceiverStat( 1, 0, 7, 1 )
+
+    stats.UpdateDlqExpiredStat( 1, 2 )
+
+    if result := stats.GetResult( false ); result.Undelivered != 0 {
+        t.Errorf( "GetResult - expected nothing undelivered before the end of the run, got %v", result.Undelivered )
+    }
+
+    // Only what the broker dead lettered on expiry is known to have expired
+    result := stats.GetResult( true )
+    if result.Undelivered != 3 || result.DlqExpired != 2 || result.MessageTtl != 60000 {
+        t.Errorf( "GetResult - expected 3 undelivered, 2 expired with a ttl of 60000ms, got %v %v and %v", result.Undelivered, result.DlqExpired, result.MessageTtl )
+    }
+}
+
+func TestUpdateSelfSkip( t *testing.T ) {
+    result := &Result {
+        StartTime   :   0,
+        EndTime     :   10000,
+        Rcvd        :   500,
+        Topology    :   &Topology{ Delivery : DeliveryFanout, SelfSkip : true },
+    }
+
+    result.UpdateSelfSkip( )
+    if result.SelfSkipMode != SelfSkipClient || result.SelfSkipRcvdRate != 50 {
+        t.Errorf( "UpdateSelfSkip - expected 50 msgs/s client side, got %v %v", result.SelfSkipRcvdRate, result.SelfSkipMode )
+    }
+
+    result.SubFilter = "sql"
+    result.UpdateSelfSkip( )
+    if result.SelfSkipMode != SelfSkipFiltered || result.SelfSkipRcvdRate != 50 {
+        t.Errorf( "UpdateSelfSkip - expected 50 msgs/s filtered, got %v %v", result.SelfSkipRcvdRate, result.SelfSkipMode )
+    }
+
+    result.SubFilter, result.Topology.SelfSkip = "", false
+    result.UpdateSelfSkip( )
+    if len( result.SelfSkipMode ) > 0 || result.SelfSkipRcvdRate != 0 {
+        t.Errorf( "UpdateSelfSkip - expected no mode without self skip, got %v %v", result.SelfSkipRcvdRate, result.SelfSkipMode )
+    }
+}
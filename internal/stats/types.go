@@ -3,22 +3,87 @@ package stats
 import (
     "context"
     "sync"
+    "sync/atomic"
     "time"
 )
 
+const (
+    StageWarmup         = "warmup"
+    StageMeasure        = "measure"
+    StageCooldown       = "cooldown"
+)
+
+const (
+    ErrorClassSend      = "send"
+    ErrorClassReceive   = "receive"
+    ErrorClassParse     = "parse"
+    ErrorClassValidate  = "validate"
+    ErrorClassSettle    = "settle"
+    ErrorClassSession   = "session"
+    ErrorClassCancel    = "cancel"
+    ErrorClassRenew     = "renew"
+)
+
+const (
+    SettleComplete      = "complete"
+    SettleAbandon       = "abandon"
+    SettleDeadLetter    = "deadletter"
+    SettleDefer         = "defer"
+)
+
+const (
+    // Own messages kept out of the subscriptions by broker side filters or discarded by the receivers
+    SelfSkipFiltered    = "filtered"
+    SelfSkipClient      = "client-side"
+)
+
 type statsElem struct {
     sent             uint64
+    sentBytes        uint64
+    msgSizeHist      Histogram
 
     rcvd             uint64
     rcvdById      [ ]uint64
+    rcvdBytes        uint64
+    late             uint64
+    brokerSent       uint64
+    brokerRcvd       uint64
+    redelivered      uint64
+    outOfOrder       uint64
+    locksLost        uint64
+    cancelled        uint64
+    cancelledRcvd    uint64
+    dlqRcvd          uint64
+    dlqInvalid       uint64
+    deferRcvd        uint64
+    deferLost        uint64
+    selfSkipped      uint64
+    expiredRcvd      uint64
+    dlqExpired       uint64
+    dupSent          uint64
+    dupRcvd          uint64
+    lockRenewals     uint64
+    msgLocksLost     uint64
+    rcvCalls         uint64
+    emptyRcvCalls    uint64
 
     retries          uint64
     maxRetries       uint64
 
     latency          uint64
     maxLatency       uint64
+    latencyHist      Histogram
+
+    sendLatencyHist  Histogram
+    settleHist       Histogram
+    acceptHist       Histogram
+
+    negLatencies     uint64
 
     errors           uint64
+
+    sending          bool
+    receiving        bool
 }
 
 type Stats struct {
@@ -28,4 +93,258 @@ type Stats struct {
     ctx              context.Context
     wg              *sync.WaitGroup
     dumpInterval     time.Duration
+    sampleInterval   time.Duration
+
+    name             string
+    config        [ ]ConfigEntry
+    startTime        time.Time
+    measureStart     int64
+    measureEnd       int64
+    stage            atomic.Value
+
+    latencyHist      Histogram
+    sendLatencyHist  Histogram
+    latencyBoundHist Histogram
+    msgSizeHist      Histogram
+    settleHist       Histogram
+    acceptHist       Histogram
+    earlyHist        Histogram
+    lateHist         Histogram
+    dlqHist          Histogram
+    deferHist        Histogram
+    processHist      Histogram
+    rcvBatchHist     Histogram
+    prefetchHist     Histogram
+    connectHist      Histogram
+    tokenHist        Histogram
+
+    clockOffset      int64
+    clockUncertainty int64
+
+    subFilter        string
+    subFilterSetup   int64
+    messageTtl       int64
+    dupDelay         int64
+    dupWindow        int64
+    clientTopology   string
+    connections      int
+    credential       string
+    tokensAcquired   uint64
+    tokenRefreshes   uint64
+    tokenFailures    uint64
+
+    topology        *Topology
+
+    errorsLock       sync.Mutex
+    errorsByClass    map[ string ]uint64
+
+    settledLock      sync.Mutex
+    settled          map[ string ]uint64
+
+    timelineLock     sync.Mutex
+    timeline      [ ]Sample
+
+    runtimeLock      sync.Mutex
+    runtime         *runtimeSampler
+
+    sinks         [ ]Sink
+    finalResult     *Result
+}
+
+type ConfigEntry struct {
+    Name             string                 `json:"name"`
+    Value            string                 `json:"value"`
+}
+
+type Sample struct {
+    TimeStamp        int64                  `json:"ts"`
+    Sent             uint64                 `json:"sent"`
+    Rcvd             uint64                 `json:"rcvd"`
+    Errors           uint64                 `json:"errors"`
+    SentBytes        uint64                 `json:"sentBytes"`
+    RcvdBytes        uint64                 `json:"rcvdBytes"`
+}
+
+type GatewayResult struct {
+    Id               string                 `json:"id"`
+    Sent             uint64                 `json:"sent"`
+    Rcvd             uint64                 `json:"rcvd"`
+    Late             uint64                 `json:"late"`
+    SentBytes        uint64                 `json:"sentBytes"`
+    RcvdBytes        uint64                 `json:"rcvdBytes"`
+    MsgSize          HistogramSnapshot      `json:"msgSizeBytes"`
+    BrokerSent       uint64                 `json:"brokerSent"`
+    BrokerRcvd       uint64                 `json:"brokerRcvd"`
+    Redelivered      uint64                 `json:"redelivered"`
+    SettleLatency    HistogramSnapshot      `json:"settleLatencyUs"`
+    OutOfOrder       uint64                 `json:"outOfOrder"`
+    SessionLocksLost uint64                 `json:"sessionLocksLost"`
+    SessionAccept    HistogramSnapshot      `json:"sessionAcceptUs"`
+    Cancelled        uint64                 `json:"cancelled"`
+    CancelledRcvd    uint64                 `json:"cancelledRcvd"`
+    DlqRcvd          uint64                 `json:"dlqRcvd"`
+    DlqInvalid       uint64                 `json:"dlqInvalid"`
+    DeferRcvd        uint64                 `json:"deferRcvd"`
+    DeferLost        uint64                 `json:"deferLost"`
+    SelfSkipped      uint64                 `json:"selfSkipped"`
+    ExpiredRcvd      uint64                 `json:"expiredRcvd"`
+    DlqExpired       uint64                 `json:"dlqExpired"`
+    DupSent          uint64                 `json:"dupSent"`
+    DupRcvd          uint64                 `json:"dupRcvd"`
+    LockRenewals     uint64                 `json:"lockRenewals"`
+    MsgLocksLost     uint64                 `json:"msgLocksLost"`
+    ReceiveCalls     uint64                 `json:"receiveCalls"`
+    EmptyReceives    uint64                 `json:"emptyReceives"`
+    Retries          uint64                 `json:"retries"`
+    MaxRetries       uint64                 `json:"maxRetries"`
+    Errors           uint64                 `json:"errors"`
+    Latency          HistogramSnapshot      `json:"latency"`
+    SendLatency      HistogramSnapshot      `json:"sendLatencyUs"`
+    NegLatencies     uint64                 `json:"negativeLatencies"`
+
+    // Whether this gateway sent or received in the processes that contributed to the result
+    Sending          bool                   `json:"sending"`
+    Receiving        bool                   `json:"receiving"`
+    AsSender         DeliveryCount          `json:"asSender"`
+    AsReceiver       DeliveryCount          `json:"asReceiver"`
+}
+
+// End to end latencies are in milliseconds, send call latencies are in microseconds
+// and time stamps are unix milliseconds
+type Result struct {
+    Name             string                 `json:"name"`
+    StartTime        int64                  `json:"startTime"`
+    EndTime          int64                  `json:"endTime"`
+    MeasureStart     int64                  `json:"measureStart"`
+    MeasureEnd       int64                  `json:"measureEnd"`
+    Final            bool                   `json:"final"`
+    Stage            string                 `json:"stage"`
+    Config        [ ]ConfigEntry            `json:"config"`
+
+    Sent             uint64                 `json:"sent"`
+    Rcvd             uint64                 `json:"rcvd"`
+    Errors           uint64                 `json:"errors"`
+
+    // Measured messages that were only delivered during cooldown, included in Rcvd
+    Late             uint64                 `json:"late"`
+
+    // Payload plus properties, MsgSize is the size of a single broker message
+    SentBytes        uint64                 `json:"sentBytes"`
+    RcvdBytes        uint64                 `json:"rcvdBytes"`
+    MsgSize          HistogramSnapshot      `json:"msgSizeBytes"`
+
+    // Messages as the broker sees them, Sent and Rcvd count the entries packed into their bodies
+    BrokerSent       uint64                 `json:"brokerSent"`
+    BrokerRcvd       uint64                 `json:"brokerRcvd"`
+
+    Latency          HistogramSnapshot      `json:"latency"`
+    SendLatency      HistogramSnapshot      `json:"sendLatencyUs"`
+    ErrorsByClass    map[ string ]uint64    `json:"errorsByClass"`
+
+    // Messages handed back by the broker after an abandon or lock expiry, not included in Rcvd
+    Redelivered      uint64                 `json:"redelivered"`
+    SettleLatency    HistogramSnapshot      `json:"settleLatencyUs"`
+    Settled          map[ string ]uint64    `json:"settled,omitempty"`
+
+    // Dead lettered messages read back from the dead letter queue, DlqInvalid of them with wrong
+    // properties and DlqLatency from dead lettering to reading them back
+    DlqRcvd          uint64                 `json:"dlqRcvd"`
+    DlqInvalid       uint64                 `json:"dlqInvalid"`
+    DlqLatency       HistogramSnapshot      `json:"dlqLatencyMs"`
+
+    // Deferred messages fetched back by sequence number and completed, DeferLost of them the broker
+    // no longer had or that could not be fetched by the end of the run. DeferLatency is the time from
+    // deferring a message to completing it.
+    DeferRcvd        uint64                 `json:"deferRcvd"`
+    DeferLost        uint64                 `json:"deferLost"`
+    DeferLatency     HistogramSnapshot      `json:"deferLatencyMs"`
+
+    // Sessions only, OutOfOrder counts messages older than one already received from the same sender
+    SessionAccept    HistogramSnapshot      `json:"sessionAcceptUs"`
+    SessionLocksLost uint64                 `json:"sessionLocksLost"`
+    OutOfOrder       uint64                 `json:"outOfOrder"`
+
+    // Scheduled messages only, how far before or after the scheduled time they were delivered.
+    // Cancelled messages are not included in Sent, CancelledRcvd of them arrived anyway.
+    ScheduleEarly    HistogramSnapshot      `json:"scheduleEarlyMs"`
+    ScheduleLate     HistogramSnapshot      `json:"scheduleLateMs"`
+    Cancelled        uint64                 `json:"cancelled"`
+    CancelledRcvd    uint64                 `json:"cancelledRcvd"`
+
+    // Messages from the receiver's own gateway discarded by the receiver, none should get through
+    // a server side SubFilter. SubFilterSetup is the time to create the filtered subscriptions.
+    // SelfSkipRcvdRate is the receive rate over the measured part tagged with SelfSkipMode.
+    SelfSkipped      uint64                 `json:"selfSkipped"`
+    SubFilter        string                 `json:"subFilter,omitempty"`
+    SubFilterSetup   int64                  `json:"subFilterSetupMs"`
+    SelfSkipMode     string                 `json:"selfSkipMode,omitempty"`
+    SelfSkipRcvdRate float64                `json:"selfSkipRcvdRate"`
+
+    // How gateways share client connections, Connections is the number opened and ConnectTime
+    // how long each took to establish
+    ClientTopology   string                 `json:"clientTopology,omitempty"`
+    Connections      int                    `json:"connections"`
+    ConnectTime      HistogramSnapshot      `json:"connectTimeMs"`
+
+    // Kind of credential the clients authenticate with and the tokens fetched for it, the first one
+    // of each scope is acquired and every later one a refresh. TokenTime is the time a request took.
+    Credential       string                 `json:"credential,omitempty"`
+    TokensAcquired   uint64                 `json:"tokensAcquired"`
+    TokenRefreshes   uint64                 `json:"tokenRefreshes"`
+    TokenFailures    uint64                 `json:"tokenFailures"`
+    TokenTime        HistogramSnapshot      `json:"tokenTimeMs"`
+
+    // Messages sent with a time to live of MessageTtl only. Expected deliveries that never happened
+    // are Undelivered, expiry is one reason of several. Expirations are only counted where they are
+    // seen: ExpiredRcvd were delivered after they expired and DlqExpired were read back from the
+    // dead letter queue after the broker dead lettered them on expiry.
+    MessageTtl       int64                  `json:"messageTtlMs"`
+    Undelivered      uint64                 `json:"undelivered"`
+    ExpiredRcvd      uint64                 `json:"expiredRcvd"`
+    DlqExpired       uint64                 `json:"dlqExpired"`
+
+    // Messages resent with the MessageID of one already sent, DupDelay after it. DupRcvd counts the
+    // resends and originals delivered again, none should get through when DupDelay is inside the
+    // duplicate detection window DupWindow, which is only known when the bench provisioned the entity.
+    DupDelay         int64                  `json:"dupDelayMs"`
+    DupWindow        int64                  `json:"dupWindowMs"`
+    DupSent          uint64                 `json:"dupSent"`
+    DupRcvd          uint64                 `json:"dupRcvd"`
+
+    // Simulated processing only, ProcessLatency runs from receiving a message to settling it, including
+    // the wait for a worker. Message locks are renewed while processing outlasts them, MsgLocksLost
+    // counts messages whose lock ran out anyway and that the broker hands out again.
+    ProcessLatency   HistogramSnapshot      `json:"processLatencyMs"`
+    LockRenewals     uint64                 `json:"lockRenewals"`
+    MsgLocksLost     uint64                 `json:"msgLocksLost"`
+
+    // Receive calls made and how many came back empty, ReceiveBatch is the number of messages
+    // returned by the others. PrefetchWait is how long received messages waited for a worker.
+    ReceiveCalls     uint64                 `json:"receiveCalls"`
+    EmptyReceives    uint64                 `json:"emptyReceives"`
+    ReceiveBatch     HistogramSnapshot      `json:"receiveBatch"`
+    PrefetchWait     HistogramSnapshot      `json:"prefetchWaitUs"`
+
+    // Offset of the local clock to the reference clock, latencies are within LatencyBound of the true value
+    ClockOffset      int64                  `json:"clockOffset"`
+    ClockUncertainty int64                  `json:"clockUncertainty"`
+    LatencyBound     HistogramSnapshot      `json:"latencyBound"`
+    NegLatencies     uint64                 `json:"negativeLatencies"`
+
+    Gateways      [ ]GatewayResult          `json:"gateways"`
+
+    // Indexed by receiver and then by sender
+    RcvdById      [ ][ ]uint64              `json:"rcvdById"`
+
+    // Expected deliveries only cover cells where both ends ran, see ExpectedCell
+    Topology        *Topology               `json:"topology,omitempty"`
+    Delivery         DeliveryCount          `json:"delivery"`
+
+    // Spread of received messages across receivers, mostly of interest for competing receivers
+    Balance          ReceiverBalance        `json:"balance"`
+
+    Timeline      [ ]Sample                 `json:"timeline"`
+
+    // Resource usage of the bench process itself
+    Runtime          RuntimeResult          `json:"runtime"`
 }